@@ -0,0 +1,221 @@
+package activity
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+// Activity types, used to filter the activities
+const (
+	FileCreated  = "file_created"
+	FileChanged  = "file_changed"
+	FileDeleted  = "file_deleted"
+	FileRestored = "file_restored"
+	Shared       = "shared"
+)
+
+// Subjects of the activities, they tell what happened
+const (
+	SubjectCreated       = "created"
+	SubjectChanged       = "changed"
+	SubjectMoved         = "moved"
+	SubjectDeleted       = "deleted"
+	SubjectRestored      = "restored"
+	SubjectSharedUser    = "shared_user"
+	SubjectSharedGroup   = "shared_group"
+	SubjectUnsharedUser  = "unshared_user"
+	SubjectUnsharedGroup = "unshared_group"
+)
+
+// typeOfSubject is the activity type of every subject
+var typeOfSubject = map[string]string{
+	SubjectCreated:       FileCreated,
+	SubjectChanged:       FileChanged,
+	SubjectMoved:         FileChanged,
+	SubjectDeleted:       FileDeleted,
+	SubjectRestored:      FileRestored,
+	SubjectSharedUser:    Shared,
+	SubjectSharedGroup:   Shared,
+	SubjectUnsharedUser:  Shared,
+	SubjectUnsharedGroup: Shared,
+}
+
+// Event is an activity which is about to be published, together with the users
+// and groups it affects
+type Event struct {
+	activity *db.Activity
+	targets  []db.ActivityTarget
+}
+
+// Record publishes an activity of actor on the node, see Prepare
+func Record(actor, subject string, node *db.Node) {
+	Prepare(actor, subject, node).Publish()
+}
+
+// Prepare prepares an activity of actor on the node, for its owner and the users
+// and groups it is shared with. The targets are looked up right away, so an
+// activity on a node which is about to be deleted or moved reaches everyone
+// who could see it before. Failures are logged, the event is still returned.
+func Prepare(actor, subject string, node *db.Node) *Event {
+	event := &Event{activity: &db.Activity{
+		Actor:   actor,
+		Type:    typeOfSubject[subject],
+		Subject: subject,
+		NodeID:  node.ID,
+	}}
+	if path, ok := filesPath(node.Path); ok {
+		event.targets = append(event.targets, db.ActivityTarget{Target: node.Owner, Path: path})
+	}
+	shares, err := db.GetSharesOnAncestors(node.ID)
+	if err != nil {
+		log.Errorf("Failed to get the shares of %v for the activity: %v", node.Path, err)
+		return event
+	}
+	for _, share := range shares {
+		root, err := db.GetNodeById(share.NodeID)
+		if err != nil || root == nil {
+			log.Errorf("Failed to get the shared node %v for the activity: %v", share.NodeID, err)
+			continue
+		}
+		event.targets = append(event.targets, db.ActivityTarget{
+			Target: share.Target,
+			Path:   sharedPath(root, node.Path),
+		})
+	}
+	return event
+}
+
+// RecordShare publishes the sharing or unsharing of the node by actor, for the
+// owner of the node and the user or group it was shared with
+func RecordShare(actor string, node *db.Node, share *db.Share, shared bool) {
+	subject := SubjectSharedUser
+	if share.ShareType == db.GROUPSHARE {
+		subject = SubjectSharedGroup
+	}
+	if !shared {
+		subject = "un" + subject
+	}
+	event := &Event{activity: &db.Activity{
+		Actor:     actor,
+		Type:      typeOfSubject[subject],
+		Subject:   subject,
+		NodeID:    node.ID,
+		ShareWith: share.Target,
+	}}
+	if path, ok := filesPath(node.Path); ok {
+		event.targets = append(event.targets, db.ActivityTarget{Target: node.Owner, Path: path})
+	}
+	event.targets = append(event.targets, db.ActivityTarget{Target: share.Target, Path: sharedPath(node, node.Path)})
+	event.Publish()
+}
+
+// Publish saves the activity for its targets
+func (e *Event) Publish() {
+	if len(e.targets) == 0 {
+		return
+	}
+	err := db.CreateActivity(e.activity, e.targets)
+	if err != nil {
+		log.Errorf("Failed to save the %v activity of %v: %v", e.activity.Subject, e.activity.Actor, err)
+	}
+}
+
+// filesPath returns the path of a node relative to the files directory of its
+// owner, or false if the node isn't in the files, e.g. in the trash
+func filesPath(path string) (string, bool) {
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) < 2 || parts[1] != "files" {
+		return "", false
+	}
+	if len(parts) == 2 {
+		return "/", true
+	}
+	return "/" + parts[2], true
+}
+
+// sharedPath returns the path of a node in the files of a user it is shared
+// with, through the share of root. Shared nodes are shown in the root of the
+// files of the user.
+func sharedPath(root *db.Node, path string) string {
+	name := root.Path[strings.LastIndex(root.Path, "/")+1:]
+	return "/" + name + strings.TrimPrefix(path, root.Path)
+}
+
+// UserPath returns the path of a node in the files of a user, who either owns
+// it or has access through a share to him or one of his groups. False is
+// returned if the user can't access the node.
+func UserPath(node *db.Node, username string, groups []string) (string, bool, error) {
+	if node.Owner == username {
+		path, ok := filesPath(node.Path)
+		return path, ok, nil
+	}
+	shares, err := db.GetAllSharesToUser(username, groups)
+	if err != nil {
+		return "", false, err
+	}
+	for _, share := range shares {
+		root, err := db.GetNodeById(share.NodeID)
+		if err != nil {
+			return "", false, err
+		}
+		if root != nil && (node.Path == root.Path || strings.HasPrefix(node.Path, root.Path+"/")) {
+			return sharedPath(root, node.Path), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// SubjectTemplate returns the subject of an activity as the user reading it
+// sees it, with {user}, {file} and {sharewith} placeholders
+func SubjectTemplate(a *db.Activity, username string) string {
+	self := a.Actor == username
+	actor := "{user}"
+	if self {
+		actor = "You"
+	}
+	switch a.Subject {
+	case SubjectCreated:
+		return actor + " created {file}"
+	case SubjectChanged:
+		return actor + " changed {file}"
+	case SubjectMoved:
+		return actor + " moved {file}"
+	case SubjectDeleted:
+		return actor + " deleted {file}"
+	case SubjectRestored:
+		return actor + " restored {file}"
+	case SubjectSharedUser:
+		if !self && a.ShareWith == username {
+			return actor + " shared {file} with you"
+		}
+		return actor + " shared {file} with {sharewith}"
+	case SubjectSharedGroup:
+		return actor + " shared {file} with group {sharewith}"
+	case SubjectUnsharedUser:
+		if a.Actor == a.ShareWith {
+			// The user removed the share to him
+			if self {
+				return "You removed the share of {file}"
+			}
+			return "{user} removed the share of {file}"
+		}
+		if !self && a.ShareWith == username {
+			return actor + " stopped sharing {file} with you"
+		}
+		return actor + " stopped sharing {file} with {sharewith}"
+	case SubjectUnsharedGroup:
+		return actor + " stopped sharing {file} with group {sharewith}"
+	}
+	return actor + " changed {file}"
+}
+
+// Subject returns the subject of an activity as the user reading it sees it
+func Subject(a *db.Activity, username string) string {
+	return strings.NewReplacer(
+		"{user}", a.Actor,
+		"{file}", strings.TrimPrefix(a.Path, "/"),
+		"{sharewith}", a.ShareWith,
+	).Replace(SubjectTemplate(a, username))
+}
@@ -0,0 +1,255 @@
+package activity
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gowncloud/gowncloud/activity"
+	"github.com/gowncloud/gowncloud/core/identity"
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+const (
+	// defaultLimit is the number of activities returned if the limit parameter
+	// is missing
+	defaultLimit = 30
+	// maxLimit is the highest number of activities returned at once
+	maxLimit = 200
+)
+
+// filterTypes are the activity types shown by the filters which select types
+var filterTypes = map[string][]string{
+	"files":               {activity.FileCreated, activity.FileChanged, activity.FileDeleted, activity.FileRestored},
+	"files_sharing":       {activity.Shared},
+	"shares":              {activity.Shared},
+	activity.FileCreated:  {activity.FileCreated},
+	activity.FileChanged:  {activity.FileChanged},
+	activity.FileDeleted:  {activity.FileDeleted},
+	activity.FileRestored: {activity.FileRestored},
+	activity.Shared:       {activity.Shared},
+}
+
+var (
+	errUnknownFilter  = errors.New("Unknown filter")
+	errInvalidParam   = errors.New("Invalid parameter")
+	errFolderNotFound = errors.New("Folder not found")
+	errNoObject       = errors.New("The filter needs an object_type and object_id")
+)
+
+// Activity is an activity as returned by the activity API
+type Activity struct {
+	ActivityId   int64             `json:"activity_id"`
+	App          string            `json:"app"`
+	Type         string            `json:"type"`
+	User         string            `json:"user"`
+	AffectedUser string            `json:"affecteduser"`
+	Subject      string            `json:"subject"`
+	SubjectRich  []interface{}     `json:"subject_rich"`
+	Message      string            `json:"message"`
+	MessageRich  []interface{}     `json:"message_rich"`
+	ObjectType   string            `json:"object_type"`
+	ObjectId     int64             `json:"object_id"`
+	ObjectName   string            `json:"object_name"`
+	Objects      map[string]string `json:"objects"`
+	Link         string            `json:"link"`
+	Icon         string            `json:"icon"`
+	Datetime     string            `json:"datetime"`
+}
+
+// richObject is a parameter of a rich subject, like the file or the user
+type richObject struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Path string `json:"path,omitempty"`
+}
+
+// ListActivities lists the activities on the files of the user and the files
+// shared with him, newest first. The filter in the url selects all activities,
+// those of the user (self), those of the other users (by), file activities
+// (files, or one of the activity types) or sharing activities (files_sharing or
+// shares). The object_type and object_id parameters limit the activities to a
+// folder, the filter named filter requires them.
+// The since parameter continues after the activity with that id, limit sets
+// the number of activities returned and sort=asc returns the oldest first.
+// The next page is linked in the Link header, and if there are no activities
+// 304 Not Modified is returned.
+// It is the endpoint for GET /ocs/v{1,2}.php/apps/activity/api/v2/activity[/{filter}]
+func ListActivities(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	query := r.URL.Query()
+	q := &db.ActivityQuery{
+		Username: id.Username,
+		Groups:   id.Organizations,
+		Limit:    defaultLimit,
+	}
+
+	filter := mux.Vars(r)["filter"]
+	switch filter {
+	case "", "all", "filter":
+	case "self":
+		q.Self = true
+	case "by":
+		q.Others = true
+	default:
+		types, ok := filterTypes[filter]
+		if !ok {
+			writeOCSError(w, r, http.StatusNotFound, errUnknownFilter)
+			return
+		}
+		q.Types = types
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		q.Since, err = db.ParseId(since)
+		if err != nil {
+			writeOCSError(w, r, http.StatusBadRequest, errInvalidParam)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit <= 0 {
+			writeOCSError(w, r, http.StatusBadRequest, errInvalidParam)
+			return
+		}
+		if q.Limit > maxLimit {
+			q.Limit = maxLimit
+		}
+	}
+	q.Ascending = query.Get("sort") == "asc"
+
+	if query.Get("object_type") != "" || query.Get("object_id") != "" {
+		status, err := setFolder(q, query, id)
+		if err != nil {
+			writeOCSError(w, r, status, err)
+			return
+		}
+	} else if filter == "filter" {
+		writeOCSError(w, r, http.StatusBadRequest, errNoObject)
+		return
+	}
+
+	// One more activity is loaded to know if there is a next page
+	limit := q.Limit
+	q.Limit++
+	activities, err := db.GetActivities(q)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if len(activities) == 0 {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if q.Since == 0 {
+		w.Header().Set("X-Activity-First-Known", strconv.FormatInt(activities[0].ID, 10))
+	}
+	if len(activities) > limit {
+		activities = activities[:limit]
+		next := *r.URL
+		nextQuery := next.Query()
+		nextQuery.Set("since", strconv.FormatInt(activities[limit-1].ID, 10))
+		nextQuery.Set("limit", strconv.Itoa(limit))
+		next.RawQuery = nextQuery.Encode()
+		w.Header().Set("Link", "<"+next.RequestURI()+">; rel=\"next\"")
+	}
+	w.Header().Set("X-Activity-Last-Given", strconv.FormatInt(activities[len(activities)-1].ID, 10))
+
+	result := make([]Activity, len(activities))
+	for i, a := range activities {
+		result[i] = makeActivity(a, id.Username)
+	}
+	writeOCS(w, r, http.StatusOK, "", result)
+}
+
+// setFolder limits the query to the folder in the object_type and object_id
+// parameters, which has to be accessible by the user
+func setFolder(q *db.ActivityQuery, query url.Values, id identity.Session) (int, error) {
+	if query.Get("object_type") != "files" {
+		return http.StatusBadRequest, errInvalidParam
+	}
+	nodeId, err := db.ParseId(query.Get("object_id"))
+	if err != nil {
+		return http.StatusBadRequest, errInvalidParam
+	}
+	node, err := db.GetNodeById(nodeId)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if node == nil {
+		return http.StatusNotFound, errFolderNotFound
+	}
+	path, ok, err := activity.UserPath(node, id.Username, id.Organizations)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !ok {
+		return http.StatusNotFound, errFolderNotFound
+	}
+	q.Folder = path
+	return http.StatusOK, nil
+}
+
+// makeActivity formats an activity for the user reading it
+func makeActivity(a *db.Activity, username string) Activity {
+	name := a.Path[strings.LastIndex(a.Path, "/")+1:]
+	parameters := map[string]richObject{
+		"file": {Type: "file", Id: strconv.FormatInt(a.NodeID, 10), Name: name, Path: a.Path},
+		"user": {Type: "user", Id: a.Actor, Name: a.Actor},
+	}
+	if a.ShareWith != "" {
+		shareType := "user"
+		if a.Subject == activity.SubjectSharedGroup || a.Subject == activity.SubjectUnsharedGroup {
+			shareType = "group"
+		}
+		parameters["sharewith"] = richObject{Type: shareType, Id: a.ShareWith, Name: a.ShareWith}
+	}
+	template := activity.SubjectTemplate(a, username)
+	subject := template
+	for key, parameter := range parameters {
+		value := parameter.Name
+		if key == "file" {
+			value = strings.TrimPrefix(parameter.Path, "/")
+		}
+		subject = strings.Replace(subject, "{"+key+"}", value, -1)
+	}
+
+	app := "files"
+	if a.Type == activity.Shared {
+		app = "files_sharing"
+	}
+	dir := a.Path[:strings.LastIndex(a.Path, "/")]
+	if dir == "" {
+		dir = "/"
+	}
+	link := "/index.php/apps/files/?dir=" + url.QueryEscape(dir) + "&scrollto=" + url.QueryEscape(name)
+	if a.Type == activity.FileDeleted {
+		link = "/index.php/apps/files/?view=trashbin"
+	}
+
+	return Activity{
+		ActivityId:   a.ID,
+		App:          app,
+		Type:         a.Type,
+		User:         a.Actor,
+		AffectedUser: username,
+		Subject:      subject,
+		SubjectRich:  []interface{}{template, parameters},
+		Message:      "",
+		MessageRich:  []interface{}{"", map[string]richObject{}},
+		ObjectType:   "files",
+		ObjectId:     a.NodeID,
+		ObjectName:   a.Path,
+		Objects:      map[string]string{strconv.FormatInt(a.NodeID, 10): a.Path},
+		Link:         link,
+		Icon:         "",
+		Datetime:     a.Time.UTC().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,22 @@
+package activity
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	activity "github.com/gowncloud/gowncloud/apps/activity/api"
+)
+
+func RegisterRoutes(protectedMux *http.ServeMux, publicMux *http.ServeMux) {
+	log.Debug("Regestering activity routes")
+
+	ocs := mux.NewRouter()
+	for _, version := range []string{"v1", "v2"} {
+		prefix := "/ocs/" + version + ".php/apps/activity/api/v2/activity"
+		ocs.HandleFunc(prefix, activity.ListActivities).Methods("GET")
+		ocs.HandleFunc(prefix+"/{filter}", activity.ListActivities).Methods("GET")
+		protectedMux.Handle(prefix, ocs)
+		protectedMux.Handle(prefix+"/", ocs)
+	}
+}
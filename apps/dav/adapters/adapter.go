@@ -7,11 +7,21 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/fs"
 )
 
 // Adapter is an interface for the ocdavadapters
 type Adapter func(handler http.HandlerFunc, w http.ResponseWriter, r *http.Request)
 
+// storage is the file system served by the webdav server, for the adapters
+// handling files themselves
+var storage fs.FileSystem
+
+// Init sets the file system served by the webdav server
+func Init(fileSystem fs.FileSystem) {
+	storage = fileSystem
+}
+
 // getNodePath finds a possible node for a user from a given web path
 func getNodePath(path string, id identity.Session) (string, error) {
 	username := id.Username
@@ -1,14 +1,16 @@
 package ocdavadapters
 
 import (
+	"context"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/activity"
+	"github.com/gowncloud/gowncloud/core/audit"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/notification"
 )
 
 // DeleteAdapter is the adapter for the WebDav DELETE method
@@ -44,12 +46,24 @@ func DeleteAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Requ
 			target = targets[0]
 			if strings.HasSuffix(path, target.Path) {
 				// This is a root of a share, just unshare
+				var share *db.Share
+				share, err = db.GetNodeShareToTarget(target.ID, user)
+				if err != nil {
+					log.Error("Error getting share: ", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
 				err = db.DeleteNodeShareToUserFromNodeId(target.ID, user)
 				if err != nil {
 					log.Error("Error deleting shared node: ", err)
 					w.WriteHeader(http.StatusInternalServerError)
 					return
 				}
+				audit.Record(r, user, audit.ShareDelete, audit.Fields{"path": target.Path, "nodeid": target.ID, "sharedwith": user})
+				if share != nil {
+					activity.RecordShare(user, target, share, false)
+					notification.ShareRemoved(share.ShareID)
+				}
 				w.WriteHeader(http.StatusNoContent)
 				return
 			}
@@ -71,94 +85,139 @@ func DeleteAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	diskPath := db.GetSetting(db.DAV_ROOT) + rootPath
+	rootNode, err := db.GetNode(rootPath)
+	if err != nil {
+		log.Error("Error getting node: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	err = filepath.Walk(diskPath, func(path string, _ os.FileInfo, err error) error {
-		if err != nil {
-			log.Debug("trashFile called with none-nil error")
-			log.Info(err)
-			return err
-		}
-		dbPath := strings.TrimPrefix(path, db.GetSetting(db.DAV_ROOT))
-		node, err := db.GetNode(dbPath)
-		if err != nil {
-			log.Error("Error getting node: ", err)
-			return err
-		}
-		if node == nil {
-			log.Warn("Node found on disk but not in database: ", dbPath)
-			return nil
-		}
-		// Save the original path in the trash node table
-		_, err = db.CreateTrashNode(node.ID, node.Owner, node.Path, node.Isdir)
-		if err != nil {
-			log.Error("Could not create trash entry: ", err)
-			return err
-		}
+	// The users the node is shared with are looked up before it is moved away
+	deleted := activity.Prepare(user, activity.SubjectDeleted, rootNode)
 
-		// check if the parent exists in the trash folder
-		parentPath := dbPath
-		parentPath = strings.TrimPrefix(parentPath, node.Owner+"/files")
-		parentPath = parentPath[:strings.LastIndex(parentPath, "/")]
-		trashPrefix := node.Owner + "/files_trash"
-		pathPieces := strings.Split(parentPath, "/")
+	rootTrashPath, err := getTrashPath(rootPath, rootNode.Owner)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-		exists, err := db.NodeExists(trashPrefix + "/" + parentPath)
-		if err != nil {
-			log.Errorf("Could not verify if node %v exists: %v", parentPath, err)
-			return err
+	// Patch the request to send to the webdav
+	// FIXME: derive scheme from the original request
+	r.Header.Set("Destination", "http://"+r.Host+"/remote.php/webdav/"+rootTrashPath)
+	// patch the request method to MOVE before sending it to webdav.
+	r.Method = "MOVE"
+
+	// The files are moved on disk before the transaction, the storage may use
+	// the database itself and would wait for the transaction to end
+	rh := newResponseHijacker(w)
+	handler.ServeHTTP(rh, r)
+	if rh.status != http.StatusCreated && rh.status != http.StatusNoContent {
+		log.Errorf("Failed to move %v to the trash, status %v", rootPath, rh.status)
+		// Send the response of the webdav server
+		for key, values := range rh.headers {
+			w.Header()[key] = values
 		}
-		for !exists {
-			// Remove the first piece of the path
-			pathPieces = append(pathPieces[:0], pathPieces[1:]...)
-			parentPath = strings.Join(pathPieces, "/")
-			if parentPath != "" {
-				parentPath = "/" + parentPath
-			}
+		w.WriteHeader(rh.status)
+		w.Write(rh.body)
+		return
+	}
 
-			exists, err = db.NodeExists(trashPrefix + parentPath)
+	// The nodes are moved to the trash in a transaction, the files are moved
+	// back if it fails
+	err = db.WithTx(func(tx *db.Tx) error {
+		tx.OnRollback(func() {
+			err := storage.Rename(context.Background(), rootTrashPath, rootPath)
 			if err != nil {
-				log.Errorf("Could not verify if node %v exists: %v", parentPath, err)
-				return err
+				log.Errorf("Failed to move %v back from the trash: %v", rootPath, err)
 			}
-		}
-
-		parentPath = strings.Join(pathPieces, "/")
+		})
 
-		if !strings.HasPrefix(parentPath, "/") && parentPath != "" {
-			parentPath = "/" + parentPath
-		}
+		return trashNode(tx, rootNode, rootTrashPath)
+	})
 
-		// FIXME: derive scheme from the original request
-		destinationUrl := "http://" + r.Host + "/remote.php/webdav/" + trashPrefix + parentPath +
-			"/" + node.Path[strings.LastIndex(node.Path, "/")+1:]
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	audit.Record(r, user, audit.FileDelete, audit.Fields{"path": rootPath, "nodeid": rootNode.ID, "trashpath": rootTrashPath})
+	deleted.Publish()
 
-		// Patch the request to send to the webdav. Only set destination on the first node
-		// This should be the root node, so this should be the target for the webdav
-		if r.Header.Get("Destination") == "" {
-			r.Header.Set("Destination", destinationUrl)
-		}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-		err = db.MoveNode(dbPath, trashPrefix+parentPath+"/"+node.Path[strings.LastIndex(node.Path, "/")+1:])
+// trashNode moves a node with its descendants to trashPath in the trash of its
+// owner in the transaction, remembering their original paths so they can be
+// restored
+func trashNode(tx *db.Tx, node *db.Node, trashPath string) error {
+	nodes, err := tx.GetSubtreeNodes(node.Path)
+	if err != nil {
+		log.Error("Error getting nodes: ", err)
+		return err
+	}
+	// Save the original paths in the trash node table
+	for _, n := range nodes {
+		_, err = tx.CreateTrashNode(n.ID, n.Owner, n.Path, n.Isdir)
 		if err != nil {
-			log.Error("Could not update node location: ", err)
-			log.Info("Original path: ", dbPath)
-			log.Info("Target path: ", trashPrefix+parentPath+"/"+node.Path[strings.LastIndex(node.Path, "/")+1:])
+			log.Error("Could not create trash entry: ", err)
 			return err
 		}
+	}
 
-		return nil
-	})
+	// The descendants follow the root node
+	err = tx.MoveNode(node.Path, trashPath)
+	if err != nil {
+		log.Error("Could not update node location: ", err)
+		log.Info("Original path: ", node.Path)
+		log.Info("Target path: ", trashPath)
+		return err
+	}
 
+	// Move the size of the deleted subtree from the original parents to the trash
+	err = tx.PropagateSize(node.Path, -node.Size)
+	if err == nil {
+		err = tx.PropagateSize(trashPath, node.Size)
+	}
 	if err != nil {
-		log.Error("Failed to mark nodes as deleted: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		log.Error("Failed to update directory sizes: ", err)
 	}
+	return err
+}
 
-	// patch the request method to MOVE before sending it to webdav.
-	r.Method = "MOVE"
+// getTrashPath returns the path in the trash of the owner a node is moved to
+// when it is deleted. The node keeps the part of its parent path which already
+// exists in the trash.
+func getTrashPath(rootPath, owner string) (string, error) {
+	// check if the parent exists in the trash folder
+	parentPath := strings.TrimPrefix(rootPath, owner+"/files")
+	parentPath = parentPath[:strings.LastIndex(parentPath, "/")]
+	trashPrefix := owner + "/files_trash"
+	pathPieces := strings.Split(parentPath, "/")
+
+	exists, err := db.NodeExists(trashPrefix + "/" + parentPath)
+	if err != nil {
+		log.Errorf("Could not verify if node %v exists: %v", parentPath, err)
+		return "", err
+	}
+	for !exists {
+		// Remove the first piece of the path
+		pathPieces = append(pathPieces[:0], pathPieces[1:]...)
+		parentPath = strings.Join(pathPieces, "/")
+		if parentPath != "" {
+			parentPath = "/" + parentPath
+		}
+
+		exists, err = db.NodeExists(trashPrefix + parentPath)
+		if err != nil {
+			log.Errorf("Could not verify if node %v exists: %v", parentPath, err)
+			return "", err
+		}
+	}
 
-	handler.ServeHTTP(w, r)
+	parentPath = strings.Join(pathPieces, "/")
+
+	if !strings.HasPrefix(parentPath, "/") && parentPath != "" {
+		parentPath = "/" + parentPath
+	}
 
+	return trashPrefix + parentPath + "/" + rootPath[strings.LastIndex(rootPath, "/")+1:], nil
 }
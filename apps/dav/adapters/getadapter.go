@@ -5,11 +5,21 @@ import (
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/checksum"
+	"github.com/gowncloud/gowncloud/core/audit"
 	"github.com/gowncloud/gowncloud/core/identity"
+	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/media"
 )
 
-// GetAdapter is the adapter for the GET method. It adds the correct header to the
-// response so the file can be downloaded by the client
+// inlineTypes are the mimetypes, or mimetype prefixes ending in a '/', browsers
+// can show without the risk of running scripts from the file
+var inlineTypes = []string{"image/", "video/", "audio/", "text/plain", "application/pdf"}
+
+// GetAdapter is the adapter for the GET method. Media files are served inline
+// so browsers can play them and seek in them, other files and explicit downloads
+// from the web interface are served as attachment. Range requests are handled
+// by the webdav handler.
 func GetAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
 
 	id := identity.CurrentSession(r)
@@ -26,12 +36,88 @@ func GetAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	node, err := db.GetNode(path)
+	if err != nil {
+		log.Errorf("Failed to get the node (%v): %v", path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if node == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	// Players fetch media in many range requests, only the first one is recorded
+	if rangeHeader := r.Header.Get("Range"); rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-") {
+		audit.Record(r, id.Username, audit.FileDownload, audit.Fields{"path": node.Path, "nodeid": node.ID})
+	}
+
 	r.URL.Path = "/remote.php/webdav/" + path
+	filename := path[strings.LastIndex(path, "/")+1:]
 
-	fullname := r.URL.RequestURI()
-	filename := fullname[strings.LastIndex(fullname, "/")+1:]
+	// The web interface adds downloadStartSecret to its download links, and
+	// waits for the cookie to know the download started
+	downloadSecret := r.URL.Query().Get("downloadStartSecret")
+	if downloadSecret != "" {
+		http.SetCookie(w, &http.Cookie{Name: "ocDownloadStarted", Value: downloadSecret, Path: "/"})
+	}
 
-	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	disposition := "attachment"
+	if downloadSecret == "" && isInlineType(node.MimeType) {
+		disposition = "inline"
+		if media.ServeRendition(w, r, node) {
+			return
+		}
+	}
+	// Renditions have other content, the checksums are of the original
+	checksums, err := checksum.Load(node)
+	if err != nil {
+		log.Errorf("Failed to get the checksums (%v): %v", path, err)
+	}
+	if checksums != nil {
+		w.Header().Set(checksum.Header, checksum.SHA1+":"+checksums.SHA1)
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, filename))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if node.MimeType != "" && node.MimeType != "application/octet-stream" {
+		w.Header().Set("Content-Type", node.MimeType)
+	}
 
 	handler.ServeHTTP(w, r)
 }
+
+// isInlineType checks if files of the mimetype can be shown in the browser
+func isInlineType(mimetype string) bool {
+	mimetype = strings.ToLower(mimetype)
+	if strings.HasPrefix(mimetype, "image/svg") {
+		return false
+	}
+	for _, inlineType := range inlineTypes {
+		if mimetype == inlineType || strings.HasSuffix(inlineType, "/") && strings.HasPrefix(mimetype, inlineType) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentDisposition formats the Content-Disposition header. The plain filename
+// parameter is for old clients, others use the UTF-8 filename* parameter.
+func contentDisposition(disposition, filename string) string {
+	plain := make([]rune, 0, len(filename))
+	for _, c := range filename {
+		if c < 0x20 || c > 0x7e || c == '"' || c == '\\' {
+			c = '_'
+		}
+		plain = append(plain, c)
+	}
+	encoded := make([]byte, 0, len(filename))
+	for i := 0; i < len(filename); i++ {
+		c := filename[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			encoded = append(encoded, c)
+		} else {
+			encoded = append(encoded, '%', "0123456789ABCDEF"[c>>4], "0123456789ABCDEF"[c&15])
+		}
+	}
+	return disposition + "; filename=\"" + string(plain) + "\"; filename*=UTF-8''" + string(encoded)
+}
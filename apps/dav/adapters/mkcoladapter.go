@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/activity"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
 )
@@ -73,12 +74,13 @@ func MkcolAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Reque
 	nodeOwner := path[:strings.Index(path, "/")]
 	r.URL.Path = "/remote.php/webdav/" + path
 
-	_, err = db.SaveNode(path, nodeOwner, true, "httpd/unix-directory")
+	node, err := db.SaveNode(path, nodeOwner, true, "httpd/unix-directory")
 	if err != nil {
 		log.Error("Failed to save node: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	activity.Record(id.Username, activity.SubjectCreated, node)
 
 	handler.ServeHTTP(w, r)
 }
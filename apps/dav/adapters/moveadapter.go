@@ -1,15 +1,16 @@
 package ocdavadapters
 
 import (
+	"context"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/activity"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/notification"
 )
 
 // MoveAdapter is the adapter for the MOVE method. It patches the request url and payload
@@ -25,13 +26,6 @@ func MoveAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Don't move folders inside themselfs
-	if destinationUrl.Path[:strings.LastIndex(destinationUrl.Path, "/")] == r.URL.Path {
-		log.Debug("Trying to move node to the same location")
-		http.Error(w, "The destination may not be part of the same subtree as the source path.", http.StatusConflict)
-		return
-	}
-
 	inputPath := strings.TrimPrefix(r.URL.Path, "/remote.php/webdav/")
 	path, err := getNodePath(inputPath, id)
 	if err != nil {
@@ -46,11 +40,10 @@ func MoveAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Reques
 
 	r.URL.Path = "/remote.php/webdav/" + path
 
-	targetParentPath := strings.TrimPrefix(destinationUrl.Path, "/remote.php/webdav/")
-	if strings.Contains(targetParentPath, "/") {
-		targetParentPath = targetParentPath[:strings.LastIndex(targetParentPath, "/")]
-	} else {
-		targetParentPath = ""
+	destinationPath := strings.TrimSuffix(strings.TrimPrefix(destinationUrl.Path, "/remote.php/webdav/"), "/")
+	targetParentPath := ""
+	if strings.Contains(destinationPath, "/") {
+		targetParentPath = destinationPath[:strings.LastIndex(destinationPath, "/")]
 	}
 
 	log.Debugf("check if %v exists", targetParentPath)
@@ -62,70 +55,172 @@ func MoveAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Reques
 		return
 	}
 	if parentPath == "" {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
 		return
 	}
 
-	targetPath := parentPath + path[strings.LastIndex(path, "/"):]
+	name := destinationPath[strings.LastIndex(destinationPath, "/")+1:]
+	if name == "" {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	targetPath := parentPath + "/" + name
 	destinationUrl.Path = "/remote.php/webdav/" + targetPath
 
-	exists, err := db.NodeExists(targetPath)
+	if targetPath == path {
+		http.Error(w, "The source and destination are the same.", http.StatusForbidden)
+		return
+	}
+	// Don't move folders inside themselfs
+	if strings.HasPrefix(targetPath, path+"/") {
+		log.Debug("Trying to move node inside itself")
+		http.Error(w, "The destination may not be part of the same subtree as the source path.", http.StatusConflict)
+		return
+	}
+	// Nor replace a folder with one of its descendants
+	if strings.HasPrefix(path, targetPath+"/") {
+		http.Error(w, "The destination may not be an ancestor of the source path.", http.StatusConflict)
+		return
+	}
+
+	rootNode, err := db.GetNode(path)
 	if err != nil {
-		log.Errorf("Failed to verify if node exists at path %v: %v", targetPath, err)
+		log.Error("Error getting node: ", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-
-	if exists {
-		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+	if rootNode == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
 
-	oldDbPath := strings.TrimPrefix(r.URL.Path, "/remote.php/webdav/")
-	diskPath := db.GetSetting(db.DAV_ROOT) + oldDbPath
+	// The destination is replaced unless the client asks not to, the webdav
+	// server only replaces it if told explicitly
+	overwrite := r.Header.Get("Overwrite") != "F"
+	if overwrite {
+		r.Header.Set("Overwrite", "T")
+	}
+
+	replaced, err := db.GetNode(targetPath)
+	if err != nil {
+		log.Errorf("Failed to verify if node exists at path %v: %v", targetPath, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if replaced != nil && !overwrite {
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return
+	}
 
-	newDbPath := strings.TrimPrefix(destinationUrl.Path, "/remote.php/webdav/")
-	newOwner := newDbPath[:strings.Index(newDbPath, "/")]
+	// Moving into a directory of another user, like a shared folder, transfers
+	// the moved nodes to the owner of that directory
+	newOwner := targetPath[:strings.Index(targetPath, "/")]
+	r.Header.Set("Destination", destinationUrl.String())
 
-	err = filepath.Walk(diskPath, func(path string, _ os.FileInfo, err error) error {
+	// The replaced node is moved to the trash of its owner rather than deleted,
+	// so it can be restored, also if the move fails
+	var replacedTrashPath string
+	if replaced != nil {
+		replacedTrashPath, err = getTrashPath(targetPath, replaced.Owner)
 		if err != nil {
-			log.Error("Move - walk called with non-nil error: ", err)
-			return err
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
 		}
-		dbPath := strings.TrimPrefix(path, db.GetSetting(db.DAV_ROOT))
-		target := strings.Replace(dbPath, oldDbPath, newDbPath, 1)
-
-		node, err := db.GetNode(dbPath)
+		err = storage.Rename(context.Background(), targetPath, replacedTrashPath)
 		if err != nil {
-			log.Error("Error getting node: ", err)
-			return err
+			log.Errorf("Failed to move the replaced %v to the trash: %v", targetPath, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	restoreReplaced := func() {
+		if replaced == nil {
+			return
 		}
-		if node == nil {
-			log.Warn("Node found on disk but not in database: ", dbPath)
-			return nil
+		err := storage.Rename(context.Background(), replacedTrashPath, targetPath)
+		if err != nil {
+			log.Errorf("Failed to move the replaced %v back from the trash: %v", targetPath, err)
 		}
+	}
 
-		err = db.TransferNode(dbPath, target, newOwner)
+	// The files are moved on disk before the transaction, the storage may use
+	// the database itself and would wait for the transaction to end
+	rh := newResponseHijacker(w)
+	handler.ServeHTTP(rh, r)
+	if rh.status != http.StatusCreated && rh.status != http.StatusNoContent {
+		log.Errorf("Failed to move %v to %v, status %v", path, targetPath, rh.status)
+		restoreReplaced()
+		// Send the response of the webdav server
+		for key, values := range rh.headers {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(rh.status)
+		w.Write(rh.body)
+		return
+	}
+
+	// The nodes are moved in a transaction, the files are moved back if it
+	// fails. The ids of the nodes don't change, so their shares, favorites and
+	// trash references move with them.
+	err = db.WithTx(func(tx *db.Tx) error {
+		// The compensations run in reverse order, the moved files make room
+		// for the replaced ones first
+		tx.OnRollback(restoreReplaced)
+		tx.OnRollback(func() {
+			err := storage.Rename(context.Background(), targetPath, path)
+			if err != nil {
+				log.Errorf("Failed to move %v back to %v: %v", targetPath, path, err)
+			}
+		})
+
+		if replaced != nil {
+			err := trashNode(tx, replaced, replacedTrashPath)
+			if err != nil {
+				log.Errorf("Failed to move the replaced node %v to the trash: %v", targetPath, err)
+				return err
+			}
+		}
+
+		// The descendants follow the root node, and are transferred with it
+		err := tx.TransferNode(path, targetPath, newOwner)
 		if err != nil {
-			log.Error("Could not update node location: ", err)
-			log.Info("Original path: ", dbPath)
-			log.Info("Target path: ", target)
+			log.Error("Failed to move nodes: ", err)
+			log.Info("Original path: ", path)
+			log.Info("Target path: ", targetPath)
 			return err
-
 		}
 
-		return nil
+		err = tx.PropagateSize(path, -rootNode.Size)
+		if err == nil {
+			err = tx.PropagateSize(targetPath, rootNode.Size)
+		}
+		if err != nil {
+			log.Error("Failed to update directory sizes: ", err)
+		}
+		return err
 	})
 
 	if err != nil {
-		log.Error("Failed to move nodes: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	movedNode, err := db.GetNode(targetPath)
+	if err != nil || movedNode == nil {
+		log.Errorf("Failed to get the moved node %v: %v", targetPath, err)
+	} else {
+		activity.Record(id.Username, activity.SubjectMoved, movedNode)
+	}
+	notification.CheckQuota(newOwner)
 
-	destination = destinationUrl.String()
-
-	r.Header.Set("Destination", destination)
+	if replaced != nil && rh.status == http.StatusCreated {
+		// The destination was moved aside, but it existed
+		rh.status = http.StatusNoContent
+	}
 
-	handler.ServeHTTP(w, r)
+	// Send the response of the webdav server
+	for key, values := range rh.headers {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(rh.status)
+	w.Write(rh.body)
 }
@@ -6,13 +6,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/beevik/etree"
+	"github.com/gowncloud/gowncloud/checksum"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
 )
@@ -40,6 +39,7 @@ var patchMap map[string]patchFunction = map[string]patchFunction{
 	"favorite":           patchFavorite,
 	"size":               patchSize,
 	"owner-display-name": patchOwnerDisplayName,
+	"checksums":          patchChecksums,
 }
 
 // PropFindAdapter is the adapter for the PROPFIND method. It intercepts the response
@@ -140,7 +140,7 @@ func PropFindAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Re
 	patchErrors := make([]error, 0)
 
 	// Keep track of the node id's
-	nodeIDs := make([]float64, 0)
+	nodeIDs := make([]int64, 0)
 
 	// Remove the user folder from the href nodes and patch the responses
 	for _, response := range responses {
@@ -193,6 +193,7 @@ func PropFindAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Re
 			}
 		}
 		href.SetText(hrefString)
+		patchEtag(foundProps, node)
 		shares, err := db.GetSharesByNodeId(node.ID)
 		if err != nil {
 			log.Error("Error getting possible shares from database")
@@ -289,6 +290,7 @@ func PropFindAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Re
 					log.Debug("No not found props, nothing to do here")
 					continue
 				}
+				patchEtag(foundProps, sharedNode)
 				s := []*db.Share{
 					0: share,
 				}
@@ -315,7 +317,7 @@ func PropFindAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Re
 
 	log.Debugf("Propfind patching finished with %v errors", len(patchErrors))
 	for i, e := range patchErrors {
-		log.Debug("Error %v: %v", i, e)
+		log.Debugf("Error %v: %v", i, e)
 	}
 
 	w.WriteHeader(rh.status)
@@ -328,7 +330,7 @@ func patchFileId(foundProps *etree.Element, notFoundProps *etree.Element, node *
 		return fmt.Errorf("Failed to get the fileid prop from the not found section")
 	}
 	fileId := foundProps.CreateElement("oc:fileid")
-	fileIdString := strconv.FormatFloat(node.ID, 'e', -1, 64)
+	fileIdString := strconv.FormatInt(node.ID, 10)
 	fileId.SetText(fileIdString)
 
 	removedChild := notFoundProps.RemoveChild(fileIdNotFound)
@@ -345,7 +347,7 @@ func patchId(foundProps *etree.Element, notFoundProps *etree.Element, node *db.N
 		return fmt.Errorf("Failed to get the id prop from the not found section")
 	}
 	id := foundProps.CreateElement("oc:id")
-	idString := strconv.FormatFloat(node.ID, 'e', -1, 64)
+	idString := db.FormatOcId(node.ID)
 	id.SetText(idString)
 
 	removedChild := notFoundProps.RemoveChild(idNotFound)
@@ -429,12 +431,7 @@ func patchSize(foundProps *etree.Element, notFoundProps *etree.Element, node *db
 	if notFoundSize == nil {
 		return fmt.Errorf("Failed to get size prop from the not found section")
 	}
-	byteSize, err := getDirSize(db.GetSetting(db.DAV_ROOT) + node.Path)
-	if err != nil {
-		log.Error("Failed to calculate directory size: ", err)
-		return fmt.Errorf("Failed to calculate directory size: %v", err)
-	}
-	sizeString := strconv.FormatInt(byteSize, 10)
+	sizeString := strconv.FormatInt(node.Size, 10)
 	size := foundProps.CreateElement("oc:size")
 	size.SetText(sizeString)
 
@@ -462,6 +459,49 @@ func patchOwnerDisplayName(foundProps *etree.Element, notFoundProps *etree.Eleme
 	return nil
 }
 
+// patchChecksums adds the checksums of the file. Directories and files of which
+// the checksums are unknown, e.g. because they were added outside of gowncloud,
+// keep the property in the not found section.
+func patchChecksums(foundProps *etree.Element, notFoundProps *etree.Element, node *db.Node, shared []*db.Share, user string) error {
+	if node.Isdir {
+		return nil
+	}
+	checksums, err := checksum.Load(node)
+	if err != nil {
+		return fmt.Errorf("Database error")
+	}
+	if checksums == nil {
+		return nil
+	}
+	notFoundChecksums := notFoundProps.SelectElement("checksums")
+	if notFoundChecksums == nil {
+		return fmt.Errorf("Failed to get checksums prop from the not found section")
+	}
+	checksumsElement := foundProps.CreateElement("oc:checksums")
+	checksumElement := checksumsElement.CreateElement("oc:checksum")
+	checksumElement.SetText(checksums.String())
+
+	removedChild := notFoundProps.RemoveChild(notFoundChecksums)
+	if removedChild == nil {
+		log.Warn("Failed to patch checksums")
+		return fmt.Errorf("Failed to patch checksums")
+	}
+	return nil
+}
+
+// patchEtag replaces the etag generated by the webdav server with the etag of
+// the node, which also changes when a descendant of a directory changes
+func patchEtag(foundProps *etree.Element, node *db.Node) {
+	if node.Etag == "" {
+		return
+	}
+	etag := foundProps.SelectElement("getetag")
+	if etag == nil {
+		return
+	}
+	etag.SetText("\"" + node.Etag + "\"")
+}
+
 func getPropStats(response *etree.Element) (foundProps, notFoundProps *etree.Element, err error) {
 	propstats := response.SelectElements("propstat")
 	var foundPstat, notFoundPstat *etree.Element
@@ -502,18 +542,6 @@ func modifyNamespaceToLower(element *etree.Element) {
 	}
 }
 
-// getDirSize gets the size of the directory (all of its descendants) at path.
-func getDirSize(path string) (int64, error) {
-	var space int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			space += info.Size()
-		}
-		return err
-	})
-	return space, err
-}
-
 // getNodeFromHref unescapes the href and returns the associated node
 func getNodeFromHref(href string, username string) (*db.Node, error) {
 	path := strings.TrimSuffix(strings.Replace(href, "/remote.php/webdav", username+"/files", 1), "/")
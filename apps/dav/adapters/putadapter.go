@@ -1,15 +1,27 @@
 package ocdavadapters
 
 import (
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/activity"
+	"github.com/gowncloud/gowncloud/checksum"
+	"github.com/gowncloud/gowncloud/core/audit"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/image"
+	"github.com/gowncloud/gowncloud/media"
+	"github.com/gowncloud/gowncloud/notification"
+	"golang.org/x/net/context"
 )
 
-// PutAdapter saves the uploaded node in the database, then pass it on to store it on disk
+// PutAdapter lets the webdav server store the upload, then verifies the checksum
+// sent by the client and saves the node with its checksums in the database
 func PutAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
 	id := identity.CurrentSession(r)
 
@@ -29,25 +41,107 @@ func PutAdapter(handler http.HandlerFunc, w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	path = path + "/" + inputPath[strings.LastIndex(inputPath, "/")+1:]
-	r.URL.Path = "/remote.php/webdav/" + path
+	name := inputPath[strings.LastIndex(inputPath, "/")+1:]
+	path = path + "/" + name
 
-	// Since put replaces any existing file, just remove the node.
-	err = db.DeleteNode(path)
+	existing, err := db.GetNode(path)
 	if err != nil {
-		log.Error("Failed to remove old node")
+		log.Error("Failed to get node: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if existing != nil && existing.Isdir {
+		log.Warn("Upload would replace a directory: ", path)
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+		return
+	}
+
+	// The upload is written to a part file first, and only replaces the existing
+	// file once it is complete and matches the checksum sent by the client
+	partPath := path[:strings.LastIndex(path, "/")] + "/." + name + ".part" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	ctx := context.Background()
+	r.URL.Path = "/remote.php/webdav/" + partPath
+	hasher := checksum.NewHasher()
+	r.Body = ioutil.NopCloser(io.TeeReader(r.Body, hasher))
+
+	rh := newResponseHijacker(w)
+	handler.ServeHTTP(rh, r)
+	if rh.status != http.StatusCreated && rh.status != http.StatusNoContent && rh.status != http.StatusOK {
+		storage.RemoveAll(ctx, partPath)
+		for key, values := range rh.headers {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(rh.status)
+		w.Write(rh.body)
+		return
+	}
 
-	contentType := r.Header.Get("Content-Type")
+	checksums := hasher.Sum()
+	if header := r.Header.Get(checksum.Header); header != "" {
+		err = checksums.Verify(header)
+		if err != nil {
+			storage.RemoveAll(ctx, partPath)
+			log.Warnf("Rejecting upload of %v with checksum %v: %v", path, header, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// An existing node is updated in place, so its id and everything attached
+	// to it, like shares and favorites, are kept
+	if existing == nil {
+		_, err = db.SaveNode(path, path[:strings.Index(path, "/")], false, r.Header.Get("Content-Type"))
+		if err != nil {
+			storage.RemoveAll(ctx, partPath)
+			log.Error("Failed to save node in database")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	} else {
+		image.InvalidatePreviews(existing)
+		media.InvalidateRenditions(existing)
+	}
+
+	err = storage.Rename(ctx, partPath, path)
+	if err != nil {
+		storage.RemoveAll(ctx, partPath)
+		log.Error("Failed to move the upload in place: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	_, err = db.SaveNode(path, path[:strings.Index(path, "/")], false, contentType)
+	fileInfo, err := storage.Stat(ctx, path)
 	if err != nil {
-		log.Error("Failed to save node in database")
+		log.Error("Failed to get file info after upload: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	node, err := db.UpdateFileMetadata(path, fileInfo.Size(), fileInfo.ModTime())
+	if err != nil {
+		log.Error("Failed to update node metadata: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	err = checksum.Save(node, checksums)
+	if err != nil {
+		log.Error("Failed to save the checksums: ", err)
+	}
+	image.SchedulePregeneration(node)
+	media.ScheduleTranscoding(node)
+	audit.Record(r, id.Username, audit.FileUpload, audit.Fields{"path": node.Path, "nodeid": node.ID, "size": node.Size})
+	if existing != nil {
+		activity.Record(id.Username, activity.SubjectChanged, node)
+	} else {
+		activity.Record(id.Username, activity.SubjectCreated, node)
+	}
+	notification.CheckQuota(path[:strings.Index(path, "/")])
 
-	handler.ServeHTTP(w, r)
+	for key, values := range rh.headers {
+		w.Header()[key] = values
+	}
+	// The etag of the webdav server is the one of the part file
+	w.Header().Set("ETag", "\""+node.Etag+"\"")
+	w.Header().Set(checksum.Header, checksum.SHA1+":"+checksums.SHA1)
+	w.WriteHeader(rh.status)
+	w.Write(rh.body)
 }
@@ -1,6 +1,7 @@
 package dav
 
 import (
+	"errors"
 	"net/http"
 	"os"
 	"strings"
@@ -8,26 +9,32 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/gowncloud/gowncloud/apps/dav/adapters"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/fs"
 	"golang.org/x/net/webdav"
 )
 
+// ErrReservedUsername is returned when creating a user named after the app-data
+// directory, which is in the root of the storage next to the home directories
+var ErrReservedUsername = errors.New("This username is reserved")
+
 // CustomOCDav is a wrapper around the stadard golang webdav implementation. It aims
 // to mimic the standard owncloud webdav as much as possible, i.e. this implementation
 // and the standard owncloud implementation should be interchangeable
 // without an external client noticing
 type CustomOCDav struct {
-	dav          webdav.Handler
-	filePathRoot string
+	dav        webdav.Handler
+	fileSystem fs.FileSystem
 }
 
 // NewCustomOCDav initializes a new CustomOCDav. The root of the DAV server will
-// be the given path.
-func NewCustomOCDav(path string) *CustomOCDav {
+// be the root of the given file system.
+func NewCustomOCDav(fileSystem fs.FileSystem) *CustomOCDav {
+	ocdavadapters.Init(fileSystem)
 	server := &CustomOCDav{
-		filePathRoot: path,
+		fileSystem: fileSystem,
 		dav: webdav.Handler{
 			Prefix:     "/remote.php/webdav",
-			FileSystem: webdav.Dir(path),
+			FileSystem: fileSystem,
 			LockSystem: webdav.NewMemLS(),
 			Logger: func(r *http.Request, err error) {
 				log.Debug("Internal WEBDAV")
@@ -78,44 +85,40 @@ func (dav *CustomOCDav) DispatchRequest() http.Handler {
 
 // MakeUserHomeDirectory creates the home directory for a user. The folder name is
 // the username, and its parent folder is the webdavroot. It also creates the user
-// in the database
+// in the database. Users can't be named after the app-data directory. The user and directories are created in a transaction, if any
+// step fails the directories created on disk are removed again.
 func MakeUserHomeDirectory(username string) error {
-	_, err := db.CreateUser(username)
-	if err != nil {
-		log.Errorf("Failed to create user %v: %v", username, err)
-		return err
-	}
-	_, err = db.SaveNode(username, username, true, "httpd/unix-directory")
-	if err != nil {
-		log.Errorf("Failed to make base directory for user %v: %v", username, err)
-		return err
-	}
-	err = os.Mkdir(db.GetSetting(db.DAV_ROOT)+username, os.ModePerm)
-	if err != nil {
-		log.Errorf("Failed to make base directory for user %v: %v", username, err)
-		return err
-	}
-	_, err = db.SaveNode(username+"/files", username, true, "httpd/unix-directory")
-	if err != nil {
-		log.Errorf("Failed to make files directory for user %v: %v", username, err)
-		return err
-	}
-	err = os.Mkdir(db.GetSetting(db.DAV_ROOT)+username+"/files", os.ModePerm)
-	if err != nil {
-		log.Errorf("Failed to make files directory for user %v: %v", username, err)
-		return err
-	}
-	_, err = db.SaveNode(username+"/files_trash", username, true, "httpd/unix-directory")
-	if err != nil {
-		log.Errorf("Failed to make trash directory for user %v: %v", username, err)
-		return err
+	if username == fs.AppDataDir {
+		log.Errorf("Refused to create user %v: the username is reserved", username)
+		return ErrReservedUsername
 	}
-	err = os.Mkdir(db.GetSetting(db.DAV_ROOT)+username+"/files_trash", os.ModePerm)
-	if err != nil {
-		log.Errorf("Failed to make trash directory for user %v: %v", username, err)
-		return err
-	}
-	return nil
+	return db.WithTx(func(tx *db.Tx) error {
+		_, err := tx.CreateUser(username)
+		if err != nil {
+			log.Errorf("Failed to create user %v: %v", username, err)
+			return err
+		}
+		for _, dir := range []string{username, username + "/files", username + "/files_trash"} {
+			_, err = tx.SaveNode(dir, username, true, "httpd/unix-directory")
+			if err != nil {
+				log.Errorf("Failed to make directory %v for user %v: %v", dir, username, err)
+				return err
+			}
+			diskPath := db.GetSetting(db.DAV_ROOT) + dir
+			err = os.Mkdir(diskPath, os.ModePerm)
+			if err != nil {
+				log.Errorf("Failed to make directory %v for user %v: %v", dir, username, err)
+				return err
+			}
+			tx.OnRollback(func() {
+				err := os.Remove(diskPath)
+				if err != nil {
+					log.Errorf("Failed to remove directory %v: %v", diskPath, err)
+				}
+			})
+		}
+		return nil
+	})
 }
 
 // NormalizePath removes trailing slashes from a path, it is a middleware that should
@@ -23,6 +23,10 @@ func ensureHomeDirectoryMiddleware(adapter ocdavadapters.Adapter, handler http.H
 		err = MakeUserHomeDirectory(username)
 	}
 
+	if err == ErrReservedUsername {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		log.Error("Failed to make user home directory")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -4,19 +4,28 @@ import (
 	"archive/zip"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/core/audit"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/fs"
+	"golang.org/x/net/context"
 )
 
+// storage is the file system holding the files of the users
+var storage fs.FileSystem
+
+// Init sets the file system holding the files of the users
+func Init(fileSystem fs.FileSystem) {
+	storage = fileSystem
+}
+
 // Download serves the file or directory for downloading
 func Download(w http.ResponseWriter, r *http.Request) {
 	log.Debug("Starting download")
@@ -84,22 +93,29 @@ func serveSingle(file string, dir string, w http.ResponseWriter, r *http.Request
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
 	}
+	audit.Record(r, id.Username, audit.FileDownload, audit.Fields{"path": node.Path, "nodeid": node.ID})
 	if node.Isdir {
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%v.zip\"", file))
 		w.Header().Set("Content-Type", "application/zip")
 		w.WriteHeader(http.StatusOK)
 		zipper := zip.NewWriter(w)
 		defer zipper.Close()
-		err = serveDir(db.GetSetting(db.DAV_ROOT)+filePath, zipper)
+		err = serveDir(filePath, zipper)
 		if err != nil {
 			log.Error("Failed to serve file or directory: ", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		}
 		return
 	}
+	f, err := storage.OpenFile(context.Background(), filePath, os.O_RDONLY, 0)
+	if err != nil {
+		log.Error("Failed to open file: ", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
 	w.Header().Set("Content-Disposition", "attachment; filename="+file)
-	w.WriteHeader(http.StatusOK)
-	http.ServeFile(w, r, db.GetSetting(db.DAV_ROOT)+filePath)
+	http.ServeContent(w, r, file, node.Mtime, f)
 	return
 }
 
@@ -124,8 +140,9 @@ func serveMultiple(files []string, dir string, w http.ResponseWriter, r *http.Re
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
+		audit.Record(r, id.Username, audit.FileDownload, audit.Fields{"path": filePath})
 		// No need to retrieve the node from the database as we don't need any info from it
-		err = serveDir(db.GetSetting(db.DAV_ROOT)+filePath, zipper)
+		err = serveDir(filePath, zipper)
 		if err != nil {
 			log.Error("Error while writing zip file: ", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -140,9 +157,8 @@ func serveMultiple(files []string, dir string, w http.ResponseWriter, r *http.Re
 func serveHomeDir(w http.ResponseWriter, r *http.Request) {
 	log.Debug("Serving all files and shares from user home directory")
 	id := identity.CurrentSession(r)
-	davroot := db.GetSetting(db.DAV_ROOT)
 	dirPath := id.Username + "/files"
-	info, err := ioutil.ReadDir(davroot + dirPath)
+	info, err := readDir(dirPath)
 	if err != nil {
 		log.Error("Failed to read directory content: ", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -182,10 +198,13 @@ func serveHomeDir(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// finally, serve all the files and directories
+	for _, path := range files {
+		audit.Record(r, id.Username, audit.FileDownload, audit.Fields{"path": path})
+	}
 	zipper := zip.NewWriter(w)
 	defer zipper.Close()
 	for _, path := range files {
-		err = serveDir(davroot+path, zipper)
+		err = serveDir(path, zipper)
 		if err != nil {
 			log.Error("Error while writing zip file: ", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -194,11 +213,21 @@ func serveHomeDir(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// readDir returns the content of a directory in the storage
+func readDir(dirPath string) ([]os.FileInfo, error) {
+	dir, err := storage.OpenFile(context.Background(), dirPath, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return dir.Readdir(-1)
+}
+
 // serveDir walks the directory tree and serves all the files. If the path points to a file,
 // only said file is served
 func serveDir(dirPath string, zipper *zip.Writer) error {
 	var total int64
-	return filepath.Walk(dirPath, func(path string, fi os.FileInfo, err error) error {
+	return storage.Walk(dirPath, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -210,7 +239,7 @@ func serveDir(dirPath string, zipper *zip.Writer) error {
 		if err != nil {
 			return err
 		}
-		file, err := os.Open(path)
+		file, err := storage.OpenFile(context.Background(), path, os.O_RDONLY, 0)
 		if err != nil {
 			return err
 		}
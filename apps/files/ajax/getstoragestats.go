@@ -10,7 +10,7 @@ import (
 )
 
 type Data struct {
-	UploadMaxFileSize int    `json:"uploadMaxFilesize"`
+	UploadMaxFileSize int64  `json:"uploadMaxFilesize"`
 	MaxHumanFilesize  string `json:"maxHumanFilesize"`
 	FreeSpace         int64  `json:"freeSpace"`
 	UsedSpacePercent  int    `json:"usedSpacePercent"`
@@ -31,20 +31,32 @@ func GetStorageStats(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		log.Error("Failed to get user from db: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		log.Error("User not found: ", username)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	var size, freeSpace int64
+	var freeSpace int64
 	usedSpacePercent := 0
 	if user.Allowedspace != 0 {
-		size, err = getDirSize(db.GetSetting(db.DAV_ROOT) + username)
+		// Only the files count against the quota, not the trash and the versions
+		filesNode, err := db.GetNode(username + "/files")
 		if err != nil {
-			log.Error("Failed to get directory size: ", err)
+			log.Error("Failed to get files directory node: ", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		var size int64
+		if filesNode != nil {
+			size = filesNode.Size
+		}
 		// Allowedspace is stored as GB
-		freeSpace = int64(user.Allowedspace)<<30 - size
-		usedSpacePercent = int(100 * (freeSpace / int64(user.Allowedspace) << 30))
+		allowedSpace := int64(user.Allowedspace) << 30
+		freeSpace = allowedSpace - size
+		usedSpacePercent = int(100 * size / allowedSpace)
 	}
 
 	diskSpace, err := getFreeDiskSpace()
@@ -62,10 +74,11 @@ func GetStorageStats(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	maxSize := uploadMaxSize()
 	data := &StorageStats{
 		Data: Data{
-			UploadMaxFileSize: 537919488,
-			MaxHumanFilesize:  "Upload (max. 513 MB)",
+			UploadMaxFileSize: maxSize,
+			MaxHumanFilesize:  "Upload (max. " + humanFileSize(maxSize) + ")",
 			FreeSpace:         freeSpace,
 			UsedSpacePercent:  usedSpacePercent,
 			Owner:             username,
@@ -2,11 +2,7 @@ package files
 
 import (
 	"encoding/json"
-	"math/rand"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strconv"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -20,11 +16,11 @@ type favoriteList struct {
 
 type file struct {
 	Etag        string   `json:"etag"`
-	Id          float64  `json:"id"`
+	Id          int64    `json:"id"`
 	MimeType    string   `json:"mimetype"`
 	Mtime       int64    `json:"mtime"`
 	Name        string   `json:"name"`
-	ParentId    float64  `json:"parentId"`
+	ParentId    int64    `json:"parentId"`
 	ParentPath  string   `json:"path"`
 	Permissions int      `json:"permissions"`
 	Sharetypes  []int    `json:"shareTypes,omitempty"`
@@ -46,15 +42,7 @@ func ListFavorites(w http.ResponseWriter, r *http.Request) {
 
 	files := make([]file, 0)
 
-	davroot := db.GetSetting(db.DAV_ROOT)
 	for _, node := range nodes {
-		fi, err := os.Stat(davroot + node.Path)
-		if err != nil {
-			log.Error("Failed to get node information: ", err)
-			err = nil
-			continue
-		}
-
 		parentNode, err := db.GetNode(node.Path[:strings.LastIndex(node.Path, "/")])
 		if err != nil {
 			log.Error("Failed to get parent node: ", err)
@@ -87,28 +75,20 @@ func ListFavorites(w http.ResponseWriter, r *http.Request) {
 		}
 
 		fileData := file{
-			Etag:        strconv.Itoa(rand.Int()), // Fake for now
+			Etag:        node.Etag,
 			Id:          node.ID,
 			MimeType:    node.MimeType,
-			Mtime:       fi.ModTime().Unix() * 1000,
-			Name:        fi.Name(),
+			Mtime:       node.Mtime.Unix() * 1000,
+			Name:        node.Path[strings.LastIndex(node.Path, "/")+1:],
 			ParentId:    homeNode.ID,
 			ParentPath:  parentPath,
 			Permissions: permissions,
-			Size:        fi.Size(),
+			Size:        node.Size,
 			Type:        "file",
 		}
 
 		if node.Isdir {
 			fileData.Type = "dir"
-
-			size, err := getDirSize(db.GetSetting(db.DAV_ROOT) + node.Path)
-			if err != nil {
-				log.Error("Failed to get directory size: ", err)
-				err = nil
-				continue
-			}
-			fileData.Size = size
 		}
 
 		if share != nil {
@@ -131,14 +111,3 @@ func ListFavorites(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
-
-func getDirSize(path string) (int64, error) {
-	var space int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			space += info.Size()
-		}
-		return err
-	})
-	return space, err
-}
@@ -59,11 +59,20 @@ func GetPreview(w http.ResponseWriter, r *http.Request) {
 		filePath = username + "/files" + filePath
 	}
 
-	generatePreview(query.Get("x"), query.Get("y"), filePath, w)
+	generatePreview(w, r, query.Get("x"), query.Get("y"), filePath)
 }
 
-// generatePreview generates an image preview from a file
-func generatePreview(widthString, heightString, filePath string, w http.ResponseWriter) {
-	path := db.GetSetting(db.DAV_ROOT) + filePath
-	image.GeneratePreview(widthString, heightString, path, w)
+// generatePreview generates an image preview from the node at nodePath
+func generatePreview(w http.ResponseWriter, r *http.Request, widthString, heightString, nodePath string) {
+	node, err := db.GetNode(nodePath)
+	if err != nil {
+		log.Error("Failed to get node: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if node == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	image.GeneratePreview(w, r, node, widthString, heightString)
 }
@@ -66,5 +66,5 @@ func GetThumbnail(w http.ResponseWriter, r *http.Request) {
 		filePath = nodes[0].Path
 	}
 
-	generatePreview(widthString, heightString, filePath, w)
+	generatePreview(w, r, widthString, heightString, filePath)
 }
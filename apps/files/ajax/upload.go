@@ -3,34 +3,55 @@ package files
 import (
 	"encoding/json"
 	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/activity"
+	"github.com/gowncloud/gowncloud/checksum"
+	"github.com/gowncloud/gowncloud/core/audit"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/image"
+	"github.com/gowncloud/gowncloud/media"
+	"github.com/gowncloud/gowncloud/notification"
+	"golang.org/x/net/context"
 )
 
 type UploadResponse struct {
-	Directory         string  `json:"directory"`
-	Etag              string  `json:"etag"`
-	Id                float64 `json:"id"`
-	MaxHumanFilesize  string  `json:"maxHumanFilesize"`
-	Mimetype          string  `json:"mimetype"`
-	Mtime             int64   `json:"mtime"`
-	Name              string  `json:"name"`
-	Originalname      string  `json:"originalname"`
-	ParentId          float64 `json:"parentId"`
-	Permissions       int     `json:"permissions"`
-	Size              int     `json:"size"`
-	Status            string  `json:"status"`
-	Sort              string  `json:"type"`
-	UploadMaxFilesize int     `json:"uploadMaxFilesize"`
+	Checksum          string `json:"checksum"`
+	Directory         string `json:"directory"`
+	Etag              string `json:"etag"`
+	Id                int64  `json:"id"`
+	MaxHumanFilesize  string `json:"maxHumanFilesize"`
+	Mimetype          string `json:"mimetype"`
+	Mtime             int64  `json:"mtime"`
+	Name              string `json:"name"`
+	Originalname      string `json:"originalname"`
+	ParentId          int64  `json:"parentId"`
+	Permissions       int    `json:"permissions"`
+	Size              int64  `json:"size"`
+	Status            string `json:"status"`
+	Sort              string `json:"type"`
+	UploadMaxFilesize int64  `json:"uploadMaxFilesize"`
 }
 
-// Upload uploads files to the server and stores data in the database
+const (
+	// defaultUploadMaxSize is the upload limit used when the setting is missing
+	// or invalid, 512MB
+	defaultUploadMaxSize = 1 << 29
+	// maxFieldSize limits the size of the form fields sent along with the files
+	maxFieldSize = 1 << 16
+)
+
+// Upload uploads files to the server and stores data in the database. The files
+// are streamed to disk part by part, so uploads are never buffered in memory.
+// The form fields must precede the files, as the web interface sends them.
 func Upload(w http.ResponseWriter, r *http.Request) {
 	username := identity.CurrentSession(r).Username
 	groups := identity.CurrentSession(r).Organizations
@@ -42,31 +63,91 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO: is this required?
-	err := r.ParseMultipartForm(1 << 29) // reserve 2^29 bytes = 536870912B / 512MB
+	reader, err := r.MultipartReader()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Warn("Upload is not a multipart form: ", err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	fileDirectory := r.PostForm.Get("file_directory")
-	if fileDirectory != "" {
-		uploadDirectory(w, r)
-		return
+	maxSize := uploadMaxSize()
+	fields := make(map[string]string)
+	targetdir := ""
+	responseDir := ""
+	body := []UploadResponse{}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Warn("Failed to read the upload: ", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err != nil {
+				log.Warn("Failed to read form field: ", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fields[part.FormName()] = string(value)
+			continue
+		}
+
+		// The target directory is known once the first file arrives
+		if targetdir == "" {
+			var status int
+			if fields["file_directory"] != "" {
+				targetdir, responseDir, status = uploadDirectory(fields, username, groups)
+			} else {
+				targetdir, responseDir, status = uploadTarget(fields, username, groups)
+			}
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			log.Debug("target directory: ", targetdir)
+		}
+
+		data, status := saveUpload(part, targetdir, maxSize, username)
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		data.Directory = responseDir
+		body = append(body, data)
+		audit.Record(r, username, audit.FileUpload, audit.Fields{"path": targetdir + "/" + data.Name, "nodeid": data.Id, "size": data.Size})
+	}
+
+	if targetdir != "" {
+		notification.CheckQuota(targetdir[:strings.Index(targetdir, "/")])
 	}
 
-	dir := r.PostForm.Get("dir")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(body)
+}
+
+// uploadTarget returns the path of the node of the directory to upload to, and
+// the directory to report in the response. The directory is either in the
+// files of the user, or in a folder shared with him.
+func uploadTarget(fields map[string]string, username string, groups []string) (string, string, int) {
+	dir := fields["dir"]
+	if dir == "" {
+		dir = "/"
+	}
 	targetdir := username + "/files"
 	if dir != "/" {
 		targetdir += dir
 	}
-	log.Debug("target directory: ", targetdir)
 
 	exists, err := db.NodeExists(targetdir)
 	if err != nil {
 		log.Error("Failed to check if node exists")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return "", "", http.StatusInternalServerError
 	}
 	if !exists {
 		nodePath := strings.TrimPrefix(targetdir, username+"/files")
@@ -78,12 +159,10 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 		sharedNodes, err = findShareRoot(nodePath, username, groups)
 		if err != nil {
 			log.Error("Error while searching for shared nodes")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return "", "", http.StatusInternalServerError
 		}
 		if len(sharedNodes) == 0 {
-			w.WriteHeader(http.StatusNotFound)
-			return
+			return "", "", http.StatusNotFound
 		}
 		// Log collisions
 		if len(sharedNodes) > 1 {
@@ -92,98 +171,33 @@ func Upload(w http.ResponseWriter, r *http.Request) {
 
 		targetNode := sharedNodes[0]
 		targetdir = targetNode.Path[:strings.LastIndex(targetNode.Path, "/")] + strings.TrimPrefix(targetdir, username+"/files")
-
-		targetdir = db.GetSetting(db.DAV_ROOT) + targetdir
-
-	} else {
-
-		targetdir = db.GetSetting(db.DAV_ROOT) + targetdir
-
 	}
-
-	body := []UploadResponse{}
-
-	for _, fileHeaders := range r.MultipartForm.File {
-		for _, file := range fileHeaders {
-			// Open the upload file
-			upload, err := file.Open()
-			if err != nil {
-				log.Errorf("Failed to open upload file: %v", file.Filename)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			// Create the upload target
-			target, err := os.Create(targetdir + "/" + file.Filename)
-			if err != nil {
-				log.Errorf("Failed to open target file: %v", targetdir+"/"+file.Filename)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			log.Debug("target file: ", target.Name())
-			// Buffered copy
-			written, err := io.Copy(target, upload)
-			if err != nil {
-				log.Error("Failed to copy upload file")
-				// TODO: clean up target
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			log.Debugf("copied %v bytes", written)
-
-			targetStats, err := target.Stat()
-			if err != nil {
-				log.Error("Failed to get stats")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			dbFileName := strings.TrimPrefix(target.Name(), db.GetSetting(db.DAV_ROOT))
-			node, err := db.SaveNode(dbFileName, dbFileName[:strings.Index(dbFileName, "/")], false, file.Header.Get("Content-Type"))
-			if err != nil {
-				log.Error("Failed to save node in database")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			// Create the response
-			data := UploadResponse{
-				Directory:         dir,
-				Etag:              "adfafdlasdfafdsaf", // TODO: send upload through webdav
-				Id:                node.ID,
-				MaxHumanFilesize:  "512MB",
-				Mimetype:          file.Header.Get("Content-Type"),
-				Mtime:             int64(time.Now().Unix()) * 1000, // the upload time aka Now
-				Name:              file.Filename,
-				Originalname:      file.Filename,
-				ParentId:          2,
-				Permissions:       31,
-				Size:              int(targetStats.Size()),
-				Status:            "success",
-				Sort:              "file",
-				UploadMaxFilesize: 1 << 29,
-			}
-			body = append(body, data)
-		}
-	}
-
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(body)
+	return targetdir, dir, http.StatusOK
 }
 
-// TODO: Merge with Upload
-func uploadDirectory(w http.ResponseWriter, r *http.Request) {
+// uploadDirectory returns the target of a file in an uploaded directory, like
+// uploadTarget. The directories of the file_directory field which don't exist
+// yet are created.
+func uploadDirectory(fields map[string]string, username string, groups []string) (string, string, int) {
 	log.Debug("Uploading directory")
-	username := identity.CurrentSession(r).Username
-	groups := identity.CurrentSession(r).Organizations
 
-	fileDirectory := strings.TrimSuffix(r.PostForm.Get("file_directory"), "/")
-	dir := r.PostForm.Get("dir")
+	fileDirectory := strings.TrimSuffix(fields["file_directory"], "/")
+	dir := fields["dir"]
+	if dir == "" {
+		dir = "/"
+	}
+	for _, name := range strings.Split(fileDirectory, "/") {
+		if name == "" || name == "." || name == ".." {
+			log.Warn("Invalid upload directory: ", fileDirectory)
+			return "", "", http.StatusBadRequest
+		}
+	}
 	fullDirectory := username + "/files"
 	if dir != "/" {
 		fullDirectory += dir
 	}
 	fullDirectory += "/" + fileDirectory
 
-	log.Debug("target directory: ", fullDirectory)
-
 	// small hack to fix uploads to user home directory
 	exists := true
 	var err error
@@ -191,8 +205,7 @@ func uploadDirectory(w http.ResponseWriter, r *http.Request) {
 		exists, err = parentExists(fullDirectory, username)
 		if err != nil {
 			log.Error("Failed to check if node exists")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return "", "", http.StatusInternalServerError
 		}
 	}
 
@@ -206,12 +219,10 @@ func uploadDirectory(w http.ResponseWriter, r *http.Request) {
 		sharedNodes, err = findShareRoot(nodePath, username, groups)
 		if err != nil {
 			log.Error("Error while searching for shared nodes")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return "", "", http.StatusInternalServerError
 		}
 		if len(sharedNodes) == 0 {
-			w.WriteHeader(http.StatusNotFound)
-			return
+			return "", "", http.StatusNotFound
 		}
 		// Log collisions
 		if len(sharedNodes) > 1 {
@@ -229,8 +240,7 @@ func uploadDirectory(w http.ResponseWriter, r *http.Request) {
 		exists, err := db.NodeExists(tmpDir)
 		if err != nil {
 			log.Error("Failed to check if directory exists")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return "", "", http.StatusInternalServerError
 		}
 		if exists {
 			break
@@ -241,96 +251,165 @@ func uploadDirectory(w http.ResponseWriter, r *http.Request) {
 
 	for i := len(nodesToCreate) - 1; i >= 0; i-- {
 		nodePath := nodesToCreate[i]
-		err := os.Mkdir(db.GetSetting(db.DAV_ROOT)+nodePath, os.ModePerm)
+		err := storage.Mkdir(context.Background(), nodePath, os.ModePerm)
 		if err != nil {
 			log.Error("Failed to create directory")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return "", "", http.StatusInternalServerError
 		}
 		_, err = db.SaveNode(nodePath, nodePath[:strings.Index(nodePath, "/")], true, "httpd/unix-directory")
 		if err != nil {
 			log.Error("Failed to save directory info")
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return "", "", http.StatusInternalServerError
 		}
 	}
 
-	targetdir := db.GetSetting(db.DAV_ROOT) + fullDirectory
-	log.Debug("target directory: ", targetdir)
-
-	body := []UploadResponse{}
+	dirName := dir
+	if dirName != "/" {
+		dirName += "/"
+	}
+	dirName += fileDirectory
+	return fullDirectory, dirName, http.StatusOK
+}
 
-	for _, fileHeaders := range r.MultipartForm.File {
-		for _, file := range fileHeaders {
-			// Open the upload file
-			upload, err := file.Open()
-			if err != nil {
-				log.Errorf("Failed to open upload file: %v", file.Filename)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+// saveUpload streams an uploaded file to the target directory, and saves or
+// updates its node. The size and checksums are computed while the file is
+// written, a checksum sent in the OC-Checksum header of the part is verified.
+// The file is written next to its destination first, so an aborted, corrupted
+// or too large upload doesn't replace an existing file. The upload is recorded
+// as an activity of username.
+func saveUpload(part *multipart.Part, targetdir string, maxSize int64, username string) (UploadResponse, int) {
+	filename := part.FileName()
+	if filename == "." || filename == ".." || strings.ContainsAny(filename, "/\\") {
+		log.Warn("Invalid upload file name: ", filename)
+		return UploadResponse{}, http.StatusBadRequest
+	}
+	dbFileName := targetdir + "/" + filename
+	ctx := context.Background()
 
-			dbFileName := fullDirectory + "/" + file.Filename
-			node, err := db.SaveNode(dbFileName, dbFileName[:strings.Index(dbFileName, "/")], false, file.Header.Get("Content-Type"))
-			if err != nil {
-				log.Error("Failed to save node in database")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+	existing, err := db.GetNode(dbFileName)
+	if err != nil {
+		log.Error("Failed to get node: ", err)
+		return UploadResponse{}, http.StatusInternalServerError
+	}
+	if existing != nil && existing.Isdir {
+		log.Warn("Upload would replace a directory: ", dbFileName)
+		return UploadResponse{}, http.StatusConflict
+	}
 
-			// Create the upload target
-			target, err := os.Create(targetdir + "/" + file.Filename)
-			if err != nil {
-				log.Errorf("Failed to open target file: %v", targetdir+"/"+file.Filename)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			log.Debug("target file: ", target.Name())
-			// Buffered copy
-			written, err := io.Copy(target, upload)
-			if err != nil {
-				log.Error("Failed to copy upload file")
-				// TODO: clean up target
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			log.Debugf("copied %v bytes", written)
+	tempPath := targetdir + "/.upload-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + filename
+	target, err := storage.OpenFile(ctx, tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		log.Errorf("Failed to open target file: %v", tempPath)
+		return UploadResponse{}, http.StatusInternalServerError
+	}
+	log.Debug("target file: ", dbFileName)
+
+	hasher := checksum.NewHasher()
+	// Read one byte more than allowed to detect files that are too large
+	written, err := io.Copy(io.MultiWriter(target, hasher), io.LimitReader(part, maxSize+1))
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil || written > maxSize {
+		storage.RemoveAll(ctx, tempPath)
+		if err != nil {
+			log.Error("Failed to copy upload file: ", err)
+			return UploadResponse{}, http.StatusInternalServerError
+		}
+		log.Warnf("Upload of %v exceeds the maximum size of %v bytes", dbFileName, maxSize)
+		return UploadResponse{}, http.StatusRequestEntityTooLarge
+	}
+	log.Debugf("copied %v bytes", written)
 
-			targetStats, err := target.Stat()
-			if err != nil {
-				log.Error("Failed to get stats")
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
+	checksums := hasher.Sum()
+	if header := part.Header.Get(checksum.Header); header != "" {
+		err = checksums.Verify(header)
+		if err != nil {
+			storage.RemoveAll(ctx, tempPath)
+			log.Warnf("Rejecting upload of %v with checksum %v: %v", dbFileName, header, err)
+			return UploadResponse{}, http.StatusBadRequest
+		}
+	}
 
-			dirName := dir
-			if dirName != "/" {
-				dirName += "/"
-			}
-			dirName += fileDirectory
-			// Create the response
-			data := UploadResponse{
-				Directory:         dirName,
-				Etag:              "adfafdlasdfafdsaf", // TODO: send upload through webdav
-				Id:                node.ID,
-				MaxHumanFilesize:  "512MB",
-				Mimetype:          file.Header.Get("Content-Type"),
-				Mtime:             int64(time.Now().Unix()) * 1000, // the upload time aka Now
-				Name:              file.Filename,
-				Originalname:      file.Filename,
-				ParentId:          2,
-				Permissions:       31,
-				Size:              int(targetStats.Size()),
-				Status:            "success",
-				Sort:              "file",
-				UploadMaxFilesize: 1 << 29,
-			}
-			body = append(body, data)
+	if existing == nil {
+		_, err = db.SaveNode(dbFileName, dbFileName[:strings.Index(dbFileName, "/")], false, part.Header.Get("Content-Type"))
+		if err != nil {
+			storage.RemoveAll(ctx, tempPath)
+			log.Error("Failed to save node in database")
+			return UploadResponse{}, http.StatusInternalServerError
 		}
+	} else {
+		image.InvalidatePreviews(existing)
+		media.InvalidateRenditions(existing)
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(body)
+	err = storage.Rename(ctx, tempPath, dbFileName)
+	if err != nil {
+		storage.RemoveAll(ctx, tempPath)
+		log.Error("Failed to move upload file in place: ", err)
+		return UploadResponse{}, http.StatusInternalServerError
+	}
+	targetStats, err := storage.Stat(ctx, dbFileName)
+	if err != nil {
+		log.Error("Failed to get stats")
+		return UploadResponse{}, http.StatusInternalServerError
+	}
+	node, err := db.UpdateFileMetadata(dbFileName, written, targetStats.ModTime())
+	if err != nil {
+		log.Error("Failed to save node metadata in database")
+		return UploadResponse{}, http.StatusInternalServerError
+	}
+	err = checksum.Save(node, checksums)
+	if err != nil {
+		log.Error("Failed to save the checksums: ", err)
+	}
+	image.SchedulePregeneration(node)
+	media.ScheduleTranscoding(node)
+	if existing != nil {
+		activity.Record(username, activity.SubjectChanged, node)
+	} else {
+		activity.Record(username, activity.SubjectCreated, node)
+	}
+
+	// Create the response
+	return UploadResponse{
+		Checksum:          checksums.String(),
+		Etag:              node.Etag,
+		Id:                node.ID,
+		MaxHumanFilesize:  humanFileSize(maxSize),
+		Mimetype:          part.Header.Get("Content-Type"),
+		Mtime:             node.Mtime.Unix() * 1000,
+		Name:              filename,
+		Originalname:      filename,
+		ParentId:          2,
+		Permissions:       31,
+		Size:              node.Size,
+		Status:            "success",
+		Sort:              "file",
+		UploadMaxFilesize: maxSize,
+	}, http.StatusOK
+}
+
+// uploadMaxSize returns the maximum size in bytes of an uploaded file
+func uploadMaxSize() int64 {
+	maxSize, err := strconv.ParseInt(db.GetSetting(db.UPLOAD_MAX_SIZE), 10, 64)
+	if err != nil || maxSize <= 0 {
+		return defaultUploadMaxSize
+	}
+	return maxSize
+}
+
+// humanFileSize formats a size in bytes like the web interface does
+func humanFileSize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return strings.TrimSuffix(strconv.FormatFloat(value, 'f', 1, 64), ".0") + " " + units[unit]
 }
 
 // findShareRoot parses a path and tries to find a share
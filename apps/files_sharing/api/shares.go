@@ -10,8 +10,11 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 
+	"github.com/gowncloud/gowncloud/activity"
+	"github.com/gowncloud/gowncloud/core/audit"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/notification"
 )
 
 type meta struct {
@@ -31,11 +34,11 @@ type sharedata struct {
 	Displayname_file_owner string     `json:"displayname_file_owner"`
 	Displayname_owner      string     `json:"displayname_owner"`
 	Expiration             *time.Time `json:"expiration"` // null unless link?
-	File_parent            float64    `json:"file_parent"`
-	File_source            float64    `json:"file_source"` // nodeId?
+	File_parent            int64      `json:"file_parent"`
+	File_source            int64      `json:"file_source"` // nodeId?
 	File_target            string     `json:"file_target"` // without username leading, start with slash
 	Id                     string     `json:"id"`          // shareId?
-	Item_source            float64    `json:"item_source"` // same as file source
+	Item_source            int64      `json:"item_source"` // same as file source
 	Item_type              string     `json:"item_type"`   // "file" or ...
 	Mail_send              int        `json:"mail_send"`   // leave at 0 for now, could be bool
 	Mimetype               string     `json:"mimetype"`
@@ -176,6 +179,18 @@ func CreateShare(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	// The share expires at the start of the expireDate, in the time zone of the
+	// server
+	var expiration *time.Time
+	if expireDate := r.FormValue("expireDate"); expireDate != "" {
+		date, err := time.ParseInLocation("2006-01-02", expireDate, time.Local)
+		if err != nil || !date.After(time.Now()) {
+			log.Warn("Invalid share expiration date: ", expireDate)
+			http.Error(w, "Invalid expiration date "+expireDate, http.StatusBadRequest)
+			return
+		}
+		expiration = &date
+	}
 	target := r.FormValue("shareWith")
 	share, err := db.CreateShare(shareNode.ID, permissions, target, shareType)
 	if err != nil {
@@ -183,6 +198,21 @@ func CreateShare(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if expiration != nil {
+		err = db.SetShareExpiration(share.ShareID, expiration)
+		if err != nil {
+			log.Error("Failed to set the share expiration")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		share.Expiration = expiration
+	}
+
+	audit.Record(r, identity.CurrentSession(r).Username, audit.ShareCreate, audit.Fields{
+		"path": shareNode.Path, "nodeid": shareNode.ID, "shareid": share.ShareID,
+		"sharewith": target, "sharetype": shareType, "permissions": permissions})
+	activity.RecordShare(identity.CurrentSession(r).Username, shareNode, share, true)
+	notification.IncomingShare(identity.CurrentSession(r).Username, shareNode, share)
 
 	response := struct {
 		Ocs ocs `json:"ocs"`
@@ -295,19 +325,39 @@ func Sharees(w http.ResponseWriter, r *http.Request) {
 func DeleteShare(w http.ResponseWriter, r *http.Request) {
 	shareIdString := mux.Vars(r)["shareid"]
 
-	shareId, err := strconv.ParseFloat(shareIdString, 64)
+	shareId, err := db.ParseId(shareIdString)
 	if err != nil {
 		log.Error("Error parsing shareId: ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
+	// The share and node are looked up before the share is gone, for the audit
+	// log and the activity
+	fields := audit.Fields{"shareid": shareId}
+	share, err := db.GetShareById(shareId)
+	if err != nil {
+		log.Error("Error getting share: ", err)
+	}
+	shareNode, err := db.GetSharedNode(shareId)
+	if err != nil {
+		log.Error("Error getting shared node: ", err)
+	} else if shareNode != nil {
+		fields["path"] = shareNode.Path
+		fields["nodeid"] = shareNode.ID
+	}
+
 	err = db.DeleteShare(shareId)
 	if err != nil {
 		log.Error("Error deleting share: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	audit.Record(r, identity.CurrentSession(r).Username, audit.ShareDelete, fields)
+	if share != nil && shareNode != nil {
+		activity.RecordShare(identity.CurrentSession(r).Username, shareNode, share, false)
+	}
+	notification.ShareRemoved(shareId)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -330,11 +380,11 @@ func makeShareData(shareNode *db.Node, share *db.Share, target string) (*shareda
 	data := sharedata{
 		Displayname_file_owner: shareNode.Owner,
 		Displayname_owner:      shareNode.Owner,
-		Expiration:             nil,
+		Expiration:             share.Expiration,
 		File_parent:            parent.ID,
 		File_source:            shareNode.ID,
 		File_target:            strings.TrimPrefix(shareNode.Path, shareNode.Owner+"/files"),
-		Id:                     strconv.FormatFloat(share.ShareID, 'e', -1, 64),
+		Id:                     strconv.FormatInt(share.ShareID, 10),
 		Item_source:            shareNode.ID,
 		Item_type:              item_type,
 		Mail_send:              0,
@@ -10,6 +10,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"golang.org/x/net/context"
 )
 
 const errFileTooLarge = "This file is too big to be opened. Please download the file instead."
@@ -44,8 +45,8 @@ func LoadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := db.GetSetting(db.DAV_ROOT) + nodePath
-	fi, err := os.Stat(filePath)
+	ctx := context.Background()
+	fi, err := storage.Stat(ctx, nodePath)
 	if err != nil {
 		log.Errorf("Failed to get the node info (%v): %v", nodePath, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -62,9 +63,9 @@ func LoadFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, err := os.Open(filePath)
+	file, err := storage.OpenFile(ctx, nodePath, os.O_RDONLY, 0)
 	if err != nil {
-		log.Errorf("Failed to open the file (%v): %v", filePath, err)
+		log.Errorf("Failed to open the file (%v): %v", nodePath, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -4,8 +4,17 @@ import (
 	"net/http"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/fs"
 )
 
+// storage is the file system holding the edited files
+var storage fs.FileSystem
+
+// Init sets the file system holding the edited files
+func Init(fileSystem fs.FileSystem) {
+	storage = fileSystem
+}
+
 func RegisterRoutes(protectedMux *http.ServeMux, publicMux *http.ServeMux) {
 	log.Debug("Regestering texteditor routes")
 
@@ -5,10 +5,17 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/activity"
+	"github.com/gowncloud/gowncloud/checksum"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/image"
+	"github.com/gowncloud/gowncloud/media"
+	"github.com/gowncloud/gowncloud/notification"
+	"golang.org/x/net/context"
 )
 
 const errFileModified = "Cannot save file as it has been modified since opening"
@@ -49,11 +56,10 @@ func SaveFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filePath := db.GetSetting(db.DAV_ROOT) + nodePath
-
-	oldFileInfo, err := os.Stat(filePath)
+	ctx := context.Background()
+	oldFileInfo, err := storage.Stat(ctx, nodePath)
 	if err != nil {
-		log.Errorf("Failed to get old file info (%v): %v", filePath, err)
+		log.Errorf("Failed to get old file info (%v): %v", nodePath, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
@@ -70,26 +76,57 @@ func SaveFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, err := os.OpenFile(filePath, os.O_WRONLY, os.ModeAppend)
+	hasher := checksum.NewHasher()
+	hasher.Write([]byte(fileIn.FileContents))
+	checksums := hasher.Sum()
+	if header := r.Header.Get(checksum.Header); header != "" {
+		err = checksums.Verify(header)
+		if err != nil {
+			log.Warnf("Rejecting changes to %v with checksum %v: %v", nodePath, header, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	file, err := storage.OpenFile(ctx, nodePath, os.O_WRONLY|os.O_TRUNC, os.ModeAppend)
 	if err != nil {
-		log.Errorf("Failed to open the file (%v): %v", filePath, err)
+		log.Errorf("Failed to open the file (%v): %v", nodePath, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
 	_, err = file.Write([]byte(fileIn.FileContents))
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Errorf("Failed to write to the file (%v): %v", nodePath, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	fi, err := storage.Stat(ctx, nodePath)
 	if err != nil {
-		log.Errorf("Failed to write to the file (%v): %v", filePath, err)
+		log.Errorf("Failed to get file info (%v): %v", nodePath, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	fi, err := file.Stat()
+	node, err := db.UpdateFileMetadata(nodePath, fi.Size(), fi.ModTime())
 	if err != nil {
-		log.Errorf("Failed to get file info (%v): %v", filePath, err)
+		log.Errorf("Failed to update the node metadata (%v): %v", nodePath, err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	err = checksum.Save(node, checksums)
+	if err != nil {
+		log.Error("Failed to save the checksums: ", err)
+	}
+	image.InvalidatePreviews(node)
+	media.InvalidateRenditions(node)
+	image.SchedulePregeneration(node)
+	activity.Record(id.Username, activity.SubjectChanged, node)
+	notification.CheckQuota(nodePath[:strings.Index(nodePath, "/")])
 
 	resp := struct {
 		Mtime int64 `json:"mtime"`
@@ -2,15 +2,18 @@ package trash
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/core/audit"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/image"
+	"github.com/gowncloud/gowncloud/media"
+	"golang.org/x/net/context"
 )
 
 type deleteResponse struct {
@@ -46,25 +49,28 @@ func DeleteTrash(w http.ResponseWriter, r *http.Request) {
 	nodeResponses := make([]nodeResponse, 0)
 
 	for i, path := range filePaths {
-		info, err := os.Stat(db.GetSetting(db.DAV_ROOT) + path)
+		info, err := storage.Stat(context.Background(), path)
 		if err != nil {
-			log.Errorf("Node %v not found in trash: %v", db.GetSetting(db.DAV_ROOT)+path, err)
+			log.Errorf("Node %v not found in trash: %v", path, err)
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 		modTime := info.ModTime()
-		err = os.RemoveAll(db.GetSetting(db.DAV_ROOT) + path)
+		err = storage.RemoveAll(context.Background(), path)
 		if err != nil {
 			log.Error("Failed to remove node from trash: ", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		image.InvalidateSubtreePreviews(path)
+		media.InvalidateSubtreeRenditions(path)
 		err = db.DeleteNode(path)
 		if err != nil {
 			log.Error("Failed to remove node form db: ", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		audit.Record(r, username, audit.FileDelete, audit.Fields{"path": path, "permanent": true})
 		nodeResponses = append(nodeResponses, nodeResponse{
 			// Make sure to remove quotes from the filename because it is quoted
 			// when we take it from the form values
@@ -111,7 +117,7 @@ func generateFileList(rawfiles, dir, username, allFiles string) ([]string, []str
 	}
 
 	if allFiles == "true" {
-		entries, err := ioutil.ReadDir(db.GetSetting(db.DAV_ROOT) + basePath)
+		entries, err := readDir(basePath)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -135,3 +141,13 @@ func generateFileList(rawfiles, dir, username, allFiles string) ([]string, []str
 
 	return filePaths, files, nil
 }
+
+// readDir returns the entries of the directory name in the storage
+func readDir(name string) ([]os.FileInfo, error) {
+	f, err := storage.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdir(-1)
+}
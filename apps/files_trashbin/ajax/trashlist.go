@@ -2,18 +2,26 @@ package trash
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"net/http"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/fs"
 )
 
 const TRASH_DIR = "/files_trash"
 const FILES_DIR = "/files"
 
+// storage is the file system holding the files of the users
+var storage fs.FileSystem
+
+// Init sets the file system holding the files of the users
+func Init(fileSystem fs.FileSystem) {
+	storage = fileSystem
+}
+
 type response struct {
 	Data   data   `json:"data"`
 	Status string `json:"status"`
@@ -50,49 +58,43 @@ func GetTrash(w http.ResponseWriter, r *http.Request) {
 		dirParts[1] = dirParts[1][:strings.LastIndex(dirParts[1], ".")]
 	}
 	dir = strings.Join(dirParts, "/")
-	basePath := db.GetSetting(db.DAV_ROOT) + identity.CurrentSession(r).Username +
-		TRASH_DIR + dir
+	basePath := identity.CurrentSession(r).Username + TRASH_DIR + dir
+	basePath = strings.TrimSuffix(basePath, "/")
 
-	// ensure basePath ends with a '/' character
-	if !strings.HasSuffix(dir, "/") {
-		basePath += "/"
+	exists, err := db.NodeExists(basePath)
+	if err != nil {
+		log.Error("Failed to check if trash directory exists: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		log.Errorf("Directory %v not found in trash", dir)
+		w.WriteHeader(http.StatusNotFound)
+		return
 	}
 
-	entries, err := ioutil.ReadDir(basePath)
+	nodes, err := db.GetChildNodes(basePath)
 	if err != nil {
-		log.Errorf("Directory %v not found in trash: %v", dir, err)
-		w.WriteHeader(http.StatusNotFound)
+		log.Errorf("Failed to get nodes in trash directory %v: %v", dir, err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
 	files := make([]file, 0)
 
-	for i, entry := range entries {
-		nodePath := strings.TrimPrefix(basePath, db.GetSetting(db.DAV_ROOT))
-		node, err := db.GetNode(nodePath + entry.Name())
-		if err != nil {
-			log.Errorf("Failed to get node %v in trash: %v", entry.Name(), err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		// If a node is found on disk but not in the database, log an error and
-		// ommit the information on said node altogether.
-		if node == nil {
-			log.Error("Node not found in database - database out of sync")
-			continue
-		}
+	for i, node := range nodes {
 		fileInfo := file{
 			Etag:        0,
 			Id:          i,
 			MimeType:    node.MimeType,
-			Mtime:       entry.ModTime().Unix() * 1000,
-			Name:        entry.Name(),
+			Mtime:       node.Mtime.Unix() * 1000,
+			Name:        node.Path[strings.LastIndex(node.Path, "/")+1:],
 			ParentId:    nil,
 			Permissions: 1,
-			Size:        entry.Size(),
+			Size:        node.Size,
 			Type:        "file",
 		}
-		if entry.IsDir() {
+		if node.Isdir {
 			fileInfo.Type = "dir"
 		}
 		files = append(files, fileInfo)
@@ -3,14 +3,15 @@ package trash
 import (
 	"encoding/json"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/activity"
+	"github.com/gowncloud/gowncloud/core/audit"
 	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
+	"golang.org/x/net/context"
 )
 
 // UndeleteTrash tries to restore nodes to their previous location before being deleted
@@ -36,9 +37,9 @@ func UndeleteTrash(w http.ResponseWriter, r *http.Request) {
 	nodeResponses := make([]nodeResponse, 0)
 
 	for i, path := range filePaths {
-		info, err := os.Stat(db.GetSetting(db.DAV_ROOT) + path)
+		info, err := storage.Stat(context.Background(), path)
 		if err != nil {
-			log.Errorf("Node %v not found in trash: %v", db.GetSetting(db.DAV_ROOT)+path, err)
+			log.Errorf("Node %v not found in trash: %v", path, err)
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
@@ -65,47 +66,66 @@ func UndeleteTrash(w http.ResponseWriter, r *http.Request) {
 			skippedPath = strings.TrimPrefix(parentPath, username+FILES_DIR)
 		}
 
-		filepath.Walk(db.GetSetting(db.DAV_ROOT)+path, func(path string, info os.FileInfo, err error) error {
+		node, err := db.GetNode(path)
+		if err != nil {
+			log.Error("Could not get node: ", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if node == nil {
+			log.Errorf("Node %v not found in database", path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// The files are moved on disk before the transaction, the storage may
+		// use the database itself and would wait for the transaction to end
+		restorePath := strings.Replace(trashNode.Path, skippedPath, "", 1)
+		err = storage.Rename(context.Background(), path, restorePath)
+		if err != nil {
+			log.Error("Failed to restore node: ", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// The nodes are restored in a transaction, the files are moved back to
+		// the trash if it fails
+		err = db.WithTx(func(tx *db.Tx) error {
+			tx.OnRollback(func() {
+				err := storage.Rename(context.Background(), restorePath, path)
+				if err != nil {
+					log.Errorf("Failed to move %v back to the trash: %v", restorePath, err)
+				}
+			})
+
+			// The descendants follow the root node
+			err := tx.MoveNode(path, restorePath)
 			if err != nil {
-				log.Debug("Walking with none nill error")
+				log.Error("Failed to restore node in database: ", err)
 				return err
 			}
-			path = strings.TrimPrefix(path, db.GetSetting(db.DAV_ROOT))
-			trashSubNode, err := db.GetTrashNode(path)
+			err = tx.DeleteTrashNodesUnder(restorePath)
 			if err != nil {
-				log.Error("Could not get trash node: ", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				log.Error("Could not delete trash nodes: ", err)
 				return err
 			}
-			restorePath := strings.Replace(trashSubNode.Path, skippedPath, "", 1)
-			err = db.MoveNode(path, restorePath)
-			if err != nil {
-				log.Error("Failed to restore node in database: ", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return err
+
+			err = tx.PropagateSize(path, -node.Size)
+			if err == nil {
+				err = tx.PropagateSize(restorePath, node.Size)
 			}
-			err = db.DeleteTrashNode(trashSubNode.Path)
 			if err != nil {
-				log.Error("Could not delete trash node: ", err)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return err
+				log.Error("Failed to update directory sizes: ", err)
 			}
-			return nil
+			return err
 		})
 		if err != nil {
-			log.Error("Failed to restore node structure: ", err)
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			return
-		}
-
-		targetPath := db.GetSetting(db.DAV_ROOT) + trashNode.Path
-		targetPath = strings.Replace(targetPath, skippedPath, "", 1)
-		err = os.Rename(db.GetSetting(db.DAV_ROOT)+path, targetPath)
-		if err != nil {
-			log.Error("Failed to restore node: ", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		audit.Record(r, username, audit.FileRestore, audit.Fields{"path": restorePath, "nodeid": node.ID, "trashpath": path})
+		node.Path = restorePath
+		activity.Record(username, activity.SubjectRestored, node)
 
 		nodeResponses = append(nodeResponses, nodeResponse{
 			// Make sure to remove quotes from the filename because it is quoted
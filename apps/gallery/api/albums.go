@@ -0,0 +1,360 @@
+package gallery
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/gowncloud/gowncloud/core/identity"
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+// AlbumInfo is the information about an album returned by the album endpoints
+type AlbumInfo struct {
+	Id      string  `json:"id"`
+	Owner   string  `json:"owner"`
+	Name    string  `json:"name"`
+	Created int64   `json:"created"`
+	Photos  []Photo `json:"photos,omitempty"`
+}
+
+// AlbumShareInfo is a share of an album with a user or group
+type AlbumShareInfo struct {
+	ShareType int    `json:"shareType"`
+	ShareWith string `json:"shareWith"`
+	Time      int64  `json:"stime"`
+}
+
+var (
+	errAlbumNotFound = errors.New("Album not found")
+	errNotAlbumOwner = errors.New("Only the owner can change the album")
+	errNoName        = errors.New("The album needs a name")
+	errInvalidIds    = errors.New("Invalid node ids")
+)
+
+// ListAlbums lists the albums of the user and the albums shared with him
+// It is the endpoint for GET /ocs/v{1,2}.php/apps/gallery/api/v1/albums
+func ListAlbums(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	albums, err := db.GetAlbumsForUser(id.Username, id.Organizations)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	result := make([]AlbumInfo, len(albums))
+	for i, album := range albums {
+		result[i] = makeAlbumInfo(album)
+	}
+	writeOCS(w, r, http.StatusOK, "", result)
+}
+
+// CreateAlbum creates an album with the name, and optionally the photos in the
+// nodeids parameter
+// It is the endpoint for POST /ocs/v{1,2}.php/apps/gallery/api/v1/albums
+func CreateAlbum(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		writeOCSError(w, r, http.StatusBadRequest, errNoName)
+		return
+	}
+	var nodeIds []int64
+	if r.FormValue("nodeids") != "" {
+		var ok bool
+		nodeIds, ok = parseIds(r.FormValue("nodeids"))
+		if !ok {
+			writeOCSError(w, r, http.StatusBadRequest, errInvalidIds)
+			return
+		}
+		if status, err := checkNodeAccess(nodeIds, id); err != nil {
+			writeOCSError(w, r, status, err)
+			return
+		}
+	}
+
+	album, err := db.CreateAlbum(id.Username, name)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if len(nodeIds) > 0 {
+		err = db.AddAlbumItems(album.ID, nodeIds)
+		if err != nil {
+			writeOCSError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeOCS(w, r, http.StatusOK, "", makeAlbumInfo(album))
+}
+
+// GetAlbum returns the album with its photos, in the order of the album
+// It is the endpoint for GET /ocs/v{1,2}.php/apps/gallery/api/v1/albums/{id}
+func GetAlbum(w http.ResponseWriter, r *http.Request) {
+	album, status, err := viewableAlbum(r)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	nodes, err := db.GetAlbumItems(album.ID)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	info := makeAlbumInfo(album)
+	info.Photos, err = makePhotos(nodes)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", info)
+}
+
+// RenameAlbum changes the name of an album
+// It is the endpoint for PUT /ocs/v{1,2}.php/apps/gallery/api/v1/albums/{id}
+func RenameAlbum(w http.ResponseWriter, r *http.Request) {
+	album, status, err := ownedAlbum(r)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		writeOCSError(w, r, http.StatusBadRequest, errNoName)
+		return
+	}
+	err = db.RenameAlbum(album.ID, name)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	album.Name = name
+	writeOCS(w, r, http.StatusOK, "", makeAlbumInfo(album))
+}
+
+// DeleteAlbum removes an album, the photos in it are kept
+// It is the endpoint for DELETE /ocs/v{1,2}.php/apps/gallery/api/v1/albums/{id}
+func DeleteAlbum(w http.ResponseWriter, r *http.Request) {
+	album, status, err := ownedAlbum(r)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	err = db.DeleteAlbum(album.ID)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", nil)
+}
+
+// AddAlbumItems appends the photos in the nodeids parameter to an album. The
+// owner of the album must have access to the photos.
+// It is the endpoint for POST /ocs/v{1,2}.php/apps/gallery/api/v1/albums/{id}/items
+func AddAlbumItems(w http.ResponseWriter, r *http.Request) {
+	album, status, err := ownedAlbum(r)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	nodeIds, ok := parseIds(r.FormValue("nodeids"))
+	if !ok {
+		writeOCSError(w, r, http.StatusBadRequest, errInvalidIds)
+		return
+	}
+	if status, err := checkNodeAccess(nodeIds, identity.CurrentSession(r)); err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	err = db.AddAlbumItems(album.ID, nodeIds)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", nil)
+}
+
+// RemoveAlbumItem removes a photo from an album
+// It is the endpoint for DELETE /ocs/v{1,2}.php/apps/gallery/api/v1/albums/{id}/items/{nodeid}
+func RemoveAlbumItem(w http.ResponseWriter, r *http.Request) {
+	album, status, err := ownedAlbum(r)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	nodeId, err := db.ParseId(mux.Vars(r)["nodeid"])
+	if err != nil {
+		writeOCSError(w, r, http.StatusBadRequest, errInvalidIds)
+		return
+	}
+	err = db.RemoveAlbumItem(album.ID, nodeId)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", nil)
+}
+
+// ReorderAlbum moves the photos in the nodeids parameter to the start of an
+// album, in the given order
+// It is the endpoint for PUT /ocs/v{1,2}.php/apps/gallery/api/v1/albums/{id}/order
+func ReorderAlbum(w http.ResponseWriter, r *http.Request) {
+	album, status, err := ownedAlbum(r)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	nodeIds, ok := parseIds(r.FormValue("nodeids"))
+	if !ok {
+		writeOCSError(w, r, http.StatusBadRequest, errInvalidIds)
+		return
+	}
+	err = db.ReorderAlbum(album.ID, nodeIds)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", nil)
+}
+
+// ListAlbumShares lists the users and groups an album is shared with
+// It is the endpoint for GET /ocs/v{1,2}.php/apps/gallery/api/v1/albums/{id}/shares
+func ListAlbumShares(w http.ResponseWriter, r *http.Request) {
+	album, status, err := viewableAlbum(r)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	shares, err := db.GetAlbumShares(album.ID)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	result := make([]AlbumShareInfo, len(shares))
+	for i, share := range shares {
+		result[i] = AlbumShareInfo{
+			ShareType: share.ShareType,
+			ShareWith: share.Target,
+			Time:      share.Time.Unix(),
+		}
+	}
+	writeOCS(w, r, http.StatusOK, "", result)
+}
+
+// ShareAlbum shares an album with the user or group in shareWith, shareType is
+// 0 for a user and 1 for a group. The users can view all photos in the album,
+// also the ones that are not shared with them.
+// It is the endpoint for POST /ocs/v{1,2}.php/apps/gallery/api/v1/albums/{id}/shares
+func ShareAlbum(w http.ResponseWriter, r *http.Request) {
+	album, status, err := ownedAlbum(r)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	shareType, err := strconv.Atoi(r.FormValue("shareType"))
+	if err != nil || !(shareType == db.USERSHARE || shareType == db.GROUPSHARE) {
+		writeOCS(w, r, http.StatusBadRequest, "Invalid share type: "+r.FormValue("shareType"), nil)
+		return
+	}
+	target := r.FormValue("shareWith")
+	if target == "" || target == album.Owner {
+		writeOCS(w, r, http.StatusBadRequest, "Invalid share target: "+target, nil)
+		return
+	}
+	if shareType == db.USERSHARE {
+		user, err := db.GetUser(target)
+		if err != nil {
+			writeOCSError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if user == nil {
+			writeOCS(w, r, http.StatusNotFound, "Unknown user: "+target, nil)
+			return
+		}
+	}
+	err = db.ShareAlbum(album.ID, target, shareType)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", nil)
+}
+
+// UnshareAlbum removes the share of an album with a user or group
+// It is the endpoint for DELETE /ocs/v{1,2}.php/apps/gallery/api/v1/albums/{id}/shares/{target}
+func UnshareAlbum(w http.ResponseWriter, r *http.Request) {
+	album, status, err := ownedAlbum(r)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	err = db.UnshareAlbum(album.ID, mux.Vars(r)["target"])
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", nil)
+}
+
+// viewableAlbum returns the album in the request, if the user can view it. The
+// status is the http status to report if the album can't be returned.
+func viewableAlbum(r *http.Request) (*db.Album, int, error) {
+	id := identity.CurrentSession(r)
+	albumId, err := db.ParseId(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, http.StatusNotFound, errAlbumNotFound
+	}
+	canView, err := db.CanViewAlbum(albumId, id.Username, id.Organizations)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if !canView {
+		return nil, http.StatusNotFound, errAlbumNotFound
+	}
+	album, err := db.GetAlbum(albumId)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if album == nil {
+		return nil, http.StatusNotFound, errAlbumNotFound
+	}
+	return album, http.StatusOK, nil
+}
+
+// ownedAlbum returns the album in the request, if the user owns it
+func ownedAlbum(r *http.Request) (*db.Album, int, error) {
+	album, status, err := viewableAlbum(r)
+	if err != nil {
+		return nil, status, err
+	}
+	if album.Owner != identity.CurrentSession(r).Username {
+		return nil, http.StatusForbidden, errNotAlbumOwner
+	}
+	return album, http.StatusOK, nil
+}
+
+// checkNodeAccess checks that the nodes exist and the user can access them, so
+// albums can't be used to view other users' files
+func checkNodeAccess(nodeIds []int64, id identity.Session) (int, error) {
+	for _, nodeId := range nodeIds {
+		canAccess, err := db.CanAccessNode(nodeId, id.Username, id.Organizations)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if !canAccess {
+			return http.StatusNotFound, errors.New("Node not found: " + formatId(nodeId))
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// makeAlbumInfo returns the information about the album, without its photos
+func makeAlbumInfo(album *db.Album) AlbumInfo {
+	return AlbumInfo{
+		Id:      formatId(album.ID),
+		Owner:   album.Owner,
+		Name:    album.Name,
+		Created: album.Created.Unix(),
+	}
+}
@@ -3,22 +3,34 @@ package gallery
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
+
+	"github.com/gowncloud/gowncloud/image"
 )
 
-// Config returns a fake config for the UI gallery app
+// baseMediaTypes are the image formats decoded by the image package
+var baseMediaTypes = []string{
+	"image/png",
+	"image/jpeg",
+	"image/gif",
+	"image/x-xbitmap",
+	"image/bmp",
+}
+
+// Config returns the config of the UI gallery app. The media types are the
+// images the previews can be rendered for.
 func Config(w http.ResponseWriter, r *http.Request) {
 	response := struct {
 		Features   []string `json:"features"`
 		MediaTypes []string `json:"mediatypes"`
 	}{
-		Features: make([]string, 0),
-		MediaTypes: []string{
-			"image/png",
-			"image/jpeg",
-			"image/gif",
-			"image/x-xbitmap",
-			"image/bmp",
-		},
+		Features:   []string{"exif_metadata", "albums"},
+		MediaTypes: append([]string{}, baseMediaTypes...),
+	}
+	for _, mimetype := range image.PreviewMimeTypes() {
+		if strings.HasPrefix(mimetype, "image/") {
+			response.MediaTypes = append(response.MediaTypes, mimetype)
+		}
 	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(&response)
@@ -0,0 +1,124 @@
+package gallery
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+type meta struct {
+	Status     string  `json:"status"`
+	StatusCode int     `json:"statuscode"`
+	Message    *string `json:"message"`
+}
+
+// Photo is the information about a single photo, as returned by the photo and
+// album endpoints
+type Photo struct {
+	Id        string   `json:"id"`
+	Owner     string   `json:"owner"`
+	Path      string   `json:"path"`
+	Name      string   `json:"name"`
+	MimeType  string   `json:"mimetype"`
+	Modified  int64    `json:"mtime"`
+	Etag      string   `json:"etag"`
+	Size      int64    `json:"size"`
+	Taken     *int64   `json:"taken"`
+	Make      string   `json:"make"`
+	Model     string   `json:"model"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Width     int      `json:"width"`
+	Height    int      `json:"height"`
+}
+
+// writeOCS writes an OCS response. A status other than http.StatusOK is
+// reported as a failure with the message.
+func writeOCS(w http.ResponseWriter, r *http.Request, status int, message string, data interface{}) {
+	ocsResponse := struct {
+		Ocs struct {
+			Meta meta        `json:"meta"`
+			Data interface{} `json:"data"`
+		} `json:"ocs"`
+	}{}
+	ocsResponse.Ocs.Meta.Status = "ok"
+	ocsResponse.Ocs.Meta.StatusCode = 100
+	if strings.HasPrefix(r.URL.Path, "/ocs/v2.php/") {
+		ocsResponse.Ocs.Meta.StatusCode = 200
+	}
+	if status != http.StatusOK {
+		ocsResponse.Ocs.Meta.Status = "failure"
+		ocsResponse.Ocs.Meta.StatusCode = status
+		ocsResponse.Ocs.Meta.Message = &message
+		data = []string{}
+	}
+	ocsResponse.Ocs.Data = data
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ocsResponse)
+}
+
+// writeOCSError writes a failed OCS response, database errors are reported as
+// internal server errors
+func writeOCSError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if err == db.ErrDB {
+		status = http.StatusInternalServerError
+	}
+	writeOCS(w, r, status, err.Error(), nil)
+}
+
+// makePhoto combines a node and its metadata, which may be nil. The path is
+// relative to the files of the owner.
+func makePhoto(node *db.Node, metadata *db.PhotoMetadata) Photo {
+	nodePath := node.Path[strings.Index(node.Path, "/")+1:]
+	nodePath = nodePath[strings.Index(nodePath, "/"):]
+	photo := Photo{
+		Id:       formatId(node.ID),
+		Owner:    node.Owner,
+		Path:     nodePath,
+		Name:     node.Path[strings.LastIndex(node.Path, "/")+1:],
+		MimeType: node.MimeType,
+		Modified: node.Mtime.Unix(),
+		Etag:     node.Etag,
+		Size:     node.Size,
+	}
+	if metadata != nil {
+		if metadata.Taken != nil {
+			taken := metadata.Taken.Unix()
+			photo.Taken = &taken
+		}
+		photo.Make = metadata.Make
+		photo.Model = metadata.Model
+		photo.Latitude = metadata.Latitude
+		photo.Longitude = metadata.Longitude
+		photo.Width = metadata.Width
+		photo.Height = metadata.Height
+	}
+	return photo
+}
+
+// formatId formats a node or album id for the API
+func formatId(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// parseIds parses a comma separated list of ids
+func parseIds(input string) ([]int64, bool) {
+	var ids []int64
+	for _, idString := range strings.Split(input, ",") {
+		idString = strings.TrimSpace(idString)
+		if idString == "" {
+			continue
+		}
+		id, err := db.ParseId(idString)
+		if err != nil {
+			return nil, false
+		}
+		ids = append(ids, id)
+	}
+	return ids, len(ids) > 0
+}
@@ -0,0 +1,137 @@
+package gallery
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/core/identity"
+	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/image"
+)
+
+const (
+	// defaultPageSize is the amount of photos returned if the client doesn't
+	// specify a page size
+	defaultPageSize = 100
+	// maxPageSize is the maximum amount of photos returned in a single page
+	maxPageSize = 1000
+)
+
+// sortFields maps the supported values of the sort parameter to the database
+// sort fields
+var sortFields = map[string]string{
+	"taken": db.SortByTaken,
+	"name":  db.SortByName,
+	"mtime": db.SortByMtime,
+	"size":  db.SortBySize,
+}
+
+// Photos lists the photos in a folder of the user and its subfolders, with
+// their metadata. The photos are sorted on the time they were taken, newest
+// first, unless the client asks for another sort order.
+// It is the endpoint for GET /ocs/v{1,2}.php/apps/gallery/api/v1/photos
+func Photos(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	params := r.URL.Query()
+
+	page, err := parsePositiveInt(params.Get("page"), 1)
+	if err != nil {
+		writeOCS(w, r, http.StatusBadRequest, "Invalid page: "+params.Get("page"), nil)
+		return
+	}
+	pageSize, err := parsePositiveInt(params.Get("size"), defaultPageSize)
+	if err != nil {
+		writeOCS(w, r, http.StatusBadRequest, "Invalid page size: "+params.Get("size"), nil)
+		return
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	sortField, ok := sortFields[strings.ToLower(params.Get("sort"))]
+	if !ok {
+		if params.Get("sort") != "" {
+			writeOCS(w, r, http.StatusBadRequest, "Invalid sort field: "+params.Get("sort"), nil)
+			return
+		}
+		sortField = db.SortByTaken
+	}
+	order := strings.ToLower(params.Get("order"))
+	if order != "" && order != "asc" && order != "desc" {
+		writeOCS(w, r, http.StatusBadRequest, "Invalid sort order: "+params.Get("order"), nil)
+		return
+	}
+	descending := order == "desc" || (order == "" && sortField == db.SortByTaken)
+
+	location := path.Clean("/" + params.Get("location"))
+	under := id.Username + "/files"
+	if location != "/" {
+		under += location
+	}
+
+	isDir := false
+	nodes, err := db.SearchNodes(&db.NodeQuery{
+		User:       id.Username,
+		Groups:     id.Organizations,
+		MimeTypes:  []string{"image/"},
+		IsDir:      &isDir,
+		Under:      under,
+		Sort:       sortField,
+		Descending: descending,
+		Limit:      pageSize,
+		Offset:     (page - 1) * pageSize,
+	})
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	photos, err := makePhotos(nodes)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", photos)
+}
+
+// makePhotos returns the photos of the nodes with their metadata. Metadata
+// which wasn't extracted yet, or is outdated, is extracted now.
+func makePhotos(nodes []*db.Node) ([]Photo, error) {
+	ids := make([]int64, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.ID
+	}
+	metadata, err := db.GetPhotoMetadataForNodes(ids)
+	if err != nil {
+		return nil, err
+	}
+	photos := make([]Photo, len(nodes))
+	for i, node := range nodes {
+		nodeMetadata := metadata[node.ID]
+		if nodeMetadata == nil || nodeMetadata.Etag != node.Etag {
+			nodeMetadata, err = image.UpdateMetadata(node)
+			if err != nil {
+				log.Warnf("Failed to extract the metadata of %v: %v", node.Path, err)
+			}
+		}
+		photos[i] = makePhoto(node, nodeMetadata)
+	}
+	return photos, nil
+}
+
+// parsePositiveInt parses a strictly positive integer. If the input is empty
+// the default value is returned.
+func parsePositiveInt(input string, defaultValue int) (int, error) {
+	if input == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(input)
+	if err != nil {
+		return 0, err
+	}
+	if value < 1 {
+		return 0, strconv.ErrRange
+	}
+	return value, nil
+}
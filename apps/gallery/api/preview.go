@@ -2,17 +2,17 @@ package gallery
 
 import (
 	"net/http"
-	"strconv"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	"github.com/gowncloud/gowncloud/core/identity"
 	db "github.com/gowncloud/gowncloud/database"
 	"github.com/gowncloud/gowncloud/image"
 )
 
 // Preview renders the image identified by the id
 func Preview(w http.ResponseWriter, r *http.Request) {
-	fileId, err := strconv.ParseFloat(mux.Vars(r)["id"], 64)
+	fileId, err := db.ParseId(mux.Vars(r)["id"])
 	if err != nil {
 		log.Error("Failed to parse file id: ", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -28,15 +28,25 @@ func Preview(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if node == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	path := node.Path
-
-	renderImage(widthString, heightString, path, w)
-}
-
-func renderImage(maxWidthString string, maxHeightString string, path string, w http.ResponseWriter) {
-
-	file := db.GetSetting(db.DAV_ROOT) + path
+	// Photos in albums can be viewed by everyone the album is shared with
+	id := identity.CurrentSession(r)
+	canAccess, err := db.CanAccessNode(node.ID, id.Username, id.Organizations)
+	if err == nil && !canAccess {
+		canAccess, err = db.IsInSharedAlbum(node.ID, id.Username, id.Organizations)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !canAccess {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	image.RenderImage(maxWidthString, maxHeightString, file, w)
+	image.RenderImage(w, r, node, widthString, heightString)
 }
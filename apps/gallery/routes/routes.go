@@ -17,4 +17,24 @@ func RegisterRoutes(protectedMux *http.ServeMux, publicMux *http.ServeMux) {
 	r.HandleFunc("/index.php/apps/gallery/preview/{id}", gallery.Preview).Methods("GET")
 	protectedMux.Handle("/index.php/apps/gallery/preview/", r)
 
+	ocs := mux.NewRouter()
+	for _, version := range []string{"v1", "v2"} {
+		prefix := "/ocs/" + version + ".php/apps/gallery/api/v1"
+		ocs.HandleFunc(prefix+"/photos", gallery.Photos).Methods("GET")
+		ocs.HandleFunc(prefix+"/albums", gallery.ListAlbums).Methods("GET")
+		ocs.HandleFunc(prefix+"/albums", gallery.CreateAlbum).Methods("POST")
+		ocs.HandleFunc(prefix+"/albums/{id}", gallery.GetAlbum).Methods("GET")
+		ocs.HandleFunc(prefix+"/albums/{id}", gallery.RenameAlbum).Methods("PUT")
+		ocs.HandleFunc(prefix+"/albums/{id}", gallery.DeleteAlbum).Methods("DELETE")
+		ocs.HandleFunc(prefix+"/albums/{id}/items", gallery.AddAlbumItems).Methods("POST")
+		ocs.HandleFunc(prefix+"/albums/{id}/items/{nodeid}", gallery.RemoveAlbumItem).Methods("DELETE")
+		ocs.HandleFunc(prefix+"/albums/{id}/order", gallery.ReorderAlbum).Methods("PUT")
+		ocs.HandleFunc(prefix+"/albums/{id}/shares", gallery.ListAlbumShares).Methods("GET")
+		ocs.HandleFunc(prefix+"/albums/{id}/shares", gallery.ShareAlbum).Methods("POST")
+		ocs.HandleFunc(prefix+"/albums/{id}/shares/{target}", gallery.UnshareAlbum).Methods("DELETE")
+		protectedMux.Handle(prefix+"/photos", ocs)
+		protectedMux.Handle(prefix+"/albums", ocs)
+		protectedMux.Handle(prefix+"/albums/", ocs)
+	}
+
 }
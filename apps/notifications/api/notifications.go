@@ -0,0 +1,315 @@
+package notifications
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gowncloud/gowncloud/core/identity"
+	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/notification"
+)
+
+// keepAliveInterval is how often a comment is sent on an idle event stream, so
+// proxies don't close it
+const keepAliveInterval = 30 * time.Second
+
+var (
+	errInvalidParam         = errors.New("Invalid parameter")
+	errNotificationNotFound = errors.New("Notification not found")
+	errStreamingUnsupported = errors.New("Streaming is not supported")
+)
+
+// Notification is a notification as returned by the notifications API
+type Notification struct {
+	NotificationId        int64                 `json:"notification_id"`
+	App                   string                `json:"app"`
+	User                  string                `json:"user"`
+	Datetime              string                `json:"datetime"`
+	ObjectType            string                `json:"object_type"`
+	ObjectId              string                `json:"object_id"`
+	Subject               string                `json:"subject"`
+	Message               string                `json:"message"`
+	Link                  string                `json:"link"`
+	SubjectRich           string                `json:"subjectRich"`
+	SubjectRichParameters map[string]richObject `json:"subjectRichParameters"`
+	MessageRich           string                `json:"messageRich"`
+	MessageRichParameters map[string]richObject `json:"messageRichParameters"`
+	Icon                  string                `json:"icon"`
+	Actions               []interface{}         `json:"actions"`
+}
+
+// richObject is a parameter of a rich subject, like the file or the user
+type richObject struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ListNotifications lists the notifications of the user and his groups which
+// he didn't dismiss, newest first. The ETag header identifies the list, if it
+// matches If-None-Match 304 Not Modified is returned.
+// It is the endpoint for GET /ocs/v{1,2}.php/apps/notifications/api/v2/notifications
+func ListNotifications(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	notifications, err := db.GetNotifications(id.Username, id.Organizations, 0)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+
+	ids := make([]string, len(notifications))
+	for i, n := range notifications {
+		ids[i] = strconv.FormatInt(n.ID, 10)
+	}
+	etag := "\"" + strings.Join(ids, "-") + "\""
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	result := make([]Notification, len(notifications))
+	for i, n := range notifications {
+		result[i] = makeNotification(n, id.Username)
+	}
+	writeOCS(w, r, http.StatusOK, "", result)
+}
+
+// GetNotification returns a notification of the user.
+// It is the endpoint for GET /ocs/v{1,2}.php/apps/notifications/api/v2/notifications/{id}
+func GetNotification(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	n, status, err := getNotification(r, id)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", makeNotification(n, id.Username))
+}
+
+// DismissNotification dismisses a notification of the user.
+// It is the endpoint for DELETE /ocs/v{1,2}.php/apps/notifications/api/v2/notifications/{id}
+func DismissNotification(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	n, status, err := getNotification(r, id)
+	if err != nil {
+		writeOCSError(w, r, status, err)
+		return
+	}
+	err = notification.Dismiss(n, id.Username)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", []string{})
+}
+
+// DismissAllNotifications dismisses all notifications of the user.
+// It is the endpoint for DELETE /ocs/v{1,2}.php/apps/notifications/api/v2/notifications
+func DismissAllNotifications(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	notifications, err := db.GetNotifications(id.Username, id.Organizations, 0)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	for _, n := range notifications {
+		err = notification.Dismiss(n, id.Username)
+		if err != nil {
+			writeOCSError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeOCS(w, r, http.StatusOK, "", []string{})
+}
+
+// Events streams the notifications of the user as server-sent events. New
+// notifications are sent as notification events with the notification as data,
+// dismissed notifications as dismissed events with their notification_id. The
+// notifications after the Last-Event-ID header or the since parameter are sent
+// first, so a client which reconnects doesn't miss any.
+// It is the endpoint for GET /ocs/v{1,2}.php/apps/notifications/api/v2/notifications/events
+func Events(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOCSError(w, r, http.StatusInternalServerError, errStreamingUnsupported)
+		return
+	}
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("since")
+	}
+	var since int64
+	if lastId != "" {
+		var err error
+		since, err = db.ParseId(lastId)
+		if err != nil {
+			writeOCSError(w, r, http.StatusBadRequest, errInvalidParam)
+			return
+		}
+	}
+
+	// Subscribe before catching up, so no notification is lost in between
+	events, unsubscribe := notification.Subscribe(id.Username, id.Organizations)
+	defer unsubscribe()
+	var missed []*db.Notification
+	if since > 0 {
+		var err error
+		missed, err = db.GetNotifications(id.Username, id.Organizations, since)
+		if err != nil {
+			writeOCSError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// The missed notifications are newest first, they are sent in order
+	for i := len(missed) - 1; i >= 0; i-- {
+		since = missed[i].ID
+		writeEvent(w, id.Username, notification.Event{Notification: missed[i]})
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			// Skip the notifications already sent while catching up
+			if event.Notification != nil && event.Notification.ID <= since {
+				continue
+			}
+			writeEvent(w, id.Username, event)
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes a notification event to an event stream
+func writeEvent(w http.ResponseWriter, username string, event notification.Event) {
+	if event.Notification == nil {
+		fmt.Fprintf(w, "event: dismissed\ndata: {\"notification_id\":%d}\n\n", event.Dismissed)
+		return
+	}
+	data, _ := json.Marshal(makeNotification(event.Notification, username))
+	fmt.Fprintf(w, "id: %d\nevent: notification\ndata: %s\n\n", event.Notification.ID, data)
+}
+
+// getNotification returns the notification in the url if the user can see it,
+// or the status and error to respond with
+func getNotification(r *http.Request, id identity.Session) (*db.Notification, int, error) {
+	notificationId, err := db.ParseId(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, http.StatusBadRequest, errInvalidParam
+	}
+	n, err := db.GetNotification(notificationId, id.Username, id.Organizations)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if n == nil {
+		return nil, http.StatusNotFound, errNotificationNotFound
+	}
+	return n, http.StatusOK, nil
+}
+
+// makeNotification formats a notification for the user reading it
+func makeNotification(n *db.Notification, username string) Notification {
+	p := n.Parameters
+	parameters := map[string]richObject{}
+	if p["file"] != "" {
+		parameters["file"] = richObject{Type: "file", Id: p["nodeid"], Name: p["file"]}
+	}
+	if p["user"] != "" {
+		parameters["user"] = richObject{Type: "user", Id: p["user"], Name: p["user"]}
+	}
+	if p["sharewith"] != "" {
+		shareType := "user"
+		if p["sharetype"] == strconv.Itoa(db.GROUPSHARE) {
+			shareType = "group"
+		}
+		parameters["sharewith"] = richObject{Type: shareType, Id: p["sharewith"], Name: p["sharewith"]}
+	}
+	if p["remote"] != "" {
+		parameters["remote"] = richObject{Type: "highlight", Id: p["remote"], Name: p["remote"]}
+	}
+
+	template := subjectTemplate(n, username)
+	subject := template
+	for key, parameter := range parameters {
+		subject = strings.Replace(subject, "{"+key+"}", parameter.Name, -1)
+	}
+
+	link := "/index.php/apps/files/"
+	switch n.Subject {
+	case notification.SubjectIncomingShare, notification.SubjectFederatedShare:
+		link += "?view=sharingin"
+	case notification.SubjectShareExpiring:
+		if p["owner"] == username {
+			link += "?view=sharingout"
+		} else {
+			link += "?view=sharingin"
+		}
+	}
+
+	return Notification{
+		NotificationId:        n.ID,
+		App:                   n.App,
+		User:                  username,
+		Datetime:              n.Time.UTC().Format(time.RFC3339),
+		ObjectType:            n.ObjectType,
+		ObjectId:              n.ObjectID,
+		Subject:               subject,
+		Message:               "",
+		Link:                  link,
+		SubjectRich:           template,
+		SubjectRichParameters: parameters,
+		MessageRich:           "",
+		MessageRichParameters: map[string]richObject{},
+		Icon:                  "",
+		Actions:               []interface{}{},
+	}
+}
+
+// subjectTemplate returns the subject of a notification as the user reading it
+// sees it, with placeholders for the rich parameters
+func subjectTemplate(n *db.Notification, username string) string {
+	p := n.Parameters
+	switch n.Subject {
+	case notification.SubjectIncomingShare:
+		if p["sharewith"] != username {
+			return "{user} shared {file} with group {sharewith}"
+		}
+		return "{user} shared {file} with you"
+	case notification.SubjectShareExpiring:
+		expiration := p["expiration"]
+		if t, err := time.Parse(time.RFC3339, expiration); err == nil {
+			expiration = t.Local().Format("2006-01-02 15:04")
+		}
+		if p["owner"] == username {
+			return "The share of {file} with {sharewith} expires at " + expiration
+		}
+		return "The share of {file} with you expires at " + expiration
+	case notification.SubjectQuotaWarning:
+		return "You are using " + p["percent"] + "% of your storage quota"
+	case notification.SubjectFederatedShare:
+		return "{user}@{remote} wants to share {file} with you"
+	}
+	return n.Subject
+}
@@ -0,0 +1,51 @@
+package notifications
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+type meta struct {
+	Status     string  `json:"status"`
+	StatusCode int     `json:"statuscode"`
+	Message    *string `json:"message"`
+}
+
+// writeOCS writes an OCS response. A status other than http.StatusOK is
+// reported as a failure with the message.
+func writeOCS(w http.ResponseWriter, r *http.Request, status int, message string, data interface{}) {
+	ocsResponse := struct {
+		Ocs struct {
+			Meta meta        `json:"meta"`
+			Data interface{} `json:"data"`
+		} `json:"ocs"`
+	}{}
+	ocsResponse.Ocs.Meta.Status = "ok"
+	ocsResponse.Ocs.Meta.StatusCode = 100
+	if strings.HasPrefix(r.URL.Path, "/ocs/v2.php/") {
+		ocsResponse.Ocs.Meta.StatusCode = 200
+	}
+	if status != http.StatusOK {
+		ocsResponse.Ocs.Meta.Status = "failure"
+		ocsResponse.Ocs.Meta.StatusCode = status
+		ocsResponse.Ocs.Meta.Message = &message
+		data = []string{}
+	}
+	ocsResponse.Ocs.Data = data
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ocsResponse)
+}
+
+// writeOCSError writes a failed OCS response, database errors are reported as
+// internal server errors
+func writeOCSError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if err == db.ErrDB {
+		status = http.StatusInternalServerError
+	}
+	writeOCS(w, r, status, err.Error(), nil)
+}
@@ -0,0 +1,103 @@
+package notifications
+
+import (
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+
+	"github.com/gowncloud/gowncloud/core/identity"
+	db "github.com/gowncloud/gowncloud/database"
+	gowncloud_mail "github.com/gowncloud/gowncloud/mail"
+)
+
+var (
+	errUserNotFound = errors.New("User not found")
+	errInvalidEmail = errors.New("Invalid email address")
+)
+
+// MailSettings are the mail settings of a user as returned by the API
+type MailSettings struct {
+	// Enabled tells if the server can send mails at all
+	Enabled bool   `json:"enabled"`
+	Email   string `json:"email"`
+	Shares  bool   `json:"shares"`
+	Digest  bool   `json:"digest"`
+}
+
+// GetMailSettings returns the email address of the user and the mails he wants.
+// It is the endpoint for GET /ocs/v{1,2}.php/apps/notifications/api/v2/settings/mail
+func GetMailSettings(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	settings, err := db.GetMailSettings(id.Username)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if settings == nil {
+		writeOCSError(w, r, http.StatusNotFound, errUserNotFound)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", makeMailSettings(settings))
+}
+
+// SetMailSettings changes the email address of the user with the email
+// parameter, and the mails he wants with the shares and digest parameters
+// (true or false). Missing parameters are left unchanged, an empty email
+// removes the address.
+// It is the endpoint for PUT /ocs/v{1,2}.php/apps/notifications/api/v2/settings/mail
+func SetMailSettings(w http.ResponseWriter, r *http.Request) {
+	id := identity.CurrentSession(r)
+	settings, err := db.GetMailSettings(id.Username)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if settings == nil {
+		writeOCSError(w, r, http.StatusNotFound, errUserNotFound)
+		return
+	}
+
+	if err = r.ParseForm(); err != nil {
+		writeOCSError(w, r, http.StatusBadRequest, errInvalidParam)
+		return
+	}
+	if email, ok := r.Form["email"]; ok {
+		settings.Email = email[0]
+		if settings.Email != "" {
+			address, err := mail.ParseAddress(settings.Email)
+			if err != nil {
+				writeOCSError(w, r, http.StatusBadRequest, errInvalidEmail)
+				return
+			}
+			settings.Email = address.Address
+		}
+	}
+	for name, value := range map[string]*bool{"shares": &settings.Shares, "digest": &settings.Digest} {
+		if _, ok := r.Form[name]; !ok {
+			continue
+		}
+		*value, err = strconv.ParseBool(r.Form.Get(name))
+		if err != nil {
+			writeOCSError(w, r, http.StatusBadRequest, errInvalidParam)
+			return
+		}
+	}
+
+	err = db.SetMailSettings(id.Username, settings)
+	if err != nil {
+		writeOCSError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	writeOCS(w, r, http.StatusOK, "", makeMailSettings(settings))
+}
+
+// makeMailSettings formats the mail settings of a user
+func makeMailSettings(settings *db.MailSettings) MailSettings {
+	return MailSettings{
+		Enabled: gowncloud_mail.Enabled(),
+		Email:   settings.Email,
+		Shares:  settings.Shares,
+		Digest:  settings.Digest,
+	}
+}
@@ -0,0 +1,30 @@
+package notifications
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	notifications "github.com/gowncloud/gowncloud/apps/notifications/api"
+)
+
+func RegisterRoutes(protectedMux *http.ServeMux, publicMux *http.ServeMux) {
+	log.Debug("Regestering notifications routes")
+
+	ocs := mux.NewRouter()
+	for _, version := range []string{"v1", "v2"} {
+		prefix := "/ocs/" + version + ".php/apps/notifications/api/v2/notifications"
+		ocs.HandleFunc(prefix, notifications.ListNotifications).Methods("GET")
+		ocs.HandleFunc(prefix, notifications.DismissAllNotifications).Methods("DELETE")
+		ocs.HandleFunc(prefix+"/events", notifications.Events).Methods("GET")
+		ocs.HandleFunc(prefix+"/{id:[0-9]+}", notifications.GetNotification).Methods("GET")
+		ocs.HandleFunc(prefix+"/{id:[0-9]+}", notifications.DismissNotification).Methods("DELETE")
+		protectedMux.Handle(prefix, ocs)
+		protectedMux.Handle(prefix+"/", ocs)
+
+		settings := "/ocs/" + version + ".php/apps/notifications/api/v2/settings/mail"
+		ocs.HandleFunc(settings, notifications.GetMailSettings).Methods("GET")
+		ocs.HandleFunc(settings, notifications.SetMailSettings).Methods("PUT", "POST")
+		protectedMux.Handle(settings, ocs)
+	}
+}
@@ -0,0 +1,145 @@
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/adler32"
+	"strings"
+
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+// Algorithms supported in OC-Checksum headers
+const (
+	SHA1    = "SHA1"
+	MD5     = "MD5"
+	ADLER32 = "ADLER32"
+)
+
+// Header is the header sync clients use to send the checksum of an upload, and
+// in which the checksum of a download is returned, e.g. "SHA1:<hex digest>"
+const Header = "OC-Checksum"
+
+var (
+	// ErrMismatch is returned when the content doesn't match the checksum sent
+	// by the client
+	ErrMismatch = errors.New("The computed checksum does not match the one received from the client")
+	// ErrUnsupported is returned for checksums of an unknown algorithm
+	ErrUnsupported = errors.New("Unsupported checksum algorithm")
+	// ErrInvalid is returned for checksum headers without algorithm or digest
+	ErrInvalid = errors.New("Invalid checksum")
+)
+
+// Checksums are the hex encoded digests of a file in all supported algorithms
+type Checksums struct {
+	SHA1    string
+	MD5     string
+	Adler32 string
+}
+
+// Get returns the digest of the algorithm, or an empty string if the algorithm
+// is not supported
+func (c Checksums) Get(algorithm string) string {
+	switch strings.ToUpper(algorithm) {
+	case SHA1:
+		return c.SHA1
+	case MD5:
+		return c.MD5
+	case ADLER32:
+		return c.Adler32
+	}
+	return ""
+}
+
+// String formats the checksums as owncloud does in the oc:checksum property,
+// space separated "ALGORITHM:digest" pairs
+func (c Checksums) String() string {
+	return SHA1 + ":" + c.SHA1 + " " + MD5 + ":" + c.MD5 + " " + ADLER32 + ":" + c.Adler32
+}
+
+// Verify checks the checksums against the value of an OC-Checksum header
+func (c Checksums) Verify(header string) error {
+	algorithm, digest, err := Parse(header)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(c.Get(algorithm), digest) {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// Parse splits the value of an OC-Checksum header in its algorithm and digest
+func Parse(header string) (string, string, error) {
+	i := strings.Index(header, ":")
+	if i < 0 {
+		return "", "", ErrInvalid
+	}
+	algorithm := strings.ToUpper(strings.TrimSpace(header[:i]))
+	digest := strings.TrimSpace(header[i+1:])
+	if algorithm == "" || digest == "" {
+		return "", "", ErrInvalid
+	}
+	if algorithm != SHA1 && algorithm != MD5 && algorithm != ADLER32 {
+		return "", "", ErrUnsupported
+	}
+	return algorithm, digest, nil
+}
+
+// Hasher computes the checksums of the data written to it in all supported
+// algorithms at once, so content is only read once
+type Hasher struct {
+	sha1    hash.Hash
+	md5     hash.Hash
+	adler32 hash.Hash32
+}
+
+// NewHasher creates a hasher for new content
+func NewHasher() *Hasher {
+	return &Hasher{
+		sha1:    sha1.New(),
+		md5:     md5.New(),
+		adler32: adler32.New(),
+	}
+}
+
+// Write adds data to the checksums, it never returns an error
+func (h *Hasher) Write(p []byte) (int, error) {
+	h.sha1.Write(p)
+	h.md5.Write(p)
+	h.adler32.Write(p)
+	return len(p), nil
+}
+
+// Sum returns the checksums of the data written so far
+func (h *Hasher) Sum() Checksums {
+	return Checksums{
+		SHA1:    hex.EncodeToString(h.sha1.Sum(nil)),
+		MD5:     hex.EncodeToString(h.md5.Sum(nil)),
+		Adler32: hex.EncodeToString(h.adler32.Sum(nil)),
+	}
+}
+
+// Save stores the checksums of the current version of the node
+func Save(node *db.Node, checksums Checksums) error {
+	return db.SaveChecksums(&db.FileChecksums{
+		NodeID:  node.ID,
+		Etag:    node.Etag,
+		SHA1:    checksums.SHA1,
+		MD5:     checksums.MD5,
+		Adler32: checksums.Adler32,
+	})
+}
+
+// Load returns the stored checksums of the current version of the node, or nil
+// if they are unknown
+func Load(node *db.Node) (*Checksums, error) {
+	stored, err := db.GetChecksums(node)
+	if err != nil || stored == nil {
+		return nil, err
+	}
+	return &Checksums{SHA1: stored.SHA1, MD5: stored.MD5, Adler32: stored.Adler32}, nil
+}
@@ -0,0 +1,57 @@
+package checksum
+
+import (
+	"io"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		header    string
+		algorithm string
+		digest    string
+		err       error
+	}{
+		{"SHA1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", SHA1, "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", nil},
+		{"md5:098f6bcd4621d373cade4e832627b4f6", MD5, "098f6bcd4621d373cade4e832627b4f6", nil},
+		{" Adler32 : 045d01c1 ", ADLER32, "045d01c1", nil},
+		{"SHA256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", "", "", ErrUnsupported},
+		{"a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", "", "", ErrInvalid},
+		{":a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", "", "", ErrInvalid},
+		{" :a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", "", "", ErrInvalid},
+		{"SHA1:", "", "", ErrInvalid},
+		{"SHA1: ", "", "", ErrInvalid},
+		{"", "", "", ErrInvalid},
+	}
+	for _, test := range tests {
+		algorithm, digest, err := Parse(test.header)
+		if algorithm != test.algorithm || digest != test.digest || err != test.err {
+			t.Errorf("Parse(%q) = %q, %q, %v, want %q, %q, %v", test.header, algorithm, digest, err,
+				test.algorithm, test.digest, test.err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	h := NewHasher()
+	io.WriteString(h, "test")
+	checksums := h.Sum()
+	tests := []struct {
+		header string
+		err    error
+	}{
+		{"SHA1:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", nil},
+		{"SHA1:A94A8FE5CCB19BA61C4C0873D391E987982FBBD3", nil},
+		{"MD5:098f6bcd4621d373cade4e832627b4f6", nil},
+		{"ADLER32:045d01c1", nil},
+		{"SHA1:0000000000000000000000000000000000000000", ErrMismatch},
+		{"MD5:a94a8fe5ccb19ba61c4c0873d391e987982fbbd3", ErrMismatch},
+		{"CRC32:d87f7e0c", ErrUnsupported},
+		{"SHA1", ErrInvalid},
+	}
+	for _, test := range tests {
+		if err := checksums.Verify(test.header); err != test.err {
+			t.Errorf("Verify(%q) = %v, want %v", test.header, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,690 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+	"github.com/gowncloud/gowncloud/apps/dav"
+	"github.com/gowncloud/gowncloud/core/maintenance"
+	"github.com/gowncloud/gowncloud/core/scanner"
+	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/fs"
+	"github.com/gowncloud/gowncloud/image"
+	"github.com/gowncloud/gowncloud/mail"
+	"github.com/gowncloud/gowncloud/media"
+	"golang.org/x/net/context"
+)
+
+// versionsDir is the directory in the home of a user where owncloud keeps the
+// old versions of files
+const versionsDir = "files_versions"
+
+// adminCommands returns the administrative subcommands. They work directly on
+// the database and the dav root directory, so they can be used without the
+// server running. openDatabase connects to and initializes the database, and
+// returns the dav root directory. openFileSystem returns the file system storing
+// the files in the dav root directory.
+func adminCommands(openDatabase func() string, openFileSystem func(davroot string) fs.FileSystem) []cli.Command {
+	// withDatabase wraps a command so it runs with an open database connection
+	withDatabase := func(action func(c *cli.Context, fileSystem fs.FileSystem) error) func(c *cli.Context) error {
+		return func(c *cli.Context) error {
+			davroot := openDatabase()
+			defer db.Close()
+			fileSystem := openFileSystem(davroot)
+			// Needed to remove the cached previews and renditions of removed files
+			image.Init(fileSystem)
+			media.Init(fileSystem, "")
+			err := action(c, fileSystem)
+			if err != nil {
+				if _, ok := err.(*cli.ExitError); ok {
+					return err
+				}
+				return cli.NewExitError(err.Error(), 1)
+			}
+			return nil
+		}
+	}
+
+	return []cli.Command{
+		{
+			Name:      "user:add",
+			Usage:     "Create a user and his home directory",
+			ArgsUsage: "<username>",
+			Action:    withDatabase(addUser),
+		},
+		{
+			Name:      "user:delete",
+			Usage:     "Delete a user and all his files",
+			ArgsUsage: "<username>",
+			Action:    withDatabase(deleteUser),
+		},
+		{
+			Name:      "user:quota",
+			Usage:     "Show or set the allowed space of a user in GB, 0 is unlimited",
+			ArgsUsage: "<username> [quota]",
+			Action:    withDatabase(userQuota),
+		},
+		{
+			Name:   "user:list",
+			Usage:  "List all users with their quota and used space",
+			Action: withDatabase(listUsers),
+		},
+		{
+			Name:      "files:scan",
+			Usage:     "Reconcile the files on disk with the database",
+			ArgsUsage: "[username...]",
+			Action: withDatabase(func(c *cli.Context, fileSystem fs.FileSystem) error {
+				return scanFiles(fileSystem, c.Args())
+			}),
+		},
+		{
+			Name:      "trashbin:cleanup",
+			Usage:     "Remove the deleted files of the given users, or of all users",
+			ArgsUsage: "[username...]",
+			Action:    withDatabase(cleanupTrash),
+		},
+		{
+			Name:      "versions:cleanup",
+			Usage:     "Remove the file versions of the given users, or of all users",
+			ArgsUsage: "[username...]",
+			Action:    withDatabase(cleanupVersions),
+		},
+		{
+			Name:      "share:list",
+			Usage:     "List the shares of the given owners, or all shares",
+			ArgsUsage: "[owner...]",
+			Action:    withDatabase(listShares),
+		},
+		{
+			Name:      "maintenance:mode",
+			Usage:     "Enable or disable maintenance mode",
+			ArgsUsage: "on|off",
+			Action:    withDatabase(maintenanceMode),
+		},
+		{
+			Name:      "mail:test",
+			Usage:     "Send a test mail through the SMTP server",
+			ArgsUsage: "<address>",
+			Action:    sendTestMail,
+		},
+		{
+			Name:  "mail:digest",
+			Usage: "Send the activity digests now",
+			Action: withDatabase(func(c *cli.Context, fileSystem fs.FileSystem) error {
+				mail.SendDigests()
+				return nil
+			}),
+		},
+		{
+			Name:   "db:migrate",
+			Usage:  "Create or update the database schema",
+			Action: withDatabase(migrateDatabase),
+		},
+		{
+			Name:      "config:get",
+			Usage:     "Show a setting, or all settings",
+			ArgsUsage: "[key]",
+			Action:    withDatabase(getConfig),
+		},
+		{
+			Name:      "config:set",
+			Usage:     "Change a setting",
+			ArgsUsage: "<key> <value>",
+			Action:    withDatabase(setConfig),
+		},
+		{
+			Name:  "dedup:convert",
+			Usage: "Move the content of the files stored before deduplication was enabled to the blob store",
+			Action: withDatabase(func(c *cli.Context, fileSystem fs.FileSystem) error {
+				return convertDeduplication(fileSystem, true)
+			}),
+		},
+		{
+			Name:  "dedup:expand",
+			Usage: "Store the content of all files in the files again, to disable deduplication, with the server stopped",
+			Action: withDatabase(func(c *cli.Context, fileSystem fs.FileSystem) error {
+				return convertDeduplication(fileSystem, false)
+			}),
+		},
+		{
+			Name:   "dedup:gc",
+			Usage:  "Recount the references to the blobs and remove the unreferenced blobs",
+			Action: withDatabase(collectGarbageCommand),
+		},
+		{
+			Name:  "encryption:encrypt",
+			Usage: "Encrypt the files stored before encryption was enabled, with the server stopped",
+			Action: withDatabase(func(c *cli.Context, fileSystem fs.FileSystem) error {
+				return convertEncryption(fileSystem, true)
+			}),
+		},
+		{
+			Name:  "encryption:decrypt",
+			Usage: "Decrypt all the files, to disable encryption, with the server stopped",
+			Action: withDatabase(func(c *cli.Context, fileSystem fs.FileSystem) error {
+				return convertEncryption(fileSystem, false)
+			}),
+		},
+	}
+}
+
+// usageError returns the error for a command called with the wrong arguments
+func usageError(c *cli.Context) error {
+	return cli.NewExitError(fmt.Sprintf("Usage: %v %v %v", c.App.Name, c.Command.Name, c.Command.ArgsUsage), 2)
+}
+
+// usersOrAll returns the usernames given as arguments, or all users if there are none
+func usersOrAll(c *cli.Context) ([]string, error) {
+	if c.NArg() > 0 {
+		return c.Args(), nil
+	}
+	return db.SearchUserNames("")
+}
+
+// requireUser returns an error if the user doesn't exist
+func requireUser(username string) error {
+	user, err := db.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("User %v does not exist", username)
+	}
+	return nil
+}
+
+func addUser(c *cli.Context, fileSystem fs.FileSystem) error {
+	if c.NArg() != 1 {
+		return usageError(c)
+	}
+	username := c.Args().First()
+	if username == fs.AppDataDir {
+		return fmt.Errorf("The username %v is reserved", username)
+	}
+	user, err := db.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if user != nil {
+		return fmt.Errorf("User %v already exists", username)
+	}
+	err = dav.MakeUserHomeDirectory(username)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Created user", username)
+	return nil
+}
+
+func deleteUser(c *cli.Context, fileSystem fs.FileSystem) error {
+	if c.NArg() != 1 {
+		return usageError(c)
+	}
+	username := c.Args().First()
+	err := requireUser(username)
+	if err != nil {
+		return err
+	}
+	err = db.DeleteUser(username)
+	if err != nil {
+		return err
+	}
+	err = fileSystem.RemoveAll(context.Background(), username)
+	if err != nil {
+		return fmt.Errorf("User %v deleted, but failed to remove his files: %v", username, err)
+	}
+	fmt.Println("Deleted user", username)
+	return nil
+}
+
+func userQuota(c *cli.Context, fileSystem fs.FileSystem) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		return usageError(c)
+	}
+	username := c.Args().First()
+	user, err := db.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("User %v does not exist", username)
+	}
+	if c.NArg() == 1 {
+		fmt.Println(formatQuota(user.Allowedspace))
+		return nil
+	}
+	quota, err := strconv.Atoi(c.Args().Get(1))
+	if err != nil || quota < 0 {
+		return fmt.Errorf("Invalid quota: %v", c.Args().Get(1))
+	}
+	err = db.SetAllowedSpace(username, quota)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Quota of %v set to %v\n", username, formatQuota(quota))
+	return nil
+}
+
+func listUsers(c *cli.Context, fileSystem fs.FileSystem) error {
+	usernames, err := db.SearchUserNames("")
+	if err != nil {
+		return err
+	}
+	sort.Strings(usernames)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "USERNAME\tQUOTA\tUSED")
+	for _, username := range usernames {
+		user, err := db.GetUser(username)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			continue
+		}
+		var used int64
+		home, err := db.GetNode(username)
+		if err != nil {
+			return err
+		}
+		if home != nil {
+			used = home.Size
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", username, formatQuota(user.Allowedspace), formatBytes(used))
+	}
+	return w.Flush()
+}
+
+// scanFiles scans the files of the given users, or of all users if none are given,
+// and prints a summary of the changes
+func scanFiles(fileSystem fs.FileSystem, usernames []string) error {
+	if len(usernames) == 0 {
+		summary, err := scanner.ScanAll(fileSystem)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprint("Failed to scan files: ", err), 1)
+		}
+		fmt.Println("All users:", summary)
+		return nil
+	}
+	failed := false
+	for _, username := range usernames {
+		summary, err := scanner.ScanUser(fileSystem, username)
+		if err != nil {
+			fmt.Printf("%v: failed to scan files: %v\n", username, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%v: %v\n", username, summary)
+	}
+	if failed {
+		return cli.NewExitError("Not all users could be scanned", 1)
+	}
+	return nil
+}
+
+func cleanupTrash(c *cli.Context, fileSystem fs.FileSystem) error {
+	usernames, err := usersOrAll(c)
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		err = requireUser(username)
+		if err != nil {
+			return err
+		}
+		nodes, err := db.GetChildNodes(username + "/files_trash")
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			err = removeNode(fileSystem, node.Path)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%v: removed %v items from the trash\n", username, len(nodes))
+	}
+	return collectGarbage(fileSystem)
+}
+
+func cleanupVersions(c *cli.Context, fileSystem fs.FileSystem) error {
+	usernames, err := usersOrAll(c)
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		err = requireUser(username)
+		if err != nil {
+			return err
+		}
+		// gowncloud does not keep versions itself, but data directories taken
+		// over from owncloud can still contain them
+		versionsPath := username + "/" + versionsDir
+		nodes, err := db.GetChildNodes(versionsPath)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			err = removeNode(fileSystem, node.Path)
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%v: removed %v versions\n", username, len(nodes))
+	}
+	return collectGarbage(fileSystem)
+}
+
+// removeNode removes a node from disk and from the database
+func removeNode(fileSystem fs.FileSystem, path string) error {
+	err := fileSystem.RemoveAll(context.Background(), path)
+	if err != nil {
+		return fmt.Errorf("Failed to remove %v: %v", path, err)
+	}
+	image.InvalidateSubtreePreviews(path)
+	media.InvalidateSubtreeRenditions(path)
+	return db.DeleteNode(path)
+}
+
+func listShares(c *cli.Context, fileSystem fs.FileSystem) error {
+	var shares []*db.Share
+	var err error
+	if c.NArg() == 0 {
+		shares, err = db.GetAllShares()
+		if err != nil {
+			return err
+		}
+	}
+	for _, owner := range c.Args() {
+		ownerShares, err := db.GetSharedNodesForUser(owner)
+		if err != nil {
+			return err
+		}
+		shares = append(shares, ownerShares...)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tOWNER\tPATH\tTARGET\tTYPE\tPERMISSIONS\tCREATED")
+	for _, share := range shares {
+		node, err := db.GetNodeById(share.NodeID)
+		if err != nil {
+			return err
+		}
+		owner, path := "?", "?"
+		if node != nil {
+			owner, path = node.Owner, node.Path
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", share.ShareID,
+			owner, path, share.Target, shareTypeName(share.ShareType), share.Permissions,
+			share.Time.Format("2006-01-02 15:04"))
+	}
+	return w.Flush()
+}
+
+func maintenanceMode(c *cli.Context, fileSystem fs.FileSystem) error {
+	if c.NArg() == 0 {
+		if maintenance.Enabled() {
+			fmt.Println("Maintenance mode is enabled")
+		} else {
+			fmt.Println("Maintenance mode is disabled")
+		}
+		return nil
+	}
+	var enabled bool
+	switch strings.ToLower(c.Args().First()) {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		return usageError(c)
+	}
+	err := maintenance.SetEnabled(enabled)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		fmt.Println("Maintenance mode enabled")
+	} else {
+		fmt.Println("Maintenance mode disabled")
+	}
+	return nil
+}
+
+func migrateDatabase(c *cli.Context, fileSystem fs.FileSystem) error {
+	// The pending migrations are applied when the database is opened
+	applied, err := db.GetAppliedMigrations()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tAPPLIED\tDESCRIPTION")
+	for _, m := range applied {
+		fmt.Fprintf(w, "%v\t%v\t%v\n", m.Version, m.Applied.Local().Format("2006-01-02 15:04:05"), m.Description)
+	}
+	w.Flush()
+	fmt.Printf("Database schema is up to date at version %v\n", db.LatestSchemaVersion())
+	return nil
+}
+
+func getConfig(c *cli.Context, fileSystem fs.FileSystem) error {
+	settings := db.GetSettings()
+	if c.NArg() == 1 {
+		value, ok := settings[c.Args().First()]
+		if !ok {
+			return errors.New("Unknown setting: " + c.Args().First())
+		}
+		fmt.Println(value)
+		return nil
+	}
+	if c.NArg() > 1 {
+		return usageError(c)
+	}
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("%v: %v\n", key, settings[key])
+	}
+	return nil
+}
+
+func setConfig(c *cli.Context, fileSystem fs.FileSystem) error {
+	if c.NArg() != 2 {
+		return usageError(c)
+	}
+	return db.SetSetting(c.Args().First(), c.Args().Get(1))
+}
+
+// formatQuota formats an allowed space in GB
+func formatQuota(allowedSpace int) string {
+	if allowedSpace == 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(allowedSpace) + " GB"
+}
+
+// formatBytes formats a size in bytes using the largest fitting binary unit
+func formatBytes(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%v B", size)
+	}
+	return fmt.Sprintf("%.1f %v", value, units[unit])
+}
+
+// shareTypeName returns a readable name for a share type
+func shareTypeName(shareType int) string {
+	switch shareType {
+	case db.USERSHARE:
+		return "user"
+	case db.GROUPSHARE:
+		return "group"
+	case db.LINKSHARE:
+		return "link"
+	}
+	return strconv.Itoa(shareType)
+}
+
+// convertEncryption encrypts or decrypts all the files in the dav root in place.
+// Files already in the requested state are skipped, so an interrupted conversion
+// can be run again.
+func convertEncryption(fileSystem fs.FileSystem, encrypt bool) error {
+	// Encryption is the layer below deduplication, which encrypts the pointers
+	// and the blobs alike
+	if dedup, ok := fileSystem.(*fs.DedupFileSystem); ok {
+		fileSystem = dedup.FileSystem
+	}
+	encrypted, ok := fileSystem.(*fs.EncryptedFileSystem)
+	if !ok {
+		return cli.NewExitError("No master key configured, use --encryption-key-file or "+fs.MasterKeyEnv, 1)
+	}
+	var files []string
+	err := encrypted.Walk("", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	converted := 0
+	for _, file := range files {
+		var changed bool
+		if encrypt {
+			changed, err = encrypted.Encrypt(ctx, file)
+		} else {
+			changed, err = encrypted.Decrypt(ctx, file)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to convert %v: %v", file, err)
+		}
+		if changed {
+			converted++
+		}
+	}
+	if encrypt {
+		fmt.Printf("Encrypted %v of %v files\n", converted, len(files))
+	} else {
+		fmt.Printf("Decrypted %v of %v files\n", converted, len(files))
+	}
+	return nil
+}
+
+// convertDeduplication moves the content of all files to the blob store, or
+// back into the files
+func convertDeduplication(fileSystem fs.FileSystem, deduplicate bool) error {
+	dedup, ok := fileSystem.(*fs.DedupFileSystem)
+	if !ok {
+		return cli.NewExitError("Deduplication is not enabled, use --deduplicate", 1)
+	}
+	var files []string
+	err := dedup.Walk("", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == fs.AppDataDir {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	converted := 0
+	for _, file := range files {
+		var changed bool
+		if deduplicate {
+			changed, err = dedup.Deduplicate(ctx, file)
+		} else {
+			changed, err = dedup.Expand(ctx, file)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to convert %v: %v", file, err)
+		}
+		if changed {
+			converted++
+		}
+	}
+	if deduplicate {
+		fmt.Printf("Deduplicated %v of %v files\n", converted, len(files))
+		return collectGarbage(fileSystem)
+	}
+	fmt.Printf("Expanded %v of %v files\n", converted, len(files))
+	return nil
+}
+
+func collectGarbageCommand(c *cli.Context, fileSystem fs.FileSystem) error {
+	if _, ok := fileSystem.(*fs.DedupFileSystem); !ok {
+		return cli.NewExitError("Deduplication is not enabled, use --deduplicate", 1)
+	}
+	err := collectGarbage(fileSystem)
+	if err != nil {
+		return err
+	}
+	stats, err := db.GetBlobStats()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v files reference %v blobs, storing %v in %v\n", stats.References, stats.Blobs,
+		formatBytes(stats.ReferencedSize), formatBytes(stats.StoredSize))
+	return nil
+}
+
+// collectGarbage removes the blobs which are no longer referenced if the files
+// are deduplicated
+func collectGarbage(fileSystem fs.FileSystem) error {
+	dedup, ok := fileSystem.(*fs.DedupFileSystem)
+	if !ok {
+		return nil
+	}
+	removed, freed, err := dedup.CollectGarbage()
+	if err != nil {
+		return fmt.Errorf("Failed to collect garbage: %v", err)
+	}
+	fmt.Printf("Removed %v unreferenced blobs, freeing %v\n", removed, formatBytes(freed))
+	return nil
+}
+
+// sendTestMail sends a mail to the address to check the SMTP settings
+func sendTestMail(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return usageError(c)
+	}
+	err := mail.Send(&mail.Message{
+		To:      c.Args().First(),
+		Subject: "gowncloud test mail",
+		Text:    "The mails of gowncloud are sent through this SMTP server.\n",
+		HTML:    "<p>The mails of gowncloud are sent through this SMTP server.</p>",
+	})
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	fmt.Println("Test mail sent to", c.Args().First())
+	return nil
+}
@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The event names are part of the audit log format, they must not be changed
+// once released so the tools processing the log keep working
+const (
+	// FileUpload is recorded when a file is uploaded or overwritten
+	FileUpload = "file.upload"
+	// FileDownload is recorded when a file or directory is downloaded
+	FileDownload = "file.download"
+	// FileDelete is recorded when a node is moved to the trash, or removed from
+	// the trash for good
+	FileDelete = "file.delete"
+	// FileRestore is recorded when a node is restored from the trash
+	FileRestore = "file.restore"
+	// ShareCreate is recorded when a node is shared
+	ShareCreate = "share.create"
+	// ShareDelete is recorded when a share is removed, by its owner or by the
+	// user it was shared with
+	ShareDelete = "share.delete"
+	// Login is recorded when a user logs in
+	Login = "user.login"
+	// LoginFailed is recorded when a login or a token is rejected
+	LoginFailed = "user.login_failed"
+)
+
+// Fields are the details of an event, like the path and id of the node
+type Fields map[string]interface{}
+
+var (
+	// out is where the events are written, nothing is recorded if it is nil
+	out     io.Writer
+	outLock sync.Mutex
+)
+
+// Init sets where the audit events are written, as one JSON object per line
+func Init(w io.Writer) {
+	outLock.Lock()
+	defer outLock.Unlock()
+	out = w
+}
+
+// Record writes an event done by user in the request r to the audit log. The
+// time, event, user and remote address are added to the fields.
+func Record(r *http.Request, user, event string, fields Fields) {
+	outLock.Lock()
+	defer outLock.Unlock()
+	if out == nil {
+		return
+	}
+	entry := make(Fields, len(fields)+4)
+	for key, value := range fields {
+		entry[key] = value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["event"] = event
+	entry["user"] = user
+	if r != nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		entry["remote"] = host
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Failed to record %v event of %v: %v", event, user, err)
+		return
+	}
+	_, err = out.Write(append(line, '\n'))
+	if err != nil {
+		log.Errorf("Failed to record %v event of %v: %v", event, user, err)
+	}
+}
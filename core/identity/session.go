@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gowncloud/gowncloud/core/audit"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -95,6 +96,7 @@ func Protect(clientID string, clientSecret string, handler http.Handler) http.Ha
 			if err != nil {
 				//TODO: handle more gracefully than this
 				log.Debugln("Error getting a jwt token:", err)
+				audit.Record(r, "", audit.LoginFailed, audit.Fields{"reason": "invalid code"})
 				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 				return
 			}
@@ -102,6 +104,7 @@ func Protect(clientID string, clientSecret string, handler http.Handler) http.Ha
 			// If the user isnt a member of clientID, itsYou.Online seems to return the following token at the moment
 			if token == "Unauthorized\n" {
 				log.Debug("Rejected login due to invalid jwt")
+				audit.Record(r, "", audit.LoginFailed, audit.Fields{"reason": "not a member"})
 				rejectString := "Only members of " + clientID + " have access to this gowncloud server"
 				w.WriteHeader(http.StatusUnauthorized)
 				w.Write([]byte(rejectString))
@@ -111,6 +114,7 @@ func Protect(clientID string, clientSecret string, handler http.Handler) http.Ha
 			s, err := verifyJWTToken(token, clientID)
 			if err != nil {
 				log.Debugln("Error processing jwt token:", err, "- TOKEN: ", token)
+				audit.Record(r, "", audit.LoginFailed, audit.Fields{"reason": "invalid token"})
 				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 				return
 			}
@@ -126,6 +130,7 @@ func Protect(clientID string, clientSecret string, handler http.Handler) http.Ha
 
 			if !authorized {
 				// TODO: provide a nice page to tell the user they have been rejected
+				audit.Record(r, s.Username, audit.LoginFailed, audit.Fields{"reason": "not a member"})
 				rejectString := "Only members of " + clientID + " have access to this gowncloud server"
 				w.WriteHeader(http.StatusUnauthorized)
 				w.Write([]byte(rejectString))
@@ -133,6 +138,7 @@ func Protect(clientID string, clientSecret string, handler http.Handler) http.Ha
 			}
 
 			startSession(w, s)
+			audit.Record(r, s.Username, audit.Login, nil)
 
 			//TODO: handle direct links
 			http.Redirect(w, r, "/index.php", http.StatusFound)
@@ -141,6 +147,7 @@ func Protect(clientID string, clientSecret string, handler http.Handler) http.Ha
 		s := CurrentSession(r)
 		if s.Username == "" || s.IsExpired() {
 			if s.Kind == SessionByHeader {
+				audit.Record(r, s.Username, audit.LoginFailed, audit.Fields{"reason": "invalid bearer token"})
 				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 				return
 			}
@@ -0,0 +1,111 @@
+package logging
+
+import (
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Open opens the destination of a log, which is "stdout", "stderr", "syslog"
+// for the local syslog daemon, "syslog://host:port" or "syslog+tcp://host:port"
+// for a remote one, or the path of a file. tag identifies the log in syslog.
+// Files are rotated once they grow past maxSize bytes, keeping maxBackups
+// rotated files. A maxSize of 0 disables the rotation.
+func Open(destination, tag string, maxSize int64, maxBackups int) (io.Writer, error) {
+	switch destination {
+	case "", "stdout", "-":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	case "syslog":
+		return openSyslog("", "", tag)
+	}
+	if strings.HasPrefix(destination, "syslog://") || strings.HasPrefix(destination, "syslog+") {
+		u, err := url.Parse(destination)
+		if err != nil {
+			return nil, err
+		}
+		network := "udp"
+		if strings.HasPrefix(u.Scheme, "syslog+") {
+			network = strings.TrimPrefix(u.Scheme, "syslog+")
+		}
+		return openSyslog(network, u.Host, tag)
+	}
+	return openRotatingFile(strings.TrimPrefix(destination, "file://"), maxSize, maxBackups)
+}
+
+// rotatingFile is a log file which is renamed to <path>.1 once it is full, the
+// earlier rotated files are shifted to <path>.2 and so on
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the log file, appending to it if it exists
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes an entry to the log file, rotating it first if the entry doesn't
+// fit anymore
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		err := f.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the full log file out of the way, removing the oldest rotated
+// file, and opens a new log file
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		return err
+	}
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+		}
+		err = os.Rename(f.path, f.path+".1")
+	} else {
+		err = os.Remove(f.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.open()
+}
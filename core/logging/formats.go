@@ -0,0 +1,100 @@
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gowncloud/gowncloud/core/identity"
+)
+
+// Format builds the log entry of a request, without the trailing newline.
+// ts is the time the request started, status and size are the HTTP status and
+// the size of the response.
+type Format func(req *http.Request, url url.URL, ts time.Time, status int, size int) []byte
+
+var (
+	// CommonLogFormat logs requests in the Apache Common Log Format
+	CommonLogFormat Format = buildCommonLogLine
+	// CombinedLogFormat logs requests in the Apache Combined Log Format, which
+	// adds the referer and user agent to the Common Log Format
+	CombinedLogFormat Format = buildCombinedLogLine
+	// JSONLogFormat logs every request as a JSON object
+	JSONLogFormat Format = buildJSONLogLine
+)
+
+// ErrUnknownFormat is returned for the name of a log format which doesn't exist
+var ErrUnknownFormat = errors.New("Unknown log format, use clf, combined or json")
+
+// FormatByName returns the log format with the given name: clf, combined or json
+func FormatByName(name string) (Format, error) {
+	switch name {
+	case "", "clf", "common":
+		return CommonLogFormat, nil
+	case "combined":
+		return CombinedLogFormat, nil
+	case "json":
+		return JSONLogFormat, nil
+	}
+	return nil, ErrUnknownFormat
+}
+
+// buildCombinedLogLine builds a log entry for req in Apache Combined Log Format.
+func buildCombinedLogLine(req *http.Request, url url.URL, ts time.Time, status int, size int) []byte {
+	buf := buildCommonLogLine(req, url, ts, status, size)
+	buf = append(buf, ` "`...)
+	buf = appendQuoted(buf, req.Referer())
+	buf = append(buf, `" "`...)
+	buf = appendQuoted(buf, req.UserAgent())
+	buf = append(buf, '"')
+	return buf
+}
+
+// jsonLogLine are the fields of a request logged in JSON
+type jsonLogLine struct {
+	Time      string  `json:"time"`
+	Remote    string  `json:"remote"`
+	User      string  `json:"user"`
+	Method    string  `json:"method"`
+	URI       string  `json:"uri"`
+	Proto     string  `json:"proto"`
+	Status    int     `json:"status"`
+	Size      int     `json:"size"`
+	Duration  float64 `json:"duration"`
+	Referer   string  `json:"referer"`
+	UserAgent string  `json:"user_agent"`
+}
+
+// buildJSONLogLine builds a log entry for req as a JSON object. The duration is
+// in seconds.
+func buildJSONLogLine(req *http.Request, url url.URL, ts time.Time, status int, size int) []byte {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	uri := req.RequestURI
+	if uri == "" {
+		uri = url.RequestURI()
+	}
+	buf, err := json.Marshal(&jsonLogLine{
+		Time:      ts.Format(time.RFC3339Nano),
+		Remote:    host,
+		User:      identity.CurrentSession(req).Username,
+		Method:    req.Method,
+		URI:       uri,
+		Proto:     req.Proto,
+		Status:    status,
+		Size:      size,
+		Duration:  time.Since(ts).Seconds(),
+		Referer:   req.Referer(),
+		UserAgent: req.UserAgent(),
+	})
+	if err != nil {
+		// The fields are all strings and numbers, this can't happen
+		return []byte("{}")
+	}
+	return buf
+}
@@ -19,6 +19,7 @@ import (
 // friends
 type loggingHandler struct {
 	writer  io.Writer
+	format  Format
 	handler http.Handler
 }
 
@@ -27,7 +28,7 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	logger := makeLogger(w)
 	url := *req.URL
 	h.handler.ServeHTTP(logger, req)
-	writeLog(h.writer, req, url, t, logger.Status(), logger.Size())
+	writeLog(h.writer, h.format, req, url, t, logger.Status(), logger.Size())
 }
 
 // buildCommonLogLine builds a log entry for req in Apache Common Log Format.
@@ -140,11 +141,11 @@ func appendQuoted(buf []byte, s string) []byte {
 
 }
 
-// writeLog writes a log entry for req to w in Apache Common Log Format.
+// writeLog writes a log entry for req to w in the given format.
 // ts is the timestamp with which the entry should be logged.
 // status and size are used to provide the response HTTP status and size.
-func writeLog(w io.Writer, req *http.Request, url url.URL, ts time.Time, status, size int) {
-	buf := buildCommonLogLine(req, url, ts, status, size)
+func writeLog(w io.Writer, format Format, req *http.Request, url url.URL, ts time.Time, status, size int) {
+	buf := format(req, url, ts, status, size)
 	buf = append(buf, '\n')
 	w.Write(buf)
 }
@@ -255,5 +256,11 @@ type responseLogger struct {
 //  http.ListenAndServe(":1123", loggedRouter)
 //
 func Handler(out io.Writer, h http.Handler) http.Handler {
-	return loggingHandler{out, h}
+	return loggingHandler{out, CommonLogFormat, h}
+}
+
+// FormatHandler returns a http.Handler that wraps h and logs requests to out in
+// the given format
+func FormatHandler(out io.Writer, format Format, h http.Handler) http.Handler {
+	return loggingHandler{out, format, h}
 }
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package logging
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to the syslog daemon at address over network, or to the
+// local one if network is empty
+func openSyslog(network, address, tag string) (io.Writer, error) {
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package logging
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog fails, syslog is not available on this platform
+func openSyslog(network, address, tag string) (io.Writer, error) {
+	return nil, errors.New("Syslog is not supported on this platform")
+}
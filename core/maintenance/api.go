@@ -0,0 +1,53 @@
+package maintenance
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/core/identity"
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+type maintenanceStatus struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+// MaintenanceMode shows or changes the maintenance mode. Changing it requires the
+// user to be an admin and the 'enabled' form value to be 'true' or 'false'.
+// It is the endpoint for GET and POST /index.php/core/maintenance
+func MaintenanceMode(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST", "PUT":
+		isAdmin, err := db.IsAdmin(identity.CurrentSession(r).Username)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !isAdmin {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		maintenance, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "Invalid value for enabled: "+r.FormValue("enabled"), http.StatusBadRequest)
+			return
+		}
+		err = SetEnabled(maintenance)
+		if err != nil {
+			log.Error("Failed to change the maintenance mode: ", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Maintenance mode set to %v by %v", maintenance, identity.CurrentSession(r).Username)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&maintenanceStatus{Maintenance: Enabled()})
+}
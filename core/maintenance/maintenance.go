@@ -0,0 +1,119 @@
+package maintenance
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+const (
+	// refreshInterval is how long the maintenance setting is cached before it is
+	// read from the database again, so a change made with the CLI is picked up
+	// by a running server
+	refreshInterval = 5 * time.Second
+	// retryAfter is the amount of seconds clients are asked to wait before
+	// retrying a request during maintenance
+	retryAfter = 120
+	// adminPath is the path of the admin API to toggle the maintenance mode, it
+	// stays reachable during maintenance
+	adminPath = "/index.php/core/maintenance"
+	// logoutPath stays reachable during maintenance so users can still log out
+	logoutPath = "/logout"
+)
+
+var (
+	lock        sync.Mutex
+	enabled     bool
+	lastRefresh time.Time
+)
+
+var pageTemplate = template.Must(template.New("maintenance").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.}}">
+<title>gowncloud</title>
+</head>
+<body>
+<h2>This gowncloud instance is currently in maintenance mode</h2>
+<p>This page will refresh itself when the instance is available again.</p>
+<p>Contact your system administrator if this message persists or appeared unexpectedly.</p>
+</body>
+</html>
+`))
+
+// Enabled checks if the server is in maintenance mode
+func Enabled() bool {
+	lock.Lock()
+	defer lock.Unlock()
+	if time.Since(lastRefresh) > refreshInterval {
+		value, err := db.ReloadSetting(db.MAINTENANCE)
+		if err != nil {
+			// Keep the last known state, the database might be unavailable
+			// because of the maintenance
+			log.Warn("Failed to reload the maintenance setting: ", err)
+		} else {
+			enabled = value == "true"
+		}
+		lastRefresh = time.Now()
+	}
+	return enabled
+}
+
+// SetEnabled enables or disables the maintenance mode
+func SetEnabled(maintenance bool) error {
+	lock.Lock()
+	defer lock.Unlock()
+	err := db.SetSetting(db.MAINTENANCE, strconv.FormatBool(maintenance))
+	if err != nil {
+		return err
+	}
+	enabled = maintenance
+	lastRefresh = time.Now()
+	return nil
+}
+
+// Handler rejects all requests with a 503 Service Unavailable while the server
+// is in maintenance mode. Browsers get a page explaining the maintenance, other
+// clients a Retry-After header so they pause their synchronization. It must go
+// behind the login handler, so admins can still log in to end the maintenance.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == adminPath || r.URL.Path == logoutPath || !Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log.Debug("Rejecting request during maintenance: ", r.URL.Path)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		if !isBrowserRequest(r) {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		err := pageTemplate.Execute(w, retryAfter)
+		if err != nil {
+			log.Error("Failed to render the maintenance page: ", err)
+		}
+	})
+}
+
+// isBrowserRequest checks if the request is a page load in a browser, rather
+// than a WebDAV, OCS or AJAX call
+func isBrowserRequest(r *http.Request) bool {
+	if r.Method != "GET" || r.Header.Get("X-Requested-With") != "" {
+		return false
+	}
+	if strings.HasPrefix(r.URL.Path, "/remote.php/") || strings.HasPrefix(r.URL.Path, "/ocs/") ||
+		strings.Contains(r.URL.Path, "/ajax/") {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
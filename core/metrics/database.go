@@ -0,0 +1,40 @@
+package metrics
+
+import (
+	"time"
+
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+var (
+	// queryDuration is the time taken by the database to execute the queries
+	queryDuration = NewHistogram("gowncloud_db_query_duration_seconds",
+		"Time taken to execute database queries by operation.", DefaultBuckets, "operation")
+	// The storage used by every user is read from the sizes of his files and
+	// trash directories when the metrics are scraped
+	_ = NewGaugeFunc("gowncloud_user_storage_bytes",
+		"Size of the files and of the trash of every user.", storageSamples, "user", "directory")
+)
+
+func init() {
+	db.SetQueryObserver(func(operation string, duration time.Duration) {
+		queryDuration.Observe(duration.Seconds(), operation)
+	})
+}
+
+// storageSamples returns the size of the files and files_trash directories of
+// all the users
+func storageSamples() []Sample {
+	samples := make([]Sample, 0)
+	usages, err := db.GetStorageUsage()
+	if err != nil {
+		return samples
+	}
+	for _, usage := range usages {
+		samples = append(samples, Sample{
+			LabelValues: []string{usage.Username, usage.Directory},
+			Value:       float64(usage.Size),
+		})
+	}
+	return samples
+}
@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gowncloud/gowncloud/core/identity"
+)
+
+// sessionWindow is how long a user counts as active after his last request
+const sessionWindow = 15 * time.Minute
+
+var (
+	requests = NewCounter("gowncloud_http_requests_total",
+		"Amount of handled HTTP requests by route, method and status code.", "route", "method", "code")
+	requestDuration = NewHistogram("gowncloud_http_request_duration_seconds",
+		"Time taken to handle HTTP requests by route and method.", DefaultBuckets, "route", "method")
+	uploadedBytes = NewCounter("gowncloud_http_uploaded_bytes_total",
+		"Bytes read from HTTP request bodies by route.", "route")
+	downloadedBytes = NewCounter("gowncloud_http_downloaded_bytes_total",
+		"Bytes written in HTTP response bodies by route.", "route")
+	_ = NewGaugeFunc("gowncloud_active_sessions",
+		"Users with a valid session who made a request in the last 15 minutes.", activeSessionSamples)
+)
+
+// knownMethods are the HTTP and WebDAV methods reported as they are, other
+// methods are reported as OTHER so clients can't create arbitrary labels
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true, "OPTIONS": true,
+	"PATCH": true, "PROPFIND": true, "PROPPATCH": true, "MKCOL": true, "COPY": true,
+	"MOVE": true, "LOCK": true, "UNLOCK": true, "REPORT": true, "SEARCH": true,
+}
+
+var (
+	// sessions holds when the session of every user expires and when he made
+	// his last request
+	sessions     = make(map[string]sessionActivity)
+	sessionsLock sync.Mutex
+)
+
+type sessionActivity struct {
+	expires  time.Time
+	lastSeen time.Time
+}
+
+// InstrumentHandler returns a handler counting the requests handled by h and
+// their duration and size. The requests are labeled with the pattern of the
+// route in routes they match, it must be wrapped by identity.AddIdentity to
+// count the active sessions.
+func InstrumentHandler(routes *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := routes.Handler(r)
+		if route == "" {
+			route = "other"
+		}
+		method := r.Method
+		if !knownMethods[method] {
+			method = "OTHER"
+		}
+		trackSession(identity.CurrentSession(r), start)
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		writer := &countingWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(writer, r)
+
+		requests.Inc(route, method, strconv.Itoa(writer.status))
+		requestDuration.ObserveSince(start, route, method)
+		uploadedBytes.Add(float64(body.size), route)
+		downloadedBytes.Add(float64(writer.size), route)
+	})
+}
+
+// trackSession records the request of the user of the session
+func trackSession(s identity.Session, now time.Time) {
+	if s.Username == "" || s.IsExpired() {
+		return
+	}
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	sessions[s.Username] = sessionActivity{expires: s.Expires, lastSeen: now}
+}
+
+// activeSessionSamples counts the active sessions, forgetting the inactive ones
+func activeSessionSamples() []Sample {
+	now := time.Now()
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for username, activity := range sessions {
+		if now.After(activity.expires) || now.Sub(activity.lastSeen) > sessionWindow {
+			delete(sessions, username)
+		}
+	}
+	return []Sample{{Value: float64(len(sessions))}}
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	size int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.size += int64(n)
+	return n, err
+}
+
+// countingWriter keeps track of the status code and the bytes written to a
+// response. It passes on flushes, so streamed responses keep working.
+type countingWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+func (c *countingWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.status = status
+		c.wroteHeader = true
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	c.wroteHeader = true
+	n, err := c.ResponseWriter.Write(b)
+	c.size += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *countingWriter) CloseNotify() <-chan bool {
+	if cn, ok := c.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (c *countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := c.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("The response writer does not support hijacking")
+}
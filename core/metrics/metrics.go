@@ -0,0 +1,254 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the buckets of the latency
+// histograms
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector writes one or more metrics in the Prometheus text format
+type collector interface {
+	collect(w io.Writer)
+}
+
+var (
+	// collectors are the registered metrics, in the order they are exposed
+	collectors     []collector
+	collectorsLock sync.Mutex
+)
+
+// register adds a metric to the ones exposed on /metrics
+func register(c collector) {
+	collectorsLock.Lock()
+	defer collectorsLock.Unlock()
+	collectors = append(collectors, c)
+}
+
+// Handler serves all the registered metrics in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		collectorsLock.Lock()
+		registered := make([]collector, len(collectors))
+		copy(registered, collectors)
+		collectorsLock.Unlock()
+
+		var buffer bytes.Buffer
+		for _, c := range registered {
+			c.collect(&buffer)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buffer.Bytes())
+	})
+}
+
+// Counter is a value that only goes up, like the amount of handled requests.
+// A counter has a value for every combination of its label values.
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter creates and registers a counter with the given labels
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+// Inc adds one to the counter for the label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta to the counter for the label values
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	key := labelKey(c.labels, labelValues)
+	c.lock.Lock()
+	c.values[key] += delta
+	c.lock.Unlock()
+}
+
+func (c *Counter) collect(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		writeSample(w, c.name, key, c.values[key])
+	}
+}
+
+// Histogram counts observations, like request durations, in buckets. A histogram
+// has buckets for every combination of its label values.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+// histogramValue are the buckets of a single combination of label values
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates and registers a histogram with the given bucket upper
+// bounds, which must be sorted, and labels
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets,
+		values: make(map[string]*histogramValue)}
+	register(h)
+	return h
+}
+
+// Observe adds an observation to the histogram for the label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := labelKey(h.labels, labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+// ObserveSince adds the time passed since start in seconds to the histogram
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) collect(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := h.values[key]
+		for i, bound := range h.buckets {
+			writeSample(w, h.name+"_bucket", joinLabels(key, `le="`+formatValue(bound)+`"`), float64(v.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", joinLabels(key, `le="+Inf"`), float64(v.count))
+		writeSample(w, h.name+"_sum", key, v.sum)
+		writeSample(w, h.name+"_count", key, float64(v.count))
+	}
+}
+
+// Sample is a single value of a gauge, with the values of its labels
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// GaugeFunc is a value that can go up and down, like the used storage, which is
+// read when the metrics are scraped
+type GaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	read   func() []Sample
+}
+
+// NewGaugeFunc creates and registers a gauge of which the samples are returned by
+// read. read returns a sample for every combination of label values.
+func NewGaugeFunc(name, help string, read func() []Sample, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, labels: labels, read: read}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) collect(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, sample := range g.read() {
+		writeSample(w, g.name, labelKey(g.labels, sample.LabelValues), sample.Value)
+	}
+}
+
+// labelKey formats the label names and values as they are written in the
+// samples, it is also used to tell the combinations of label values apart
+func labelKey(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + escapeLabelValue(value) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// joinLabels adds a label to the formatted labels of a sample
+func joinLabels(key, label string) string {
+	if key == "" {
+		return label
+	}
+	return key + "," + label
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueReplacer.Replace(value)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name, labels string, value float64) {
+	if labels != "" {
+		fmt.Fprintf(w, "%v{%v} %v\n", name, labels, formatValue(value))
+		return
+	}
+	fmt.Fprintf(w, "%v %v\n", name, formatValue(value))
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
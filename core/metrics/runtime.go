@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"runtime"
+)
+
+// The Go runtime statistics are read when the metrics are scraped
+var (
+	_ = NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() []Sample {
+		return []Sample{{Value: float64(runtime.NumGoroutine())}}
+	})
+	_ = NewGaugeFunc("go_info", "Information about the Go environment.", func() []Sample {
+		return []Sample{{LabelValues: []string{runtime.Version()}, Value: 1}}
+	}, "version")
+	_ = NewGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.",
+		memStat(func(m *runtime.MemStats) float64 { return float64(m.Alloc) }))
+	_ = NewGaugeFunc("go_memstats_sys_bytes", "Number of bytes obtained from the system.",
+		memStat(func(m *runtime.MemStats) float64 { return float64(m.Sys) }))
+	_ = NewGaugeFunc("go_memstats_heap_objects", "Number of allocated objects.",
+		memStat(func(m *runtime.MemStats) float64 { return float64(m.HeapObjects) }))
+	_ = NewGaugeFunc("go_memstats_gc_cpu_fraction", "The fraction of the available CPU time used by the GC since the program started.",
+		memStat(func(m *runtime.MemStats) float64 { return m.GCCPUFraction }))
+	_ = NewGaugeFunc("go_memstats_gc_completed", "Number of completed GC cycles.",
+		memStat(func(m *runtime.MemStats) float64 { return float64(m.NumGC) }))
+	_ = NewGaugeFunc("go_memstats_gc_pause_seconds", "Total time the program was paused by the GC.",
+		memStat(func(m *runtime.MemStats) float64 { return float64(m.PauseTotalNs) / 1e9 }))
+)
+
+// memStat returns the samples of a gauge reading a value from the memory
+// statistics of the runtime
+func memStat(value func(m *runtime.MemStats) float64) func() []Sample {
+	return func() []Sample {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return []Sample{{Value: value(&m)}}
+	}
+}
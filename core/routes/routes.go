@@ -5,10 +5,13 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gowncloud/gowncloud/core"
+	"github.com/gowncloud/gowncloud/core/maintenance"
 )
 
 func RegisterRoutes(protected *http.ServeMux, publicMux *http.ServeMux) {
 	log.Debug("Registering core routes")
 
 	publicMux.HandleFunc("/status.php", core.Status)
+
+	protected.HandleFunc("/index.php/core/maintenance", maintenance.MaintenanceMode)
 }
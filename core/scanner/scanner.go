@@ -0,0 +1,425 @@
+package scanner
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/fs"
+	"github.com/gowncloud/gowncloud/image"
+	"github.com/gowncloud/gowncloud/media"
+	"golang.org/x/net/context"
+)
+
+const directoryMimeType = "httpd/unix-directory"
+
+var (
+	// scanLock makes sure only one scan runs at a time, concurrent scans would
+	// try to add the same nodes
+	scanLock sync.Mutex
+
+	// ErrUnknownUser is returned when scanning a user that doesn't exist
+	ErrUnknownUser = errors.New("Unknown user")
+)
+
+// Summary reports the changes made during a scan
+type Summary struct {
+	// Scanned is the amount of files and directories found on disk
+	Scanned int
+	// Added is the amount of nodes created for files and directories which were
+	// not in the database
+	Added int
+	// Updated is the amount of nodes whose size or modification time were updated
+	Updated int
+	// Removed is the amount of nodes removed because they were no longer on disk
+	Removed int
+	// Repaired is the amount of fixed directory sizes, share, favorite and trash
+	// references
+	Repaired int
+	// Errors is the amount of files and directories that could not be processed
+	Errors int
+}
+
+// add adds the counts of another summary to this one
+func (s *Summary) add(other *Summary) {
+	s.Scanned += other.Scanned
+	s.Added += other.Added
+	s.Updated += other.Updated
+	s.Removed += other.Removed
+	s.Repaired += other.Repaired
+	s.Errors += other.Errors
+}
+
+func (s *Summary) String() string {
+	return fmt.Sprintf("%v scanned, %v added, %v updated, %v removed, %v repaired, %v errors",
+		s.Scanned, s.Added, s.Updated, s.Removed, s.Repaired, s.Errors)
+}
+
+// ScanAll scans the home directories of all users
+func ScanAll(fileSystem fs.FileSystem) (*Summary, error) {
+	usernames, err := db.SearchUserNames("")
+	if err != nil {
+		return nil, err
+	}
+	summary := &Summary{}
+	for _, username := range usernames {
+		userSummary, err := ScanUser(fileSystem, username)
+		if err != nil {
+			log.Errorf("Failed to scan the files of user %v: %v", username, err)
+			summary.Errors++
+			continue
+		}
+		summary.add(userSummary)
+	}
+	return summary, nil
+}
+
+// ScanUser walks the home directory of the user and reconciles the database with
+// the files on disk. Nodes are created for files that are missing in the database,
+// nodes of files that are no longer on disk are removed, and the size and
+// modification time of changed files are updated. Afterwards the directory sizes
+// and the share, favorite and trash references are repaired.
+func ScanUser(fileSystem fs.FileSystem, username string) (*Summary, error) {
+	scanLock.Lock()
+	defer scanLock.Unlock()
+
+	user, err := db.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUnknownUser
+	}
+
+	log.Debug("Scanning files of user ", username)
+	summary := &Summary{}
+	seen := make(map[string]bool)
+	// failed holds the paths that could not be scanned, their nodes are left alone
+	failed := make([]string, 0)
+	// dirSizes holds the combined size of the files found in every directory
+	dirSizes := make(map[string]int64)
+
+	err = fileSystem.Walk(username, func(nodePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if nodePath == username {
+				return err
+			}
+			log.Errorf("Failed to scan %v: %v", nodePath, err)
+			summary.Errors++
+			failed = append(failed, nodePath)
+			return nil
+		}
+		if nodePath != username && isTemporary(path.Base(nodePath)) {
+			// Files being uploaded or rewritten get a node once they are complete
+			return nil
+		}
+		summary.Scanned++
+		seen[nodePath] = true
+		if info.IsDir() {
+			dirSizes[nodePath] = 0
+		} else {
+			for _, parent := range parents(nodePath, username) {
+				dirSizes[parent] += info.Size()
+			}
+		}
+
+		err = scanNode(fileSystem, username, nodePath, info, summary)
+		if err != nil {
+			log.Errorf("Failed to scan %v: %v", nodePath, err)
+			summary.Errors++
+			failed = append(failed, nodePath)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := db.GetSubtreeNodes(username)
+	if err != nil {
+		return nil, err
+	}
+	// The nodes are sorted by path, so removing a directory also removes the
+	// nodes which come after it in the list
+	removedDir := ""
+	for _, node := range nodes {
+		if seen[node.Path] || isInside(node.Path, failed) {
+			continue
+		}
+		if removedDir != "" && isInside(node.Path, []string{removedDir}) {
+			continue
+		}
+		// Files uploaded while the scan was running were not walked
+		if !isTemporary(path.Base(node.Path)) {
+			_, err = fileSystem.Stat(context.Background(), node.Path)
+			if err == nil {
+				continue
+			}
+			if !os.IsNotExist(err) {
+				log.Errorf("Failed to check %v: %v", node.Path, err)
+				summary.Errors++
+				continue
+			}
+		}
+		log.Debug("Removing node which is no longer on disk: ", node.Path)
+		image.InvalidateSubtreePreviews(node.Path)
+		media.InvalidateSubtreeRenditions(node.Path)
+		err = db.DeleteNode(node.Path)
+		if err != nil {
+			summary.Errors++
+			continue
+		}
+		summary.Removed++
+		removedDir = node.Path
+	}
+
+	// The directory sizes can only be trusted if the entire tree was scanned
+	if len(failed) == 0 {
+		repaired, err := repairDirectorySizes(username, dirSizes)
+		summary.Repaired += repaired
+		if err != nil {
+			return summary, err
+		}
+	}
+	repaired, err := repairReferences(username, seen)
+	summary.Repaired += repaired
+	if err != nil {
+		return summary, err
+	}
+
+	// Photos added outside of the web interface have no metadata yet
+	_, err = image.UpdateMissingMetadata(username)
+	if err != nil {
+		log.Errorf("Failed to extract the photo metadata of user %v: %v", username, err)
+	}
+
+	log.Debugf("Scanned files of user %v: %v", username, summary)
+	return summary, nil
+}
+
+// StartBackgroundScan scans the files of all users every interval. If the files
+// are deduplicated, the unreferenced blobs are removed after each scan.
+func StartBackgroundScan(fileSystem fs.FileSystem, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			summary, err := ScanAll(fileSystem)
+			if err != nil {
+				log.Error("Background file scan failed: ", err)
+				continue
+			}
+			log.Info("Background file scan finished: ", summary)
+			if dedup, ok := fileSystem.(*fs.DedupFileSystem); ok {
+				removed, freed, err := dedup.CollectGarbage()
+				if err != nil {
+					log.Error("Blob garbage collection failed: ", err)
+					continue
+				}
+				log.Infof("Removed %v unreferenced blobs of %v bytes", removed, freed)
+			}
+		}
+	}()
+}
+
+// scanNode creates or updates the node for a single file or directory
+func scanNode(fileSystem fs.FileSystem, username, nodePath string, info os.FileInfo, summary *Summary) error {
+	node, err := db.GetNode(nodePath)
+	if err != nil {
+		return err
+	}
+	if node != nil && node.Isdir != info.IsDir() {
+		// A file was replaced by a directory or the other way around
+		image.InvalidateSubtreePreviews(nodePath)
+		media.InvalidateSubtreeRenditions(nodePath)
+		err = db.DeleteNode(nodePath)
+		if err != nil {
+			return err
+		}
+		summary.Removed++
+		node = nil
+	}
+
+	if node == nil {
+		log.Debug("Adding node which was not in the database: ", nodePath)
+		mimetype := directoryMimeType
+		if !info.IsDir() {
+			mimetype = detectMimeType(fileSystem, nodePath)
+		}
+		_, err = db.SaveNode(nodePath, username, info.IsDir(), mimetype)
+		if err != nil {
+			return err
+		}
+		summary.Added++
+		if info.IsDir() {
+			return nil
+		}
+		_, err = db.UpdateFileMetadata(nodePath, info.Size(), info.ModTime())
+		return err
+	}
+
+	if info.IsDir() {
+		return nil
+	}
+	if node.Size != info.Size() || node.Mtime.Unix() != info.ModTime().Unix() {
+		log.Debug("Updating metadata of changed file: ", nodePath)
+		image.InvalidatePreviews(node)
+		media.InvalidateRenditions(node)
+		_, err = db.UpdateFileMetadata(nodePath, info.Size(), info.ModTime())
+		if err != nil {
+			return err
+		}
+		summary.Updated++
+	}
+	return nil
+}
+
+// repairDirectorySizes sets the size of all directories to the combined size of
+// the files in them. It returns the amount of fixed directories.
+func repairDirectorySizes(username string, dirSizes map[string]int64) (int, error) {
+	nodes, err := db.GetSubtreeNodes(username)
+	if err != nil {
+		return 0, err
+	}
+	repaired := 0
+	for _, node := range nodes {
+		size, ok := dirSizes[node.Path]
+		if !node.Isdir || !ok || node.Size == size {
+			continue
+		}
+		log.Debugf("Repairing size of directory %v: %v instead of %v", node.Path, size, node.Size)
+		err = db.SetDirectorySize(node.Path, size)
+		if err != nil {
+			return repaired, err
+		}
+		repaired++
+	}
+	return repaired, nil
+}
+
+// repairReferences removes shares, favorites and trash nodes which point to
+// nodes that no longer exist, and creates the missing trash nodes for the nodes
+// in the trash of the user. It returns the amount of repaired references.
+func repairReferences(username string, seen map[string]bool) (int, error) {
+	repaired := 0
+
+	removed, err := db.DeleteStaleTrashNodes(username)
+	if err != nil {
+		return repaired, err
+	}
+	repaired += int(removed)
+
+	trashPrefix := username + "/files_trash/"
+	for nodePath := range seen {
+		if !strings.HasPrefix(nodePath, trashPrefix) {
+			continue
+		}
+		trashNode, err := db.GetTrashNode(nodePath)
+		if err != nil {
+			return repaired, err
+		}
+		if trashNode != nil {
+			continue
+		}
+		node, err := db.GetNode(nodePath)
+		if err != nil {
+			return repaired, err
+		}
+		if node == nil {
+			continue
+		}
+		// Without a record of the original location, restore the node to the
+		// same place in the files directory
+		originalPath := username + "/files/" + strings.TrimPrefix(nodePath, trashPrefix)
+		log.Debugf("Adding missing trash node for %v, restoring to %v", nodePath, originalPath)
+		_, err = db.CreateTrashNode(node.ID, username, originalPath, node.Isdir)
+		if err != nil {
+			// The original path might already be used by another trash node,
+			// the node can still be removed from the trash
+			log.Warnf("Could not add trash node for %v: %v", nodePath, err)
+			continue
+		}
+		repaired++
+	}
+
+	removed, err = db.DeleteDanglingShares()
+	if err != nil {
+		return repaired, err
+	}
+	repaired += int(removed)
+
+	removed, err = db.DeleteDanglingFavorites()
+	if err != nil {
+		return repaired, err
+	}
+	repaired += int(removed)
+
+	return repaired, nil
+}
+
+// detectMimeType guesses the mimetype of a file from its extension, or from its
+// content if the extension is unknown
+func detectMimeType(fileSystem fs.FileSystem, nodePath string) string {
+	mimetype := mime.TypeByExtension(path.Ext(nodePath))
+	if mimetype == "" {
+		mimetype = "application/octet-stream"
+		file, err := fileSystem.OpenFile(context.Background(), nodePath, os.O_RDONLY, 0)
+		if err == nil {
+			buffer := make([]byte, 512)
+			n, _ := file.Read(buffer)
+			file.Close()
+			mimetype = http.DetectContentType(buffer[:n])
+		}
+	}
+	// Strip parameters like the charset
+	if i := strings.Index(mimetype, ";"); i >= 0 {
+		mimetype = strings.TrimSpace(mimetype[:i])
+	}
+	return mimetype
+}
+
+// temporaryName matches the names of the temporary files written while a file is
+// uploaded through the web interface (.upload-*) or WebDAV (.<name>.part*), or
+// rewritten by the storage (.rewrite-*)
+var temporaryName = regexp.MustCompile(`^\.(upload-.*|rewrite-.*|.+\.part[0-9a-z]+)$`)
+
+// isTemporary checks if name is the name of a temporary file
+func isTemporary(name string) bool {
+	return temporaryName.MatchString(name)
+}
+
+// isInside checks if nodePath is one of the given paths, or a descendant of one
+func isInside(nodePath string, paths []string) bool {
+	for _, p := range paths {
+		if nodePath == p || strings.HasPrefix(nodePath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parents returns the paths of all the parents of the node at nodePath, up to and
+// including root
+func parents(nodePath, root string) []string {
+	result := make([]string, 0)
+	for nodePath != root {
+		i := strings.LastIndex(nodePath, "/")
+		if i < 0 {
+			break
+		}
+		nodePath = nodePath[:i]
+		result = append(result, nodePath)
+	}
+	return result
+}
@@ -0,0 +1,48 @@
+package scanner
+
+import "testing"
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		name      string
+		temporary bool
+	}{
+		{".upload-ixk3z1-photo.jpg", true},
+		{".photo.jpg.partixk3z1", true},
+		{".rewrite-photo.jpg", true},
+		{"photo.jpg", false},
+		{".hidden", false},
+		{".config.part", false},
+		{"report.part1", false},
+		{"upload-notes.txt", false},
+	}
+	for _, test := range tests {
+		if temporary := isTemporary(test.name); temporary != test.temporary {
+			t.Errorf("isTemporary(%q) = %v, want %v", test.name, temporary, test.temporary)
+		}
+	}
+}
+
+func TestParents(t *testing.T) {
+	tests := []struct {
+		path    string
+		parents []string
+	}{
+		{"alice", []string{}},
+		{"alice/files", []string{"alice"}},
+		{"alice/files/a/b.txt", []string{"alice/files/a", "alice/files", "alice"}},
+	}
+	for _, test := range tests {
+		parents := parents(test.path, "alice")
+		if len(parents) != len(test.parents) {
+			t.Errorf("parents(%q) = %v, want %v", test.path, parents, test.parents)
+			continue
+		}
+		for i := range parents {
+			if parents[i] != test.parents[i] {
+				t.Errorf("parents(%q) = %v, want %v", test.path, parents, test.parents)
+				break
+			}
+		}
+	}
+}
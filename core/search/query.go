@@ -0,0 +1,212 @@
+package search
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+// typeMimeTypes maps the values of the 'type:' filter to the mimetypes they match.
+// Mimetypes ending in a '/' match all mimetypes with that prefix.
+var typeMimeTypes = map[string][]string{
+	"image":    {"image/"},
+	"video":    {"video/"},
+	"audio":    {"audio/"},
+	"text":     {"text/"},
+	"pdf":      {"application/pdf"},
+	"document": {"application/pdf", "application/msword", "application/vnd.oasis.opendocument.", "application/vnd.openxmlformats-officedocument."},
+	"archive":  {"application/zip", "application/x-tar", "application/gzip", "application/x-gzip", "application/x-7z-compressed", "application/x-rar-compressed"},
+}
+
+// sizeUnits are the recognized size suffixes for the 'size:' filter
+var sizeUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+	"t":  1 << 40,
+	"tb": 1 << 40,
+}
+
+// dateLayouts are the accepted formats for the 'modified:' filter
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// query is a parsed search query
+type query struct {
+	nodeQuery db.NodeQuery
+}
+
+// parseQuery parses a search query. A query consists of space separated terms,
+// a term is either a filter in the form 'key:value' or a part of the node name.
+// Values containing spaces can be quoted. The supported filters are:
+//
+//	type:image|video|audio|text|pdf|document|archive|folder|file|<mimetype>
+//	size:[<|<=|>|>=]<number>[B|KB|MB|GB|TB]
+//	modified:[<|<=|>|>=]<date>
+//	owner:<username>
+//	is:shared|favorite
+func parseQuery(input string) (*query, error) {
+	q := &query{}
+	for _, term := range splitTerms(input) {
+		separatorIndex := strings.Index(term, ":")
+		if separatorIndex <= 0 {
+			q.nodeQuery.Names = append(q.nodeQuery.Names, term)
+			continue
+		}
+		key := strings.ToLower(term[:separatorIndex])
+		value := term[separatorIndex+1:]
+		if value == "" {
+			return nil, fmt.Errorf("Missing value for filter '%v'", key)
+		}
+		switch key {
+		case "type":
+			err := q.parseType(strings.ToLower(value))
+			if err != nil {
+				return nil, err
+			}
+		case "size":
+			c, err := parseSize(value)
+			if err != nil {
+				return nil, err
+			}
+			q.nodeQuery.Size = append(q.nodeQuery.Size, c)
+		case "modified", "mtime":
+			cs, err := parseModified(value)
+			if err != nil {
+				return nil, err
+			}
+			q.nodeQuery.Mtime = append(q.nodeQuery.Mtime, cs...)
+		case "owner":
+			q.nodeQuery.Owners = append(q.nodeQuery.Owners, value)
+		case "is":
+			switch strings.ToLower(value) {
+			case "shared":
+				q.nodeQuery.Shared = true
+			case "favorite", "favourite":
+				q.nodeQuery.Favorite = true
+			default:
+				return nil, fmt.Errorf("Unknown value for filter 'is': %v", value)
+			}
+		default:
+			// Not a known filter, search for the literal term instead
+			q.nodeQuery.Names = append(q.nodeQuery.Names, term)
+		}
+	}
+	return q, nil
+}
+
+// parseType adds the conditions for a 'type:' filter to the query
+func (q *query) parseType(value string) error {
+	switch value {
+	case "folder", "dir", "directory":
+		isDir := true
+		q.nodeQuery.IsDir = &isDir
+		return nil
+	case "file":
+		isDir := false
+		q.nodeQuery.IsDir = &isDir
+		return nil
+	}
+	if mimetypes, ok := typeMimeTypes[value]; ok {
+		q.nodeQuery.MimeTypes = append(q.nodeQuery.MimeTypes, mimetypes...)
+		return nil
+	}
+	if strings.Contains(value, "/") {
+		q.nodeQuery.MimeTypes = append(q.nodeQuery.MimeTypes, strings.TrimSuffix(value, "*"))
+		return nil
+	}
+	return fmt.Errorf("Unknown value for filter 'type': %v", value)
+}
+
+// parseSize parses the value of a 'size:' filter
+func parseSize(value string) (db.Comparison, error) {
+	operator, value := splitOperator(value)
+	value = strings.ToLower(value)
+	numberEnd := strings.IndexFunc(value, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	if numberEnd < 0 {
+		numberEnd = len(value)
+	}
+	unit, ok := sizeUnits[value[numberEnd:]]
+	if !ok {
+		return db.Comparison{}, fmt.Errorf("Unknown size unit: %v", value[numberEnd:])
+	}
+	number, err := strconv.ParseFloat(value[:numberEnd], 64)
+	if err != nil {
+		return db.Comparison{}, fmt.Errorf("Invalid size: %v", value)
+	}
+	return db.Comparison{Operator: operator, Value: int64(number * float64(unit))}, nil
+}
+
+// parseModified parses the value of a 'modified:' filter. Without an operator
+// the filter matches the entire day (or minute) described by the date.
+func parseModified(value string) ([]db.Comparison, error) {
+	operator, value := splitOperator(value)
+	for _, layout := range dateLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if operator != "=" {
+			return []db.Comparison{{Operator: operator, Value: t.Unix()}}, nil
+		}
+		end := t.AddDate(0, 0, 1)
+		if layout != "2006-01-02" {
+			end = t.Add(time.Minute)
+		}
+		return []db.Comparison{
+			{Operator: ">=", Value: t.Unix()},
+			{Operator: "<", Value: end.Unix()},
+		}, nil
+	}
+	return nil, fmt.Errorf("Invalid date: %v", value)
+}
+
+// splitOperator splits a comparison operator from the start of the value. If no
+// operator is present, '=' is returned.
+func splitOperator(value string) (string, string) {
+	for _, operator := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(value, operator) {
+			return operator, value[len(operator):]
+		}
+	}
+	return "=", value
+}
+
+// splitTerms splits the query in terms on whitespace, while keeping quoted
+// sections together. The quotes themselves are removed.
+func splitTerms(input string) []string {
+	terms := make([]string, 0)
+	var term []rune
+	inQuotes := false
+	for _, r := range input {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case unicode.IsSpace(r) && !inQuotes:
+			if len(term) > 0 {
+				terms = append(terms, string(term))
+				term = term[:0]
+			}
+		default:
+			term = append(term, r)
+		}
+	}
+	if len(term) > 0 {
+		terms = append(terms, string(term))
+	}
+	return terms
+}
@@ -0,0 +1,90 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+func TestParseQuery(t *testing.T) {
+	isDir, isFile := true, false
+	day := time.Date(2017, 3, 14, 0, 0, 0, 0, time.Local)
+	minute := time.Date(2017, 3, 14, 15, 9, 0, 0, time.Local)
+	tests := []struct {
+		input     string
+		nodeQuery db.NodeQuery
+		err       bool
+	}{
+		{"", db.NodeQuery{}, false},
+		{"holiday cat", db.NodeQuery{Names: []string{"holiday", "cat"}}, false},
+		{`"summer holiday"  cat`, db.NodeQuery{Names: []string{"summer holiday", "cat"}}, false},
+		{"type:image", db.NodeQuery{MimeTypes: []string{"image/"}}, false},
+		{"TYPE:PDF", db.NodeQuery{MimeTypes: []string{"application/pdf"}}, false},
+		{"type:folder", db.NodeQuery{IsDir: &isDir}, false},
+		{"type:file", db.NodeQuery{IsDir: &isFile}, false},
+		{"type:application/json", db.NodeQuery{MimeTypes: []string{"application/json"}}, false},
+		{"type:video/*", db.NodeQuery{MimeTypes: []string{"video/"}}, false},
+		{"type:spreadsheet", db.NodeQuery{}, true},
+		{"size:>1MB", db.NodeQuery{Size: []db.Comparison{{Operator: ">", Value: 1 << 20}}}, false},
+		{"size:<=1.5k", db.NodeQuery{Size: []db.Comparison{{Operator: "<=", Value: 1536}}}, false},
+		{"size:100", db.NodeQuery{Size: []db.Comparison{{Operator: "=", Value: 100}}}, false},
+		{"size:10PB", db.NodeQuery{}, true},
+		{"size:>big", db.NodeQuery{}, true},
+		{"modified:>=2017-03-14", db.NodeQuery{Mtime: []db.Comparison{{Operator: ">=", Value: day.Unix()}}}, false},
+		{"modified:2017-03-14", db.NodeQuery{Mtime: []db.Comparison{
+			{Operator: ">=", Value: day.Unix()},
+			{Operator: "<", Value: day.AddDate(0, 0, 1).Unix()},
+		}}, false},
+		{"mtime:2017-03-14T15:09", db.NodeQuery{Mtime: []db.Comparison{
+			{Operator: ">=", Value: minute.Unix()},
+			{Operator: "<", Value: minute.Add(time.Minute).Unix()},
+		}}, false},
+		{"modified:yesterday", db.NodeQuery{}, true},
+		{"owner:bob owner:carol", db.NodeQuery{Owners: []string{"bob", "carol"}}, false},
+		{"is:shared is:favourite", db.NodeQuery{Shared: true, Favorite: true}, false},
+		{"is:deleted", db.NodeQuery{}, true},
+		{"size:", db.NodeQuery{}, true},
+		// Unknown filters and terms starting with a colon are searched literally
+		{"note:todo :smile:", db.NodeQuery{Names: []string{"note:todo", ":smile:"}}, false},
+		{`cat type:image size:>100kb "is:shared"`, db.NodeQuery{
+			Names:     []string{"cat"},
+			MimeTypes: []string{"image/"},
+			Size:      []db.Comparison{{Operator: ">", Value: 100 << 10}},
+			Shared:    true,
+		}, false},
+	}
+	for _, test := range tests {
+		q, err := parseQuery(test.input)
+		if (err != nil) != test.err {
+			t.Errorf("parseQuery(%q) returned error %v, want error %v", test.input, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(q.nodeQuery, test.nodeQuery) {
+			t.Errorf("parseQuery(%q) = %+v, want %+v", test.input, q.nodeQuery, test.nodeQuery)
+		}
+	}
+}
+
+func TestSplitTerms(t *testing.T) {
+	tests := []struct {
+		input string
+		terms []string
+	}{
+		{"", []string{}},
+		{"  a\tb\nc ", []string{"a", "b", "c"}},
+		{`"a b" c`, []string{"a b", "c"}},
+		{`owner:"john doe"`, []string{"owner:john doe"}},
+		{`"unterminated quote`, []string{"unterminated quote"}},
+		{`""`, []string{}},
+	}
+	for _, test := range tests {
+		if terms := splitTerms(test.input); !reflect.DeepEqual(terms, test.terms) {
+			t.Errorf("splitTerms(%q) = %q, want %q", test.input, terms, test.terms)
+		}
+	}
+}
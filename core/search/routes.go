@@ -10,4 +10,7 @@ func RegisterRoutes(protectedMux *http.ServeMux, publicMux *http.ServeMux) {
 	log.Debug("Regestering search routes")
 
 	protectedMux.HandleFunc("/index.php/core/search", Search)
+
+	protectedMux.HandleFunc("/ocs/v1.php/apps/files/api/v1/search", OCSSearch)
+	protectedMux.HandleFunc("/ocs/v2.php/apps/files/api/v1/search", OCSSearch)
 }
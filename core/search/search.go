@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 
@@ -13,6 +12,14 @@ import (
 	db "github.com/gowncloud/gowncloud/database"
 )
 
+const (
+	// defaultPageSize is the amount of results returned if the client doesn't
+	// specify a page size, it matches the page size of the web UI
+	defaultPageSize = 30
+	// maxPageSize is the maximum amount of results returned in a single page
+	maxPageSize = 1000
+)
+
 // SearchResult contains information about a single result to be returned by a search
 type SearchResult struct {
 	Id          string `json:"id"`
@@ -27,80 +34,206 @@ type SearchResult struct {
 	Type        string `json:"type"`
 }
 
+type meta struct {
+	Status     string  `json:"status"`
+	StatusCode int     `json:"statuscode"`
+	Message    *string `json:"message"`
+}
+
+type ocsSearch struct {
+	Meta meta           `json:"meta"`
+	Data []SearchResult `json:"data"`
+}
+
+// sortFields maps the supported values of the sort parameter to the database
+// sort fields
+var sortFields = map[string]string{
+	"name":     db.SortByName,
+	"path":     db.SortByPath,
+	"size":     db.SortBySize,
+	"mtime":    db.SortByMtime,
+	"modified": db.SortByMtime,
+}
+
 // Search looks for all nodes the user has access to and gathers info about them
+// It is the endpoint for GET /index.php/core/search
 func Search(w http.ResponseWriter, r *http.Request) {
-	id := identity.CurrentSession(r)
-	q := r.URL.Query()
-
-	query := q.Get("query")
-	log.Debug("Looking for nodes with query ", query)
-	if strings.Contains(query, "/") {
-		response := []SearchResult{}
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(&response)
+	response, err := search(r)
+	if err != nil {
+		if err == db.ErrDB {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(&response)
+}
+
+// OCSSearch is the OCS version of the search endpoint. It accepts the same
+// parameters as Search.
+// It is the endpoint for GET /ocs/v{1,2}.php/apps/files/api/v1/search
+func OCSSearch(w http.ResponseWriter, r *http.Request) {
+	ocsResponse := struct {
+		Ocs ocsSearch `json:"ocs"`
+	}{}
+	ocsResponse.Ocs.Meta.Status = "ok"
+	ocsResponse.Ocs.Meta.StatusCode = 100
+	if strings.HasPrefix(r.URL.Path, "/ocs/v2.php/") {
+		ocsResponse.Ocs.Meta.StatusCode = 200
+	}
+
+	status := http.StatusOK
+	results, err := search(r)
+	if err != nil {
+		status = http.StatusBadRequest
+		if err == db.ErrDB {
+			status = http.StatusInternalServerError
+		}
+		message := err.Error()
+		ocsResponse.Ocs.Meta.Status = "failure"
+		ocsResponse.Ocs.Meta.StatusCode = status
+		ocsResponse.Ocs.Meta.Message = &message
+		results = make([]SearchResult, 0)
+	}
+	ocsResponse.Ocs.Data = results
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ocsResponse)
+}
+
+// search executes the search described by the query parameters of the request
+// and returns the requested page of results. Errors other than db.ErrDB are
+// caused by invalid parameters.
+func search(r *http.Request) ([]SearchResult, error) {
+	id := identity.CurrentSession(r)
+	params := r.URL.Query()
+
+	page, err := parsePositiveInt(params.Get("page"), 1)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid page: %v", params.Get("page"))
+	}
+	pageSize, err := parsePositiveInt(params.Get("size"), defaultPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid page size: %v", params.Get("size"))
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	sortField, ok := sortFields[strings.ToLower(params.Get("sort"))]
+	if !ok {
+		if params.Get("sort") != "" {
+			return nil, fmt.Errorf("Invalid sort field: %v", params.Get("sort"))
+		}
+		sortField = db.SortByName
+	}
+	order := strings.ToLower(params.Get("order"))
+	if order != "" && order != "asc" && order != "desc" {
+		return nil, fmt.Errorf("Invalid sort order: %v", params.Get("order"))
+	}
 
-	nodes, err := db.SearchNodesByName(query, id.Username, id.Organizations)
+	input := params.Get("query")
+	log.Debug("Looking for nodes with query ", input)
+	q, err := parseQuery(input)
+	if err != nil {
+		log.Debug("Invalid search query: ", err)
+		return nil, err
+	}
+	if len(q.nodeQuery.Names) == 0 && input == "" {
+		return make([]SearchResult, 0), nil
+	}
+	for _, name := range q.nodeQuery.Names {
+		if strings.Contains(name, "/") {
+			return make([]SearchResult, 0), nil
+		}
+	}
+	q.nodeQuery.User = id.Username
+	q.nodeQuery.Groups = id.Organizations
+	q.nodeQuery.Sort = sortField
+	q.nodeQuery.Descending = order == "desc"
+	q.nodeQuery.Limit = pageSize
+	q.nodeQuery.Offset = (page - 1) * pageSize
+
+	nodes, err := db.SearchNodes(&q.nodeQuery)
 	if err != nil {
 		log.Error("Failed to search for nodes: ", err)
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		return
+		return nil, err
 	}
-	response := make([]SearchResult, len(nodes))
+
+	results := make([]SearchResult, len(nodes))
 	for i, node := range nodes {
-		isShared := node.Path[:strings.Index(node.Path, "/")] == id.Username
-		nodeInfo, err := os.Stat(db.GetSetting(db.DAV_ROOT) + node.Path)
-		if err != nil {
-			log.Error("Could not get node info: ", err)
-			continue
-		}
-		var shareNode *db.Share
-		if isShared {
-			for _, target := range append(id.Organizations, id.Username) {
-				shareNode, err = db.GetNodeShareToTarget(node.ID, target)
-				if err != nil {
-					log.Errorf("Failed to get share on node %v to target %v", node.ID, target)
-					continue
-				}
-				if shareNode != nil {
-					break
-				}
+		results[i] = makeSearchResult(node, id)
+	}
+	return results, nil
+}
+
+// makeSearchResult generates the search result for a node
+func makeSearchResult(node *db.Node, id identity.Session) SearchResult {
+	var err error
+	isShared := node.Owner != id.Username
+	var shareNode *db.Share
+	if isShared {
+		for _, target := range append(id.Organizations, id.Username) {
+			shareNode, err = db.GetNodeShareToTarget(node.ID, target)
+			if err != nil {
+				log.Errorf("Failed to get share on node %v to target %v", node.ID, target)
+				continue
+			}
+			if shareNode != nil {
+				break
 			}
 		}
-		permissionString := "27"
-		if node.Isdir {
-			permissionString = "31"
-		}
-		if shareNode != nil {
-			permissionString = strconv.Itoa(shareNode.Permissions)
-		}
-		typeString := "file"
-		if node.Isdir {
-			typeString = "folder"
-		}
-		nodePath := node.Path[strings.Index(node.Path, "/")+1:]
-		nodePath = nodePath[strings.Index(nodePath, "/")+1:]
+	}
+	permissionString := "27"
+	if node.Isdir {
+		permissionString = "31"
+	}
+	if shareNode != nil {
+		permissionString = strconv.Itoa(shareNode.Permissions)
+	}
+	typeString := "file"
+	if node.Isdir {
+		typeString = "folder"
+	}
+	nodePath := node.Path[strings.Index(node.Path, "/")+1:]
+	nodePath = nodePath[strings.Index(nodePath, "/")+1:]
 
-		var linkDir string
-		if strings.Contains(nodePath, "/") {
-			linkDir = nodePath[:strings.LastIndex(nodePath, "/")]
-		}
-		link := fmt.Sprintf("/index.php/apps/files/?dir=/%v&scrollto=%v", linkDir, node.Path[strings.LastIndex(node.Path, "/")+1:])
-
-		sr := SearchResult{
-			Id:          strconv.FormatFloat(node.ID, 'e', -1, 64),
-			Link:        link,
-			Mime:        node.MimeType,
-			Modified:    strconv.Itoa(int(nodeInfo.ModTime().Unix())),
-			Name:        nodeInfo.Name(),
-			Path:        nodePath,
-			Permissions: permissionString,
-			Size:        strconv.Itoa(int(nodeInfo.Size())),
-			Type:        typeString,
-		}
-		response[i] = sr
+	var linkDir string
+	if strings.Contains(nodePath, "/") {
+		linkDir = nodePath[:strings.LastIndex(nodePath, "/")]
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(&response)
+	link := fmt.Sprintf("/index.php/apps/files/?dir=/%v&scrollto=%v", linkDir, node.Path[strings.LastIndex(node.Path, "/")+1:])
+
+	return SearchResult{
+		Id:          strconv.FormatInt(node.ID, 10),
+		Link:        link,
+		Mime:        node.MimeType,
+		MimeType:    node.MimeType,
+		Modified:    strconv.FormatInt(node.Mtime.Unix(), 10),
+		Name:        node.Path[strings.LastIndex(node.Path, "/")+1:],
+		Path:        nodePath,
+		Permissions: permissionString,
+		Size:        strconv.FormatInt(node.Size, 10),
+		Type:        typeString,
+	}
+}
+
+// parsePositiveInt parses a strictly positive integer. If the input is empty
+// the default value is returned.
+func parsePositiveInt(input string, defaultValue int) (int, error) {
+	if input == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(input)
+	if err != nil {
+		return 0, err
+	}
+	if value < 1 {
+		return 0, fmt.Errorf("%v is not a positive number", value)
+	}
+	return value, nil
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/gowncloud/gowncloud/core/maintenance"
 	db "github.com/gowncloud/gowncloud/database"
 )
 
@@ -19,7 +20,7 @@ func Status(w http.ResponseWriter, r *http.Request) {
 	version := db.GetSetting(db.VERSION)
 	response := &status{
 		Installed:     true,
-		Maintenance:   false,
+		Maintenance:   maintenance.Enabled(),
 		Edition:       "",
 		Version:       version,
 		VersionString: version,
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Activity is something a user did to a node, like creating, changing or sharing
+// it. An activity is shown to every user and group it affects, each with the
+// path of the node as they see it.
+type Activity struct {
+	ID int64
+	// Actor is the user who did it
+	Actor string
+	// Type groups the activities for filtering, e.g. file_created
+	Type string
+	// Subject tells what happened, e.g. created or shared_user
+	Subject string
+	// NodeID is the id of the node, which may no longer exist
+	NodeID int64
+	// ShareWith is the user or group a node was shared with or unshared from
+	ShareWith string
+	Time      time.Time
+	// Path is the path of the node in the files of the user reading the activity
+	Path string
+}
+
+// ActivityTarget is a user or group affected by an activity
+type ActivityTarget struct {
+	Target string
+	// Path is the path of the node in the files of the target
+	Path string
+}
+
+// ActivityQuery selects the activities shown to a user
+type ActivityQuery struct {
+	Username string
+	Groups   []string
+	// Types limits the activities to these types, all types if it is empty
+	Types []string
+	// Self only selects the activities of the user, Others only the activities
+	// of the other users
+	Self, Others bool
+	// Folder only selects the activities on the folder and the nodes in it, the
+	// path is relative to the files of the user
+	Folder string
+	// Since only selects the activities after the activity with this id, in the
+	// sort order. 0 starts at the first activity.
+	Since int64
+	// Ascending returns the oldest activities first
+	Ascending bool
+	Limit     int
+}
+
+// CreateActivity saves an activity for its targets. The id and time of the
+// activity are set.
+func CreateActivity(activity *Activity, targets []ActivityTarget) error {
+	return WithTx(func(tx *Tx) error {
+		activity.Time = time.Now()
+		err := tx.tx.QueryRow("INSERT INTO gowncloud.activities (actor, type, subject, nodeid, sharewith, time) "+
+			"VALUES ($1, $2, $3, $4, $5, $6) RETURNING activityid", activity.Actor, activity.Type, activity.Subject,
+			activity.NodeID, activity.ShareWith, activity.Time).Scan(&activity.ID)
+		if err != nil {
+			log.Error("Failed to save activity: ", err)
+			return ErrDB
+		}
+		for _, target := range targets {
+			_, err = tx.tx.Exec("INSERT INTO gowncloud.activitytargets (activityid, target, path) "+
+				"VALUES ($1, $2, $3) ON CONFLICT (activityid, target) DO NOTHING", activity.ID, target.Target, target.Path)
+			if err != nil {
+				log.Error("Failed to save activity target: ", err)
+				return ErrDB
+			}
+		}
+		return nil
+	})
+}
+
+// GetActivities returns the activities matching the query, newest first unless
+// the query is ascending. An activity affecting the user in multiple ways, e.g.
+// through a share to him and one to his group, is only returned once.
+func GetActivities(q *ActivityQuery) ([]*Activity, error) {
+	qb := &queryBuilder{}
+	qb.where("(" + shareTargetCondition(qb, "t.target", q.Username, q.Groups) + ")")
+	if len(q.Types) > 0 {
+		types := make([]string, len(q.Types))
+		for i, activityType := range q.Types {
+			types[i] = qb.arg(activityType)
+		}
+		qb.where("a.type IN (" + strings.Join(types, ", ") + ")")
+	}
+	if q.Self {
+		qb.where("a.actor = " + qb.arg(q.Username))
+	}
+	if q.Others {
+		qb.where("a.actor != " + qb.arg(q.Username))
+	}
+	if q.Folder != "" && q.Folder != "/" {
+		folder := strings.TrimSuffix(q.Folder, "/")
+		prefix := qb.arg(folder + "/")
+		qb.where("(t.path = " + qb.arg(folder) + " OR substr(t.path, 1, length(" + prefix + ")) = " + prefix + ")")
+	}
+	order := "DESC"
+	if q.Ascending {
+		order = "ASC"
+		if q.Since > 0 {
+			qb.where("a.activityid > " + qb.arg(q.Since))
+		}
+	} else if q.Since > 0 {
+		qb.where("a.activityid < " + qb.arg(q.Since))
+	}
+	limit := ""
+	if q.Limit > 0 {
+		limit = " LIMIT " + qb.arg(q.Limit)
+	}
+	rows, err := db.Query("SELECT a.activityid, a.actor, a.type, a.subject, a.nodeid, a.sharewith, a.time, MIN(t.path) "+
+		"FROM gowncloud.activities a JOIN gowncloud.activitytargets t ON t.activityid = a.activityid "+
+		"WHERE "+strings.Join(qb.conditions, " AND ")+" "+
+		"GROUP BY a.activityid, a.actor, a.type, a.subject, a.nodeid, a.sharewith, a.time "+
+		"ORDER BY a.activityid "+order+limit, qb.args...)
+	if err != nil {
+		log.Error("Failed to get activities: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	activities := make([]*Activity, 0)
+	for rows.Next() {
+		activity := &Activity{}
+		err = rows.Scan(&activity.ID, &activity.Actor, &activity.Type, &activity.Subject, &activity.NodeID,
+			&activity.ShareWith, &activity.Time, &activity.Path)
+		if err != nil {
+			log.Error("Error while reading activities: ", err)
+			return nil, ErrDB
+		}
+		activities = append(activities, activity)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Error while reading the activity rows: ", err)
+		return nil, ErrDB
+	}
+	return activities, nil
+}
+
+// GetSharesOnAncestors returns the shares of the node and of the directories
+// above it, they give access to the node
+func GetSharesOnAncestors(nodeId int64) ([]*Share, error) {
+	rows, err := db.Query("WITH RECURSIVE ancestors (nodeid, parentid) AS ("+
+		"SELECT nodeid, parentid FROM gowncloud.nodes WHERE nodeid = $1 UNION ALL "+
+		"SELECT n.nodeid, n.parentid FROM gowncloud.nodes n, ancestors a WHERE n.nodeid = a.parentid) "+
+		"SELECT "+shareColumns+" FROM gowncloud.shares WHERE nodeid IN (SELECT nodeid FROM ancestors) ORDER BY shareid", nodeId)
+	if err != nil {
+		log.Error("Failed to get the shares above the node: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	return readSharesRows(rows)
+}
+
+// deleteActivitiesOfTarget removes a user or group from the targets of the
+// activities, and removes the activities which no longer have targets
+func deleteActivitiesOfTarget(target string) error {
+	_, err := db.Exec("DELETE FROM gowncloud.activitytargets WHERE target = $1", target)
+	if err != nil {
+		log.Error("Failed to delete the activities of the user: ", err)
+		return ErrDB
+	}
+	_, err = db.Exec("DELETE FROM gowncloud.activities WHERE activityid NOT IN (" +
+		"SELECT activityid FROM gowncloud.activitytargets)")
+	if err != nil {
+		log.Error("Failed to delete the activities of the user: ", err)
+		return ErrDB
+	}
+	return nil
+}
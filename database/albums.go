@@ -0,0 +1,274 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Album is a user defined collection of photos. The photos are referenced by
+// node id, so an album can combine photos from different folders and shares.
+type Album struct {
+	ID      int64
+	Owner   string
+	Name    string
+	Created time.Time
+}
+
+// AlbumShare gives a user or group access to an album and the photos in it
+type AlbumShare struct {
+	AlbumID   int64
+	Target    string
+	ShareType int
+	Time      time.Time
+}
+
+// CreateAlbum creates an empty album
+func CreateAlbum(owner, name string) (*Album, error) {
+	var albumId int64
+	err := db.QueryRow("INSERT INTO gowncloud.albums (owner, name, created) VALUES ($1, $2, $3) "+
+		"RETURNING albumid", owner, name, time.Now()).Scan(&albumId)
+	if err != nil {
+		log.Error("Failed to create album: ", err)
+		return nil, ErrDB
+	}
+	return GetAlbum(albumId)
+}
+
+// GetAlbum returns the album with the id, or nil if it doesn't exist
+func GetAlbum(albumId int64) (*Album, error) {
+	row := db.QueryRow("SELECT albumid, owner, name, created FROM gowncloud.albums "+
+		"WHERE albumid = $1", albumId)
+	album, err := scanAlbum(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Error("Failed to get album: ", err)
+		return nil, ErrDB
+	}
+	return album, nil
+}
+
+// GetAlbumsForUser returns the albums owned by the user, followed by the albums
+// shared with the user or one of the groups
+func GetAlbumsForUser(username string, groups []string) ([]*Album, error) {
+	qb := &queryBuilder{}
+	user := qb.arg(username)
+	rows, err := db.Query("SELECT albumid, owner, name, created FROM gowncloud.albums a WHERE "+
+		"a.owner = "+user+" OR EXISTS (SELECT 1 FROM gowncloud.albumshares s WHERE "+
+		"s.albumid = a.albumid AND ("+shareTargetCondition(qb, "s.target", username, groups)+")) "+
+		"ORDER BY a.owner != "+user+", lower(a.name), a.albumid", qb.args...)
+	if err != nil {
+		log.Error("Failed to get albums: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	albums := make([]*Album, 0)
+	for rows.Next() {
+		album, err := scanAlbum(rows)
+		if err != nil {
+			log.Error("Error while reading albums: ", err)
+			return nil, ErrDB
+		}
+		albums = append(albums, album)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Error while reading the album rows: ", err)
+		return nil, ErrDB
+	}
+	return albums, nil
+}
+
+// CanViewAlbum checks if the user owns the album, or if it is shared with the
+// user or one of the groups
+func CanViewAlbum(albumId int64, username string, groups []string) (bool, error) {
+	qb := &queryBuilder{}
+	album := qb.arg(albumId)
+	user := qb.arg(username)
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM gowncloud.albums a WHERE a.albumid = "+album+
+		" AND (a.owner = "+user+" OR EXISTS (SELECT 1 FROM gowncloud.albumshares s WHERE "+
+		"s.albumid = a.albumid AND ("+shareTargetCondition(qb, "s.target", username, groups)+"))))",
+		qb.args...).Scan(&exists)
+	if err != nil {
+		log.Error("Failed to check access to album: ", err)
+		return false, ErrDB
+	}
+	return exists, nil
+}
+
+// RenameAlbum changes the name of the album
+func RenameAlbum(albumId int64, name string) error {
+	_, err := db.Exec("UPDATE gowncloud.albums SET name = $1 WHERE albumid = $2", name, albumId)
+	if err != nil {
+		log.Error("Failed to rename album: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// DeleteAlbum removes the album with its shares. The photos are not removed.
+func DeleteAlbum(albumId int64) error {
+	for _, table := range []string{"albumitems", "albumshares", "albums"} {
+		_, err := db.Exec("DELETE FROM gowncloud."+table+" WHERE albumid = $1", albumId)
+		if err != nil {
+			log.Errorf("Failed to delete album from %v: %v", table, err)
+			return ErrDB
+		}
+	}
+	return nil
+}
+
+// GetAlbumItems returns the nodes in the album, in the order of the album
+func GetAlbumItems(albumId int64) ([]*Node, error) {
+	rows, err := db.Query("SELECT "+prefixColumns("n.", nodeColumns)+" FROM gowncloud.nodes n, "+
+		"gowncloud.albumitems i WHERE i.nodeid = n.nodeid AND i.albumid = $1 "+
+		"ORDER BY i.position, n.name, n.nodeid", albumId)
+	if err != nil {
+		log.Error("Failed to get album items: ", err)
+		return nil, ErrDB
+	}
+	if rows == nil {
+		log.Error("Error loading nodes")
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	return readNodeRows(db, rows)
+}
+
+// AddAlbumItems appends the nodes to the end of the album. Nodes which are
+// already in the album keep their position.
+func AddAlbumItems(albumId int64, nodeIds []int64) error {
+	for _, nodeId := range nodeIds {
+		_, err := db.Exec("INSERT INTO gowncloud.albumitems (albumid, nodeid, position) "+
+			"SELECT $1, $2, COALESCE(MAX(position), -1) + 1 FROM gowncloud.albumitems WHERE albumid = $1 "+
+			"ON CONFLICT (albumid, nodeid) DO NOTHING", albumId, nodeId)
+		if err != nil {
+			log.Error("Failed to add item to album: ", err)
+			return ErrDB
+		}
+	}
+	return nil
+}
+
+// RemoveAlbumItem removes the node from the album
+func RemoveAlbumItem(albumId, nodeId int64) error {
+	_, err := db.Exec("DELETE FROM gowncloud.albumitems WHERE albumid = $1 AND nodeid = $2",
+		albumId, nodeId)
+	if err != nil {
+		log.Error("Failed to remove item from album: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// ReorderAlbum puts the nodes first in the album, in the given order. The other
+// items of the album follow in their current order.
+func ReorderAlbum(albumId int64, nodeIds []int64) error {
+	_, err := db.Exec("UPDATE gowncloud.albumitems SET position = position + $1 WHERE albumid = $2",
+		len(nodeIds), albumId)
+	if err != nil {
+		log.Error("Failed to reorder album: ", err)
+		return ErrDB
+	}
+	for position, nodeId := range nodeIds {
+		_, err = db.Exec("UPDATE gowncloud.albumitems SET position = $1 WHERE albumid = $2 AND nodeid = $3",
+			position, albumId, nodeId)
+		if err != nil {
+			log.Error("Failed to reorder album: ", err)
+			return ErrDB
+		}
+	}
+	return nil
+}
+
+// ShareAlbum shares the album with a user or group, sharetype is USERSHARE or
+// GROUPSHARE
+func ShareAlbum(albumId int64, target string, sharetype int) error {
+	_, err := db.Exec("INSERT INTO gowncloud.albumshares (albumid, target, sharetype, time) "+
+		"VALUES ($1, $2, $3, $4) ON CONFLICT (albumid, target) DO NOTHING",
+		albumId, target, sharetype, time.Now())
+	if err != nil {
+		log.Error("Failed to share album: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// UnshareAlbum removes the share of the album with the target
+func UnshareAlbum(albumId int64, target string) error {
+	_, err := db.Exec("DELETE FROM gowncloud.albumshares WHERE albumid = $1 AND target = $2",
+		albumId, target)
+	if err != nil {
+		log.Error("Failed to unshare album: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// GetAlbumShares returns the shares of the album
+func GetAlbumShares(albumId int64) ([]*AlbumShare, error) {
+	rows, err := db.Query("SELECT albumid, target, sharetype, time FROM gowncloud.albumshares "+
+		"WHERE albumid = $1 ORDER BY target", albumId)
+	if err != nil {
+		log.Error("Failed to get album shares: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	shares := make([]*AlbumShare, 0)
+	for rows.Next() {
+		share := &AlbumShare{}
+		err = rows.Scan(&share.AlbumID, &share.Target, &share.ShareType, &share.Time)
+		if err != nil {
+			log.Error("Error while reading album shares: ", err)
+			return nil, ErrDB
+		}
+		shares = append(shares, share)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Error while reading the album share rows: ", err)
+		return nil, ErrDB
+	}
+	return shares, nil
+}
+
+// IsInSharedAlbum checks if the node is in an album the user can view, which
+// gives the user access to the photo even if the file isn't shared with him
+func IsInSharedAlbum(nodeId int64, username string, groups []string) (bool, error) {
+	qb := &queryBuilder{}
+	node := qb.arg(nodeId)
+	user := qb.arg(username)
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM gowncloud.albumitems i, gowncloud.albums a WHERE "+
+		"i.albumid = a.albumid AND i.nodeid = "+node+" AND (a.owner = "+user+" OR EXISTS ("+
+		"SELECT 1 FROM gowncloud.albumshares s WHERE s.albumid = a.albumid AND ("+
+		shareTargetCondition(qb, "s.target", username, groups)+"))))", qb.args...).Scan(&exists)
+	if err != nil {
+		log.Error("Failed to check if node is in a shared album: ", err)
+		return false, ErrDB
+	}
+	return exists, nil
+}
+
+// scanAlbum reads a single album
+func scanAlbum(row rowScanner) (*Album, error) {
+	album := &Album{}
+	err := row.Scan(&album.ID, &album.Owner, &album.Name, &album.Created)
+	if err != nil {
+		return nil, err
+	}
+	return album, nil
+}
+
+// prefixColumns prefixes every column in a comma separated list with the table
+// alias, for queries joining tables with the same column names
+func prefixColumns(prefix, columns string) string {
+	names := strings.Split(columns, ", ")
+	for i, name := range names {
+		names[i] = prefix + name
+	}
+	return strings.Join(names, ", ")
+}
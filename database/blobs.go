@@ -0,0 +1,84 @@
+package db
+
+import (
+	log "github.com/Sirupsen/logrus"
+)
+
+// BlobStats summarizes the content stored in the deduplicating blob store
+type BlobStats struct {
+	// Blobs is the amount of stored blobs
+	Blobs int64
+	// References is the amount of files referencing a blob
+	References int64
+	// StoredSize is the size in bytes of the stored blobs
+	StoredSize int64
+	// ReferencedSize is the size in bytes of the files referencing a blob, as
+	// they would be stored without deduplication
+	ReferencedSize int64
+}
+
+// ReferenceBlob counts a new reference to the blob with the given hash, adding
+// the blob if it is not known yet
+func ReferenceBlob(hash string, size int64) error {
+	_, err := db.Exec("INSERT INTO gowncloud.blobs (hash, size, refcount) VALUES ($1, $2, 1) "+
+		"ON CONFLICT (hash) DO UPDATE SET refcount = gowncloud.blobs.refcount + 1", hash, size)
+	if err != nil {
+		log.Error("Failed to reference blob: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// ReleaseBlob removes a reference to the blob with the given hash. The blob
+// itself is only removed by the garbage collection.
+func ReleaseBlob(hash string) error {
+	_, err := db.Exec("UPDATE gowncloud.blobs SET refcount = refcount - 1 WHERE hash = $1 AND refcount > 0", hash)
+	if err != nil {
+		log.Error("Failed to release blob: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// SetBlobReferences replaces the reference counts of all blobs by the counted
+// references, which map the hashes of the referenced blobs to their amount of
+// references. Blobs missing from references are left without references.
+func SetBlobReferences(references map[string]int64, sizes map[string]int64) error {
+	_, err := db.Exec("UPDATE gowncloud.blobs SET refcount = 0 WHERE refcount != 0")
+	if err != nil {
+		log.Error("Failed to reset blob references: ", err)
+		return ErrDB
+	}
+	for hash, count := range references {
+		_, err = db.Exec("INSERT INTO gowncloud.blobs (hash, size, refcount) VALUES ($1, $2, $3) "+
+			"ON CONFLICT (hash) DO UPDATE SET refcount = excluded.refcount", hash, sizes[hash], count)
+		if err != nil {
+			log.Error("Failed to set blob references: ", err)
+			return ErrDB
+		}
+	}
+	return nil
+}
+
+// DeleteBlob removes a blob which is no longer stored
+func DeleteBlob(hash string) error {
+	_, err := db.Exec("DELETE FROM gowncloud.blobs WHERE hash = $1", hash)
+	if err != nil {
+		log.Error("Failed to delete blob: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// GetBlobStats returns the statistics of the blob store
+func GetBlobStats() (*BlobStats, error) {
+	stats := &BlobStats{}
+	err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(refcount), 0), COALESCE(SUM(size), 0), "+
+		"COALESCE(SUM(size * refcount), 0) FROM gowncloud.blobs").Scan(
+		&stats.Blobs, &stats.References, &stats.StoredSize, &stats.ReferencedSize)
+	if err != nil {
+		log.Error("Failed to get blob statistics: ", err)
+		return nil, ErrDB
+	}
+	return stats, nil
+}
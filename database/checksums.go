@@ -0,0 +1,52 @@
+package db
+
+import (
+	"database/sql"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FileChecksums are the checksums of the content of a file node, as hex encoded
+// digests
+type FileChecksums struct {
+	NodeID int64
+	// Etag is the etag of the node when the checksums were computed
+	Etag    string
+	SHA1    string
+	MD5     string
+	Adler32 string
+}
+
+// SaveChecksums stores the checksums of a file, replacing the checksums of an
+// earlier version of the file
+func SaveChecksums(checksums *FileChecksums) error {
+	_, err := db.Exec("INSERT INTO gowncloud.checksums (nodeid, etag, sha1, md5, adler32) "+
+		"VALUES ($1, $2, $3, $4, $5) ON CONFLICT (nodeid) DO UPDATE SET "+
+		"etag = excluded.etag, sha1 = excluded.sha1, md5 = excluded.md5, adler32 = excluded.adler32",
+		checksums.NodeID, checksums.Etag, checksums.SHA1, checksums.MD5, checksums.Adler32)
+	if err != nil {
+		log.Error("Failed to save checksums: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// GetChecksums returns the checksums of the current version of the node. It
+// returns nil if no checksums are stored, or if they belong to an older version
+// of the file.
+func GetChecksums(node *Node) (*FileChecksums, error) {
+	checksums := &FileChecksums{}
+	err := db.QueryRow("SELECT nodeid, etag, sha1, md5, adler32 FROM gowncloud.checksums WHERE nodeid = $1",
+		node.ID).Scan(&checksums.NodeID, &checksums.Etag, &checksums.SHA1, &checksums.MD5, &checksums.Adler32)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Error("Failed to get checksums: ", err)
+		return nil, ErrDB
+	}
+	if checksums.Etag != node.Etag {
+		return nil, nil
+	}
+	return checksums, nil
+}
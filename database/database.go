@@ -11,37 +11,51 @@ import (
 )
 
 var (
-	db          *sql.DB
+	db          *database
 	initialized bool
 
 	ErrDB = errors.New("Internal database error")
 )
 
-// Connect opens a database connection
-func Connect(driver, databaseurl string) {
-	var err error
-
+// Connect opens a database connection. The scheme of the database url selects
+// the database: cockroachdb://, postgres:// or sqlite://path/to/file.db. A
+// postgres:// url pointing to a CockroachDB server is used as CockroachDB.
+func Connect(databaseurl string) {
 	if db != nil {
 		log.Debug("Already connected to the database")
 		return
 	}
 
+	d, dataSource, err := dialectFor(databaseurl)
+	if err != nil {
+		log.Fatal("Invalid database url: ", err)
+	}
+
+	var conn *sql.DB
 	for {
-		db, err = sql.Open(driver, databaseurl)
+		conn, err = sql.Open(d.driver, dataSource)
 		if err != nil {
-			log.Error("Failed to connect to database: ", err)
+			log.Fatal("Failed to connect to database: ", err)
 		}
-		err = db.Ping()
+		err = conn.Ping()
 		if err == nil {
 			break
 		}
+		conn.Close()
 		log.Errorln("Failed to open database,", err, "- retry in 5 seconds")
 		time.Sleep(5 * time.Second)
 	}
+	if d == postgresDialect && isCockroachDB(conn) {
+		d = cockroachDialect
+	}
+	db = &database{DB: conn, dialect: d}
 
-	log.Info("Connected to database")
+	log.Info("Connected to ", d.name, " database")
 }
 
+// Initialize creates the gowncloud database if it doesn't exist, applies the
+// pending schema migrations and loads the settings. It refuses to continue if
+// the database schema is newer than this version of gowncloud supports.
 func Initialize() {
 	if db == nil {
 		log.Error("Not connected to database")
@@ -53,20 +67,18 @@ func Initialize() {
 	}
 
 	log.Info("Initializing database")
-	_, err := db.Exec("CREATE DATABASE IF NOT EXISTS gowncloud")
+	if db.dialect.createNamespace != "" {
+		_, err := db.Exec(db.dialect.createNamespace)
+		if err != nil {
+			log.Fatal("Failed to create gowncloud database: ", err)
+		}
+	}
+	// Bring the schema up to date before anything is read from it
+	err := Migrate()
 	if err != nil {
-		log.Fatal("Failed to create gowncloud database: ", err)
+		log.Fatal("Failed to migrate the database schema: ", err)
 	}
-	// init settings first because they might be required to provide default values
-	initSettings()
-
-	// init tables without foreign keys
-	initUsers()
-	initNodes()
-	// init tables with foreign keys to tables without foreign keys
-	initShares()
-	initTrashNodes()
-	initFavorites()
+	loadSettings()
 
 	initialized = true
 	log.Info("Database initialized")
@@ -0,0 +1,213 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The queries of the database package are written for CockroachDB. A dialect
+// adapts them to the database in use.
+type dialect struct {
+	// name identifies the database in the logs
+	name string
+	// driver is the database/sql driver used to connect
+	driver string
+	// createNamespace creates the database or schema holding the gowncloud
+	// tables, it is empty if the tables are not in a separate namespace
+	createNamespace string
+	// rewrite adapts a query to the database
+	rewrite func(query string) string
+	// contains returns the condition that a text column contains s, ignoring case
+	contains func(qb *queryBuilder, column, s string) string
+}
+
+// ErrUnsupportedDatabase is returned for a database url with an unknown scheme
+var ErrUnsupportedDatabase = errors.New("Unsupported database, use a cockroachdb://, postgres:// or sqlite:// url")
+
+// ErrNoSQLiteSupport is returned for a sqlite url if gowncloud was built without
+// the SQLite driver
+var ErrNoSQLiteSupport = errors.New("gowncloud was built without SQLite support, build it with '-tags sqlite'")
+
+var cockroachDialect = &dialect{
+	name:            "CockroachDB",
+	driver:          "postgres",
+	createNamespace: "CREATE DATABASE IF NOT EXISTS gowncloud",
+	rewrite:         func(query string) string { return query },
+	contains: func(qb *queryBuilder, column, s string) string {
+		return "strpos(lower(" + column + "), lower(" + qb.arg(s) + ")) > 0"
+	},
+}
+
+// postgresInt matches the INT type, which is 64 bits on CockroachDB but only 32
+// bits on PostgreSQL
+var postgresInt = regexp.MustCompile(`\bINT\b`)
+
+// postgresDialect differs from CockroachDB in keeping the tables in a schema,
+// which is addressed the same way as a CockroachDB database, and in the size of
+// INT
+var postgresDialect = &dialect{
+	name:            "PostgreSQL",
+	driver:          "postgres",
+	createNamespace: "CREATE SCHEMA IF NOT EXISTS gowncloud",
+	rewrite: func(query string) string {
+		if strings.HasPrefix(query, "CREATE") || strings.HasPrefix(query, "ALTER") {
+			// Sizes and quotas pass 2 GiB
+			query = postgresInt.ReplaceAllString(query, "BIGINT")
+		}
+		return query
+	},
+	contains: cockroachDialect.contains,
+}
+
+var (
+	sqliteNamespace   = regexp.MustCompile(`\bgowncloud\.`)
+	sqlitePlaceholder = regexp.MustCompile(`\$(\d+)`)
+	sqliteSerial      = regexp.MustCompile(`\bSERIAL\b`)
+	sqliteTimestamp   = regexp.MustCompile(`\bTIMESTAMPTZ\b`)
+)
+
+// sqliteDialect keeps the tables in the main database of the file, and replaces
+// the types and functions SQLite doesn't know
+var sqliteDialect = &dialect{
+	name:   "SQLite",
+	driver: "sqlite3",
+	rewrite: func(query string) string {
+		query = sqliteNamespace.ReplaceAllString(query, "")
+		query = sqlitePlaceholder.ReplaceAllString(query, "?$1")
+		if strings.HasPrefix(query, "CREATE") || strings.HasPrefix(query, "ALTER") {
+			// An INTEGER PRIMARY KEY is generated by SQLite like a SERIAL
+			query = sqliteSerial.ReplaceAllString(query, "INTEGER")
+			// The driver only converts columns declared as TIMESTAMP to time.Time
+			query = sqliteTimestamp.ReplaceAllString(query, "TIMESTAMP")
+			if strings.Contains(query, "ADD COLUMN") {
+				// Only constant defaults are allowed for added columns. Columns are
+				// only added by migrations for tables created by older versions, so
+				// they are always added to an empty table.
+				query = strings.Replace(query, "ADD COLUMN IF NOT EXISTS", "ADD COLUMN", -1)
+				query = strings.Replace(query, "DEFAULT now()", "DEFAULT '1970-01-01 00:00:00+00:00'", -1)
+			}
+			// SQLite drops columns without IF EXISTS, the migrations only drop
+			// columns they know exist
+			query = strings.Replace(query, "DROP COLUMN IF EXISTS", "DROP COLUMN", -1)
+			query = strings.Replace(query, "DEFAULT now()", "DEFAULT CURRENT_TIMESTAMP", -1)
+		}
+		return query
+	},
+	contains: func(qb *queryBuilder, column, s string) string {
+		return "instr(lower(" + column + "), lower(" + qb.arg(s) + ")) > 0"
+	},
+}
+
+// dialectFor returns the dialect for a database url, and the data source name to
+// connect with. A postgres:// url is used for both CockroachDB and PostgreSQL,
+// which are told apart once connected.
+func dialectFor(databaseurl string) (*dialect, string, error) {
+	u, err := url.Parse(databaseurl)
+	if err != nil {
+		return nil, "", err
+	}
+	switch u.Scheme {
+	case "cockroachdb", "cockroach":
+		u.Scheme = "postgres"
+		return cockroachDialect, u.String(), nil
+	case "postgres", "postgresql":
+		return postgresDialect, u.String(), nil
+	case "sqlite", "sqlite3":
+		if !driverRegistered(sqliteDialect.driver) {
+			return nil, "", ErrNoSQLiteSupport
+		}
+		// sqlite://relative/path.db and sqlite:///absolute/path.db
+		path := u.Host + u.Path
+		options := u.Query()
+		for key, value := range map[string]string{
+			// Enforce the REFERENCES constraints like the other databases
+			"_foreign_keys": "1",
+			// LIKE is case sensitive for paths, like in the other databases
+			"_case_sensitive_like": "1",
+			// Wait for other connections instead of failing while they write
+			"_busy_timeout": "5000",
+			"_journal_mode": "WAL",
+			"_txlock":       "immediate",
+		} {
+			if options.Get(key) == "" {
+				options.Set(key, value)
+			}
+		}
+		return sqliteDialect, "file:" + path + "?" + options.Encode(), nil
+	}
+	return nil, "", ErrUnsupportedDatabase
+}
+
+// driverRegistered checks if the database/sql driver with the given name is
+// compiled in
+func driverRegistered(name string) bool {
+	for _, driver := range sql.Drivers() {
+		if driver == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isCockroachDB checks if the database connected to with the postgres driver is
+// CockroachDB
+func isCockroachDB(conn *sql.DB) bool {
+	var version string
+	err := conn.QueryRow("SELECT version()").Scan(&version)
+	return err == nil && strings.Contains(version, "CockroachDB")
+}
+
+// database is the connection to the database, rewriting the queries for its dialect
+type database struct {
+	*sql.DB
+	dialect *dialect
+}
+
+func (d *database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer observeQuery(time.Now(), "exec")
+	return d.DB.Exec(d.dialect.rewrite(query), args...)
+}
+
+func (d *database) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	defer observeQuery(time.Now(), "query")
+	return d.DB.Query(d.dialect.rewrite(query), args...)
+}
+
+func (d *database) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer observeQuery(time.Now(), "query")
+	return d.DB.QueryRow(d.dialect.rewrite(query), args...)
+}
+
+// Begin starts a transaction, rewriting its queries like the database does
+func (d *database) Begin() (*transaction, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{Tx: tx, dialect: d.dialect}, nil
+}
+
+// transaction is a database transaction rewriting the queries for its dialect
+type transaction struct {
+	*sql.Tx
+	dialect *dialect
+}
+
+func (t *transaction) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer observeQuery(time.Now(), "exec")
+	return t.Tx.Exec(t.dialect.rewrite(query), args...)
+}
+
+func (t *transaction) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	defer observeQuery(time.Now(), "query")
+	return t.Tx.Query(t.dialect.rewrite(query), args...)
+}
+
+func (t *transaction) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer observeQuery(time.Now(), "query")
+	return t.Tx.QueryRow(t.dialect.rewrite(query), args...)
+}
@@ -0,0 +1,99 @@
+package db
+
+import "testing"
+
+func TestSQLiteRewrite(t *testing.T) {
+	tests := []struct {
+		query     string
+		rewritten string
+	}{
+		{
+			"SELECT * FROM gowncloud.nodes WHERE nodeid = $1 AND owner = $12",
+			"SELECT * FROM nodes WHERE nodeid = ?1 AND owner = ?12",
+		},
+		{
+			"CREATE TABLE IF NOT EXISTS gowncloud.shares (shareid SERIAL UNIQUE PRIMARY KEY, time TIMESTAMPTZ NOT NULL DEFAULT now())",
+			"CREATE TABLE IF NOT EXISTS shares (shareid INTEGER UNIQUE PRIMARY KEY, time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)",
+		},
+		{
+			"ALTER TABLE gowncloud.nodes ADD COLUMN IF NOT EXISTS mtime TIMESTAMPTZ NOT NULL DEFAULT now()",
+			"ALTER TABLE nodes ADD COLUMN mtime TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00+00:00'",
+		},
+		{
+			"ALTER TABLE gowncloud.nodes DROP COLUMN IF EXISTS checksum",
+			"ALTER TABLE nodes DROP COLUMN checksum",
+		},
+		{
+			// Only schema changes have their types rewritten
+			"SELECT 'SERIAL', 'TIMESTAMPTZ' FROM gowncloud.settings",
+			"SELECT 'SERIAL', 'TIMESTAMPTZ' FROM settings",
+		},
+		{
+			// Only the namespace of the tables is removed
+			"SELECT mygowncloud.x FROM gowncloud.users",
+			"SELECT mygowncloud.x FROM users",
+		},
+	}
+	for _, test := range tests {
+		if rewritten := sqliteDialect.rewrite(test.query); rewritten != test.rewritten {
+			t.Errorf("rewrite(%q) = %q, want %q", test.query, rewritten, test.rewritten)
+		}
+	}
+}
+
+func TestPostgresRewrite(t *testing.T) {
+	tests := []struct {
+		query     string
+		rewritten string
+	}{
+		{
+			"CREATE TABLE IF NOT EXISTS gowncloud.blobs (hash TEXT PRIMARY KEY, size INT NOT NULL, refcount INT NOT NULL DEFAULT 0)",
+			"CREATE TABLE IF NOT EXISTS gowncloud.blobs (hash TEXT PRIMARY KEY, size BIGINT NOT NULL, refcount BIGINT NOT NULL DEFAULT 0)",
+		},
+		{
+			"ALTER TABLE gowncloud.nodes ADD COLUMN IF NOT EXISTS size INT NOT NULL DEFAULT 0",
+			"ALTER TABLE gowncloud.nodes ADD COLUMN IF NOT EXISTS size BIGINT NOT NULL DEFAULT 0",
+		},
+		{
+			// INTEGER and SERIAL are left alone, ids stay 32 bits like before
+			"CREATE TABLE IF NOT EXISTS gowncloud.shares (shareid SERIAL UNIQUE PRIMARY KEY, nodeid INTEGER REFERENCES gowncloud.nodes)",
+			"CREATE TABLE IF NOT EXISTS gowncloud.shares (shareid SERIAL UNIQUE PRIMARY KEY, nodeid INTEGER REFERENCES gowncloud.nodes)",
+		},
+		{
+			// Only schema changes are rewritten
+			"SELECT 'INT' FROM gowncloud.settings",
+			"SELECT 'INT' FROM gowncloud.settings",
+		},
+	}
+	for _, test := range tests {
+		if rewritten := postgresDialect.rewrite(test.query); rewritten != test.rewritten {
+			t.Errorf("rewrite(%q) = %q, want %q", test.query, rewritten, test.rewritten)
+		}
+		// INT is already 64 bits on CockroachDB
+		if rewritten := cockroachDialect.rewrite(test.query); rewritten != test.query {
+			t.Errorf("CockroachDB rewrite(%q) = %q, want it unchanged", test.query, rewritten)
+		}
+	}
+}
+
+func TestDialectFor(t *testing.T) {
+	tests := []struct {
+		url        string
+		dialect    *dialect
+		dataSource string
+		err        error
+	}{
+		{"cockroachdb://root@localhost:26257/?sslmode=disable", cockroachDialect, "postgres://root@localhost:26257/?sslmode=disable", nil},
+		{"cockroach://root@localhost:26257", cockroachDialect, "postgres://root@localhost:26257", nil},
+		{"postgres://gowncloud@localhost/gowncloud", postgresDialect, "postgres://gowncloud@localhost/gowncloud", nil},
+		{"postgresql://gowncloud@localhost/gowncloud", postgresDialect, "postgresql://gowncloud@localhost/gowncloud", nil},
+		{"mysql://root@localhost/gowncloud", nil, "", ErrUnsupportedDatabase},
+		{"localhost:26257", nil, "", ErrUnsupportedDatabase},
+	}
+	for _, test := range tests {
+		d, dataSource, err := dialectFor(test.url)
+		if d != test.dialect || dataSource != test.dataSource || err != test.err {
+			t.Errorf("dialectFor(%q) = %v, %q, %v, want %v, %q, %v", test.url, d, dataSource, err, test.dialect, test.dataSource, test.err)
+		}
+	}
+}
@@ -2,24 +2,18 @@ package db
 
 import log "github.com/Sirupsen/logrus"
 
-func initFavorites() {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS gowncloud.favorites (" +
-		"nodeid INTEGER references gowncloud.nodes, " +
-		"username STRING references gowncloud.users, " +
-		"unique (nodeid, username)" +
-		")")
-	if err != nil {
-		log.Fatal("Failed to delete table 'favorites': ", err)
-	}
-
-	log.Debug("Initialized 'favorites' table")
-}
-
 // MarkNodeAsFavorite adds an entry poiting to a node and user. An  error is returned
 // if the node or user doesn't exist.
 func MarkNodeAsFavorite(path, user string) error {
-	_, err := db.Exec("INSERT INTO gowncloud.favorites (nodeid, username) VALUES ("+
-		"(SELECT nodeid FROM gowncloud.nodes WHERE path = $1), $2)", path, user)
+	nodeId, err := nodeIdAt(db, path)
+	if err != nil {
+		return err
+	}
+	if nodeId == 0 {
+		log.Errorf("Failed to mark node at path %v as favorite for user %v: node not found", path, user)
+		return ErrDB
+	}
+	_, err = db.Exec("INSERT INTO gowncloud.favorites (nodeid, username) VALUES ($1, $2)", nodeId, user)
 	if err != nil {
 		log.Errorf("Failed to mark node at path %v as favorite for user %v: %v", path, user, err)
 		return ErrDB
@@ -33,8 +27,11 @@ func MarkNodeAsFavorite(path, user string) error {
 // therefore if no error is returned, the combination of parameters is guaranteed to
 // not exist after calling this function.
 func RemoveNodeAsFavorite(path, user string) error {
-	_, err := db.Exec("DELETE FROM gowncloud.favorites WHERE nodeid in ("+
-		"SELECT nodeid FROM gowncloud.nodes WHERE path = $1) AND username = $2", path, user)
+	nodeId, err := nodeIdAt(db, path)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM gowncloud.favorites WHERE nodeid = $1 AND username = $2", nodeId, user)
 	if err != nil {
 		log.Errorf("Failed to umark node at path %v for user %v as favorite: %v", path, user, err)
 		return ErrDB
@@ -44,9 +41,9 @@ func RemoveNodeAsFavorite(path, user string) error {
 }
 
 // IsFavoriteByNodeid checks if a user has favorited the node identified by nodeid
-func IsFavoriteByNodeid(nodeid float64, user string) (bool, error) {
+func IsFavoriteByNodeid(nodeid int64, user string) (bool, error) {
 	row := db.QueryRow("SELECT COUNT(1) FROM gowncloud.favorites WHERE nodeid = $1 AND "+
-		"username = $2", intFromFloat(nodeid), user)
+		"username = $2", nodeid, user)
 	var count int
 	err := row.Scan(&count)
 	if err != nil {
@@ -87,12 +84,9 @@ func GetFavoritedNodes(username string, targets []string) ([]*Node, error) {
 // getFavoritedNodesForTarget gets all the favorited nodes including shares and
 // subnodes of shares
 func getFavoritedNodesForGroup(username string, target string) ([]*Node, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.nodes WHERE nodeid IN ( "+
-		"SELECT nodeid FROM gowncloud.shares WHERE target LIKE $1 || '.' || '%' UNION "+
-		"SELECT nodeid FROM gowncloud.nodes WHERE path LIKE ("+
-		"SELECT path FROM gowncloud.nodes WHERE nodeid IN ("+
-		"SELECT nodeid FROM gowncloud.shares WHERE target IN ($1 || '.' || '%'))) || '%' UNION "+
-		"SELECT nodeid FROM gowncloud.nodes WHERE owner = $1) AND "+
+	rows, err := db.Query("SELECT "+nodeColumns+" FROM gowncloud.nodes WHERE (nodeid IN "+
+		subtreeOf("nodeid IN (SELECT nodeid FROM gowncloud.shares WHERE target LIKE $1 || '.' || '%')")+
+		" OR owner = $1) AND "+
 		"nodeid IN (SELECT nodeid FROM gowncloud.favorites WHERE username = $2)", target, username)
 	if err != nil {
 		log.Errorf("Failed to get favorited nodes for user in group %v: %v", target, err)
@@ -103,33 +97,13 @@ func getFavoritedNodesForGroup(username string, target string) ([]*Node, error)
 		return nil, ErrDB
 	}
 	defer rows.Close()
-	nodes := make([]*Node, 0)
-	for rows.Next() {
-		node := &Node{}
-		var nId int
-		err = rows.Scan(&nId, &node.Owner, &node.Path, &node.Isdir, &node.MimeType, &node.Deleted)
-		if err != nil {
-			log.Error("Error while reading favorites")
-			return nil, ErrDB
-		}
-		node.ID = floatFromInt(nId)
-		nodes = append(nodes, node)
-	}
-	err = rows.Err()
-	if err != nil {
-		log.Error("Error while reading the favorite rows")
-		return nil, err
-	}
-	return nodes, nil
+	return readNodeRows(db, rows)
 }
 
 func getFavoritedNodesForUser(username string) ([]*Node, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.nodes WHERE nodeid IN ( "+
-		"SELECT nodeid FROM gowncloud.shares WHERE target = $1 UNION "+
-		"SELECT nodeid FROM gowncloud.nodes WHERE path LIKE ("+
-		"SELECT path FROM gowncloud.nodes WHERE nodeid IN ("+
-		"SELECT nodeid FROM gowncloud.shares WHERE target = $1)) || '%' UNION "+
-		"SELECT nodeid FROM gowncloud.nodes WHERE owner = $1) AND "+
+	rows, err := db.Query("SELECT "+nodeColumns+" FROM gowncloud.nodes WHERE (nodeid IN "+
+		subtreeOf("nodeid IN (SELECT nodeid FROM gowncloud.shares WHERE target = $1)")+
+		" OR owner = $1) AND "+
 		"nodeid IN (SELECT nodeid FROM gowncloud.favorites WHERE username = $1)", username)
 	if err != nil {
 		log.Errorf("Failed to get favorited nodes for user %v: %v", username, err)
@@ -140,22 +114,23 @@ func getFavoritedNodesForUser(username string) ([]*Node, error) {
 		return nil, ErrDB
 	}
 	defer rows.Close()
-	nodes := make([]*Node, 0)
-	for rows.Next() {
-		node := &Node{}
-		var nId int
-		err = rows.Scan(&nId, &node.Owner, &node.Path, &node.Isdir, &node.MimeType, &node.Deleted)
-		if err != nil {
-			log.Error("Error while reading favorites")
-			return nil, ErrDB
-		}
-		node.ID = floatFromInt(nId)
-		nodes = append(nodes, node)
+	return readNodeRows(db, rows)
+}
+
+// DeleteDanglingFavorites removes the favorites which point to a node or a user
+// that no longer exists. It returns the amount of removed favorites.
+func DeleteDanglingFavorites() (int64, error) {
+	result, err := db.Exec("DELETE FROM gowncloud.favorites WHERE " +
+		"nodeid NOT IN (SELECT nodeid FROM gowncloud.nodes) OR " +
+		"username NOT IN (SELECT username FROM gowncloud.users)")
+	if err != nil {
+		log.Error("Failed to delete dangling favorites: ", err)
+		return 0, ErrDB
 	}
-	err = rows.Err()
+	count, err := result.RowsAffected()
 	if err != nil {
-		log.Error("Error while reading the favorite rows")
-		return nil, err
+		log.Error("Failed to delete dangling favorites: ", err)
+		return 0, ErrDB
 	}
-	return nodes, nil
+	return count, nil
 }
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidId is returned when parsing an id which is not a node or share id
+var ErrInvalidId = errors.New("Invalid id")
+
+// instanceIdCharacters are the characters of a generated instance id
+const instanceIdCharacters = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// newInstanceId generates an instance id like owncloud does: "oc" followed by
+// 10 random lowercase letters and digits
+func newInstanceId() string {
+	b := make([]byte, 10)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "oc" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	for i := range b {
+		b[i] = instanceIdCharacters[int(b[i])%len(instanceIdCharacters)]
+	}
+	return "oc" + string(b)
+}
+
+// FormatOcId formats a node id as an oc:id, which is the node id padded to 8
+// digits followed by the instance id, like "00000042oc1a2b3c4d5e"
+func FormatOcId(id int64) string {
+	return fmt.Sprintf("%08d%s", id, GetSetting(INSTANCE_ID))
+}
+
+// ParseId parses a node or share id sent by a client. Besides plain integers it
+// accepts oc:ids, and the floating point ids of older gowncloud versions which
+// clients may still have stored in their favorites and share links.
+func ParseId(s string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err == nil {
+		return id, nil
+	}
+	instanceId := GetSetting(INSTANCE_ID)
+	if instanceId != "" && strings.HasSuffix(s, instanceId) {
+		id, err = strconv.ParseInt(strings.TrimSuffix(s, instanceId), 10, 64)
+		if err == nil {
+			return id, nil
+		}
+	}
+	// Older versions formatted the bits of the id as a float in exponent format
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err == nil {
+			return int64(math.Float64bits(f)), nil
+		}
+	}
+	return 0, ErrInvalidId
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"database/sql"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// MailSettings are the email address of a user and the mails he wants
+type MailSettings struct {
+	// Email is the address the mails are sent to, no mails are sent if it is
+	// empty
+	Email string
+	// Shares sends a mail when a file or folder is shared with the user
+	Shares bool
+	// Digest sends a daily mail with the activities of the other users
+	Digest bool
+}
+
+// GetMailSettings returns the mail settings of the user, or nil if the user
+// doesn't exist
+func GetMailSettings(username string) (*MailSettings, error) {
+	settings := &MailSettings{}
+	err := db.QueryRow("SELECT email, mailshares, maildigest FROM gowncloud.users WHERE username = $1", username).
+		Scan(&settings.Email, &settings.Shares, &settings.Digest)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Error("Failed to get the mail settings of the user: ", err)
+		return nil, ErrDB
+	}
+	return settings, nil
+}
+
+// SetMailSettings changes the mail settings of the user. When the digest is
+// enabled it starts after the latest activity, so the first digest doesn't hold
+// all the older activities.
+func SetMailSettings(username string, settings *MailSettings) error {
+	result, err := db.Exec("UPDATE gowncloud.users SET email = $1, mailshares = $2, "+
+		"digestactivity = CASE WHEN $3 AND NOT maildigest THEN "+
+		"(SELECT COALESCE(MAX(activityid), 0) FROM gowncloud.activities) ELSE digestactivity END, "+
+		"maildigest = $3 WHERE username = $4", settings.Email, settings.Shares, settings.Digest, username)
+	if err != nil {
+		log.Errorf("Failed to update the mail settings of user %v: %v", username, err)
+		return ErrDB
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected != 1 {
+		log.Error("Failed to update the mail settings of user ", username)
+		return ErrDB
+	}
+	return nil
+}
+
+// DigestUser is a user who gets the daily digest
+type DigestUser struct {
+	Username string
+	Email    string
+	// LastActivity is the id of the last activity sent in a digest
+	LastActivity int64
+}
+
+// GetDigestUsers returns the users who enabled the digest and have an email
+// address
+func GetDigestUsers() ([]*DigestUser, error) {
+	rows, err := db.Query("SELECT username, email, digestactivity FROM gowncloud.users " +
+		"WHERE maildigest AND email <> '' ORDER BY username")
+	if err != nil {
+		log.Error("Failed to get the digest users: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	users := make([]*DigestUser, 0)
+	for rows.Next() {
+		user := &DigestUser{}
+		err = rows.Scan(&user.Username, &user.Email, &user.LastActivity)
+		if err != nil {
+			log.Error("Error while reading the digest users: ", err)
+			return nil, ErrDB
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Error while reading the digest user rows: ", err)
+		return nil, ErrDB
+	}
+	return users, nil
+}
+
+// SetDigestActivity records the id of the last activity sent to the user in a
+// digest
+func SetDigestActivity(username string, activityId int64) error {
+	_, err := db.Exec("UPDATE gowncloud.users SET digestactivity = $1 WHERE username = $2", activityId, username)
+	if err != nil {
+		log.Error("Failed to set the digest activity of the user: ", err)
+		return ErrDB
+	}
+	return nil
+}
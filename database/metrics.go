@@ -0,0 +1,65 @@
+package db
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// QueryObserver is called with the operation, "exec" or "query", and the time
+// taken by the database to execute every query. The rows of a query may still
+// be streamed after it is observed.
+type QueryObserver func(operation string, duration time.Duration)
+
+// queryObserver observes the queries, it is set by the metrics
+var queryObserver QueryObserver
+
+// SetQueryObserver sets the function called after every query
+func SetQueryObserver(observer QueryObserver) {
+	queryObserver = observer
+}
+
+// observeQuery passes the time since start to the query observer, if any
+func observeQuery(start time.Time, operation string) {
+	if queryObserver != nil {
+		queryObserver(operation, time.Since(start))
+	}
+}
+
+// StorageUsage is the size of the files or files_trash directory of a user
+type StorageUsage struct {
+	Username  string
+	Directory string
+	Size      int64
+}
+
+// GetStorageUsage returns the size of the files and files_trash directories of
+// all the users
+func GetStorageUsage() ([]StorageUsage, error) {
+	usages := make([]StorageUsage, 0)
+	if db == nil {
+		return usages, nil
+	}
+	rows, err := db.Query("SELECT h.name, d.name, d.size FROM gowncloud.nodes d, gowncloud.nodes h " +
+		"WHERE d.parentid = h.nodeid AND h.parentid IS NULL AND d.name IN ('files', 'files_trash') " +
+		"ORDER BY h.name, d.name")
+	if err != nil {
+		log.Error("Failed to get the storage used by the users: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var usage StorageUsage
+		err = rows.Scan(&usage.Username, &usage.Directory, &usage.Size)
+		if err != nil {
+			log.Error("Failed to get the storage used by the users: ", err)
+			return nil, ErrDB
+		}
+		usages = append(usages, usage)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Failed to get the storage used by the users: ", err)
+		return nil, ErrDB
+	}
+	return usages, nil
+}
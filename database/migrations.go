@@ -0,0 +1,487 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ErrSchemaTooNew is returned when the database schema was migrated by a newer
+// version of gowncloud than the running one
+var ErrSchemaTooNew = errors.New("The database schema is newer than this version of gowncloud supports, upgrade gowncloud")
+
+// migration is a versioned change of the database schema
+type migration struct {
+	// version orders the migrations, it must be higher than the version of the
+	// migration before it
+	version     int
+	description string
+	// up applies the migration, all statements of a migration are executed in
+	// one transaction
+	up func(tx *transaction) error
+}
+
+// AppliedMigration is a migration which has been applied to the database
+type AppliedMigration struct {
+	Version     int
+	Description string
+	Applied     time.Time
+}
+
+// migrations are all the changes of the database schema, in the order they have
+// to be applied. Applied migrations must never be changed, schema changes are
+// made by appending a migration.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Create the users, settings, nodes, shares, trash and favorites tables",
+		up: execStatements(
+			"CREATE TABLE IF NOT EXISTS gowncloud.settings ("+
+				"key TEXT NOT NULL UNIQUE,"+
+				"value TEXT NOT NULL"+
+				")",
+			"CREATE TABLE IF NOT EXISTS gowncloud.users ("+
+				"id SERIAL UNIQUE, "+
+				"username TEXT PRIMARY KEY, "+
+				"allowedspace INT"+
+				")",
+			"CREATE TABLE IF NOT EXISTS gowncloud.nodes ("+
+				"nodeid SERIAL UNIQUE PRIMARY KEY, "+
+				"owner TEXT REFERENCES gowncloud.users, "+ //all nodes should have an owner
+				"path TEXT NOT NULL UNIQUE, "+
+				"isdir BOOL NOT NULL,"+
+				"mimetype TEXT NOT NULL, "+
+				"deleted BOOL NOT NULL"+
+				")",
+			"CREATE TABLE IF NOT EXISTS gowncloud.shares ("+
+				"shareid SERIAL UNIQUE PRIMARY KEY, "+
+				"nodeid INTEGER REFERENCES gowncloud.nodes, "+
+				"target TEXT NOT NULL, "+
+				"time TIMESTAMPTZ NOT NULL,"+
+				"permissions INTEGER NOT NULL,"+
+				"sharetype INTEGER NOT NULL"+
+				")",
+			"CREATE TABLE IF NOT EXISTS gowncloud.trashnodes ("+
+				"nodeid INTEGER REFERENCES gowncloud.nodes, "+
+				"owner TEXT REFERENCES gowncloud.users, "+
+				"path TEXT NOT NULL UNIQUE, "+
+				"isdir BOOL NOT NULL"+
+				")",
+			"CREATE TABLE IF NOT EXISTS gowncloud.favorites ("+
+				"nodeid INTEGER references gowncloud.nodes, "+
+				"username TEXT references gowncloud.users, "+
+				"unique (nodeid, username)"+
+				")",
+		),
+	},
+	{
+		version:     2,
+		description: "Add the size, mtime, etag and checksum of the nodes",
+		up: execStatements(
+			"ALTER TABLE gowncloud.nodes ADD COLUMN IF NOT EXISTS size INT NOT NULL DEFAULT 0",
+			"ALTER TABLE gowncloud.nodes ADD COLUMN IF NOT EXISTS mtime TIMESTAMPTZ NOT NULL DEFAULT now()",
+			"ALTER TABLE gowncloud.nodes ADD COLUMN IF NOT EXISTS etag TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE gowncloud.nodes ADD COLUMN IF NOT EXISTS checksum TEXT NOT NULL DEFAULT ''",
+		),
+	},
+	{
+		version:     3,
+		description: "Create the photo metadata table",
+		up: execStatements(
+			"CREATE TABLE IF NOT EXISTS gowncloud.photometadata (" +
+				"nodeid INTEGER PRIMARY KEY REFERENCES gowncloud.nodes, " +
+				"etag TEXT NOT NULL, " +
+				"taken TIMESTAMPTZ, " +
+				"make TEXT NOT NULL DEFAULT '', " +
+				"model TEXT NOT NULL DEFAULT '', " +
+				"latitude FLOAT, " +
+				"longitude FLOAT, " +
+				"width INTEGER NOT NULL DEFAULT 0, " +
+				"height INTEGER NOT NULL DEFAULT 0" +
+				")",
+		),
+	},
+	{
+		version:     4,
+		description: "Create the albums tables",
+		up: execStatements(
+			"CREATE TABLE IF NOT EXISTS gowncloud.albums ("+
+				"albumid SERIAL UNIQUE PRIMARY KEY, "+
+				"owner TEXT NOT NULL REFERENCES gowncloud.users, "+
+				"name TEXT NOT NULL, "+
+				"created TIMESTAMPTZ NOT NULL"+
+				")",
+			"CREATE TABLE IF NOT EXISTS gowncloud.albumitems ("+
+				"albumid INTEGER NOT NULL REFERENCES gowncloud.albums, "+
+				"nodeid INTEGER NOT NULL REFERENCES gowncloud.nodes, "+
+				"position INTEGER NOT NULL, "+
+				"PRIMARY KEY (albumid, nodeid)"+
+				")",
+			"CREATE TABLE IF NOT EXISTS gowncloud.albumshares ("+
+				"albumid INTEGER NOT NULL REFERENCES gowncloud.albums, "+
+				"target TEXT NOT NULL, "+
+				"sharetype INTEGER NOT NULL, "+
+				"time TIMESTAMPTZ NOT NULL, "+
+				"PRIMARY KEY (albumid, target)"+
+				")",
+		),
+	},
+	{
+		version:     5,
+		description: "Create the checksums table",
+		up: execStatements(
+			"CREATE TABLE IF NOT EXISTS gowncloud.checksums (" +
+				"nodeid INTEGER PRIMARY KEY REFERENCES gowncloud.nodes, " +
+				"etag TEXT NOT NULL, " +
+				"sha1 TEXT NOT NULL, " +
+				"md5 TEXT NOT NULL, " +
+				"adler32 TEXT NOT NULL" +
+				")",
+		),
+	},
+	{
+		version:     6,
+		description: "Create the blobs table",
+		up: execStatements(
+			"CREATE TABLE IF NOT EXISTS gowncloud.blobs (" +
+				"hash TEXT PRIMARY KEY, " +
+				"size INT NOT NULL, " +
+				"refcount INT NOT NULL DEFAULT 0" +
+				")",
+		),
+	},
+	{
+		version:     7,
+		description: "Generate the instance id used in the oc:id of the nodes",
+		up: func(tx *transaction) error {
+			_, err := tx.Exec("INSERT INTO gowncloud.settings (key, value) VALUES ($1, $2) "+
+				"ON CONFLICT (key) DO NOTHING", INSTANCE_ID, newInstanceId())
+			return err
+		},
+	},
+	{
+		version:     8,
+		description: "Add the parent id and name of the nodes",
+		up: execStatements(
+			"ALTER TABLE gowncloud.nodes ADD COLUMN IF NOT EXISTS parentid INTEGER REFERENCES gowncloud.nodes",
+			"ALTER TABLE gowncloud.nodes ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT ''",
+		),
+	},
+	{
+		version:     9,
+		description: "Link the nodes to their parents",
+		up:          linkNodeParents,
+	},
+	{
+		version:     10,
+		description: "Drop the paths of the nodes",
+		up:          dropNodePaths,
+	},
+	{
+		version:     11,
+		description: "Create the activities tables",
+		up: execStatements(
+			"CREATE TABLE IF NOT EXISTS gowncloud.activities ("+
+				"activityid SERIAL UNIQUE PRIMARY KEY, "+
+				"actor TEXT NOT NULL, "+
+				"type TEXT NOT NULL, "+
+				"subject TEXT NOT NULL, "+
+				"nodeid INTEGER NOT NULL, "+ // the node may be removed, the activity stays
+				"sharewith TEXT NOT NULL DEFAULT '', "+
+				"time TIMESTAMPTZ NOT NULL"+
+				")",
+			"CREATE TABLE IF NOT EXISTS gowncloud.activitytargets ("+
+				"activityid INTEGER NOT NULL REFERENCES gowncloud.activities, "+
+				"target TEXT NOT NULL, "+
+				"path TEXT NOT NULL, "+
+				"PRIMARY KEY (activityid, target)"+
+				")",
+			"CREATE INDEX IF NOT EXISTS activitytargets_target ON gowncloud.activitytargets (target)",
+		),
+	},
+	{
+		version:     12,
+		description: "Create the notifications tables and add the share expiration and quota warning",
+		up: execStatements(
+			"CREATE TABLE IF NOT EXISTS gowncloud.notifications ("+
+				"notificationid SERIAL UNIQUE PRIMARY KEY, "+
+				"target TEXT NOT NULL, "+
+				"app TEXT NOT NULL, "+
+				"subject TEXT NOT NULL, "+
+				"objecttype TEXT NOT NULL, "+
+				"objectid TEXT NOT NULL, "+
+				"parameters TEXT NOT NULL, "+
+				"time TIMESTAMPTZ NOT NULL"+
+				")",
+			"CREATE INDEX IF NOT EXISTS notifications_target ON gowncloud.notifications (target)",
+			"CREATE TABLE IF NOT EXISTS gowncloud.notificationdismissals ("+
+				"notificationid INTEGER NOT NULL REFERENCES gowncloud.notifications, "+
+				"username TEXT NOT NULL, "+
+				"PRIMARY KEY (notificationid, username)"+
+				")",
+			"ALTER TABLE gowncloud.shares ADD COLUMN IF NOT EXISTS expiration TIMESTAMPTZ",
+			"ALTER TABLE gowncloud.shares ADD COLUMN IF NOT EXISTS expirywarned BOOL NOT NULL DEFAULT FALSE",
+			"ALTER TABLE gowncloud.users ADD COLUMN IF NOT EXISTS quotawarning INT NOT NULL DEFAULT 0",
+		),
+	},
+	{
+		version:     13,
+		description: "Add the email address and mail settings of the users",
+		up: execStatements(
+			"ALTER TABLE gowncloud.users ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT ''",
+			"ALTER TABLE gowncloud.users ADD COLUMN IF NOT EXISTS mailshares BOOL NOT NULL DEFAULT TRUE",
+			"ALTER TABLE gowncloud.users ADD COLUMN IF NOT EXISTS maildigest BOOL NOT NULL DEFAULT FALSE",
+			"ALTER TABLE gowncloud.users ADD COLUMN IF NOT EXISTS digestactivity INTEGER NOT NULL DEFAULT 0",
+		),
+	},
+	{
+		version:     14,
+		description: "Drop the unused checksum of the nodes, the checksums are kept in the checksums table",
+		up: execStatements(
+			"ALTER TABLE gowncloud.nodes DROP COLUMN IF EXISTS checksum",
+		),
+	},
+	{
+		version:     15,
+		description: "Widen the size and quota columns to 64 bits on PostgreSQL",
+		up:          widenIntColumns,
+	},
+	{
+		// The unique index on the parent and the name doesn't apply to the home
+		// directories, NULL parent ids are never equal
+		version:     16,
+		description: "Make the names of the home directories unique",
+		up: execStatements(
+			"CREATE UNIQUE INDEX IF NOT EXISTS nodes_home_name ON gowncloud.nodes (name) WHERE parentid IS NULL",
+		),
+	},
+}
+
+func init() {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version <= migrations[i-1].version {
+			log.Fatalf("Migration %v is not ordered after migration %v", migrations[i].version, migrations[i-1].version)
+		}
+	}
+}
+
+// execStatements returns a migration executing the statements in order
+func execStatements(statements ...string) func(tx *transaction) error {
+	return func(tx *transaction) error {
+		for _, statement := range statements {
+			_, err := tx.Exec(statement)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// linkNodeParents sets the parent id and name of the nodes from their path. Nodes
+// of which the parent is missing are kept as roots named after their full path,
+// so they are no longer found but their data is not lost.
+func linkNodeParents(tx *transaction) error {
+	rows, err := tx.Query("SELECT nodeid, path FROM gowncloud.nodes")
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]int64)
+	for rows.Next() {
+		var id int64
+		var path string
+		err = rows.Scan(&id, &path)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids[path] = id
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for path, id := range ids {
+		var parentId sql.NullInt64
+		name := path[strings.LastIndex(path, "/")+1:]
+		if parent := parentPath(path); parent != "" {
+			parentId.Int64, parentId.Valid = ids[parent]
+			if !parentId.Valid {
+				log.Warnf("The parent of node %v is missing, keeping it as a root", path)
+				name = path
+			}
+		}
+		_, err = tx.Exec("UPDATE gowncloud.nodes SET parentid = $1, name = $2 WHERE nodeid = $3",
+			parentId, name, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropNodePaths makes the name unique within a directory and drops the path of
+// the nodes, which is resolved from the parent ids from now on
+func dropNodePaths(tx *transaction) error {
+	if tx.dialect != sqliteDialect {
+		return execStatements(
+			"CREATE UNIQUE INDEX IF NOT EXISTS nodes_parentid_name ON gowncloud.nodes (parentid, name)",
+			"ALTER TABLE gowncloud.nodes DROP COLUMN path CASCADE",
+		)(tx)
+	}
+	// SQLite can't drop a UNIQUE column, so the table is recreated. Dropping it
+	// orphans the rows referencing the nodes, which is only checked when the
+	// migration is committed, once the nodes are copied back.
+	columns := "nodeid, parentid, name, owner, isdir, mimetype, deleted, size, mtime, etag, checksum"
+	return execStatements(
+		"PRAGMA defer_foreign_keys = ON",
+		"CREATE TEMP TABLE nodes_copy AS SELECT "+columns+" FROM gowncloud.nodes",
+		"DROP TABLE gowncloud.nodes",
+		"CREATE TABLE gowncloud.nodes ("+
+			"nodeid SERIAL UNIQUE PRIMARY KEY, "+
+			"parentid INTEGER REFERENCES gowncloud.nodes, "+
+			"name TEXT NOT NULL, "+
+			"owner TEXT REFERENCES gowncloud.users, "+
+			"isdir BOOL NOT NULL,"+
+			"mimetype TEXT NOT NULL, "+
+			"deleted BOOL NOT NULL, "+
+			"size INT NOT NULL DEFAULT 0, "+
+			"mtime TIMESTAMPTZ NOT NULL DEFAULT now(), "+
+			"etag TEXT NOT NULL DEFAULT '', "+
+			"checksum TEXT NOT NULL DEFAULT ''"+
+			")",
+		"INSERT INTO gowncloud.nodes ("+columns+") SELECT "+columns+" FROM nodes_copy",
+		"DROP TABLE nodes_copy",
+		"CREATE UNIQUE INDEX IF NOT EXISTS nodes_parentid_name ON gowncloud.nodes (parentid, name)",
+	)(tx)
+}
+
+// widenIntColumns changes the INT columns created before INT was rewritten to
+// BIGINT on PostgreSQL. INT is already 64 bits on CockroachDB and SQLite.
+func widenIntColumns(tx *transaction) error {
+	if tx.dialect != postgresDialect {
+		return nil
+	}
+	return execStatements(
+		"ALTER TABLE gowncloud.users ALTER COLUMN allowedspace TYPE BIGINT",
+		"ALTER TABLE gowncloud.users ALTER COLUMN quotawarning TYPE BIGINT",
+		"ALTER TABLE gowncloud.nodes ALTER COLUMN size TYPE BIGINT",
+		"ALTER TABLE gowncloud.blobs ALTER COLUMN size TYPE BIGINT",
+		"ALTER TABLE gowncloud.blobs ALTER COLUMN refcount TYPE BIGINT",
+	)(tx)
+}
+
+// initMigrations initializes the schema_migrations table, which records the
+// applied migrations
+func initMigrations() error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS gowncloud.schema_migrations (" +
+		"version INTEGER PRIMARY KEY, " +
+		"description TEXT NOT NULL, " +
+		"applied TIMESTAMPTZ NOT NULL DEFAULT now()" +
+		")")
+	return err
+}
+
+// LatestSchemaVersion returns the schema version this version of gowncloud migrates to
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the version of the last migration applied to the
+// database, or 0 if none has been applied
+func SchemaVersion() (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM gowncloud.schema_migrations").Scan(&version)
+	if err != nil {
+		log.Error("Failed to get the schema version: ", err)
+		return 0, ErrDB
+	}
+	return version, nil
+}
+
+// GetAppliedMigrations returns the migrations applied to the database, in the
+// order they were applied
+func GetAppliedMigrations() ([]*AppliedMigration, error) {
+	rows, err := db.Query("SELECT version, description, applied FROM gowncloud.schema_migrations ORDER BY version")
+	if err != nil {
+		log.Error("Failed to get the applied migrations: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	applied := make([]*AppliedMigration, 0)
+	for rows.Next() {
+		m := &AppliedMigration{}
+		err = rows.Scan(&m.Version, &m.Description, &m.Applied)
+		if err != nil {
+			log.Error("Failed to read the applied migrations: ", err)
+			return nil, ErrDB
+		}
+		applied = append(applied, m)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Failed to read the applied migrations: ", err)
+		return nil, ErrDB
+	}
+	return applied, nil
+}
+
+// Migrate applies the migrations which have not been applied to the database
+// yet, each in its own transaction. It returns ErrSchemaTooNew if the database
+// has been migrated by a newer version of gowncloud.
+func Migrate() error {
+	err := initMigrations()
+	if err != nil {
+		log.Error("Failed to create table 'schema_migrations': ", err)
+		return ErrDB
+	}
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if current > LatestSchemaVersion() {
+		log.Errorf("Database schema version %v is newer than the supported version %v", current, LatestSchemaVersion())
+		return ErrSchemaTooNew
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err = applyMigration(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMigration applies a migration and records it in one transaction, so a
+// failing migration leaves no trace
+func applyMigration(m migration) error {
+	log.Infof("Applying migration %v: %v", m.version, m.description)
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error("Failed to start migration transaction: ", err)
+		return ErrDB
+	}
+	err = m.up(tx)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO gowncloud.schema_migrations (version, description) VALUES ($1, $2)",
+			m.version, m.description)
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Errorf("Failed to apply migration %v: %v", m.version, err)
+		return ErrDB
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Errorf("Failed to commit migration %v: %v", m.version, err)
+		return ErrDB
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package db
+
+import "testing"
+
+func TestMigrationOrder(t *testing.T) {
+	if len(migrations) == 0 {
+		t.Fatal("No migrations")
+	}
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("Migration %v has version %v, want %v", i, m.version, i+1)
+		}
+		if m.description == "" {
+			t.Errorf("Migration %v has no description", m.version)
+		}
+		if m.up == nil {
+			t.Errorf("Migration %v has no up function", m.version)
+		}
+	}
+	if latest := LatestSchemaVersion(); latest != migrations[len(migrations)-1].version {
+		t.Errorf("LatestSchemaVersion() = %v, want %v", latest, migrations[len(migrations)-1].version)
+	}
+}
@@ -1,46 +1,158 @@
 package db
 
 import (
+	"crypto/rand"
 	"database/sql"
-	"math"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
 // Node represents a file or directory, stored on disk by gowncloud.
 type Node struct {
-	ID       float64
-	Owner    string
+	ID int64
+	// ParentID is the id of the parent directory, 0 for the home directories of
+	// the users
+	ParentID int64
+	// Name is the last element of the path
+	Name  string
+	Owner string
+	// Path is resolved from the names of the node and its ancestors
 	Path     string
 	Isdir    bool
 	MimeType string
 	Deleted  bool
+	// Size is the size of a file, or the combined size of all the files in a
+	// directory
+	Size int64
+	// Mtime is the last modification time of the node. For directories this
+	// includes modifications of their descendants
+	Mtime time.Time
+	// Etag changes every time the node or one of its descendants changes
+	Etag string
 }
 
-// initNodes initializes the nodes table
-func initNodes() {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS gowncloud.nodes (" +
-		"nodeid SERIAL UNIQUE PRIMARY KEY, " +
-		"owner STRING REFERENCES gowncloud.users, " + //all nodes should have an owner
-		"path STRING NOT NULL UNIQUE, " +
-		"isdir BOOL NOT NULL," +
-		"mimetype STRING NOT NULL, " +
-		"deleted BOOL NOT NULL " +
-		")")
+// nodeColumns are the columns of the nodes table, in the order scanNode reads them
+const nodeColumns = "nodeid, parentid, name, owner, isdir, mimetype, deleted, size, mtime, etag"
+
+// maxIdsPerQuery limits the amount of ids sent in a single query
+const maxIdsPerQuery = 500
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// pathJoin returns the tables to select the node at path from, by joining the
+// nodes along the path on their parent id and name. The last element of the path
+// is the returned alias. With join "LEFT JOIN" the missing nodes at the end of
+// the path are returned as NULL instead of returning no rows.
+func pathJoin(qb *queryBuilder, path, join string) (string, string) {
+	names := strings.Split(path, "/")
+	qb.where("p0.parentid IS NULL AND p0.name = " + qb.arg(names[0]))
+	from := "gowncloud.nodes p0"
+	alias := "p0"
+	for i, name := range names[1:] {
+		parent := alias
+		alias = "p" + strconv.Itoa(i+1)
+		from += " " + join + " gowncloud.nodes " + alias + " ON " + alias + ".parentid = " + parent +
+			".nodeid AND " + alias + ".name = " + qb.arg(name)
+	}
+	return from, alias
+}
+
+// nodeIdAt returns the id of the node at path, or 0 if there is no such node
+func nodeIdAt(q execer, path string) (int64, error) {
+	qb := &queryBuilder{}
+	from, alias := pathJoin(qb, path, "JOIN")
+	var id int64
+	err := q.QueryRow("SELECT "+alias+".nodeid FROM "+from+" WHERE "+strings.Join(qb.conditions, " AND "),
+		qb.args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
 	if err != nil {
-		log.Fatal("Failed to create table 'nodes': ", err)
+		log.Errorf("Failed to look up the node at %v: %v", path, err)
+		return 0, ErrDB
+	}
+	return id, nil
+}
+
+// pathIds returns the ids of the nodes along path, starting with the home
+// directory. It stops at the first node which doesn't exist.
+func pathIds(q execer, path string) ([]int64, error) {
+	qb := &queryBuilder{}
+	from, _ := pathJoin(qb, path, "LEFT JOIN")
+	count := strings.Count(path, "/") + 1
+	columns := make([]string, count)
+	for i := range columns {
+		columns[i] = "p" + strconv.Itoa(i) + ".nodeid"
+	}
+	values := make([]sql.NullInt64, count)
+	dest := make([]interface{}, count)
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	err := q.QueryRow("SELECT "+strings.Join(columns, ", ")+" FROM "+from+" WHERE "+
+		strings.Join(qb.conditions, " AND "), qb.args...).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		log.Errorf("Failed to look up the nodes along %v: %v", path, err)
+		return nil, ErrDB
+	}
+	ids := make([]int64, 0, count)
+	for _, value := range values {
+		if !value.Valid {
+			break
+		}
+		ids = append(ids, value.Int64)
 	}
+	return ids, nil
+}
+
+// subtreeOf returns a subquery selecting the ids of the nodes matching the
+// condition and of all their descendants
+func subtreeOf(condition string) string {
+	return "(WITH RECURSIVE subtree (nodeid) AS (" +
+		"SELECT nodeid FROM gowncloud.nodes WHERE " + condition + " UNION ALL " +
+		"SELECT c.nodeid FROM gowncloud.nodes c, subtree s WHERE c.parentid = s.nodeid) " +
+		"SELECT nodeid FROM subtree)"
+}
+
+// homeDirectory returns a subquery selecting the id of a directory in the home
+// directory of a user, like "files" or "files_trash"
+func homeDirectory(user, name string) string {
+	return "(SELECT d.nodeid FROM gowncloud.nodes d, gowncloud.nodes h WHERE d.parentid = h.nodeid AND " +
+		"h.parentid IS NULL AND h.name = " + user + " AND d.name = " + name + ")"
+}
 
-	log.Debug("Initialized 'nodes' table")
+// parentPath returns the path of the parent of the node at path, or an empty
+// string for a home directory
+func parentPath(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return ""
 }
 
 // GetNode get the node with the given path from the database. If no node is found
 // a nil object is returned
 func GetNode(path string) (*Node, error) {
-	node := &Node{}
-	var nodeId int
-	row := db.QueryRow("SELECT * FROM gowncloud.nodes WHERE path = $1", path)
-	err := row.Scan(&nodeId, &node.Owner, &node.Path, &node.Isdir, &node.MimeType, &node.Deleted)
+	return getNode(db, path)
+}
+
+func getNode(q execer, path string) (*Node, error) {
+	qb := &queryBuilder{}
+	from, alias := pathJoin(qb, path, "JOIN")
+	row := q.QueryRow("SELECT "+prefixColumns(alias+".", nodeColumns)+" FROM "+from+" WHERE "+
+		strings.Join(qb.conditions, " AND "), qb.args...)
+	node, err := scanNode(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Debug("Node not found in database for path: ", path)
@@ -49,95 +161,271 @@ func GetNode(path string) (*Node, error) {
 		log.Error("Error getting node from database: ", err)
 		return nil, ErrDB
 	}
-	node.ID = floatFromInt(nodeId)
+	node.Path = path
 	return node, nil
 }
 
-func GetNodeById(id float64) (*Node, error) {
-	node := &Node{}
-	var nodeId int
-	row := db.QueryRow("SELECT * FROM gowncloud.nodes WHERE nodeid = $1", intFromFloat(id))
-	err := row.Scan(&nodeId, &node.Owner, &node.Path, &node.Isdir, &node.MimeType, &node.Deleted)
+func GetNodeById(id int64) (*Node, error) {
+	return getNodeById(db, id)
+}
+
+func getNodeById(q execer, id int64) (*Node, error) {
+	row := q.QueryRow("SELECT "+nodeColumns+" FROM gowncloud.nodes WHERE nodeid = $1", id)
+	node, err := scanNode(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			log.Debug("Node not found in database for id: ", intFromFloat(id))
+			log.Debug("Node not found in database for id: ", id)
 			return nil, nil
 		}
 		log.Error("Error getting node from database: ", err)
 		return nil, ErrDB
 	}
-	node.ID = floatFromInt(nodeId)
+	err = resolvePaths(q, []*Node{node}, nil)
+	if err != nil {
+		return nil, err
+	}
 	return node, nil
 }
 
-// SaveNode saves a new node in the database
+// SaveNode saves a new node in the database. The node is saved with size 0,
+// UpdateFileMetadata should be called once the content of a file is written.
 func SaveNode(path, owner string, isdir bool, mimetype string) (*Node, error) {
-	_, err := db.Exec("INSERT INTO gowncloud.nodes (owner, path, isdir, mimetype, deleted) "+
-		"VALUES ($1, $2, $3, $4, false)", owner, path, isdir, mimetype)
+	return saveNode(db, path, owner, isdir, mimetype)
+}
+
+func saveNode(q execer, path, owner string, isdir bool, mimetype string) (*Node, error) {
+	// Home directories have no parent
+	var parentId sql.NullInt64
+	if parent := parentPath(path); parent != "" {
+		id, err := nodeIdAt(q, parent)
+		if err != nil {
+			return nil, err
+		}
+		if id == 0 {
+			log.Errorf("Error while saving node %v: the parent directory doesn't exist", path)
+			return nil, ErrDB
+		}
+		parentId = sql.NullInt64{Int64: id, Valid: true}
+	}
+	now := time.Now()
+	_, err := q.Exec("INSERT INTO gowncloud.nodes (parentid, name, owner, isdir, mimetype, deleted, size, mtime, etag) "+
+		"VALUES ($1, $2, $3, $4, $5, false, 0, $6, $7)", parentId, path[strings.LastIndex(path, "/")+1:],
+		owner, isdir, mimetype, now, newEtag())
 	if err != nil {
 		log.Error("Error while saving node: ", err)
 		return nil, ErrDB
 	}
 
+	err = propagateSize(q, path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return getNode(q, path)
+}
+
+// UpdateFileMetadata stores the size and modification time of the file at path,
+// and gives it a new etag. The size difference is propagated to all the parent
+// directories.
+func UpdateFileMetadata(path string, size int64, mtime time.Time) (*Node, error) {
+	node, err := GetNode(path)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		log.Error("Trying to update the metadata of an unexisting node: ", path)
+		return nil, ErrDB
+	}
+	_, err = db.Exec("UPDATE gowncloud.nodes SET size = $1, mtime = $2, etag = $3 WHERE nodeid = $4",
+		size, mtime, newEtag(), node.ID)
+	if err != nil {
+		log.Errorf("Failed to update metadata of node %v: %v", path, err)
+		return nil, ErrDB
+	}
+	err = PropagateSize(path, size-node.Size)
+	if err != nil {
+		return nil, err
+	}
 	return GetNode(path)
 }
 
-// DeleteNode deletes a node for the given path from the database. DeleteNode
-// retuns an error when failing to delete an existing node in the database. If
-// no error is returned, the client can be sure no more node with the given path
-// is present in the database when this function returns.
-func DeleteNode(path string) error {
-	// Delete the shares on the node if there are any
-	_, err := db.Exec("DELETE FROM gowncloud.shares WHERE nodeid in ("+
-		"SELECT nodeid FROM gowncloud.nodes WHERE path = $1)", path)
+// PropagateSize adds delta to the size of all the ancestors of the node at path,
+// and marks them as changed by updating their etag and modification time. It
+// should be called for the root node whenever a subtree is added, moved or removed.
+func PropagateSize(path string, delta int64) error {
+	return propagateSize(db, path, delta)
+}
+
+func propagateSize(q execer, path string, delta int64) error {
+	parent := parentPath(path)
+	if parent == "" {
+		return nil
+	}
+	// The node itself may already be removed, so the ancestors are looked up
+	// from its parent
+	parents, err := pathIds(q, parent)
 	if err != nil {
-		log.Error("Failed to delete share on node: ", err)
+		return err
+	}
+	if len(parents) == 0 {
+		return nil
+	}
+	qb := &queryBuilder{}
+	size, now, etag := qb.arg(delta), qb.arg(time.Now()), qb.arg(newEtag())
+	_, err = q.Exec("UPDATE gowncloud.nodes SET size = size + "+size+", mtime = "+now+", etag = "+etag+
+		" WHERE nodeid IN ("+idList(qb, parents)+")", qb.args...)
+	if err != nil {
+		log.Errorf("Failed to propagate size change of node %v: %v", path, err)
 		return ErrDB
 	}
+	return nil
+}
 
-	// Delete the trash REFERENCES
-	_, err = db.Exec("DELETE FROM gowncloud.trashnodes WHERE nodeid in ("+
-		"SELECT nodeid FROM gowncloud.nodes WHERE path LIKE $1 || '%')", path)
+// GetChildNodes returns the direct children of the node at path
+func GetChildNodes(path string) ([]*Node, error) {
+	id, err := nodeIdAt(db, path)
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		return make([]*Node, 0), nil
+	}
+	rows, err := db.Query("SELECT "+nodeColumns+" FROM gowncloud.nodes WHERE parentid = $1 ORDER BY name", id)
+	if err != nil {
+		log.Error("Failed to get child nodes from the database: ", err)
+		return nil, ErrDB
+	}
+	if rows == nil {
+		log.Error("Error loading nodes")
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	nodes, err := readNodes(rows)
 	if err != nil {
-		log.Error("Failed to delete trash reference on node: ", err)
+		return nil, err
+	}
+	for _, node := range nodes {
+		node.Path = path + "/" + node.Name
 	}
+	return nodes, nil
+}
 
-	// Delete favorites references
-	_, err = db.Exec("DELETE FROM gowncloud.favorites WHERE nodeid in ("+
-		"SELECT nodeid FROM gowncloud.nodes WHERE path LIKE $1 || '%')", path)
+// GetSubtreeNodes returns the node at path and all its descendants, sorted by path
+// so parents come before their children
+func GetSubtreeNodes(path string) ([]*Node, error) {
+	return getSubtreeNodes(db, path)
+}
+
+func getSubtreeNodes(q execer, path string) ([]*Node, error) {
+	root, err := getNode(q, path)
 	if err != nil {
-		log.Error("Failed to delete trash reference on node: ", err)
+		return nil, err
+	}
+	if root == nil {
+		return make([]*Node, 0), nil
+	}
+	rows, err := q.Query("SELECT "+nodeColumns+" FROM gowncloud.nodes WHERE nodeid IN "+
+		subtreeOf("nodeid = $1"), root.ID)
+	if err != nil {
+		log.Error("Failed to get subtree nodes from the database: ", err)
+		return nil, ErrDB
+	}
+	if rows == nil {
+		log.Error("Error loading nodes")
+		return nil, ErrDB
 	}
+	defer rows.Close()
+	nodes, err := readNodes(rows)
+	if err != nil {
+		return nil, err
+	}
+	err = resolvePaths(q, nodes, map[int64]string{root.ID: path})
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(nodesByPath(nodes))
+	return nodes, nil
+}
 
-	_, err = db.Exec("DELETE FROM gowncloud.nodes WHERE path LIKE $1 || '%'", path)
+// SetDirectorySize overwrites the stored size of the directory at path. Unlike
+// UpdateFileMetadata the change is not propagated, it is meant to repair sizes
+// which got out of sync with the content of the directory.
+func SetDirectorySize(path string, size int64) error {
+	id, err := nodeIdAt(db, path)
 	if err != nil {
-		log.Error("Failed to delete node: ", err)
+		return err
+	}
+	_, err = db.Exec("UPDATE gowncloud.nodes SET size = $1, etag = $2 WHERE nodeid = $3 AND isdir = true",
+		size, newEtag(), id)
+	if err != nil {
+		log.Errorf("Failed to set the size of directory %v: %v", path, err)
 		return ErrDB
 	}
 	return nil
 }
 
+// DeleteNode deletes a node for the given path from the database, together with
+// all its descendants. DeleteNode retuns an error when failing to delete an
+// existing node in the database. If no error is returned, the client can be sure
+// no more node with the given path is present in the database when this
+// function returns.
+func DeleteNode(path string) error {
+	return WithTx(func(tx *Tx) error {
+		return tx.DeleteNode(path)
+	})
+}
+
+// deleteNode deletes the node at path and its descendants, with all the rows
+// referencing them
+func deleteNode(q execer, path string) error {
+	node, err := getNode(q, path)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		return nil
+	}
+	subtree := subtreeOf("nodeid = $1")
+
+	// Delete the shares, trash references and favorites, the photo metadata and
+	// checksums, and remove the photos from albums
+	for _, table := range []string{"shares", "trashnodes", "favorites", "photometadata", "checksums", "albumitems"} {
+		_, err = q.Exec("DELETE FROM gowncloud."+table+" WHERE nodeid IN "+subtree, node.ID)
+		if err != nil {
+			log.Errorf("Failed to delete %v references of node: %v", table, err)
+			return ErrDB
+		}
+	}
+
+	_, err = q.Exec("DELETE FROM gowncloud.nodes WHERE nodeid IN "+subtree, node.ID)
+	if err != nil {
+		log.Error("Failed to delete node: ", err)
+		return ErrDB
+	}
+
+	return propagateSize(q, path, -node.Size)
+}
+
 // NodeExists checks if a node for the given path exists in the database. returns
 // true a node is found, false otherwise. If an error occurs, false is returned
 // together with an error
 func NodeExists(path string) (bool, error) {
-	row := db.QueryRow("SELECT EXISTS (SELECT 1 FROM gowncloud.nodes WHERE path = $1)", path)
-	var exists bool
-	err := row.Scan(&exists)
-	if err != nil && err != sql.ErrNoRows {
-		log.Error("Failed to get node from database")
-		return false, ErrDB
+	return nodeExists(db, path)
+}
+
+func nodeExists(q execer, path string) (bool, error) {
+	id, err := nodeIdAt(q, path)
+	if err != nil {
+		return false, err
 	}
-	return exists, nil
+	return id != 0, nil
 }
 
 // GetSharedNode gets the node for the share object
-func GetSharedNode(shareId float64) (*Node, error) {
-	row := db.QueryRow("SELECT * FROM gowncloud.nodes WHERE nodeid in ("+
-		"SELECT nodeid FROM gowncloud.shares WHERE shareid = $1)", intFromFloat(shareId))
-	node := &Node{}
-	var nodeId int
-	err := row.Scan(&nodeId, &node.Owner, &node.Path, &node.Isdir, &node.MimeType, &node.Deleted)
+func GetSharedNode(shareId int64) (*Node, error) {
+	row := db.QueryRow("SELECT "+nodeColumns+" FROM gowncloud.nodes WHERE nodeid in ("+
+		"SELECT nodeid FROM gowncloud.shares WHERE shareid = $1)", shareId)
+	node, err := scanNode(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Debug("Node not found in database for shareId ", shareId)
@@ -146,7 +434,10 @@ func GetSharedNode(shareId float64) (*Node, error) {
 		log.Error("Error getting node from database: ", err)
 		return nil, ErrDB
 	}
-	node.ID = floatFromInt(nodeId)
+	err = resolvePaths(db, []*Node{node}, nil)
+	if err != nil {
+		return nil, err
+	}
 	return node, nil
 }
 
@@ -180,8 +471,8 @@ func GetSharedNamedNodesToTargets(nodeName string, username string, targets []st
 }
 
 func getSharedNamedNodesToUser(nodeName string, user string) ([]*Node, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.nodes WHERE path LIKE '%' || $1 AND "+
-		"nodeid IN (SELECT nodeid FROM gowncloud.shares WHERE target = $2)", nodeName, user)
+	rows, err := db.Query("SELECT "+nodeColumns+" FROM gowncloud.nodes WHERE name = $1 AND "+
+		"nodeid IN (SELECT nodeid FROM gowncloud.shares WHERE target = $2)", nodeName[strings.LastIndex(nodeName, "/")+1:], user)
 	if err != nil {
 		log.Error("Failed to get Nodes from the database")
 		return nil, ErrDB
@@ -191,12 +482,16 @@ func getSharedNamedNodesToUser(nodeName string, user string) ([]*Node, error) {
 		return nil, ErrDB
 	}
 	defer rows.Close()
-	return readNodeRows(rows)
+	nodes, err := readNodeRows(db, rows)
+	if err != nil {
+		return nil, err
+	}
+	return withPathSuffix(nodes, nodeName), nil
 }
 
 func getSharedNamedNodesToGroup(nodeName string, target string) ([]*Node, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.nodes WHERE path LIKE '%' || $1 AND "+
-		"nodeid IN (SELECT nodeid FROM gowncloud.shares WHERE target LIKE $2 || '.' || '%')", nodeName, target)
+	rows, err := db.Query("SELECT "+nodeColumns+" FROM gowncloud.nodes WHERE name = $1 AND "+
+		"nodeid IN (SELECT nodeid FROM gowncloud.shares WHERE target LIKE $2 || '.' || '%')", nodeName[strings.LastIndex(nodeName, "/")+1:], target)
 	if err != nil {
 		log.Error("Failed to get Nodes from the database")
 		return nil, ErrDB
@@ -206,13 +501,17 @@ func getSharedNamedNodesToGroup(nodeName string, target string) ([]*Node, error)
 		return nil, ErrDB
 	}
 	defer rows.Close()
-	return readNodeRows(rows)
+	nodes, err := readNodeRows(db, rows)
+	if err != nil {
+		return nil, err
+	}
+	return withPathSuffix(nodes, nodeName), nil
 }
 
 // GetNodesForUserByName returns all the users nodes ending with the given name
 func GetNodesForUserByName(nodeName string, username string) ([]*Node, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.nodes WHERE path LIKE $1 || '%' "+
-		"|| $2", username, nodeName)
+	rows, err := db.Query("SELECT "+nodeColumns+" FROM gowncloud.nodes WHERE name = $1 AND nodeid IN "+
+		subtreeOf("parentid IS NULL AND name = $2"), nodeName[strings.LastIndex(nodeName, "/")+1:], username)
 	if err != nil {
 		log.Error("Failed to get Nodes from the database: ", err)
 		return nil, ErrDB
@@ -222,149 +521,268 @@ func GetNodesForUserByName(nodeName string, username string) ([]*Node, error) {
 		return nil, ErrDB
 	}
 	defer rows.Close()
-	return readNodeRows(rows)
+	nodes, err := readNodeRows(db, rows)
+	if err != nil {
+		return nil, err
+	}
+	return withPathSuffix(nodes, nodeName), nil
+}
+
+// withPathSuffix returns the nodes of which the path ends with the given
+// elements. Only whole elements match, so "b" matches "a/b" but not "a/ab".
+func withPathSuffix(nodes []*Node, suffix string) []*Node {
+	matching := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		if node.Path == suffix || strings.HasSuffix(node.Path, "/"+suffix) {
+			matching = append(matching, node)
+		}
+	}
+	return matching
 }
 
-// MoveNode updates the nodes path in the database.
+// MoveNode moves the node at originalPath, together with its descendants, to
+// targetPath. Only the node itself is updated, its descendants follow it.
 func MoveNode(originalPath string, targetPath string) error {
-	result, err := db.Exec("UPDATE gowncloud.nodes SET path = $1 WHERE path = $2", targetPath, originalPath)
+	return moveNode(db, originalPath, targetPath)
+}
+
+func moveNode(q execer, originalPath string, targetPath string) error {
+	id, err := nodeIdAt(q, originalPath)
 	if err != nil {
-		log.Errorf("Error updating path %v: %v", originalPath, err)
-		return ErrDB
+		return err
 	}
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		log.Error("Error while updating path")
+	if id == 0 {
+		log.Errorf("Failed to update path: node %v not found", originalPath)
 		return ErrDB
 	}
-	if rowsAffected != 1 {
-		log.Error("Failed to update path")
+	var parentId sql.NullInt64
+	if parent := parentPath(targetPath); parent != "" {
+		parentId.Int64, err = nodeIdAt(q, parent)
+		if err != nil {
+			return err
+		}
+		if parentId.Int64 == 0 {
+			log.Errorf("Failed to update path: target directory %v not found", parent)
+			return ErrDB
+		}
+		parentId.Valid = true
+	}
+	_, err = q.Exec("UPDATE gowncloud.nodes SET parentid = $1, name = $2 WHERE nodeid = $3",
+		parentId, targetPath[strings.LastIndex(targetPath, "/")+1:], id)
+	if err != nil {
+		log.Errorf("Error updating path %v: %v", originalPath, err)
 		return ErrDB
 	}
-
 	return nil
 }
 
-// TransferNode moves a node to a new path and transfers ownership
+// TransferNode moves a node with its descendants to a new path and transfers
+// their ownership, for moves into a directory of another user like a shared
+// folder. The ids of the nodes are kept, so shares, favorites and trash
+// references on the subtree are preserved.
 func TransferNode(originalPath string, targetPath string, newOwner string) error {
-	result, err := db.Exec("UPDATE gowncloud.nodes SET path = $1, owner = $2 WHERE path = $3", targetPath, newOwner, originalPath)
+	return WithTx(func(tx *Tx) error {
+		return transferNode(tx.tx, originalPath, targetPath, newOwner)
+	})
+}
+
+func transferNode(q execer, originalPath string, targetPath string, newOwner string) error {
+	id, err := nodeIdAt(q, originalPath)
 	if err != nil {
-		log.Errorf("Error updating path %v and owner: %v", originalPath, err)
-		return ErrDB
+		return err
 	}
-	rowsAffected, err := result.RowsAffected()
+	err = moveNode(q, originalPath, targetPath)
 	if err != nil {
-		log.Error("Error while updating path and owner")
-		return ErrDB
+		return err
 	}
-	if rowsAffected != 1 {
-		log.Error("Failed to update path and owner")
+	_, err = q.Exec("UPDATE gowncloud.nodes SET owner = $1 WHERE nodeid IN "+subtreeOf("nodeid = $2"),
+		newOwner, id)
+	if err != nil {
+		log.Errorf("Error updating owner of %v: %v", targetPath, err)
 		return ErrDB
 	}
 	return nil
 }
 
-// SearchNodesByName looks for all nodes where the path contains the query, where
-// the user has access
-func SearchNodesByName(nodeName string, user string, targets []string) ([]*Node, error) {
-	nodes, err := getNodesByNameForUser(nodeName, user) //= make([]*Node, 0)
+// readNodeRows reads from *sql.Rows and creates a node for every row, with its path
+func readNodeRows(q execer, rows *sql.Rows) ([]*Node, error) {
+	nodes, err := readNodes(rows)
 	if err != nil {
 		return nil, err
 	}
-	for _, t := range targets {
-		foundNodes, err := getNodesByNameForGroup(nodeName, t)
+	err = resolvePaths(q, nodes, nil)
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// readNodes reads from *sql.Rows and creates a node for every row, without
+// resolving their paths. The rows are closed once read, so other queries can be
+// made in the same transaction.
+func readNodes(rows *sql.Rows) ([]*Node, error) {
+	nodes := make([]*Node, 0)
+	for rows.Next() {
+		node, err := scanNode(rows)
 		if err != nil {
-			return nil, err
-		}
-		// Make sure we don't add duplicates
-		for _, foundNode := range foundNodes {
-			alreadyFound := false
-			for _, node := range nodes {
-				if foundNode.ID == node.ID {
-					alreadyFound = true
-					break
-				}
-			}
-			if !alreadyFound {
-				nodes = append(nodes, foundNode)
-			}
+			log.Error("Error while reading nodes: ", err)
+			return nil, ErrDB
 		}
+		nodes = append(nodes, node)
+	}
+	err := rows.Err()
+	if err != nil {
+		log.Error("Error while reading the nodes rows")
+		return nil, err
 	}
+	rows.Close()
 	return nodes, nil
 }
 
-func getNodesByNameForUser(nodeName string, user string) ([]*Node, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.nodes WHERE path ~ ('.*' || $1 || '[^/]*$') AND "+
-		"nodeid IN (SELECT nodeid FROM gowncloud.nodes WHERE owner = $2 UNION "+
-		"SELECT nodeid FROM gowncloud.nodes WHERE path LIKE ("+
-		"SELECT path FROM gowncloud.nodes WHERE nodeid IN ("+
-		"SELECT nodeid FROM gowncloud.shares WHERE target = $2)) || '%')", nodeName, user)
+// scanNode reads a single node, the columns should be selected in the order of
+// nodeColumns
+func scanNode(row rowScanner) (*Node, error) {
+	node := &Node{}
+	var parentId sql.NullInt64
+	err := row.Scan(&node.ID, &parentId, &node.Name, &node.Owner, &node.Isdir, &node.MimeType, &node.Deleted,
+		&node.Size, &node.Mtime, &node.Etag)
 	if err != nil {
-		log.Error("Failed to get Nodes from the database: ", err)
-		return nil, ErrDB
+		return nil, err
 	}
-	if rows == nil {
-		log.Error("Error loading nodes")
-		return nil, ErrDB
+	node.ParentID = parentId.Int64
+	return node, nil
+}
+
+// pathElement is a node as far as needed to resolve paths
+type pathElement struct {
+	parentId int64
+	name     string
+}
+
+// resolvePaths sets the paths of the nodes by walking up their ancestors. known
+// are the paths which are already known, they end the walk early.
+func resolvePaths(q execer, nodes []*Node, known map[int64]string) error {
+	paths := make(map[int64]string, len(nodes)+len(known))
+	for id, path := range known {
+		paths[id] = path
 	}
-	defer rows.Close()
-	return readNodeRows(rows)
-}
-
-// getNodesByNameForTarget returns all nodes where the path contains the query and the
-// target has access
-func getNodesByNameForGroup(nodeName string, target string) ([]*Node, error) {
-	// '.*' || $1 || '[^/]*$' ==> match any characters before the placeholder, then match
-	// anything as long as its not a slash until the end of the path. This makes sure
-	// we only get nodes where the query is part of the name and not part of the path,
-	// else we would also pull in all the child nodes as well.
-	rows, err := db.Query("SELECT * FROM gowncloud.nodes WHERE path ~ ('.*' || $1 || '[^/]*$') AND "+
-		"nodeid IN ("+
-		"SELECT nodeid FROM gowncloud.nodes WHERE path LIKE ("+
-		"SELECT path FROM gowncloud.nodes WHERE nodeid IN ("+
-		"SELECT nodeid FROM gowncloud.shares WHERE target LIKE $2 || '.' || '%')) || '%')", nodeName, target)
-	if err != nil {
-		log.Error("Failed to get Nodes from the database: ", err)
-		return nil, ErrDB
+	elements := make(map[int64]pathElement, len(nodes))
+	for _, node := range nodes {
+		elements[node.ID] = pathElement{parentId: node.ParentID, name: node.Name}
 	}
-	if rows == nil {
-		log.Error("Error loading nodes")
-		return nil, ErrDB
+
+	// Load the missing ancestors, one level per query
+	for {
+		missing := make([]int64, 0)
+		seen := make(map[int64]bool)
+		for _, element := range elements {
+			id := element.parentId
+			if id == 0 || seen[id] {
+				continue
+			}
+			if _, ok := elements[id]; ok {
+				continue
+			}
+			if _, ok := paths[id]; ok {
+				continue
+			}
+			seen[id] = true
+			missing = append(missing, id)
+		}
+		if len(missing) == 0 {
+			break
+		}
+		for len(missing) > 0 {
+			batch := missing
+			if len(batch) > maxIdsPerQuery {
+				batch = batch[:maxIdsPerQuery]
+			}
+			missing = missing[len(batch):]
+			err := loadPathElements(q, batch, elements)
+			if err != nil {
+				return err
+			}
+			// Ancestors which don't exist are remembered as home directories,
+			// so the walk ends
+			for _, id := range batch {
+				if _, ok := elements[id]; !ok {
+					log.Warn("Ancestor of node not found in database: ", id)
+					elements[id] = pathElement{}
+				}
+			}
+		}
 	}
-	defer rows.Close()
-	return readNodeRows(rows)
+
+	var resolve func(id int64) string
+	resolve = func(id int64) string {
+		if path, ok := paths[id]; ok {
+			return path
+		}
+		element := elements[id]
+		path := element.name
+		if element.parentId != 0 {
+			path = resolve(element.parentId) + "/" + path
+		}
+		paths[id] = path
+		return path
+	}
+	for _, node := range nodes {
+		node.Path = resolve(node.ID)
+	}
+	return nil
 }
 
-// readNodeRows reads from *sql.Rows and creates a node for every row
-func readNodeRows(rows *sql.Rows) ([]*Node, error) {
-	nodes := make([]*Node, 0)
+// loadPathElements loads the parent ids and names of the nodes with the given ids
+func loadPathElements(q execer, ids []int64, elements map[int64]pathElement) error {
+	qb := &queryBuilder{}
+	rows, err := q.Query("SELECT nodeid, parentid, name FROM gowncloud.nodes WHERE nodeid IN ("+
+		idList(qb, ids)+")", qb.args...)
+	if err != nil {
+		log.Error("Failed to resolve node paths: ", err)
+		return ErrDB
+	}
+	defer rows.Close()
 	for rows.Next() {
-		node := &Node{}
-		var nodeId int
-		err := rows.Scan(&nodeId, &node.Owner, &node.Path, &node.Isdir, &node.MimeType, &node.Deleted)
+		var id int64
+		var parentId sql.NullInt64
+		var name string
+		err = rows.Scan(&id, &parentId, &name)
 		if err != nil {
-			log.Error("Error while reading nodes")
-			return nil, ErrDB
+			log.Error("Failed to resolve node paths: ", err)
+			return ErrDB
 		}
-		node.ID = floatFromInt(nodeId)
-		nodes = append(nodes, node)
+		elements[id] = pathElement{parentId: parentId.Int64, name: name}
 	}
-	err := rows.Err()
-	if err != nil {
-		log.Error("Error while reading the nodes rows")
-		return nil, err
+	if err = rows.Err(); err != nil {
+		log.Error("Failed to resolve node paths: ", err)
+		return ErrDB
 	}
-	return nodes, nil
+	return nil
 }
 
-// floatFromInt returns the float64 represented by the bit configuration of the input int
-// the input and output are exactly the same when written as a bit string
-func floatFromInt(i int) float64 {
-	return math.Float64frombits(uint64(i))
+// idList adds the ids as arguments of the query, and returns their placeholders
+// separated by commas
+func idList(qb *queryBuilder, ids []int64) string {
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		placeholders[i] = qb.arg(id)
+	}
+	return strings.Join(placeholders, ", ")
 }
 
-// intFromFloat returns the int represented by the bit configuration of the input float64
-// the input and output are exactly the same when written as a bit string
-func intFromFloat(f float64) int {
-	return int(math.Float64bits(f))
+// nodesByPath sorts nodes on their path
+type nodesByPath []*Node
+
+func (n nodesByPath) Len() int           { return len(n) }
+func (n nodesByPath) Less(i, j int) bool { return n[i].Path < n[j].Path }
+func (n nodesByPath) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+// newEtag generates a new random etag
+func newEtag() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
 }
@@ -0,0 +1,195 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Notification tells a user or group about something that needs their
+// attention, like a folder shared with them
+type Notification struct {
+	ID int64
+	// Target is the user or group the notification is for
+	Target string
+	// App is the app the notification is about, e.g. files_sharing
+	App string
+	// Subject tells what the notification is about, e.g. incoming_share
+	Subject string
+	// ObjectType and ObjectID identify the object of the notification, e.g. the
+	// share
+	ObjectType string
+	ObjectID   string
+	// Parameters are the details used to show the notification
+	Parameters map[string]string
+	Time       time.Time
+}
+
+// notificationColumns are the columns of the notifications table read into a
+// Notification
+const notificationColumns = "notificationid, target, app, subject, objecttype, objectid, parameters, time"
+
+// CreateNotification saves a notification, the id and time are set
+func CreateNotification(notification *Notification) error {
+	parameters, err := json.Marshal(notification.Parameters)
+	if err != nil {
+		log.Error("Failed to encode the notification parameters: ", err)
+		return ErrDB
+	}
+	notification.Time = time.Now()
+	err = db.QueryRow("INSERT INTO gowncloud.notifications (target, app, subject, objecttype, objectid, parameters, time) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING notificationid", notification.Target, notification.App,
+		notification.Subject, notification.ObjectType, notification.ObjectID, string(parameters),
+		notification.Time).Scan(&notification.ID)
+	if err != nil {
+		log.Error("Failed to save notification: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// GetNotifications returns the notifications of the user and his groups which
+// he didn't dismiss, newest first. Only the notifications with a higher id than
+// since are returned, 0 returns all of them.
+func GetNotifications(username string, groups []string, since int64) ([]*Notification, error) {
+	qb := &queryBuilder{}
+	qb.where("(" + shareTargetCondition(qb, "n.target", username, groups) + ")")
+	qb.where("NOT EXISTS (SELECT 1 FROM gowncloud.notificationdismissals d WHERE " +
+		"d.notificationid = n.notificationid AND d.username = " + qb.arg(username) + ")")
+	if since > 0 {
+		qb.where("n.notificationid > " + qb.arg(since))
+	}
+	rows, err := db.Query("SELECT "+prefixColumns("n.", notificationColumns)+" FROM gowncloud.notifications n "+
+		"WHERE "+strings.Join(qb.conditions, " AND ")+" ORDER BY n.notificationid DESC", qb.args...)
+	if err != nil {
+		log.Error("Failed to get notifications: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	notifications := make([]*Notification, 0)
+	for rows.Next() {
+		notification, err := scanNotification(rows)
+		if err != nil {
+			log.Error("Error while reading notifications: ", err)
+			return nil, ErrDB
+		}
+		notifications = append(notifications, notification)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Error while reading the notification rows: ", err)
+		return nil, ErrDB
+	}
+	return notifications, nil
+}
+
+// GetNotification returns a notification of the user or his groups, or nil if
+// it doesn't exist or he dismissed it
+func GetNotification(id int64, username string, groups []string) (*Notification, error) {
+	qb := &queryBuilder{}
+	qb.where("n.notificationid = " + qb.arg(id))
+	qb.where("(" + shareTargetCondition(qb, "n.target", username, groups) + ")")
+	qb.where("NOT EXISTS (SELECT 1 FROM gowncloud.notificationdismissals d WHERE " +
+		"d.notificationid = n.notificationid AND d.username = " + qb.arg(username) + ")")
+	row := db.QueryRow("SELECT "+prefixColumns("n.", notificationColumns)+" FROM gowncloud.notifications n "+
+		"WHERE "+strings.Join(qb.conditions, " AND "), qb.args...)
+	notification, err := scanNotification(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Error("Failed to get notification: ", err)
+		return nil, ErrDB
+	}
+	return notification, nil
+}
+
+// DismissNotification hides a notification from the user. Notifications for
+// the user are removed, notifications for his groups are only hidden from him.
+func DismissNotification(notification *Notification, username string) error {
+	var err error
+	if notification.Target == username {
+		err = deleteNotifications("notificationid = $1", notification.ID)
+	} else {
+		_, err = db.Exec("INSERT INTO gowncloud.notificationdismissals (notificationid, username) VALUES ($1, $2) "+
+			"ON CONFLICT (notificationid, username) DO NOTHING", notification.ID, username)
+		if err != nil {
+			log.Error("Failed to dismiss notification: ", err)
+			err = ErrDB
+		}
+	}
+	return err
+}
+
+// DeleteNotificationsForObject removes the notifications about an object, e.g.
+// when a share is removed
+func DeleteNotificationsForObject(objectType, objectId string) error {
+	return deleteNotifications("objecttype = $1 AND objectid = $2", objectType, objectId)
+}
+
+// deleteNotifications removes the notifications matching the condition, with
+// their dismissals
+func deleteNotifications(condition string, args ...interface{}) error {
+	_, err := db.Exec("DELETE FROM gowncloud.notificationdismissals WHERE notificationid IN ("+
+		"SELECT notificationid FROM gowncloud.notifications WHERE "+condition+")", args...)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM gowncloud.notifications WHERE "+condition, args...)
+	}
+	if err != nil {
+		log.Error("Failed to delete notifications: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// deleteNotificationsOfUser removes the notifications for the user, and the
+// notifications he dismissed
+func deleteNotificationsOfUser(username string) error {
+	_, err := db.Exec("DELETE FROM gowncloud.notificationdismissals WHERE username = $1", username)
+	if err != nil {
+		log.Error("Failed to delete the notifications of the user: ", err)
+		return ErrDB
+	}
+	return deleteNotifications("target = $1", username)
+}
+
+// GetQuotaWarning returns the percentage of the quota of the user for which he
+// was warned last, 0 if he wasn't warned
+func GetQuotaWarning(username string) (int, error) {
+	var warning int
+	err := db.QueryRow("SELECT quotawarning FROM gowncloud.users WHERE username = $1", username).Scan(&warning)
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Failed to get the quota warning of the user: ", err)
+		return 0, ErrDB
+	}
+	return warning, nil
+}
+
+// SetQuotaWarning records the percentage of the quota of the user for which he
+// was warned
+func SetQuotaWarning(username string, warning int) error {
+	_, err := db.Exec("UPDATE gowncloud.users SET quotawarning = $1 WHERE username = $2", warning, username)
+	if err != nil {
+		log.Error("Failed to set the quota warning of the user: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// scanNotification reads a notification from a row of the notificationColumns
+func scanNotification(row rowScanner) (*Notification, error) {
+	notification := &Notification{}
+	var parameters string
+	err := row.Scan(&notification.ID, &notification.Target, &notification.App, &notification.Subject,
+		&notification.ObjectType, &notification.ObjectID, &parameters, &notification.Time)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(parameters), &notification.Parameters)
+	if err != nil {
+		log.Warnf("Invalid parameters of notification %v: %v", notification.ID, err)
+	}
+	return notification, nil
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// PhotoMetadata is the information extracted from the EXIF data of an image.
+// Fields which are not present in the image are left nil or empty.
+type PhotoMetadata struct {
+	NodeID int64
+	// Etag is the etag of the node when the metadata was extracted
+	Etag string
+	// Taken is the time the photo was taken
+	Taken *time.Time
+	// Make and Model identify the camera
+	Make  string
+	Model string
+	// Latitude and Longitude are the GPS position in degrees, negative values
+	// are south and west
+	Latitude  *float64
+	Longitude *float64
+	// Width and Height are the dimensions of the image as it is displayed
+	Width  int
+	Height int
+}
+
+// photoMetadataColumns are the columns of the photometadata table, in the order
+// scanPhotoMetadata reads them
+const photoMetadataColumns = "nodeid, etag, taken, make, model, latitude, longitude, width, height"
+
+// SavePhotoMetadata stores the metadata of a photo, replacing the metadata
+// extracted from an earlier version of the file
+func SavePhotoMetadata(metadata *PhotoMetadata) error {
+	_, err := db.Exec("INSERT INTO gowncloud.photometadata ("+photoMetadataColumns+") "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT (nodeid) DO UPDATE SET "+
+		"etag = excluded.etag, taken = excluded.taken, make = excluded.make, model = excluded.model, "+
+		"latitude = excluded.latitude, longitude = excluded.longitude, "+
+		"width = excluded.width, height = excluded.height",
+		metadata.NodeID, metadata.Etag, metadata.Taken, metadata.Make, metadata.Model,
+		metadata.Latitude, metadata.Longitude, metadata.Width, metadata.Height)
+	if err != nil {
+		log.Error("Failed to save photo metadata: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// GetPhotoMetadata returns the stored metadata of the node, or nil if there is none
+func GetPhotoMetadata(nodeId int64) (*PhotoMetadata, error) {
+	row := db.QueryRow("SELECT "+photoMetadataColumns+" FROM gowncloud.photometadata "+
+		"WHERE nodeid = $1", nodeId)
+	metadata, err := scanPhotoMetadata(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Error("Failed to get photo metadata: ", err)
+		return nil, ErrDB
+	}
+	return metadata, nil
+}
+
+// GetPhotoMetadataForNodes returns the stored metadata of the nodes, indexed by
+// node id. Nodes without metadata are not in the result.
+func GetPhotoMetadataForNodes(nodeIds []int64) (map[int64]*PhotoMetadata, error) {
+	result := make(map[int64]*PhotoMetadata)
+	if len(nodeIds) == 0 {
+		return result, nil
+	}
+	qb := &queryBuilder{}
+	placeholders := make([]string, len(nodeIds))
+	for i, nodeId := range nodeIds {
+		placeholders[i] = qb.arg(nodeId)
+	}
+	rows, err := db.Query("SELECT "+photoMetadataColumns+" FROM gowncloud.photometadata "+
+		"WHERE nodeid IN ("+strings.Join(placeholders, ", ")+")", qb.args...)
+	if err != nil {
+		log.Error("Failed to get photo metadata: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	for rows.Next() {
+		metadata, err := scanPhotoMetadata(rows)
+		if err != nil {
+			log.Error("Error while reading photo metadata: ", err)
+			return nil, ErrDB
+		}
+		result[metadata.NodeID] = metadata
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("Error while reading the photo metadata rows: ", err)
+		return nil, ErrDB
+	}
+	return result, nil
+}
+
+// GetNodesWithoutPhotoMetadata returns the images in the home directory of the
+// user of which the metadata is missing or outdated
+func GetNodesWithoutPhotoMetadata(username string) ([]*Node, error) {
+	rows, err := db.Query("SELECT "+nodeColumns+" FROM gowncloud.nodes n WHERE "+
+		"n.nodeid IN "+subtreeOf("parentid IS NULL AND name = $1")+" AND n.isdir = false AND "+
+		"n.mimetype LIKE 'image/%' AND NOT EXISTS ("+
+		"SELECT 1 FROM gowncloud.photometadata m WHERE m.nodeid = n.nodeid AND m.etag = n.etag)", username)
+	if err != nil {
+		log.Error("Failed to get nodes without photo metadata: ", err)
+		return nil, ErrDB
+	}
+	if rows == nil {
+		log.Error("Error loading nodes")
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	nodes, err := readNodeRows(db, rows)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(nodesByPath(nodes))
+	return nodes, nil
+}
+
+// scanPhotoMetadata reads the metadata of a single photo, the columns should be
+// selected in the order of photoMetadataColumns
+func scanPhotoMetadata(row rowScanner) (*PhotoMetadata, error) {
+	metadata := &PhotoMetadata{}
+	var taken *time.Time
+	var latitude, longitude sql.NullFloat64
+	err := row.Scan(&metadata.NodeID, &metadata.Etag, &taken, &metadata.Make, &metadata.Model,
+		&latitude, &longitude, &metadata.Width, &metadata.Height)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Taken = taken
+	if latitude.Valid && longitude.Valid {
+		metadata.Latitude = &latitude.Float64
+		metadata.Longitude = &longitude.Float64
+	}
+	return metadata, nil
+}
@@ -0,0 +1,277 @@
+package db
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// NodeQuery describes a structured search for nodes. All the set conditions must
+// match for a node to be returned. Only nodes the user has access to, either by
+// owning them or through a share to the user or one of its groups, are searched.
+type NodeQuery struct {
+	// User is the user performing the search
+	User string
+	// Groups are the groups (organizations) the user is a member of
+	Groups []string
+	// Names are the strings that must all be part of the node name
+	Names []string
+	// MimeTypes limits the result to nodes with one of these mimetypes. A mimetype
+	// ending in a '/' matches all mimetypes with that prefix
+	MimeTypes []string
+	// IsDir limits the result to directories or files if it is set
+	IsDir *bool
+	// Owners limits the result to nodes owned by one of these users
+	Owners []string
+	// Shared limits the result to nodes shared by or with the user
+	Shared bool
+	// Favorite limits the result to nodes marked as favorite by the user
+	Favorite bool
+	// Under limits the result to the descendants of the node at this path
+	Under string
+	// Size are the conditions on the node size in bytes
+	Size []Comparison
+	// Mtime are the conditions on the node modification time, in seconds since epoch
+	Mtime []Comparison
+	// Sort is the field to sort on, one of the Sort* constants
+	Sort string
+	// Descending reverses the sort order
+	Descending bool
+	// Limit is the maximum amount of nodes to return, 0 means no limit
+	Limit int
+	// Offset is the amount of matching nodes to skip
+	Offset int
+}
+
+// Comparison is a condition on a numeric node property
+type Comparison struct {
+	// Operator is one of "<", "<=", "=", ">=" and ">"
+	Operator string
+	Value    int64
+}
+
+const (
+	SortByName  = "name"
+	SortByPath  = "path"
+	SortBySize  = "size"
+	SortByMtime = "mtime"
+	// SortByTaken sorts photos on the time they were taken, and other nodes on
+	// their modification time
+	SortByTaken = "taken"
+)
+
+// sortExpressions maps the Sort* constants to their SQL expressions. Paths are
+// not stored, so SortByPath is sorted after the query.
+var sortExpressions = map[string]string{
+	SortByName:  "lower(n.name)",
+	SortBySize:  "n.size",
+	SortByMtime: "n.mtime",
+	SortByTaken: "COALESCE((SELECT m.taken FROM gowncloud.photometadata m WHERE m.nodeid = n.nodeid), n.mtime)",
+}
+
+// comparisonOperators are the allowed comparison operators
+var comparisonOperators = map[string]bool{
+	"<":  true,
+	"<=": true,
+	"=":  true,
+	">=": true,
+	">":  true,
+}
+
+// queryBuilder collects the conditions and arguments of a query, keeping track
+// of the numbered placeholders
+type queryBuilder struct {
+	conditions []string
+	args       []interface{}
+}
+
+// arg adds an argument to the query and returns its placeholder
+func (qb *queryBuilder) arg(value interface{}) string {
+	qb.args = append(qb.args, value)
+	return "$" + strconv.Itoa(len(qb.args))
+}
+
+// where adds a condition to the query
+func (qb *queryBuilder) where(condition string) {
+	qb.conditions = append(qb.conditions, condition)
+}
+
+// accessCondition returns the SQL condition for the nodes the user can access:
+// the files in his own home directory, and the nodes shared with him or one of
+// his groups, including their descendants. alias is the alias of the nodes table.
+func accessCondition(qb *queryBuilder, alias, username string, groups []string) string {
+	files := homeDirectory(qb.arg(username), "'files'")
+	shared := "SELECT s.nodeid FROM gowncloud.shares s WHERE " + shareTargetCondition(qb, "s.target", username, groups)
+	return alias + ".nodeid IN " + subtreeOf("parentid = "+files+" OR nodeid IN ("+shared+")")
+}
+
+// shareTargetCondition returns the SQL condition for share targets which
+// include the user: the user himself, his groups and their subgroups
+func shareTargetCondition(qb *queryBuilder, column, username string, groups []string) string {
+	targets := []string{column + " = " + qb.arg(username)}
+	for _, group := range groups {
+		g := qb.arg(group)
+		targets = append(targets, column+" = "+g, column+" LIKE "+g+" || '.%'")
+	}
+	return strings.Join(targets, " OR ")
+}
+
+// CanAccessNode checks if the user can access the node, because it is in his
+// home directory or shared with him or one of his groups
+func CanAccessNode(nodeId int64, username string, groups []string) (bool, error) {
+	qb := &queryBuilder{}
+	node := qb.arg(nodeId)
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM gowncloud.nodes n WHERE n.nodeid = "+node+
+		" AND "+accessCondition(qb, "n", username, groups)+")", qb.args...).Scan(&exists)
+	if err != nil {
+		log.Error("Failed to check access to node: ", err)
+		return false, ErrDB
+	}
+	return exists, nil
+}
+
+// SearchNodes returns all the nodes matching the query.
+func SearchNodes(q *NodeQuery) ([]*Node, error) {
+	var under int64
+	if q.Under != "" {
+		var err error
+		under, err = nodeIdAt(db, q.Under)
+		if err != nil {
+			return nil, err
+		}
+	}
+	query, args, err := compileSearch(q, under, db.dialect)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("Searching nodes: ", query)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Error("Failed to search nodes in the database: ", err)
+		return nil, ErrDB
+	}
+	if rows == nil {
+		log.Error("Error loading nodes")
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	nodes, err := readNodeRows(db, rows)
+	if err != nil {
+		return nil, err
+	}
+	if q.Sort == SortByPath {
+		nodes = sortByPath(nodes, q)
+	}
+	return nodes, nil
+}
+
+// compileSearch returns the SQL query for a search and its arguments. under is
+// the id of the node at q.Under, if it is set.
+func compileSearch(q *NodeQuery, under int64, d *dialect) (string, []interface{}, error) {
+	qb := &queryBuilder{}
+	user := qb.arg(q.User)
+	qb.where(accessCondition(qb, "n", q.User, q.Groups))
+
+	if q.Under != "" {
+		qb.where("n.nodeid IN " + subtreeOf("parentid = "+qb.arg(under)))
+	}
+
+	for _, name := range q.Names {
+		qb.where(d.contains(qb, "n.name", name))
+	}
+
+	if len(q.MimeTypes) > 0 {
+		mimeConditions := make([]string, len(q.MimeTypes))
+		for i, mimetype := range q.MimeTypes {
+			if strings.HasSuffix(mimetype, "/") {
+				mimeConditions[i] = "n.mimetype LIKE " + qb.arg(mimetype) + " || '%'"
+				continue
+			}
+			mimeConditions[i] = "n.mimetype = " + qb.arg(mimetype)
+		}
+		qb.where("(" + strings.Join(mimeConditions, " OR ") + ")")
+	}
+
+	if q.IsDir != nil {
+		qb.where("n.isdir = " + qb.arg(*q.IsDir))
+	}
+
+	if len(q.Owners) > 0 {
+		owners := make([]string, len(q.Owners))
+		for i, owner := range q.Owners {
+			owners[i] = qb.arg(owner)
+		}
+		qb.where("n.owner IN (" + strings.Join(owners, ", ") + ")")
+	}
+
+	if q.Shared {
+		qb.where("(n.owner != " + user + " OR " +
+			"EXISTS (SELECT 1 FROM gowncloud.shares s WHERE s.nodeid = n.nodeid))")
+	}
+
+	if q.Favorite {
+		qb.where("EXISTS (SELECT 1 FROM gowncloud.favorites f WHERE f.nodeid = n.nodeid AND " +
+			"f.username = " + user + ")")
+	}
+
+	for _, c := range q.Size {
+		if !comparisonOperators[c.Operator] {
+			log.Error("Invalid comparison operator: ", c.Operator)
+			return "", nil, ErrDB
+		}
+		qb.where("n.size " + c.Operator + " " + qb.arg(c.Value))
+	}
+
+	for _, c := range q.Mtime {
+		if !comparisonOperators[c.Operator] {
+			log.Error("Invalid comparison operator: ", c.Operator)
+			return "", nil, ErrDB
+		}
+		qb.where("n.mtime " + c.Operator + " " + qb.arg(time.Unix(c.Value, 0)))
+	}
+
+	sortExpression, ok := sortExpressions[q.Sort]
+	if !ok && q.Sort != SortByPath {
+		sortExpression = sortExpressions[SortByName]
+	}
+	order := " ASC"
+	if q.Descending {
+		order = " DESC"
+	}
+
+	query := "SELECT " + prefixColumns("n.", nodeColumns) + " FROM gowncloud.nodes n WHERE " +
+		strings.Join(qb.conditions, " AND ")
+	if q.Sort != SortByPath {
+		query += " ORDER BY " + sortExpression + order + ", n.name" + order + ", n.nodeid" + order
+		if q.Limit > 0 {
+			query += " LIMIT " + qb.arg(q.Limit)
+		}
+		if q.Offset > 0 {
+			query += " OFFSET " + qb.arg(q.Offset)
+		}
+	}
+	return query, qb.args, nil
+}
+
+// sortByPath sorts the nodes on their path and applies the limit and offset of
+// the query, which can't be done by the database
+func sortByPath(nodes []*Node, q *NodeQuery) []*Node {
+	if q.Descending {
+		sort.Sort(sort.Reverse(nodesByPath(nodes)))
+	} else {
+		sort.Sort(nodesByPath(nodes))
+	}
+	if q.Offset >= len(nodes) {
+		return nodes[:0]
+	}
+	nodes = nodes[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(nodes) {
+		nodes = nodes[:q.Limit]
+	}
+	return nodes
+}
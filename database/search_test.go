@@ -0,0 +1,168 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileSearch(t *testing.T) {
+	isDir := true
+	tests := []struct {
+		name    string
+		query   NodeQuery
+		dialect *dialect
+		under   int64
+		// contains are parts of the expected query, excludes must not be in it
+		contains []string
+		excludes []string
+		// args are the arguments after the ones of the access condition
+		args []interface{}
+		err  error
+	}{
+		{
+			name:     "access only",
+			contains: []string{"h.name = $2", "s.target = $3", "ORDER BY lower(n.name) ASC, n.name ASC, n.nodeid ASC"},
+			excludes: []string{"LIMIT", "OFFSET"},
+		},
+		{
+			name:     "groups",
+			query:    NodeQuery{Groups: []string{"staff"}},
+			contains: []string{"s.target = $3 OR s.target = $4 OR s.target LIKE $4 || '.%'"},
+			args:     []interface{}{"staff"},
+		},
+		{
+			name:     "names",
+			query:    NodeQuery{Names: []string{"holiday", "cat"}},
+			contains: []string{"strpos(lower(n.name), lower($4)) > 0 AND strpos(lower(n.name), lower($5)) > 0"},
+			args:     []interface{}{"holiday", "cat"},
+		},
+		{
+			name:     "names on SQLite",
+			query:    NodeQuery{Names: []string{"cat"}},
+			dialect:  sqliteDialect,
+			contains: []string{"instr(lower(n.name), lower($4)) > 0"},
+			args:     []interface{}{"cat"},
+		},
+		{
+			name:     "mimetypes",
+			query:    NodeQuery{MimeTypes: []string{"image/", "application/pdf"}},
+			contains: []string{"(n.mimetype LIKE $4 || '%' OR n.mimetype = $5)"},
+			args:     []interface{}{"image/", "application/pdf"},
+		},
+		{
+			name:     "directories",
+			query:    NodeQuery{IsDir: &isDir},
+			contains: []string{"n.isdir = $4"},
+			args:     []interface{}{true},
+		},
+		{
+			name:     "owners",
+			query:    NodeQuery{Owners: []string{"bob", "carol"}},
+			contains: []string{"n.owner IN ($4, $5)"},
+			args:     []interface{}{"bob", "carol"},
+		},
+		{
+			name:     "shared and favorite",
+			query:    NodeQuery{Shared: true, Favorite: true},
+			contains: []string{"(n.owner != $1 OR EXISTS (SELECT 1 FROM gowncloud.shares s WHERE s.nodeid = n.nodeid))", "f.username = $1"},
+		},
+		{
+			name:     "under",
+			query:    NodeQuery{Under: "alice/files/photos"},
+			under:    42,
+			contains: []string{"WHERE parentid = $4 UNION ALL"},
+			args:     []interface{}{int64(42)},
+		},
+		{
+			name:     "size and mtime",
+			query:    NodeQuery{Size: []Comparison{{">=", 1024}}, Mtime: []Comparison{{"<", 1500000000}}},
+			contains: []string{"n.size >= $4 AND n.mtime < $5"},
+			args:     []interface{}{int64(1024), time.Unix(1500000000, 0)},
+		},
+		{
+			name:  "invalid size operator",
+			query: NodeQuery{Size: []Comparison{{"!=", 0}}},
+			err:   ErrDB,
+		},
+		{
+			name:  "invalid mtime operator",
+			query: NodeQuery{Mtime: []Comparison{{"; DROP TABLE nodes; --", 0}}},
+			err:   ErrDB,
+		},
+		{
+			name:     "sort with paging",
+			query:    NodeQuery{Sort: SortBySize, Descending: true, Limit: 10, Offset: 20},
+			contains: []string{"ORDER BY n.size DESC, n.name DESC, n.nodeid DESC LIMIT $4 OFFSET $5"},
+			args:     []interface{}{10, 20},
+		},
+		{
+			name:     "unknown sort",
+			query:    NodeQuery{Sort: "owner"},
+			contains: []string{"ORDER BY lower(n.name) ASC"},
+		},
+		{
+			// Paths are sorted and paged after the query
+			name:     "sort on path",
+			query:    NodeQuery{Sort: SortByPath, Limit: 10, Offset: 20},
+			excludes: []string{"ORDER BY", "LIMIT", "OFFSET"},
+		},
+	}
+	for _, test := range tests {
+		d := test.dialect
+		if d == nil {
+			d = cockroachDialect
+		}
+		test.query.User = "alice"
+		query, args, err := compileSearch(&test.query, test.under, d)
+		if err != test.err {
+			t.Errorf("%v: compileSearch returned error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for _, part := range test.contains {
+			if !strings.Contains(query, part) {
+				t.Errorf("%v: query %q doesn't contain %q", test.name, query, part)
+			}
+		}
+		for _, part := range test.excludes {
+			if strings.Contains(query, part) {
+				t.Errorf("%v: query %q contains %q", test.name, query, part)
+			}
+		}
+		want := append([]interface{}{"alice", "alice", "alice"}, test.args...)
+		if !reflect.DeepEqual(args, want) {
+			t.Errorf("%v: compileSearch args = %v, want %v", test.name, args, want)
+		}
+	}
+}
+
+func TestSortByPath(t *testing.T) {
+	paths := []string{"alice/files/b", "alice/files/a/z", "alice/files/a", "alice/files/c"}
+	tests := []struct {
+		query NodeQuery
+		paths []string
+	}{
+		{NodeQuery{}, []string{"alice/files/a", "alice/files/a/z", "alice/files/b", "alice/files/c"}},
+		{NodeQuery{Descending: true}, []string{"alice/files/c", "alice/files/b", "alice/files/a/z", "alice/files/a"}},
+		{NodeQuery{Offset: 1, Limit: 2}, []string{"alice/files/a/z", "alice/files/b"}},
+		{NodeQuery{Offset: 3, Limit: 2}, []string{"alice/files/c"}},
+		{NodeQuery{Offset: 4}, []string{}},
+	}
+	for _, test := range tests {
+		nodes := make([]*Node, len(paths))
+		for i, path := range paths {
+			nodes[i] = &Node{Path: path}
+		}
+		sorted := make([]string, 0)
+		for _, node := range sortByPath(nodes, &test.query) {
+			sorted = append(sorted, node.Path)
+		}
+		if !reflect.DeepEqual(sorted, test.paths) {
+			t.Errorf("sortByPath with %+v = %v, want %v", test.query, sorted, test.paths)
+		}
+	}
+}
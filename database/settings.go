@@ -1,6 +1,11 @@
 package db
 
-import log "github.com/Sirupsen/logrus"
+import (
+	"database/sql"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
 
 var (
 	// DEFAULT_ALLOWED_SPACE is the default allowed space, assigned to every new user
@@ -9,21 +14,28 @@ var (
 	DAV_ROOT = "davroot"
 	// VERSION is the current version of the apps
 	VERSION = "version"
+	// MAINTENANCE is "true" when the server is in maintenance mode
+	MAINTENANCE = "maintenance"
+	// ADMINS is a comma separated list of the users allowed to use the admin API
+	ADMINS = "admins"
+	// UPLOAD_MAX_SIZE is the maximum size in bytes of a file uploaded through
+	// the web interface
+	UPLOAD_MAX_SIZE = "uploadmaxsize"
+	// INSTANCE_ID identifies this gowncloud instance, it is part of the oc:id of
+	// the nodes
+	INSTANCE_ID = "instanceid"
 )
 
-var settings map[string]string
+var (
+	settings map[string]string
+	// settingsLock guards settings, which can be reloaded while serving requests
+	settingsLock sync.RWMutex
+)
 
-// initSettings initializes the settings table
-func initSettings() {
+// loadSettings loads the settings from the database, storing the default
+// settings on first run
+func loadSettings() {
 	settings = make(map[string]string)
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS gowncloud.settings (" +
-		"key STRING NOT NULL UNIQUE," +
-		"value STRING NOT NULL" +
-		")")
-	if err != nil {
-		log.Fatal("Failed to create table 'settings': ", err)
-	}
-
 	rows, err := db.Query("SELECT * FROM gowncloud.settings")
 	if err != nil {
 		log.Error("Failed to get settings from the database")
@@ -34,7 +46,6 @@ func initSettings() {
 		return
 	}
 	defer rows.Close()
-	rowCount := 0
 	for rows.Next() {
 		var key, value string
 		err = rows.Scan(&key, &value)
@@ -43,9 +54,10 @@ func initSettings() {
 			return
 		}
 		settings[key] = value
-		rowCount++
 	}
-	if rowCount == 0 {
+	// Migrations can store settings, so the first run is recognized by the
+	// missing dav root rather than by an empty table
+	if _, ok := settings[DAV_ROOT]; !ok {
 		log.Warn("No settings found")
 		makeDefaultSettings()
 		return
@@ -55,17 +67,21 @@ func initSettings() {
 		log.Error("Error while reading the settings rows")
 	}
 
-	log.Debug("Initialized 'settings' table")
+	log.Debug("Loaded settings")
 }
 
 // GetSetting returns the value for key key from the database
 func GetSetting(key string) string {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
 	return settings[key]
 }
 
 // UpdateSetting stores the updated setting in the database table
 func UpdateSetting(key, value string) error {
 	log.Debugf("Update key %v to value %v", key, value)
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
 	if settings[key] == "" {
 		log.Error("Trying to update unexisting key")
 		return ErrDB
@@ -87,15 +103,60 @@ func UpdateSetting(key, value string) error {
 	return nil
 }
 
+// ReloadSetting reads the current value of the setting from the database, so
+// changes made by other processes are picked up
+func ReloadSetting(key string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM gowncloud.settings WHERE key = $1", key).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		log.Errorf("Error reloading key %v: %v", key, err)
+		return GetSetting(key), ErrDB
+	}
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	settings[key] = value
+	return value, nil
+}
+
+// SetSetting stores the setting in the database, creating it if it doesn't exist yet
+func SetSetting(key, value string) error {
+	log.Debugf("Set key %v to value %v", key, value)
+	_, err := db.Exec("INSERT INTO gowncloud.settings (key, value) VALUES ($1, $2) "+
+		"ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value)
+	if err != nil {
+		log.Errorf("Error setting key %v: %v", key, err)
+		return ErrDB
+	}
+	settingsLock.Lock()
+	defer settingsLock.Unlock()
+	settings[key] = value
+	return nil
+}
+
+// GetSettings returns a copy of all the settings
+func GetSettings() map[string]string {
+	settingsLock.RLock()
+	defer settingsLock.RUnlock()
+	copied := make(map[string]string, len(settings))
+	for key, value := range settings {
+		copied[key] = value
+	}
+	return copied
+}
+
 // makeDefaultSettings generates the default settings and stores them in the database.
 func makeDefaultSettings() {
 	log.Warn("Generating default settings")
 
-	settings[DEFAULT_ALLOWED_SPACE] = "0"
-	settings[DAV_ROOT] = "gowncloud-data"
-	settings[VERSION] = "?"
+	defaults := map[string]string{
+		DEFAULT_ALLOWED_SPACE: "0",
+		DAV_ROOT:              "gowncloud-data",
+		VERSION:               "?",
+		UPLOAD_MAX_SIZE:       "536870912",
+	}
 
-	for key, value := range settings {
+	for key, value := range defaults {
+		settings[key] = value
 		_, err := db.Exec("INSERT INTO gowncloud.settings (key, value) VALUES ($1, $2)",
 			key, value)
 		if err != nil {
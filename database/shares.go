@@ -13,14 +13,19 @@ import (
 // he/she should be found by getting the owner from the nodes table with the user
 // of the node id.
 type Share struct {
-	ShareID     float64
-	NodeID      float64
+	ShareID     int64
+	NodeID      int64
 	Target      string
 	Time        time.Time
 	Permissions int
 	ShareType   int
+	// Expiration is when the share is removed, nil if it doesn't expire
+	Expiration *time.Time
 }
 
+// shareColumns are the columns of the shares table read into a Share
+const shareColumns = "shareid, nodeid, target, time, permissions, sharetype, expiration"
+
 const (
 	USERSHARE = iota
 	GROUPSHARE
@@ -28,30 +33,10 @@ const (
 	LINKSHARE
 )
 
-// initShares initializes the member shares table
-func initShares() {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS gowncloud.shares (" +
-		"shareid SERIAL UNIQUE PRIMARY KEY, " +
-		"nodeid INTEGER REFERENCES gowncloud.nodes, " +
-		"target STRING NOT NULL, " +
-		"time TIMESTAMPTZ NOT NULL," +
-		"permissions INTEGER NOT NULL," +
-		"sharetype INTEGER NOT NULL" +
-		")")
-	if err != nil {
-		log.Fatal("Failed to create table 'shares': ", err)
-	}
-
-	log.Debug("Initialized 'shares' table")
-}
-
 // GetShare gets share info from the database for the given share id.
-func GetShareById(shareId float64) (*Share, error) {
-	share := &Share{}
-	var sId int
-	var nodeId int
-	row := db.QueryRow("SELECT * FROM gowncloud.shares WHERE shareid = $1", intFromFloat(shareId))
-	err := row.Scan(&sId, &nodeId, &share.Target, &share.Time, &share.Permissions, &share.ShareType)
+func GetShareById(shareId int64) (*Share, error) {
+	row := db.QueryRow("SELECT "+shareColumns+" FROM gowncloud.shares WHERE shareid = $1", shareId)
+	share, err := scanShare(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Debug("Share not found in database for share id: ", shareId)
@@ -60,19 +45,14 @@ func GetShareById(shareId float64) (*Share, error) {
 		log.Error("Error getting share from database: ", err)
 		return nil, ErrDB
 	}
-	share.ShareID = floatFromInt(sId)
-	share.NodeID = floatFromInt(nodeId)
 	return share, nil
 }
 
 // GetNodeShareToTarget get the share for a node to a target. In case the target is a group,
 // shares to subgroups will not be included.
-func GetNodeShareToTarget(nodeId float64, target string) (*Share, error) {
-	share := &Share{}
-	var sId int
-	var nId int
-	row := db.QueryRow("SELECT * FROM gowncloud.shares WHERE nodeid = $1 AND target = $2", intFromFloat(nodeId), target)
-	err := row.Scan(&sId, &nId, &share.Target, &share.Time, &share.Permissions, &share.ShareType)
+func GetNodeShareToTarget(nodeId int64, target string) (*Share, error) {
+	row := db.QueryRow("SELECT "+shareColumns+" FROM gowncloud.shares WHERE nodeid = $1 AND target = $2", nodeId, target)
+	share, err := scanShare(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Debugf("Share not found in database for nodeId %v to user %v", nodeId, target)
@@ -81,15 +61,16 @@ func GetNodeShareToTarget(nodeId float64, target string) (*Share, error) {
 		log.Error("Error getting share from database: ", err)
 		return nil, ErrDB
 	}
-	share.ShareID = floatFromInt(sId)
-	share.NodeID = floatFromInt(nId)
 	return share, nil
 }
 
 // GetSharesByNodePath returns all shares for a node with the given path
 func GetSharesByNodePath(path string) ([]*Share, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.shares WHERE nodeid IN ("+
-		"SELECT nodeid FROM gowncloud.nodes WHERE path = $1)", path)
+	nodeId, err := nodeIdAt(db, path)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT "+shareColumns+" FROM gowncloud.shares WHERE nodeid = $1", nodeId)
 	if err != nil {
 		log.Error("Failed to get Nodes from the database: ", err)
 		return nil, ErrDB
@@ -103,8 +84,8 @@ func GetSharesByNodePath(path string) ([]*Share, error) {
 }
 
 // GetSharesByNodeId gets all the shares for the node id
-func GetSharesByNodeId(nodeId float64) ([]*Share, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.shares WHERE nodeid = $1", intFromFloat(nodeId))
+func GetSharesByNodeId(nodeId int64) ([]*Share, error) {
+	rows, err := db.Query("SELECT "+shareColumns+" FROM gowncloud.shares WHERE nodeid = $1", nodeId)
 	if err != nil {
 		log.Error("Failed to get Nodes from the database: ", err)
 		return nil, ErrDB
@@ -119,7 +100,7 @@ func GetSharesByNodeId(nodeId float64) ([]*Share, error) {
 
 // GetSharesToTarget gets all the shares where user is the target
 func GetSharesToTarget(target string) ([]*Share, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.shares WHERE target = $1", target)
+	rows, err := db.Query("SELECT "+shareColumns+" FROM gowncloud.shares WHERE target = $1", target)
 	if err != nil {
 		log.Error("Failed to get Nodes from the database: ", err)
 		return nil, ErrDB
@@ -134,7 +115,7 @@ func GetSharesToTarget(target string) ([]*Share, error) {
 
 // GetSharesToGroup loads all shares to a group. It also includes subgroups.
 func GetSharesToGroup(target string) ([]*Share, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.shares WHERE target LIKE $1 || '%'", target)
+	rows, err := db.Query("SELECT "+shareColumns+" FROM gowncloud.shares WHERE target LIKE $1 || '%'", target)
 	if err != nil {
 		log.Error("Failed to get shared nodes from the database: ", err)
 		return nil, ErrDB
@@ -180,20 +161,20 @@ func GetAllSharesToUser(username string, groups []string) ([]*Share, error) {
 
 // CreateShareToUser creates a new share on the node to the target with permissions.
 // Share time is the current system time
-func CreateShareToUser(nodeId float64, permissions int, target string) (*Share, error) {
+func CreateShareToUser(nodeId int64, permissions int, target string) (*Share, error) {
 	return CreateShare(nodeId, permissions, target, USERSHARE)
 }
 
 // CreateShareToGroup creates a new share on the node to the target with permissions.
 // Share time is the current system time
-func CreateShareToGroup(nodeId float64, permissions int, target string) (*Share, error) {
+func CreateShareToGroup(nodeId int64, permissions int, target string) (*Share, error) {
 	return CreateShare(nodeId, permissions, target, GROUPSHARE)
 }
 
 // CreateShare creates a new share
-func CreateShare(nodeId float64, permissions int, target string, sharetype int) (*Share, error) {
+func CreateShare(nodeId int64, permissions int, target string, sharetype int) (*Share, error) {
 	_, err := db.Exec("INSERT INTO gowncloud.shares (nodeid, target, time, permissions, sharetype) "+
-		"VALUES ($1, $2, $3, $4, $5)", intFromFloat(nodeId), target, time.Now(), permissions, sharetype)
+		"VALUES ($1, $2, $3, $4, $5)", nodeId, target, time.Now(), permissions, sharetype)
 	if err != nil {
 		log.Error("Error while creating share: ", err)
 		return nil, ErrDB
@@ -203,9 +184,9 @@ func CreateShare(nodeId float64, permissions int, target string, sharetype int)
 
 // DeleteNodeShareToUserFromNodeId deletes the share of the node with nodeId to
 // the target.
-func DeleteNodeShareToUserFromNodeId(nodeId float64, target string) error {
+func DeleteNodeShareToUserFromNodeId(nodeId int64, target string) error {
 	_, err := db.Exec("DELETE FROM gowncloud.shares WHERE target = $1 AND "+
-		"nodeid = $2", target, intFromFloat(nodeId))
+		"nodeid = $2", target, nodeId)
 	if err != nil {
 		log.Error("Error while deleting share: ", err)
 		return ErrDB
@@ -215,9 +196,9 @@ func DeleteNodeShareToUserFromNodeId(nodeId float64, target string) error {
 
 // DeleteShare removes the share with shareId from the database. It does not remove
 // the acutal node.
-func DeleteShare(shareId float64) error {
-	log.Debug("TRY TO DELETE SHARE WITH SHAREID: ", intFromFloat(shareId))
-	_, err := db.Exec("DELETE FROM gowncloud.shares WHERE shareid = $1", intFromFloat(shareId))
+func DeleteShare(shareId int64) error {
+	log.Debug("TRY TO DELETE SHARE WITH SHAREID: ", shareId)
+	_, err := db.Exec("DELETE FROM gowncloud.shares WHERE shareid = $1", shareId)
 	if err != nil {
 		log.Error("Error while deleting share: ", err)
 		return ErrDB
@@ -239,10 +220,42 @@ func DeleteShareWithPartialId(partialId int, username string) error {
 	return nil
 }
 
+// DeleteDanglingShares removes the shares on nodes that no longer exist. It
+// returns the amount of removed shares.
+func DeleteDanglingShares() (int64, error) {
+	result, err := db.Exec("DELETE FROM gowncloud.shares WHERE nodeid NOT IN (" +
+		"SELECT nodeid FROM gowncloud.nodes)")
+	if err != nil {
+		log.Error("Error while deleting dangling shares: ", err)
+		return 0, ErrDB
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		log.Error("Error while deleting dangling shares: ", err)
+		return 0, ErrDB
+	}
+	return count, nil
+}
+
+// GetAllShares returns all the shares
+func GetAllShares() ([]*Share, error) {
+	rows, err := db.Query("SELECT " + shareColumns + " FROM gowncloud.shares ORDER BY shareid")
+	if err != nil {
+		log.Error("Failed to get shares from the database: ", err)
+		return nil, ErrDB
+	}
+	if rows == nil {
+		log.Error("Error loading shares")
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	return readSharesRows(rows)
+}
+
 // GetSharedNodesForUser returns share info on all the nodes of a user that are
 // currently being shared
 func GetSharedNodesForUser(username string) ([]*Share, error) {
-	rows, err := db.Query("SELECT * FROM gowncloud.shares WHERE nodeid IN ("+
+	rows, err := db.Query("SELECT "+shareColumns+" FROM gowncloud.shares WHERE nodeid IN ("+
 		"SELECT nodeid FROM gowncloud.nodes WHERE owner = $1)", username)
 	if err != nil {
 		log.Error("Failed to get shared nodes from the database: ", err)
@@ -260,16 +273,11 @@ func GetSharedNodesForUser(username string) ([]*Share, error) {
 func readSharesRows(rows *sql.Rows) ([]*Share, error) {
 	shares := make([]*Share, 0)
 	for rows.Next() {
-		share := &Share{}
-		var sId int
-		var nId int
-		err := rows.Scan(&sId, &nId, &share.Target, &share.Time, &share.Permissions, &share.ShareType)
+		share, err := scanShare(rows)
 		if err != nil {
 			log.Error("Error while reading shares: ", err)
 			return nil, ErrDB
 		}
-		share.ShareID = floatFromInt(sId)
-		share.NodeID = floatFromInt(nId)
 		shares = append(shares, share)
 	}
 	err := rows.Err()
@@ -279,3 +287,61 @@ func readSharesRows(rows *sql.Rows) ([]*Share, error) {
 	}
 	return shares, nil
 }
+
+// scanShare reads a share from a row of the shareColumns
+func scanShare(row rowScanner) (*Share, error) {
+	share := &Share{}
+	err := row.Scan(&share.ShareID, &share.NodeID, &share.Target, &share.Time, &share.Permissions, &share.ShareType,
+		&share.Expiration)
+	if err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+// SetShareExpiration sets when the share expires, nil keeps the share until it
+// is removed. A new expiry warning is sent for the new expiration.
+func SetShareExpiration(shareId int64, expiration *time.Time) error {
+	_, err := db.Exec("UPDATE gowncloud.shares SET expiration = $1, expirywarned = $2 WHERE shareid = $3",
+		expiration, false, shareId)
+	if err != nil {
+		log.Error("Error while setting the share expiration: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// GetSharesToWarn returns the shares expiring before the time for which no
+// expiry warning has been sent yet
+func GetSharesToWarn(before time.Time) ([]*Share, error) {
+	rows, err := db.Query("SELECT "+shareColumns+" FROM gowncloud.shares WHERE expiration IS NOT NULL AND "+
+		"expiration < $1 AND expirywarned = $2 ORDER BY shareid", before, false)
+	if err != nil {
+		log.Error("Failed to get the expiring shares: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	return readSharesRows(rows)
+}
+
+// SetShareExpiryWarned records that the expiry warning of the share was sent
+func SetShareExpiryWarned(shareId int64) error {
+	_, err := db.Exec("UPDATE gowncloud.shares SET expirywarned = $1 WHERE shareid = $2", true, shareId)
+	if err != nil {
+		log.Error("Error while updating the share: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// GetExpiredShares returns the shares which expired before the time
+func GetExpiredShares(before time.Time) ([]*Share, error) {
+	rows, err := db.Query("SELECT "+shareColumns+" FROM gowncloud.shares WHERE expiration IS NOT NULL AND "+
+		"expiration <= $1 ORDER BY shareid", before)
+	if err != nil {
+		log.Error("Failed to get the expired shares: ", err)
+		return nil, ErrDB
+	}
+	defer rows.Close()
+	return readSharesRows(rows)
+}
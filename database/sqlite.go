@@ -0,0 +1,10 @@
+//go:build sqlite
+// +build sqlite
+
+package db
+
+import (
+	// sqlite driver, it requires cgo so it is only included when building with
+	// the sqlite tag
+	_ "github.com/mattn/go-sqlite3"
+)
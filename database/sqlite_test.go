@@ -0,0 +1,249 @@
+//go:build sqlite
+// +build sqlite
+
+package db
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDatabase connects to a new SQLite database in a temporary directory,
+// the returned function closes and removes it
+func openTestDatabase(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "gowncloud-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, dataSource, err := dialectFor("sqlite://" + filepath.Join(dir, "gowncloud.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	conn, err := sql.Open(d.driver, dataSource)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	db = &database{DB: conn, dialect: d}
+	return func() {
+		conn.Close()
+		db = nil
+		os.RemoveAll(dir)
+	}
+}
+
+// migrateTo applies the migrations up to version
+func migrateTo(t *testing.T, version int) {
+	err := initMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if m.version > version {
+			break
+		}
+		err = applyMigration(m)
+		if err != nil {
+			t.Fatalf("Failed to apply migration %v", m.version)
+		}
+	}
+}
+
+func TestSQLiteMigrate(t *testing.T) {
+	defer openTestDatabase(t)()
+
+	err := Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := SchemaVersion()
+	if err != nil || version != LatestSchemaVersion() {
+		t.Fatalf("SchemaVersion() = %v, %v, want %v", version, err, LatestSchemaVersion())
+	}
+	applied, err := GetAppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("%v migrations applied, want %v", len(applied), len(migrations))
+	}
+	for i, m := range applied {
+		if m.Version != migrations[i].version || m.Description != migrations[i].description {
+			t.Errorf("Applied migration %v is %v %q, want %v %q", i, m.Version, m.Description,
+				migrations[i].version, migrations[i].description)
+		}
+	}
+
+	// Migrating an up to date database does nothing
+	err = Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("INSERT INTO gowncloud.schema_migrations (version, description) VALUES ($1, $2)",
+		LatestSchemaVersion()+1, "From the future")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Migrate(); err != ErrSchemaTooNew {
+		t.Errorf("Migrate() with a newer schema = %v, want %v", err, ErrSchemaTooNew)
+	}
+}
+
+func TestSQLiteMigrateNodePaths(t *testing.T) {
+	defer openTestDatabase(t)()
+
+	// The nodes are stored with their path until migration 9 links them to
+	// their parents
+	migrateTo(t, 8)
+	_, err := db.Exec("INSERT INTO gowncloud.users (username, allowedspace) VALUES ('alice', 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{"alice", "alice/files", "alice/files/photos", "alice/files/photos/cat.jpg", "alice/files/notes.txt"}
+	ids := make(map[string]int64)
+	for _, path := range paths {
+		result, err := db.Exec("INSERT INTO gowncloud.nodes (owner, path, isdir, mimetype, deleted) VALUES ('alice', $1, $2, '', false)",
+			path, filepath.Ext(path) == "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[path], err = result.LastInsertId()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		node, err := GetNode(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node == nil || node.ID != ids[path] || node.Path != path {
+			t.Errorf("GetNode(%q) = %+v, want node %v", path, node, ids[path])
+		}
+	}
+}
+
+func TestSQLiteNodeTree(t *testing.T) {
+	defer openTestDatabase(t)()
+	migrateTo(t, LatestSchemaVersion())
+	_, err := CreateUser("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{"alice", "alice/files", "alice/files/a", "alice/files/b"} {
+		if _, err = SaveNode(dir, "alice", true, "dir"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = SaveNode("alice/files/a/x.txt", "alice", false, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = SaveNode("alice/files/a/missing/y.txt", "alice", false, "text/plain"); err != ErrDB {
+		t.Errorf("SaveNode without a parent = %v, want %v", err, ErrDB)
+	}
+	if _, err = SaveNode("alice/files/a", "alice", true, "dir"); err != ErrDB {
+		t.Errorf("SaveNode of an existing directory = %v, want %v", err, ErrDB)
+	}
+	if _, err = SaveNode("alice", "alice", true, "dir"); err != ErrDB {
+		t.Errorf("SaveNode of an existing home directory = %v, want %v", err, ErrDB)
+	}
+
+	file, err := GetNode("alice/files/a/x.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = UpdateFileMetadata(file.Path, 42, file.Mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	// The size is propagated to the ancestors
+	checkSizes := func(sizes map[string]int64) {
+		for path, size := range sizes {
+			node, err := GetNode(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if node == nil {
+				t.Errorf("Node %v not found", path)
+			} else if node.Size != size {
+				t.Errorf("Size of %v = %v, want %v", path, node.Size, size)
+			}
+		}
+	}
+	checkSizes(map[string]int64{"alice": 42, "alice/files": 42, "alice/files/a": 42, "alice/files/b": 0})
+
+	// The descendants follow a moved node
+	err = WithTx(func(tx *Tx) error {
+		err := tx.MoveNode("alice/files/a", "alice/files/b/a")
+		if err == nil {
+			err = tx.PropagateSize("alice/files/a", -42)
+		}
+		if err == nil {
+			err = tx.PropagateSize("alice/files/b/a", 42)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := GetNode("alice/files/b/a/x.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved == nil || moved.ID != file.ID {
+		t.Errorf("GetNode of the moved file = %+v, want node %v", moved, file.ID)
+	}
+	if exists, _ := NodeExists("alice/files/a"); exists {
+		t.Error("The moved directory still exists at its old path")
+	}
+	checkSizes(map[string]int64{"alice/files": 42, "alice/files/b": 42, "alice/files/b/a": 42})
+
+	subtree, err := GetSubtreeNodes("alice/files/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"alice/files/b", "alice/files/b/a", "alice/files/b/a/x.txt"}
+	if len(subtree) != len(want) {
+		t.Fatalf("GetSubtreeNodes returned %v nodes, want %v", len(subtree), len(want))
+	}
+	for i, node := range subtree {
+		if node.Path != want[i] {
+			t.Errorf("GetSubtreeNodes node %v = %v, want %v", i, node.Path, want[i])
+		}
+	}
+
+	// A failing transaction leaves the tree unchanged
+	err = WithTx(func(tx *Tx) error {
+		err := tx.DeleteNode("alice/files/b")
+		if err != nil {
+			return err
+		}
+		return tx.MoveNode("alice/files/nothing", "alice/files/c")
+	})
+	if err != ErrDB {
+		t.Errorf("WithTx with a failing move = %v, want %v", err, ErrDB)
+	}
+	checkSizes(map[string]int64{"alice/files": 42, "alice/files/b/a/x.txt": 42})
+
+	err = DeleteNode("alice/files/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range want {
+		if exists, _ := NodeExists(path); exists {
+			t.Errorf("Node %v still exists after deleting its ancestor", path)
+		}
+	}
+	checkSizes(map[string]int64{"alice": 0, "alice/files": 0})
+}
@@ -7,47 +7,43 @@ import (
 )
 
 type TrashNode struct {
-	NodeId float64
+	NodeId int64
 	Owner  string
 	Path   string
 	IsDir  bool
 }
 
-func initTrashNodes() {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS gowncloud.trashnodes (" +
-		"nodeid INTEGER REFERENCES gowncloud.nodes, " +
-		"owner STRING REFERENCES gowncloud.users, " +
-		"path STRING NOT NULL UNIQUE, " +
-		"isdir BOOL NOT NULL" +
-		")")
-	if err != nil {
-		log.Fatal("Failed to create table 'trashnodes': ", err)
-	}
-
-	log.Debug("Initialized 'trashnodes' table")
+// CreateTrashNode creates a new trash node that links to the original node
+func CreateTrashNode(nodeId int64, owner string, path string, isDir bool) (*TrashNode, error) {
+	return createTrashNode(db, nodeId, owner, path, isDir)
 }
 
-// CreateTrashNode creates a new trash node that links to the original node
-func CreateTrashNode(nodeId float64, owner string, path string, isDir bool) (*TrashNode, error) {
-	_, err := db.Exec("INSERT INTO gowncloud.trashnodes (nodeid, owner, path, isdir) "+
-		"VALUES ($1, $2, $3, $4)", intFromFloat(nodeId), owner, path, isDir)
+func createTrashNode(q execer, nodeId int64, owner string, path string, isDir bool) (*TrashNode, error) {
+	_, err := q.Exec("INSERT INTO gowncloud.trashnodes (nodeid, owner, path, isdir) "+
+		"VALUES ($1, $2, $3, $4)", nodeId, owner, path, isDir)
 
 	if err != nil {
 		log.Error("Error while saving trashnode: ", err)
 		return nil, ErrDB
 	}
 
-	return GetTrashNode(path)
+	return getTrashNode(q, path)
 }
 
 // GetTrashNode gets the trash node at the given path. If no node is found,
 // nil is returned without error.
 func GetTrashNode(path string) (*TrashNode, error) {
+	return getTrashNode(db, path)
+}
+
+func getTrashNode(q execer, path string) (*TrashNode, error) {
+	nodeId, err := nodeIdAt(q, path)
+	if err != nil {
+		return nil, err
+	}
 	tn := &TrashNode{}
-	var nId int
-	row := db.QueryRow("SELECT * FROM gowncloud.trashnodes WHERE nodeid in ("+
-		"SELECT nodeid FROM gowncloud.nodes WHERE path = $1)", path)
-	err := row.Scan(&nId, &tn.Owner, &tn.Path, &tn.IsDir)
+	row := q.QueryRow("SELECT * FROM gowncloud.trashnodes WHERE nodeid = $1", nodeId)
+	err = row.Scan(&tn.NodeId, &tn.Owner, &tn.Path, &tn.IsDir)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Debug("No trash node found for path: ", path)
@@ -56,7 +52,6 @@ func GetTrashNode(path string) (*TrashNode, error) {
 		log.Error("Error getting trash node: ", err)
 		return nil, ErrDB
 	}
-	tn.NodeId = floatFromInt(nId)
 	return tn, nil
 }
 
@@ -68,3 +63,39 @@ func DeleteTrashNode(path string) error {
 	}
 	return nil
 }
+
+// DeleteTrashNodesUnder deletes the trash nodes of the node at path and of all its
+// descendants, once they are restored from the trash
+func DeleteTrashNodesUnder(path string) error {
+	return deleteTrashNodesUnder(db, path)
+}
+
+func deleteTrashNodesUnder(q execer, path string) error {
+	nodeId, err := nodeIdAt(q, path)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec("DELETE FROM gowncloud.trashnodes WHERE nodeid IN "+subtreeOf("nodeid = $1"), nodeId)
+	if err != nil {
+		log.Error("Error while deleting trashnodes: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// DeleteStaleTrashNodes removes the trash nodes of the user which point to a node
+// that is no longer in the trash. It returns the amount of removed trash nodes.
+func DeleteStaleTrashNodes(owner string) (int64, error) {
+	result, err := db.Exec("DELETE FROM gowncloud.trashnodes WHERE owner = $1 AND nodeid NOT IN "+
+		subtreeOf("parentid = "+homeDirectory("$1", "'files_trash'")), owner)
+	if err != nil {
+		log.Error("Error while deleting stale trashnodes: ", err)
+		return 0, ErrDB
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		log.Error("Error while deleting stale trashnodes: ", err)
+		return 0, ErrDB
+	}
+	return count, nil
+}
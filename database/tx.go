@@ -0,0 +1,137 @@
+package db
+
+import (
+	"database/sql"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// execer runs queries, it is implemented by both the database and a transaction
+// so the same functions can be used with and without a transaction
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Tx is a database transaction for operations which take multiple steps. Queries
+// made outside the transaction while it runs don't see its changes, and on SQLite
+// writes outside it wait until it ends.
+type Tx struct {
+	tx *transaction
+	// compensations undo the changes made outside the database in the
+	// transaction, they are run in reverse order if it is rolled back
+	compensations []func()
+}
+
+// OnRollback registers a function undoing a change made outside the database,
+// like creating a directory on disk. It is called if the transaction is rolled
+// back or fails to commit.
+func (tx *Tx) OnRollback(compensate func()) {
+	tx.compensations = append(tx.compensations, compensate)
+}
+
+// rollback rolls back the transaction and undoes the changes made outside the
+// database
+func (tx *Tx) rollback() {
+	err := tx.tx.Rollback()
+	if err != nil {
+		log.Error("Failed to roll back transaction: ", err)
+	}
+	tx.compensate()
+}
+
+// compensate runs the compensations, the last registered one first
+func (tx *Tx) compensate() {
+	for i := len(tx.compensations) - 1; i >= 0; i-- {
+		tx.compensations[i]()
+	}
+}
+
+// WithTx runs fn in a transaction. The transaction is committed if fn returns
+// nil, and rolled back if fn returns an error or panics. The registered
+// compensations are run when the transaction is rolled back or fails to commit,
+// so a failing operation leaves neither the database nor the disk half changed.
+func WithTx(fn func(tx *Tx) error) error {
+	sqlTx, err := db.Begin()
+	if err != nil {
+		log.Error("Failed to start transaction: ", err)
+		return ErrDB
+	}
+	tx := &Tx{tx: sqlTx}
+	defer func() {
+		r := recover()
+		if r != nil {
+			tx.rollback()
+			panic(r)
+		}
+	}()
+
+	err = fn(tx)
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	err = sqlTx.Commit()
+	if err != nil {
+		log.Error("Failed to commit transaction: ", err)
+		tx.compensate()
+		return ErrDB
+	}
+	return nil
+}
+
+// GetNode gets the node with the given path in the transaction, see GetNode
+func (tx *Tx) GetNode(path string) (*Node, error) {
+	return getNode(tx.tx, path)
+}
+
+// NodeExists checks if a node exists in the transaction, see NodeExists
+func (tx *Tx) NodeExists(path string) (bool, error) {
+	return nodeExists(tx.tx, path)
+}
+
+// GetSubtreeNodes gets a node and its descendants in the transaction, see GetSubtreeNodes
+func (tx *Tx) GetSubtreeNodes(path string) ([]*Node, error) {
+	return getSubtreeNodes(tx.tx, path)
+}
+
+// SaveNode saves a new node in the transaction, see SaveNode
+func (tx *Tx) SaveNode(path, owner string, isdir bool, mimetype string) (*Node, error) {
+	return saveNode(tx.tx, path, owner, isdir, mimetype)
+}
+
+// MoveNode updates the path of a node in the transaction, see MoveNode
+func (tx *Tx) MoveNode(originalPath string, targetPath string) error {
+	return moveNode(tx.tx, originalPath, targetPath)
+}
+
+// TransferNode moves a node to another owner in the transaction, see TransferNode
+func (tx *Tx) TransferNode(originalPath string, targetPath string, newOwner string) error {
+	return transferNode(tx.tx, originalPath, targetPath, newOwner)
+}
+
+// DeleteNode deletes a node and its descendants in the transaction, see DeleteNode
+func (tx *Tx) DeleteNode(path string) error {
+	return deleteNode(tx.tx, path)
+}
+
+// PropagateSize updates the ancestors of a node in the transaction, see PropagateSize
+func (tx *Tx) PropagateSize(path string, delta int64) error {
+	return propagateSize(tx.tx, path, delta)
+}
+
+// CreateTrashNode creates a trash node in the transaction, see CreateTrashNode
+func (tx *Tx) CreateTrashNode(nodeId int64, owner string, path string, isDir bool) (*TrashNode, error) {
+	return createTrashNode(tx.tx, nodeId, owner, path, isDir)
+}
+
+// DeleteTrashNodesUnder deletes the trash nodes of a subtree in the transaction, see DeleteTrashNodesUnder
+func (tx *Tx) DeleteTrashNodesUnder(path string) error {
+	return deleteTrashNodesUnder(tx.tx, path)
+}
+
+// CreateUser creates a user in the transaction, see CreateUser
+func (tx *Tx) CreateUser(username string) (*User, error) {
+	return createUser(tx.tx, username)
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"database/sql"
 	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -14,29 +15,19 @@ type User struct {
 	Allowedspace int // allowed storage space for this user in GB
 }
 
-// initUsers initializes the users table
-func initUsers() {
-	_, err := db.Exec("CREATE TABLE IF NOT EXISTS gowncloud.users (" +
-		"id SERIAL UNIQUE, " +
-		"username STRING PRIMARY KEY, " +
-		"allowedspace INT" +
-		")")
-	if err != nil {
-		log.Fatal("Failed to create table 'users': ", err)
-	}
-
-	log.Debug("Initialized 'users' table")
-}
-
 // CreateUser creates a new user entry in the database. If the user already exists,
 // an error will be returned.
 func CreateUser(username string) (*User, error) {
+	return createUser(db, username)
+}
+
+func createUser(q execer, username string) (*User, error) {
 	user := &User{}
 	defaultSpace, err := strconv.Atoi(GetSetting(DEFAULT_ALLOWED_SPACE))
 	if err != nil {
 		log.Error("Could not read default allowed space from settings")
 	}
-	_, err = db.Exec("INSERT INTO gowncloud.users (username, allowedspace) VALUES ($1, $2)",
+	_, err = q.Exec("INSERT INTO gowncloud.users (username, allowedspace) VALUES ($1, $2)",
 		username, defaultSpace)
 	if err != nil {
 		log.Error("Failed to insert new user in database: ", err)
@@ -44,7 +35,7 @@ func CreateUser(username string) (*User, error) {
 	}
 
 	// retrieve the user from the database to get the ID
-	row := db.QueryRow("SELECT * FROM gowncloud.users WHERE username = $1", username)
+	row := q.QueryRow("SELECT COALESCE(id, 0), username, allowedspace FROM gowncloud.users WHERE username = $1", username)
 	err = row.Scan(&user.id, &user.Username, &user.Allowedspace)
 	if err != nil {
 		log.Panic("Failed to get user from database: ", err)
@@ -59,7 +50,7 @@ func CreateUser(username string) (*User, error) {
 // before using it and create the user if required.
 func GetUser(username string) (*User, error) {
 	user := &User{}
-	row := db.QueryRow("SELECT * FROM gowncloud.users WHERE username = $1", username)
+	row := db.QueryRow("SELECT COALESCE(id, 0), username, allowedspace FROM gowncloud.users WHERE username = $1", username)
 	err := row.Scan(&user.id, &user.Username, &user.Allowedspace)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -101,3 +92,112 @@ func SearchUserNames(search string) ([]string, error) {
 	}
 	return usernames, nil
 }
+
+// SetAllowedSpace changes the allowed storage space of the user, in GB. 0 means
+// the space is unlimited.
+func SetAllowedSpace(username string, allowedSpace int) error {
+	result, err := db.Exec("UPDATE gowncloud.users SET allowedspace = $1 WHERE username = $2",
+		allowedSpace, username)
+	if err != nil {
+		log.Errorf("Failed to update allowed space of user %v: %v", username, err)
+		return ErrDB
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected != 1 {
+		log.Error("Failed to update allowed space of user ", username)
+		return ErrDB
+	}
+	return nil
+}
+
+// DeleteUser removes the user and all his nodes from the database, together with
+// the shares to the user and his favorites, albums, activities and
+// notifications. The files on disk are not removed.
+func DeleteUser(username string) error {
+	err := DeleteNode(username)
+	if err != nil {
+		return err
+	}
+	// Nodes of the user in the home directory of another user are transferred to
+	// the owner of that home directory
+	rows, err := db.Query("SELECT "+nodeColumns+" FROM gowncloud.nodes WHERE owner = $1", username)
+	if err != nil {
+		log.Error("Failed to transfer the nodes of the user: ", err)
+		return ErrDB
+	}
+	defer rows.Close()
+	nodes, err := readNodeRows(db, rows)
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		_, err = db.Exec("UPDATE gowncloud.nodes SET owner = $1 WHERE nodeid = $2",
+			strings.SplitN(node.Path, "/", 2)[0], node.ID)
+		if err != nil {
+			log.Error("Failed to transfer the nodes of the user: ", err)
+			return ErrDB
+		}
+	}
+	_, err = db.Exec("DELETE FROM gowncloud.shares WHERE target = $1 AND sharetype = $2", username, USERSHARE)
+	if err != nil {
+		log.Error("Failed to delete shares to user: ", err)
+		return ErrDB
+	}
+	_, err = db.Exec("DELETE FROM gowncloud.favorites WHERE username = $1", username)
+	if err != nil {
+		log.Error("Failed to delete favorites of user: ", err)
+		return ErrDB
+	}
+	_, err = db.Exec("DELETE FROM gowncloud.albumshares WHERE target = $1 AND sharetype = $2", username, USERSHARE)
+	if err != nil {
+		log.Error("Failed to delete album shares to user: ", err)
+		return ErrDB
+	}
+	albums, err := GetAlbumsForUser(username, nil)
+	if err != nil {
+		return err
+	}
+	for _, album := range albums {
+		if album.Owner != username {
+			continue
+		}
+		err = DeleteAlbum(album.ID)
+		if err != nil {
+			return err
+		}
+	}
+	err = deleteActivitiesOfTarget(username)
+	if err != nil {
+		return err
+	}
+	err = deleteNotificationsOfUser(username)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM gowncloud.trashnodes WHERE owner = $1", username)
+	if err != nil {
+		log.Error("Failed to delete trash nodes of user: ", err)
+		return ErrDB
+	}
+	_, err = db.Exec("DELETE FROM gowncloud.users WHERE username = $1", username)
+	if err != nil {
+		log.Error("Failed to delete user: ", err)
+		return ErrDB
+	}
+	return nil
+}
+
+// IsAdmin checks if the user is listed in the admins setting. The setting is
+// reloaded so admins can be added without restarting the server.
+func IsAdmin(username string) (bool, error) {
+	admins, err := ReloadSetting(ADMINS)
+	if err != nil {
+		return false, err
+	}
+	for _, admin := range strings.Split(admins, ",") {
+		if strings.TrimSpace(admin) == username {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,73 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	db "github.com/gowncloud/gowncloud/database"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// AppDataDir is the directory in the root of the file system where gowncloud
+// keeps the data it generates itself, e.g. the previews and the blobs of the
+// deduplicated files. Its files are not deduplicated.
+const AppDataDir = "appdata_gowncloud"
+
+// NodeKey returns the name of the directory holding the data generated for a
+// node in the app-data area, e.g. its previews
+func NodeKey(node *db.Node) string {
+	return strconv.FormatInt(node.ID, 10)
+}
+
+// WriteFile writes the content read from r to the file name in fileSystem,
+// creating the parent directories. The content is written to a temporary file
+// first so readers never see a partial file.
+func WriteFile(ctx context.Context, fileSystem webdav.FileSystem, name string, r io.Reader) error {
+	err := MkdirAll(ctx, fileSystem, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	tempName := name + ".tmp" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	file, err := fileSystem.OpenFile(ctx, tempName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fileSystem.RemoveAll(ctx, tempName)
+		return err
+	}
+	return fileSystem.Rename(ctx, tempName, name)
+}
+
+// MkdirAll creates the directory name in fileSystem, along with the parents
+// that don't exist yet
+func MkdirAll(ctx context.Context, fileSystem webdav.FileSystem, name string) error {
+	if name == "" || name == "." || name == "/" {
+		return nil
+	}
+	info, err := fileSystem.Stat(ctx, name)
+	if err == nil {
+		if !info.IsDir() {
+			return os.ErrExist
+		}
+		return nil
+	}
+	err = MkdirAll(ctx, fileSystem, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	err = fileSystem.Mkdir(ctx, name, os.ModePerm)
+	if os.IsExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,44 @@
+package fs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowncloud-appdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := NewLocalFileSystem(dir)
+	ctx := context.Background()
+
+	name := AppDataDir + "/previews/42/etag/preview.jpg"
+	for _, content := range [][]byte{[]byte("first"), []byte("second")} {
+		err = WriteFile(ctx, base, name, bytes.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := readTestFile(base, name)
+		if err != nil || !bytes.Equal(read, content) {
+			t.Errorf("Reading the written file = %q, %v, want %q", read, err, content)
+		}
+	}
+	files, err := ioutil.ReadDir(base.resolve(AppDataDir + "/previews/42/etag"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("WriteFile left %v files in the directory, want 1", len(files))
+	}
+
+	// A file in the way of a directory is not replaced
+	if err = MkdirAll(ctx, base, name+"/dir"); err != os.ErrExist {
+		t.Errorf("MkdirAll below a file returned %v, want %v", err, os.ErrExist)
+	}
+}
@@ -0,0 +1,612 @@
+package fs
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	db "github.com/gowncloud/gowncloud/database"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// A deduplicated file is stored as a pointer to a blob holding its content. The
+// blobs are stored once per distinct content in blobDir, named after the SHA-256
+// hash of the content. A pointer consists of blobMagic followed by the hash and
+// the size of the content and an HMAC of both, each on their own line. The HMAC
+// is keyed with the key in pointerKeyFile, so a file stored with the content of
+// a pointer, e.g. before deduplication was enabled, can't be used to read the
+// blobs of other users.
+const (
+	// blobDir is the directory of the blob store, blobs are stored as
+	// blobDir/<first 2 characters of the hash>/<hash>
+	blobDir = AppDataDir + "/blobs"
+	// blobTempDir is the directory where new blobs are written before they are
+	// moved into the blob store
+	blobTempDir = blobDir + "/tmp"
+	blobMagic   = "GOWNBLOB2\n"
+	// maxPointerSize is the maximum size of a pointer, larger files are not
+	// read to check if they are one
+	maxPointerSize = 192
+	// pointerKeyFile holds the key of the HMAC authenticating the pointers
+	pointerKeyFile = AppDataDir + "/dedup.key"
+	// pointerKeySize is the size of the key of the pointers in bytes
+	pointerKeySize = 32
+	// gcGracePeriod protects recently stored or reused blobs from the garbage
+	// collection, as the pointers to them may not be written yet
+	gcGracePeriod = time.Hour
+)
+
+// DedupFileSystem is a FileSystem wrapper storing the content of identical files
+// only once. The references to each blob are counted in the database when files
+// are written, replaced and removed through the DedupFileSystem. As files can
+// also be removed behind its back, e.g. when the trash is emptied, the counts
+// are corrected by CollectGarbage, which also removes the unreferenced blobs.
+// Files stored before deduplication was enabled are read as they are. Sizes
+// reported by Stat, Readdir and Walk are the sizes of the content.
+type DedupFileSystem struct {
+	FileSystem
+	// pointerKey authenticates the pointers written by the DedupFileSystem
+	pointerKey []byte
+}
+
+// ErrInvalidPointerKey is returned if the key of the pointers is corrupt
+var ErrInvalidPointerKey = errors.New("Invalid dedup pointer key")
+
+// NewDedupFileSystem wraps base in a DedupFileSystem. The key of the pointers is
+// created in the app-data directory the first time.
+func NewDedupFileSystem(base FileSystem) (*DedupFileSystem, error) {
+	key, err := loadPointerKey(context.Background(), base)
+	if err != nil {
+		return nil, err
+	}
+	return &DedupFileSystem{
+		FileSystem: base,
+		pointerKey: key,
+	}, nil
+}
+
+// loadPointerKey reads the key of the pointers from base, or creates it if it
+// doesn't exist yet
+func loadPointerKey(ctx context.Context, base FileSystem) ([]byte, error) {
+	f, err := base.OpenFile(ctx, pointerKeyFile, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		err = MkdirAll(ctx, base, AppDataDir)
+		if err != nil {
+			return nil, err
+		}
+		key := make([]byte, pointerKeySize)
+		_, err = io.ReadFull(rand.Reader, key)
+		if err != nil {
+			return nil, err
+		}
+		f, err = base.OpenFile(ctx, pointerKeyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			// Created by another process in the meantime
+			return loadPointerKey(ctx, base)
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(key)
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			base.RemoveAll(ctx, pointerKeyFile)
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	key, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != pointerKeySize {
+		return nil, ErrInvalidPointerKey
+	}
+	return key, nil
+}
+
+// blobPointer is the reference of a file to its blob
+type blobPointer struct {
+	hash string
+	size int64
+}
+
+// OpenFile opens a file for reading, or creates or truncates it for writing.
+// Existing files can't be opened for writing without truncating them.
+func (d *DedupFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if !deduplicated(name) {
+		return d.FileSystem.OpenFile(ctx, name, flag, perm)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return d.create(ctx, name, flag, perm)
+	}
+	f, err := d.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return &mappedDir{File: f, name: name, mapInfo: func(name string, info os.FileInfo) os.FileInfo {
+			return d.blobInfo(ctx, name, info)
+		}}, nil
+	}
+	var pointer *blobPointer
+	if info.Size() <= maxPointerSize {
+		pointer = readPointer(f, d.pointerKey)
+	}
+	if pointer == nil {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	f.Close()
+	blob, err := d.FileSystem.OpenFile(ctx, blobPath(pointer.hash), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &blobFile{File: blob, info: sizedFileInfo{FileInfo: info, size: pointer.size}}, nil
+}
+
+// Stat returns the FileInfo of a file, with the size of its content
+func (d *DedupFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := d.FileSystem.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return d.blobInfo(ctx, name, info), nil
+}
+
+// Walk walks the tree rooted at name like the Walk of the underlying
+// FileSystem, passing the size of the content of the files to walkFn
+func (d *DedupFileSystem) Walk(name string, walkFn filepath.WalkFunc) error {
+	ctx := context.Background()
+	return d.FileSystem.Walk(name, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			info = d.blobInfo(ctx, path, info)
+		}
+		return walkFn(path, info, err)
+	})
+}
+
+// Rename renames a file, releasing the blob of the file it replaces
+func (d *DedupFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	replaced, _ := d.pointerOf(ctx, newName)
+	err := d.FileSystem.Rename(ctx, oldName, newName)
+	if err != nil {
+		return err
+	}
+	if replaced != nil {
+		db.ReleaseBlob(replaced.hash)
+	}
+	return nil
+}
+
+// RemoveAll removes a file or directory tree, releasing the blobs of the
+// removed files
+func (d *DedupFileSystem) RemoveAll(ctx context.Context, name string) error {
+	var released []string
+	err := d.walkPointers(ctx, name, func(name string, pointer *blobPointer) {
+		released = append(released, pointer.hash)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = d.FileSystem.RemoveAll(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, hash := range released {
+		db.ReleaseBlob(hash)
+	}
+	return nil
+}
+
+// Chtimes changes the access and modification times of the file name, if the
+// underlying FileSystem supports it
+func (d *DedupFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return setModTime(d.FileSystem, name, mtime)
+}
+
+// Deduplicate moves the content of a file stored before deduplication was
+// enabled to the blob store, keeping its modification time if the underlying
+// FileSystem supports it. It returns whether the file was converted.
+func (d *DedupFileSystem) Deduplicate(ctx context.Context, name string) (bool, error) {
+	if !deduplicated(name) {
+		return false, nil
+	}
+	pointer, err := d.pointerOf(ctx, name)
+	if err != nil || pointer != nil {
+		return false, err
+	}
+	return true, rewriteFile(ctx, d.FileSystem, name, d.FileSystem, d)
+}
+
+// Expand replaces the pointer to a blob by the content of the blob, keeping the
+// modification time of the file if the underlying FileSystem supports it. It
+// returns whether the file was converted.
+func (d *DedupFileSystem) Expand(ctx context.Context, name string) (bool, error) {
+	pointer, err := d.pointerOf(ctx, name)
+	if err != nil || pointer == nil {
+		return false, err
+	}
+	err = rewriteFile(ctx, d.FileSystem, name, d, d.FileSystem)
+	if err != nil {
+		return false, err
+	}
+	db.ReleaseBlob(pointer.hash)
+	return true, nil
+}
+
+// CollectGarbage counts the references to the blobs, and removes the blobs which
+// are no longer referenced, along with abandoned temporary blobs. Blobs stored
+// or reused within the last hour are kept, so it can run while files are being
+// written. It returns the amount of removed blobs and their total size.
+func (d *DedupFileSystem) CollectGarbage() (int, int64, error) {
+	ctx := context.Background()
+	references := make(map[string]int64)
+	sizes := make(map[string]int64)
+	err := d.walkPointers(ctx, "", func(name string, pointer *blobPointer) {
+		references[pointer.hash]++
+		sizes[pointer.hash] = pointer.size
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	err = db.SetBlobReferences(references, sizes)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	removed := 0
+	var freed int64
+	cutoff := time.Now().Add(-gcGracePeriod)
+	err = d.FileSystem.Walk(blobDir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			if name == blobDir && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || info.ModTime().After(cutoff) {
+			return nil
+		}
+		hash := path.Base(name)
+		temporary := path.Dir(name) == blobTempDir
+		if !temporary && references[hash] > 0 {
+			return nil
+		}
+		err = d.FileSystem.RemoveAll(ctx, name)
+		if err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		if !temporary {
+			return db.DeleteBlob(hash)
+		}
+		return nil
+	})
+	return removed, freed, err
+}
+
+// create opens the file name for writing. The content is written to a new blob,
+// which is stored once the file is closed.
+func (d *DedupFileSystem) create(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	var previous string
+	if pointer, _ := d.pointerOf(ctx, name); pointer != nil {
+		previous = pointer.hash
+	}
+	target, err := d.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := target.Stat()
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+	if info.Size() > 0 {
+		target.Close()
+		return nil, ErrNotSequential
+	}
+
+	err = MkdirAll(ctx, d.FileSystem, blobTempDir)
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+	random := make([]byte, 16)
+	_, err = io.ReadFull(rand.Reader, random)
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+	tempName := blobTempDir + "/" + hex.EncodeToString(random)
+	temp, err := d.FileSystem.OpenFile(ctx, tempName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		target.Close()
+		return nil, err
+	}
+	return &blobWriter{
+		File:       temp,
+		fs:         d,
+		ctx:        ctx,
+		tempName:   tempName,
+		target:     target,
+		previous:   previous,
+		hasher:     sha256.New(),
+		sequential: true,
+	}, nil
+}
+
+// pointerOf returns the pointer stored in the file name, or nil if it is not a
+// deduplicated file
+func (d *DedupFileSystem) pointerOf(ctx context.Context, name string) (*blobPointer, error) {
+	if !deduplicated(name) {
+		return nil, nil
+	}
+	info, err := d.FileSystem.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return d.readPointerFile(ctx, name, info)
+}
+
+// readPointerFile returns the pointer stored in the file name with the given
+// FileInfo, or nil if it is not a deduplicated file
+func (d *DedupFileSystem) readPointerFile(ctx context.Context, name string, info os.FileInfo) (*blobPointer, error) {
+	if info.IsDir() || info.Size() > maxPointerSize {
+		return nil, nil
+	}
+	f, err := d.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readPointer(f, d.pointerKey), nil
+}
+
+// walkPointers calls pointerFn for each deduplicated file in the tree rooted at name
+func (d *DedupFileSystem) walkPointers(ctx context.Context, name string, pointerFn func(name string, pointer *blobPointer)) error {
+	if !deduplicated(name) {
+		return nil
+	}
+	return d.FileSystem.Walk(name, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == AppDataDir {
+			return filepath.SkipDir
+		}
+		pointer, err := d.readPointerFile(ctx, name, info)
+		if err != nil {
+			return err
+		}
+		if pointer != nil {
+			pointerFn(name, pointer)
+		}
+		return nil
+	})
+}
+
+// blobInfo returns info with the size of the content of the file if it is
+// deduplicated
+func (d *DedupFileSystem) blobInfo(ctx context.Context, name string, info os.FileInfo) os.FileInfo {
+	if !deduplicated(name) {
+		return info
+	}
+	pointer, err := d.readPointerFile(ctx, name, info)
+	if err != nil || pointer == nil {
+		return info
+	}
+	return sizedFileInfo{FileInfo: info, size: pointer.size}
+}
+
+// deduplicated checks if the file name is stored in the blob store, which is
+// the case for all files outside the app-data directory
+func deduplicated(name string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	return name != AppDataDir && !strings.HasPrefix(name, AppDataDir+"/")
+}
+
+// blobPath returns the name of the blob with the given hash
+func blobPath(hash string) string {
+	return blobDir + "/" + hash[:2] + "/" + hash
+}
+
+// readPointer reads a pointer authenticated with key from r, it returns nil if r
+// doesn't hold one
+func readPointer(r io.Reader, key []byte) *blobPointer {
+	content := make([]byte, maxPointerSize+1)
+	n, err := io.ReadFull(r, content)
+	if err != io.ErrUnexpectedEOF || !strings.HasPrefix(string(content[:n]), blobMagic) {
+		return nil
+	}
+	lines := strings.Split(strings.TrimPrefix(string(content[:n]), blobMagic), "\n")
+	if len(lines) != 4 || len(lines[0]) != sha256.Size*2 || lines[3] != "" {
+		return nil
+	}
+	if _, err = hex.DecodeString(lines[0]); err != nil {
+		return nil
+	}
+	size, err := strconv.ParseInt(lines[1], 10, 64)
+	if err != nil || size < 0 {
+		return nil
+	}
+	pointer := &blobPointer{hash: lines[0], size: size}
+	mac, err := hex.DecodeString(lines[2])
+	if err != nil || !hmac.Equal(mac, pointerMAC(pointer, key)) {
+		return nil
+	}
+	return pointer
+}
+
+// formatPointer returns the content of the pointer to a blob, authenticated
+// with key
+func formatPointer(pointer *blobPointer, key []byte) string {
+	return blobMagic + pointer.hash + "\n" + strconv.FormatInt(pointer.size, 10) + "\n" +
+		hex.EncodeToString(pointerMAC(pointer, key)) + "\n"
+}
+
+// pointerMAC returns the HMAC of the hash and the size of a pointer
+func pointerMAC(pointer *blobPointer, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	io.WriteString(mac, pointer.hash+"\n"+strconv.FormatInt(pointer.size, 10))
+	return mac.Sum(nil)
+}
+
+// blobFile is a deduplicated file opened for reading, it reads its blob
+type blobFile struct {
+	webdav.File
+	info os.FileInfo
+}
+
+func (f *blobFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (f *blobFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// blobWriter writes the content of a deduplicated file to a new blob. When it is
+// closed, the blob is added to the blob store unless it holds the same content
+// as an existing blob, and the pointer to it is written to the target file.
+type blobWriter struct {
+	webdav.File
+	fs       *DedupFileSystem
+	ctx      context.Context
+	tempName string
+	target   webdav.File
+	// previous is the hash of the blob referenced by the file before it was
+	// truncated
+	previous string
+	hasher   hash.Hash
+	size     int64
+	// sequential is set as long as the content is written from start to end, so
+	// it is hashed as it is written
+	sequential bool
+	closed     bool
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	n, err := w.File.Write(p)
+	w.hasher.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *blobWriter) Read(p []byte) (int, error) {
+	w.sequential = false
+	return w.File.Read(p)
+}
+
+func (w *blobWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekCurrent {
+		w.sequential = false
+	}
+	return w.File.Seek(offset, whence)
+}
+
+func (w *blobWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	err := w.File.Close()
+	if err == nil {
+		err = w.store()
+	}
+	if err != nil {
+		w.fs.FileSystem.RemoveAll(w.ctx, w.tempName)
+	}
+	closeErr := w.target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// store moves the written blob into the blob store and writes the pointer to it
+func (w *blobWriter) store() error {
+	base := w.fs.FileSystem
+	if !w.sequential {
+		err := w.rehash()
+		if err != nil {
+			return err
+		}
+	}
+	pointer := &blobPointer{hash: hex.EncodeToString(w.hasher.Sum(nil)), size: w.size}
+	blob := blobPath(pointer.hash)
+	if _, err := base.Stat(w.ctx, blob); err == nil {
+		// The content is stored already. Touch the blob so a concurrent garbage
+		// collection doesn't remove it before the pointer is written.
+		err = setModTime(base, blob, time.Now())
+		if err != nil {
+			return err
+		}
+		base.RemoveAll(w.ctx, w.tempName)
+	} else {
+		err = MkdirAll(w.ctx, base, path.Dir(blob))
+		if err != nil {
+			return err
+		}
+		err = base.Rename(w.ctx, w.tempName, blob)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := db.ReferenceBlob(pointer.hash, pointer.size)
+	if err != nil {
+		return err
+	}
+	_, err = w.target.Write([]byte(formatPointer(pointer, w.fs.pointerKey)))
+	if err != nil {
+		db.ReleaseBlob(pointer.hash)
+		return err
+	}
+	if w.previous != "" {
+		db.ReleaseBlob(w.previous)
+	}
+	return nil
+}
+
+// rehash hashes the written blob again, for content which was not written
+// sequentially
+func (w *blobWriter) rehash() error {
+	f, err := w.fs.FileSystem.OpenFile(w.ctx, w.tempName, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w.hasher.Reset()
+	w.size, err = io.Copy(w.hasher, f)
+	return err
+}
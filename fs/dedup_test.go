@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const testHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestReadPointer(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	otherKey := []byte("fedcba9876543210fedcba9876543210")
+	valid := formatPointer(&blobPointer{hash: testHash, size: 4}, key)
+	tests := []struct {
+		name    string
+		content string
+		pointer *blobPointer
+	}{
+		{"valid", valid, &blobPointer{hash: testHash, size: 4}},
+		{"empty blob", formatPointer(&blobPointer{hash: testHash, size: 0}, key), &blobPointer{hash: testHash, size: 0}},
+		{"other key", formatPointer(&blobPointer{hash: testHash, size: 4}, otherKey), nil},
+		{"unsigned", blobMagic + testHash + "\n4\n", nil},
+		{"previous format", "GOWNBLOB1\n" + testHash + "\n4\n", nil},
+		{"changed size", strings.Replace(valid, "\n4\n", "\n5\n", 1), nil},
+		{"changed hash", strings.Replace(valid, testHash, strings.Repeat("0", len(testHash)), 1), nil},
+		{"missing newline", strings.TrimSuffix(valid, "\n"), nil},
+		{"trailing data", valid + "x", nil},
+		{"truncated", valid[:len(valid)-10], nil},
+		{"short hash", blobMagic + testHash[1:] + "\n4\n", nil},
+		{"negative size", formatPointer(&blobPointer{hash: testHash, size: -1}, key), nil},
+		{"plain text", "test", nil},
+		{"empty", "", nil},
+		{"too large", valid + strings.Repeat("\n", maxPointerSize), nil},
+	}
+	for _, test := range tests {
+		pointer := readPointer(strings.NewReader(test.content), key)
+		if (pointer == nil) != (test.pointer == nil) || pointer != nil && *pointer != *test.pointer {
+			t.Errorf("%v: readPointer(%q) = %v, want %v", test.name, test.content, pointer, test.pointer)
+		}
+	}
+}
+
+func TestLoadPointerKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gowncloud-dedup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := NewLocalFileSystem(dir)
+
+	key, err := loadPointerKey(context.Background(), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != pointerKeySize {
+		t.Fatalf("len(key) = %v, want %v", len(key), pointerKeySize)
+	}
+	loaded, err := loadPointerKey(context.Background(), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded) != string(key) {
+		t.Error("loadPointerKey created a new key instead of loading the existing one")
+	}
+
+	err = ioutil.WriteFile(base.resolve(pointerKeyFile), []byte("short"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadPointerKey(context.Background(), base); err != ErrInvalidPointerKey {
+		t.Errorf("loadPointerKey with a corrupt key returned %v, want %v", err, ErrInvalidPointerKey)
+	}
+}
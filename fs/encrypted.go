@@ -0,0 +1,509 @@
+package fs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// The layout of an encrypted file is a header followed by the content, split in
+// blocks of encryptionBlockSize bytes which are sealed separately with AES-GCM,
+// so any part of the file can be read without decrypting what comes before it.
+// The header starts with encryptionMagic, followed by the random key of the file
+// sealed with the master key. The blocks use their index as nonce, and the last
+// block is marked as such so a truncated file is detected. Every file has at
+// least one block, an empty file has an empty final block.
+const (
+	encryptionMagic      = "GOWNENC1"
+	encryptionBlockSize  = 64 << 10
+	encryptionKeySize    = 32
+	gcmNonceSize         = 12
+	gcmTagSize           = 16
+	wrappedKeySize       = gcmNonceSize + encryptionKeySize + gcmTagSize
+	encryptionHeaderSize = int64(len(encryptionMagic) + wrappedKeySize)
+	encryptedBlockSize   = encryptionBlockSize + gcmTagSize
+)
+
+// MasterKeyEnv is the environment variable holding the master key if no key
+// file is given
+const MasterKeyEnv = "GOWNCLOUD_MASTER_KEY"
+
+var (
+	// ErrInvalidMasterKey is returned for a master key which is not 32 bytes long
+	ErrInvalidMasterKey = errors.New("The master key must be 32 bytes, raw or hex or base64 encoded")
+	// ErrCorrupted is returned when an encrypted file can't be decrypted, because
+	// it has been changed or was encrypted with another master key
+	ErrCorrupted = errors.New("Encrypted file is corrupted or was encrypted with another master key")
+	// ErrNotSequential is returned when an encrypted or deduplicated file is
+	// written anywhere but at its end, or read while it is being written
+	ErrNotSequential = errors.New("Files can only be written sequentially from the start")
+)
+
+// EncryptedFileSystem is a FileSystem wrapper encrypting the files stored in the
+// underlying FileSystem. Each file is encrypted with its own key, which is
+// stored in the file encrypted with the master key. Files which are not
+// encrypted, e.g. those stored before encryption was enabled, are read as they are.
+// Sizes reported by Stat, Readdir and Walk are the sizes of the plaintext.
+type EncryptedFileSystem struct {
+	FileSystem
+	master cipher.AEAD
+}
+
+// NewEncryptedFileSystem wraps base in an EncryptedFileSystem using masterKey,
+// which must be 32 bytes long
+func NewEncryptedFileSystem(base FileSystem, masterKey []byte) (*EncryptedFileSystem, error) {
+	if len(masterKey) != encryptionKeySize {
+		return nil, ErrInvalidMasterKey
+	}
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedFileSystem{
+		FileSystem: base,
+		master:     master,
+	}, nil
+}
+
+// LoadMasterKey reads the master key from keyFile, or from the MasterKeyEnv
+// environment variable if keyFile is empty. The key can be stored raw or hex or
+// base64 encoded. It returns nil if no key is configured.
+func LoadMasterKey(keyFile string) ([]byte, error) {
+	var key []byte
+	if keyFile != "" {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = content
+	} else if env := os.Getenv(MasterKeyEnv); env != "" {
+		key = []byte(env)
+	} else {
+		return nil, nil
+	}
+	if len(key) == encryptionKeySize {
+		return key, nil
+	}
+	encoded := strings.TrimSpace(string(key))
+	if decoded, err := hex.DecodeString(encoded); err == nil && len(decoded) == encryptionKeySize {
+		return decoded, nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(decoded) == encryptionKeySize {
+		return decoded, nil
+	}
+	return nil, ErrInvalidMasterKey
+}
+
+// OpenFile opens a file for reading, or creates or truncates it for writing.
+// Encrypted files can only be written sequentially, so existing files can't be
+// opened for writing without truncating them.
+func (e *EncryptedFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f, err := e.FileSystem.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return &mappedDir{File: f, name: name, mapInfo: func(name string, info os.FileInfo) os.FileInfo {
+			return e.plainInfo(ctx, name, info)
+		}}, nil
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if info.Size() > 0 {
+			f.Close()
+			return nil, ErrNotSequential
+		}
+		return e.newWriter(f, info)
+	}
+	fileKey, err := e.readHeader(f)
+	if err == errNotEncrypted {
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newEncryptedReader(f, info, fileKey)
+}
+
+// Stat returns the FileInfo of a file, with the size of its plaintext
+func (e *EncryptedFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := e.FileSystem.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return e.plainInfo(ctx, name, info), nil
+}
+
+// Walk walks the tree rooted at name like the Walk of the underlying
+// FileSystem, passing the size of the plaintext of the files to walkFn
+func (e *EncryptedFileSystem) Walk(name string, walkFn filepath.WalkFunc) error {
+	ctx := context.Background()
+	return e.FileSystem.Walk(name, func(path string, info os.FileInfo, err error) error {
+		if err == nil {
+			info = e.plainInfo(ctx, path, info)
+		}
+		return walkFn(path, info, err)
+	})
+}
+
+// IsEncrypted checks if the file is stored encrypted
+func (e *EncryptedFileSystem) IsEncrypted(ctx context.Context, name string) (bool, error) {
+	f, err := e.FileSystem.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return hasMagic(f), nil
+}
+
+// Encrypt encrypts a plaintext file in place, keeping its modification time if
+// the underlying FileSystem supports it. Files which are already encrypted are
+// left alone. It returns whether the file was encrypted.
+func (e *EncryptedFileSystem) Encrypt(ctx context.Context, name string) (bool, error) {
+	encrypted, err := e.IsEncrypted(ctx, name)
+	if err != nil || encrypted {
+		return false, err
+	}
+	return true, rewriteFile(ctx, e.FileSystem, name, e.FileSystem, e)
+}
+
+// Decrypt decrypts an encrypted file in place, keeping its modification time if
+// the underlying FileSystem supports it. Files which are not encrypted are left
+// alone. It returns whether the file was decrypted.
+func (e *EncryptedFileSystem) Decrypt(ctx context.Context, name string) (bool, error) {
+	encrypted, err := e.IsEncrypted(ctx, name)
+	if err != nil || !encrypted {
+		return false, err
+	}
+	return true, rewriteFile(ctx, e.FileSystem, name, e, e.FileSystem)
+}
+
+// plainInfo returns info with the size of the plaintext if the file is encrypted
+func (e *EncryptedFileSystem) plainInfo(ctx context.Context, name string, info os.FileInfo) os.FileInfo {
+	if info.IsDir() {
+		return info
+	}
+	encrypted, err := e.IsEncrypted(ctx, name)
+	if err != nil || !encrypted {
+		return info
+	}
+	return sizedFileInfo{FileInfo: info, size: plaintextSize(info.Size())}
+}
+
+// Chtimes changes the access and modification times of the file name, if the
+// underlying FileSystem supports it
+func (e *EncryptedFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return setModTime(e.FileSystem, name, mtime)
+}
+
+// newWriter writes a new header to f, and returns the file writing the
+// encrypted content
+func (e *EncryptedFileSystem) newWriter(f webdav.File, info os.FileInfo) (webdav.File, error) {
+	fileKey := make([]byte, encryptionKeySize)
+	nonce := make([]byte, gcmNonceSize)
+	_, err := io.ReadFull(rand.Reader, fileKey)
+	if err == nil {
+		_, err = io.ReadFull(rand.Reader, nonce)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	header := append([]byte(encryptionMagic), nonce...)
+	header = e.master.Seal(header, nonce, fileKey, []byte(encryptionMagic))
+	_, err = f.Write(header)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &encryptedWriter{
+		File:   f,
+		info:   info,
+		aead:   aead,
+		buffer: make([]byte, 0, encryptionBlockSize),
+	}, nil
+}
+
+// errNotEncrypted is returned by readHeader for files without encryption header
+var errNotEncrypted = errors.New("File is not encrypted")
+
+// readHeader reads the header of f, and returns the key of the file
+func (e *EncryptedFileSystem) readHeader(f io.Reader) ([]byte, error) {
+	header := make([]byte, encryptionHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if n < len(encryptionMagic) || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return nil, errNotEncrypted
+	}
+	if err == io.ErrUnexpectedEOF {
+		// The file is marked as encrypted, but its header is cut off
+		return nil, ErrCorrupted
+	}
+	if err != nil {
+		return nil, err
+	}
+	nonce := header[len(encryptionMagic) : len(encryptionMagic)+gcmNonceSize]
+	fileKey, err := e.master.Open(nil, nonce, header[len(encryptionMagic)+gcmNonceSize:], []byte(encryptionMagic))
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return fileKey, nil
+}
+
+// hasMagic checks if the content read from f starts with encryptionMagic
+func hasMagic(f io.Reader) bool {
+	magic := make([]byte, len(encryptionMagic))
+	_, err := io.ReadFull(f, magic)
+	return err == nil && string(magic) == encryptionMagic
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// blockNonce returns the nonce of the block with the given index
+func blockNonce(index int64) []byte {
+	nonce := make([]byte, gcmNonceSize)
+	binary.BigEndian.PutUint64(nonce[gcmNonceSize-8:], uint64(index))
+	return nonce
+}
+
+// blockData returns the additional data of a block, marking the final block
+func blockData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// plaintextSize returns the size of the plaintext of an encrypted file of size bytes
+func plaintextSize(size int64) int64 {
+	content := size - encryptionHeaderSize
+	if content < gcmTagSize {
+		return 0
+	}
+	blocks := (content + encryptedBlockSize - 1) / encryptedBlockSize
+	return content - blocks*gcmTagSize
+}
+
+// encryptedWriter writes the content of a new encrypted file. The last block is
+// only sealed when the file is closed, because only then it is known to be final.
+type encryptedWriter struct {
+	webdav.File
+	info   os.FileInfo
+	aead   cipher.AEAD
+	buffer []byte
+	block  int64
+	size   int64
+	closed bool
+	err    error
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buffer) == encryptionBlockSize {
+			w.err = w.seal(false)
+			if w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buffer[len(w.buffer):cap(w.buffer)], p)
+		w.buffer = w.buffer[:len(w.buffer)+n]
+		p = p[n:]
+		written += n
+		w.size += int64(n)
+	}
+	return written, nil
+}
+
+// seal encrypts and writes the buffered block
+func (w *encryptedWriter) seal(final bool) error {
+	sealed := w.aead.Seal(nil, blockNonce(w.block), w.buffer, blockData(final))
+	_, err := w.File.Write(sealed)
+	w.block++
+	w.buffer = w.buffer[:0]
+	return err
+}
+
+func (w *encryptedWriter) Close() error {
+	if w.closed {
+		return os.ErrClosed
+	}
+	w.closed = true
+	err := w.err
+	if err == nil {
+		err = w.seal(true)
+	}
+	closeErr := w.File.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *encryptedWriter) Read(p []byte) (int, error) {
+	return 0, ErrNotSequential
+}
+
+// Seek only supports asking the current position, which is the end of the file
+func (w *encryptedWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && (whence == io.SeekCurrent || whence == io.SeekEnd) {
+		return w.size, nil
+	}
+	return 0, ErrNotSequential
+}
+
+func (w *encryptedWriter) Stat() (os.FileInfo, error) {
+	info, err := w.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return sizedFileInfo{FileInfo: info, size: w.size}, nil
+}
+
+// encryptedReader reads the plaintext of an encrypted file. It keeps the last
+// decrypted block, so small sequential reads don't decrypt a block repeatedly.
+type encryptedReader struct {
+	webdav.File
+	info   os.FileInfo
+	aead   cipher.AEAD
+	size   int64
+	blocks int64
+	offset int64
+	cached int64
+	plain  []byte
+	sealed []byte
+}
+
+func newEncryptedReader(f webdav.File, info os.FileInfo, fileKey []byte) (*encryptedReader, error) {
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	content := info.Size() - encryptionHeaderSize
+	if content < gcmTagSize {
+		f.Close()
+		return nil, ErrCorrupted
+	}
+	return &encryptedReader{
+		File:   f,
+		info:   info,
+		aead:   aead,
+		size:   plaintextSize(info.Size()),
+		blocks: (content + encryptedBlockSize - 1) / encryptedBlockSize,
+		cached: -1,
+		plain:  make([]byte, 0, encryptionBlockSize),
+		sealed: make([]byte, encryptedBlockSize),
+	}, nil
+}
+
+func (r *encryptedReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		// An empty file still has to be verified
+		if r.size == 0 && r.cached < 0 {
+			if err := r.load(0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	index := r.offset / encryptionBlockSize
+	err := r.load(index)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, r.plain[r.offset-index*encryptionBlockSize:])
+	r.offset += int64(n)
+	return n, nil
+}
+
+// load decrypts the block with the given index
+func (r *encryptedReader) load(index int64) error {
+	if r.cached == index {
+		return nil
+	}
+	start := encryptionHeaderSize + index*encryptedBlockSize
+	length := r.info.Size() - start
+	if length > encryptedBlockSize {
+		length = encryptedBlockSize
+	}
+	_, err := r.File.Seek(start, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(r.File, r.sealed[:length])
+	if err != nil {
+		return err
+	}
+	r.cached = -1
+	r.plain, err = r.aead.Open(r.plain[:0], blockNonce(index), r.sealed[:length], blockData(index == r.blocks-1))
+	if err != nil {
+		return ErrCorrupted
+	}
+	r.cached = index
+	return nil
+}
+
+func (r *encryptedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *encryptedReader) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (r *encryptedReader) Stat() (os.FileInfo, error) {
+	return sizedFileInfo{FileInfo: r.info, size: r.size}, nil
+}
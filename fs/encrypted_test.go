@@ -0,0 +1,232 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// newTestEncryptedFileSystem returns an EncryptedFileSystem storing the files in
+// a temporary directory, the returned function removes it
+func newTestEncryptedFileSystem(t *testing.T, masterKey []byte) (*EncryptedFileSystem, *LocalFileSystem, func()) {
+	dir, err := ioutil.TempDir("", "gowncloud-encrypted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := NewLocalFileSystem(dir)
+	e, err := NewEncryptedFileSystem(base, masterKey)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return e, base, func() { os.RemoveAll(dir) }
+}
+
+func writeTestFile(t *testing.T, fileSystem FileSystem, name string, content []byte) {
+	f, err := fileSystem.OpenFile(context.Background(), name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile reads the content of a file, failing on the open or on a read
+func readTestFile(fileSystem FileSystem, name string) ([]byte, error) {
+	f, err := fileSystem.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func randomContent(t *testing.T, size int) []byte {
+	content := make([]byte, size)
+	if _, err := rand.Read(content); err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	e, base, cleanup := newTestEncryptedFileSystem(t, testMasterKey)
+	defer cleanup()
+
+	tests := []struct {
+		size   int
+		blocks int
+	}{
+		{0, 1},
+		{1, 1},
+		{encryptionBlockSize - 1, 1},
+		{encryptionBlockSize, 1},
+		{encryptionBlockSize + 1, 2},
+		{2*encryptionBlockSize + 100, 3},
+	}
+	for _, test := range tests {
+		content := randomContent(t, test.size)
+		writeTestFile(t, e, "file", content)
+
+		raw, err := base.Stat(context.Background(), "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rawSize := encryptionHeaderSize + int64(test.size+test.blocks*gcmTagSize)
+		if raw.Size() != rawSize {
+			t.Errorf("Encrypted size of %v bytes = %v, want %v", test.size, raw.Size(), rawSize)
+		}
+		if size := plaintextSize(raw.Size()); size != int64(test.size) {
+			t.Errorf("plaintextSize(%v) = %v, want %v", raw.Size(), size, test.size)
+		}
+		info, err := e.Stat(context.Background(), "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(test.size) {
+			t.Errorf("Stat of %v bytes returned size %v", test.size, info.Size())
+		}
+		read, err := readTestFile(e, "file")
+		if err != nil {
+			t.Errorf("Reading %v bytes failed: %v", test.size, err)
+		} else if !bytes.Equal(read, content) {
+			t.Errorf("Reading %v bytes returned other content", test.size)
+		}
+	}
+}
+
+func TestEncryptedSeek(t *testing.T) {
+	e, _, cleanup := newTestEncryptedFileSystem(t, testMasterKey)
+	defer cleanup()
+	content := randomContent(t, 3*encryptionBlockSize)
+	writeTestFile(t, e, "file", content)
+
+	f, err := e.OpenFile(context.Background(), "file", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tests := []struct {
+		offset int64
+		whence int
+		start  int64
+	}{
+		{encryptionBlockSize - 5, io.SeekStart, encryptionBlockSize - 5},
+		{0, io.SeekStart, 0},
+		{-10, io.SeekEnd, 3*encryptionBlockSize - 10},
+		{-encryptionBlockSize, io.SeekCurrent, 2 * encryptionBlockSize},
+	}
+	for _, test := range tests {
+		start, err := f.Seek(test.offset, test.whence)
+		if err != nil || start != test.start {
+			t.Errorf("Seek(%v, %v) = %v, %v, want %v", test.offset, test.whence, start, err, test.start)
+			continue
+		}
+		read := make([]byte, 10)
+		if _, err = io.ReadFull(f, read); err != nil {
+			t.Errorf("Reading at %v failed: %v", start, err)
+		} else if !bytes.Equal(read, content[start:start+10]) {
+			t.Errorf("Reading at %v returned other content", start)
+		}
+	}
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	e, base, cleanup := newTestEncryptedFileSystem(t, testMasterKey)
+	defer cleanup()
+	content := randomContent(t, 2*encryptionBlockSize+10)
+	writeTestFile(t, e, "file", content)
+	original, err := ioutil.ReadFile(base.resolve("file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flip := func(offset int64) func([]byte) []byte {
+		return func(raw []byte) []byte {
+			raw[offset] ^= 1
+			return raw
+		}
+	}
+	truncate := func(size int64) func([]byte) []byte {
+		return func(raw []byte) []byte { return raw[:size] }
+	}
+	block := func(index int64) int64 { return encryptionHeaderSize + index*encryptedBlockSize }
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"flipped wrapped key", flip(int64(len(encryptionMagic)) + 5)},
+		{"flipped first block", flip(block(0) + 100)},
+		{"flipped tag of the last block", flip(int64(len(original)) - 1)},
+		{"dropped last block", truncate(block(2))},
+		{"truncated after the first block", truncate(block(1))},
+		{"truncated last block", truncate(int64(len(original)) - 1)},
+		{"truncated header", truncate(encryptionHeaderSize - 1)},
+		{"only header", truncate(encryptionHeaderSize)},
+		{"swapped blocks", func(raw []byte) []byte {
+			swapped := append([]byte{}, raw[:block(0)]...)
+			swapped = append(swapped, raw[block(1):block(2)]...)
+			swapped = append(swapped, raw[block(0):block(1)]...)
+			return append(swapped, raw[block(2):]...)
+		}},
+	}
+	for _, test := range tests {
+		raw := test.tamper(append([]byte{}, original...))
+		if err = ioutil.WriteFile(base.resolve("file"), raw, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = readTestFile(e, "file"); err != ErrCorrupted {
+			t.Errorf("%v: reading returned %v, want %v", test.name, err, ErrCorrupted)
+		}
+	}
+
+	if err = ioutil.WriteFile(base.resolve("file"), original, 0600); err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewEncryptedFileSystem(base, []byte("fedcba9876543210fedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readTestFile(other, "file"); err != ErrCorrupted {
+		t.Errorf("Reading with another master key returned %v, want %v", err, ErrCorrupted)
+	}
+}
+
+func TestEncryptedPlaintextFiles(t *testing.T) {
+	e, base, cleanup := newTestEncryptedFileSystem(t, testMasterKey)
+	defer cleanup()
+	// Files stored before encryption was enabled are read as they are
+	content := []byte("stored before encryption was enabled")
+	writeTestFile(t, base, "plain", content)
+	read, err := readTestFile(e, "plain")
+	if err != nil || !bytes.Equal(read, content) {
+		t.Errorf("Reading a plaintext file = %q, %v, want %q", read, err, content)
+	}
+	encrypted, err := e.IsEncrypted(context.Background(), "plain")
+	if err != nil || encrypted {
+		t.Errorf("IsEncrypted of a plaintext file = %v, %v, want false", encrypted, err)
+	}
+
+	if _, err = e.Encrypt(context.Background(), "plain"); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err = e.IsEncrypted(context.Background(), "plain")
+	if err != nil || !encrypted {
+		t.Errorf("IsEncrypted of an encrypted file = %v, %v, want true", encrypted, err)
+	}
+	read, err = readTestFile(e, "plain")
+	if err != nil || !bytes.Equal(read, content) {
+		t.Errorf("Reading an encrypted file = %q, %v, want %q", read, err, content)
+	}
+}
@@ -1,12 +1,99 @@
 package fs
 
 import (
+	"io"
+	"os"
+	"path"
 	"path/filepath"
+	"time"
 
+	"golang.org/x/net/context"
 	"golang.org/x/net/webdav"
 )
 
+// FileSystem is the storage abstraction for the files stored by gowncloud. Names
+// are '/' separated paths relative to the root of the file system.
 type FileSystem interface {
 	webdav.FileSystem
-	Walk(string, filepath.WalkFunc, error) error
+	// Walk walks the tree rooted at name, calling walkFn for each file or
+	// directory in the tree, including name. The paths passed to walkFn are
+	// relative to the root of the file system.
+	Walk(name string, walkFn filepath.WalkFunc) error
+}
+
+// timesChanger is implemented by file systems which can change the
+// modification time of a file
+type timesChanger interface {
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// setModTime changes the modification time of the file name if fileSystem
+// supports it
+func setModTime(fileSystem webdav.FileSystem, name string, mtime time.Time) error {
+	changer, ok := fileSystem.(timesChanger)
+	if !ok {
+		return nil
+	}
+	return changer.Chtimes(name, mtime, mtime)
+}
+
+// rewriteFile replaces the file name in base by its content read through from
+// and written through to, keeping its modification time. The content is
+// written to a temporary file first, so the file is never left half written.
+func rewriteFile(ctx context.Context, base FileSystem, name string, from, to webdav.FileSystem) error {
+	info, err := base.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	src, err := from.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tempName := path.Join(path.Dir(name), ".rewrite-"+path.Base(name))
+	dst, err := to.OpenFile(ctx, tempName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = setModTime(base, tempName, info.ModTime())
+	}
+	if err != nil {
+		to.RemoveAll(ctx, tempName)
+		return err
+	}
+	return to.Rename(ctx, tempName, name)
+}
+
+// sizedFileInfo is a FileInfo reporting another size than the one of the
+// stored file, e.g. the size of its content before it was encrypted
+type sizedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i sizedFileInfo) Size() int64 {
+	return i.size
+}
+
+// mappedDir is a directory passing the FileInfo of its content through mapInfo,
+// along with the path of each file
+type mappedDir struct {
+	webdav.File
+	name    string
+	mapInfo func(name string, info os.FileInfo) os.FileInfo
+}
+
+func (d *mappedDir) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := d.File.Readdir(count)
+	for i, info := range infos {
+		infos[i] = d.mapInfo(path.Join(d.name, info.Name()), info)
+	}
+	return infos, err
 }
@@ -0,0 +1,48 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// LocalFileSystem is a FileSystem storing the files in a directory on the local disk
+type LocalFileSystem struct {
+	webdav.Dir
+}
+
+// NewLocalFileSystem creates a new LocalFileSystem with root as its root directory
+func NewLocalFileSystem(root string) *LocalFileSystem {
+	return &LocalFileSystem{
+		Dir: webdav.Dir(root),
+	}
+}
+
+// Walk walks the tree rooted at name, calling walkFn for each file or directory
+// in the tree, including name. The paths passed to walkFn are relative to the
+// root of the file system. Like filepath.Walk, files are walked in lexical order.
+func (l *LocalFileSystem) Walk(name string, walkFn filepath.WalkFunc) error {
+	root := filepath.Clean(string(l.Dir))
+	start := filepath.Join(root, filepath.FromSlash(name))
+	if start != root && !strings.HasPrefix(start, root+string(filepath.Separator)) {
+		return os.ErrNotExist
+	}
+	return filepath.Walk(start, func(path string, info os.FileInfo, err error) error {
+		relativePath := strings.TrimPrefix(strings.TrimPrefix(path, root), string(filepath.Separator))
+		return walkFn(filepath.ToSlash(relativePath), info, err)
+	})
+}
+
+// Chtimes changes the access and modification times of the file name
+func (l *LocalFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(l.resolve(name), atime, mtime)
+}
+
+// resolve returns the path on disk of the file name
+func (l *LocalFileSystem) resolve(name string) string {
+	return filepath.Join(string(l.Dir), filepath.FromSlash(path.Clean("/"+name)))
+}
@@ -0,0 +1,285 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// coverMaxBytes is the maximum size of an embedded cover image
+	coverMaxBytes = 16 << 20
+	// flacPictureBlock is the metadata block type of embedded pictures in FLAC files
+	flacPictureBlock = 6
+	// frontCover is the picture type of the front cover in ID3 and FLAC
+	frontCover = 3
+)
+
+// renderAudioCover renders the cover art embedded in an audio file. ID3v2 tags,
+// as used in MP3 files, and the picture blocks of FLAC files are supported.
+func renderAudioCover(file io.ReadSeeker) (image.Image, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return nil, ErrNoPreview
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var pictures []coverPicture
+	var err error
+	switch {
+	case string(magic[:3]) == "ID3":
+		pictures, err = id3Pictures(file)
+	case string(magic) == "fLaC":
+		pictures, err = flacPictures(file)
+	default:
+		return nil, ErrNoPreview
+	}
+	if err != nil {
+		return nil, ErrNoPreview
+	}
+
+	// Prefer the front cover over other pictures
+	for _, preferFront := range []bool{true, false} {
+		for _, picture := range pictures {
+			if preferFront && picture.pictureType != frontCover {
+				continue
+			}
+			img, _, err := image.Decode(bytes.NewReader(picture.data))
+			if err == nil {
+				return img, nil
+			}
+		}
+	}
+	return nil, ErrNoPreview
+}
+
+// coverPicture is a picture embedded in an audio file
+type coverPicture struct {
+	pictureType byte
+	data        []byte
+}
+
+// id3Pictures reads the APIC frames of an ID3v2.3 or v2.4 tag, or the PIC frames
+// of an ID3v2.2 tag
+func id3Pictures(r io.Reader) ([]coverPicture, error) {
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	version := header[3]
+	flags := header[5]
+	size := syncsafe(header[6:10])
+	if version < 2 || version > 4 || size > coverMaxBytes {
+		return nil, ErrNoPreview
+	}
+	tag := make([]byte, size)
+	if _, err := io.ReadFull(r, tag); err != nil {
+		return nil, err
+	}
+	// Before version 2.4 unsynchronisation is applied to the whole tag
+	if flags&0x80 != 0 && version < 4 {
+		tag = bytes.Replace(tag, []byte{0xFF, 0x00}, []byte{0xFF}, -1)
+	}
+	if flags&0x40 != 0 && version == 3 && len(tag) >= 4 {
+		// Skip the extended header
+		extended := int(binary.BigEndian.Uint32(tag[:4])) + 4
+		if extended > len(tag) {
+			return nil, ErrNoPreview
+		}
+		tag = tag[extended:]
+	} else if flags&0x40 != 0 && version == 4 && len(tag) >= 4 {
+		extended := int(syncsafe(tag[:4]))
+		if extended > len(tag) {
+			return nil, ErrNoPreview
+		}
+		tag = tag[extended:]
+	}
+
+	var pictures []coverPicture
+	headerSize, idSize := 10, 4
+	if version == 2 {
+		headerSize, idSize = 6, 3
+	}
+	for len(tag) >= headerSize && tag[0] != 0 {
+		id := string(tag[:idSize])
+		var frameSize int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(tag[4:8]))
+			frameFlags = binary.BigEndian.Uint16(tag[8:10])
+		case 4:
+			frameSize = int(syncsafe(tag[4:8]))
+			frameFlags = binary.BigEndian.Uint16(tag[8:10])
+		}
+		if frameSize < 0 || headerSize+frameSize > len(tag) {
+			break
+		}
+		frame := tag[headerSize : headerSize+frameSize]
+		tag = tag[headerSize+frameSize:]
+
+		if version == 4 && frameFlags&0x02 != 0 {
+			frame = bytes.Replace(frame, []byte{0xFF, 0x00}, []byte{0xFF}, -1)
+		}
+		if version == 4 && frameFlags&0x01 != 0 && len(frame) >= 4 {
+			// Skip the data length indicator
+			frame = frame[4:]
+		}
+		// Compressed and encrypted frames are not supported
+		if (version == 3 && frameFlags&0xC0 != 0) || (version == 4 && frameFlags&0x0C != 0) {
+			continue
+		}
+
+		switch {
+		case version == 2 && id == "PIC":
+			if picture, ok := parsePIC(frame); ok {
+				pictures = append(pictures, picture)
+			}
+		case version > 2 && id == "APIC":
+			if picture, ok := parseAPIC(frame); ok {
+				pictures = append(pictures, picture)
+			}
+		}
+	}
+	return pictures, nil
+}
+
+// parseAPIC parses an attached picture frame: the text encoding, the mimetype,
+// the picture type, the description and the picture data
+func parseAPIC(frame []byte) (coverPicture, bool) {
+	if len(frame) < 2 {
+		return coverPicture{}, false
+	}
+	encoding := frame[0]
+	end := bytes.IndexByte(frame[1:], 0)
+	if end < 0 {
+		return coverPicture{}, false
+	}
+	rest := frame[1+end+1:]
+	if len(rest) < 1 {
+		return coverPicture{}, false
+	}
+	pictureType := rest[0]
+	data, ok := skipID3String(rest[1:], encoding)
+	return coverPicture{pictureType: pictureType, data: data}, ok
+}
+
+// parsePIC parses an ID3v2.2 picture frame, which has a three letter image
+// format instead of a mimetype
+func parsePIC(frame []byte) (coverPicture, bool) {
+	if len(frame) < 5 {
+		return coverPicture{}, false
+	}
+	data, ok := skipID3String(frame[5:], frame[0])
+	return coverPicture{pictureType: frame[4], data: data}, ok
+}
+
+// skipID3String skips a terminated string in the given text encoding
+func skipID3String(data []byte, encoding byte) ([]byte, bool) {
+	if encoding == 1 || encoding == 2 {
+		// UTF-16 strings are terminated by two zero bytes on a character boundary
+		for i := 0; i+1 < len(data); i += 2 {
+			if data[i] == 0 && data[i+1] == 0 {
+				return data[i+2:], true
+			}
+		}
+		return nil, false
+	}
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return nil, false
+	}
+	return data[end+1:], true
+}
+
+// syncsafe decodes a syncsafe integer, which uses 7 bits of every byte
+func syncsafe(data []byte) uint32 {
+	var value uint32
+	for _, b := range data {
+		value = value<<7 | uint32(b&0x7F)
+	}
+	return value
+}
+
+// flacPictures reads the picture metadata blocks of a FLAC file
+func flacPictures(r io.Reader) ([]coverPicture, error) {
+	if _, err := io.CopyN(ioutil.Discard, r, 4); err != nil {
+		return nil, err
+	}
+	var pictures []coverPicture
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		last := header[0]&0x80 != 0
+		blockType := header[0] & 0x7F
+		length := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+
+		if blockType == flacPictureBlock {
+			block := make([]byte, length)
+			if _, err := io.ReadFull(r, block); err != nil {
+				return nil, err
+			}
+			if picture, ok := parseFLACPicture(block); ok {
+				pictures = append(pictures, picture)
+			}
+		} else if _, err := io.CopyN(ioutil.Discard, r, length); err != nil {
+			return nil, err
+		}
+		if last {
+			return pictures, nil
+		}
+	}
+}
+
+// parseFLACPicture parses a picture block: the picture type, the mimetype, the
+// description, the dimensions and the picture data
+func parseFLACPicture(block []byte) (coverPicture, bool) {
+	read := func(n int) ([]byte, bool) {
+		if n < 0 || n > len(block) {
+			return nil, false
+		}
+		data := block[:n]
+		block = block[n:]
+		return data, true
+	}
+	readLength := func() (int, bool) {
+		data, ok := read(4)
+		if !ok {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint32(data)), true
+	}
+
+	pictureType, ok := readLength()
+	if !ok {
+		return coverPicture{}, false
+	}
+	// Skip the mimetype and the description
+	for i := 0; i < 2; i++ {
+		length, ok := readLength()
+		if !ok {
+			return coverPicture{}, false
+		}
+		if _, ok := read(length); !ok {
+			return coverPicture{}, false
+		}
+	}
+	// Skip the width, height, color depth and palette size
+	if _, ok := read(16); !ok {
+		return coverPicture{}, false
+	}
+	length, ok := readLength()
+	if !ok {
+		return coverPicture{}, false
+	}
+	data, ok := read(length)
+	return coverPicture{pictureType: byte(pictureType), data: data}, ok
+}
@@ -0,0 +1,188 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/core/metrics"
+	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/fs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// previewDir is the directory in the app-data area where previews are cached.
+	// Previews are stored as previewDir/<node id>/<etag>/<size>.<extension>
+	previewDir = fs.AppDataDir + "/previews"
+	// pregenerateQueueSize is the amount of nodes waiting for their previews to
+	// be generated, new nodes are dropped when the queue is full
+	pregenerateQueueSize = 100
+)
+
+var (
+	// storage is where the originals are read and the previews are cached
+	storage fs.FileSystem
+	// pregenerateQueue holds the nodes waiting for their previews to be generated
+	pregenerateQueue chan *db.Node
+
+	// ErrNoPreview is returned when no preview can be generated for a file
+	ErrNoPreview = errors.New("No preview available")
+
+	previewRequests = metrics.NewCounter("gowncloud_preview_cache_requests_total",
+		"Previews looked up in the cache, by result (hit or miss).", "result")
+	previewDuration = metrics.NewHistogram("gowncloud_preview_generation_duration_seconds",
+		"Time taken to generate previews by provider.", metrics.DefaultBuckets, "provider")
+)
+
+// commonSizes are the previews generated in the background after an upload: the
+// icons in the file list, on normal and high density screens, and the gallery
+var commonSizes = []previewSpec{
+	{width: 32, height: 32, mode: ModeFill},
+	{width: 64, height: 64, mode: ModeFill},
+	{width: 400, height: 400, mode: ModeFit},
+}
+
+// Init sets the storage of the originals and the preview cache, and starts
+// generating the previews of uploaded files in the background
+func Init(fileSystem fs.FileSystem) {
+	storage = fileSystem
+	pregenerateQueue = make(chan *db.Node, pregenerateQueueSize)
+	go pregenerate()
+}
+
+// SchedulePregeneration queues the node to generate its previews in the common
+// sizes, so they are available once the client asks for them
+func SchedulePregeneration(node *db.Node) {
+	if pregenerateQueue == nil || node.Isdir || !canPreview(node.MimeType, node.Path) {
+		return
+	}
+	select {
+	case pregenerateQueue <- node:
+	default:
+		log.Debug("Preview queue is full, not pregenerating previews for ", node.Path)
+	}
+}
+
+// InvalidatePreviews removes the cached previews of the node
+func InvalidatePreviews(node *db.Node) {
+	if storage == nil {
+		return
+	}
+	err := storage.RemoveAll(context.Background(), path.Join(previewDir, fs.NodeKey(node)))
+	if err != nil {
+		log.Warnf("Failed to remove the previews of %v: %v", node.Path, err)
+	}
+}
+
+// InvalidateSubtreePreviews removes the cached previews of the node at nodePath
+// and all its descendants. It must be called before the nodes are removed from
+// the database.
+func InvalidateSubtreePreviews(nodePath string) {
+	if storage == nil {
+		return
+	}
+	nodes, err := db.GetSubtreeNodes(nodePath)
+	if err != nil {
+		log.Warnf("Failed to get the nodes to remove the previews of %v: %v", nodePath, err)
+		return
+	}
+	for _, node := range nodes {
+		if !node.Isdir {
+			InvalidatePreviews(node)
+		}
+	}
+}
+
+// pregenerate generates the previews of the queued nodes, and extracts the
+// metadata of photos
+func pregenerate() {
+	for node := range pregenerateQueue {
+		_, err := UpdateMetadata(node)
+		if err != nil {
+			log.Warnf("Failed to extract the metadata of %v: %v", node.Path, err)
+		}
+		for _, spec := range commonSizes {
+			_, _, err := getPreview(node, spec, false)
+			if err != nil {
+				if err != ErrNoPreview {
+					log.Warnf("Failed to pregenerate preview of %v: %v", node.Path, err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// getPreview returns the preview of the node from the cache, or generates and
+// caches it if it doesn't exist yet. The encoding depends on the preview itself,
+// so all encodings the client accepts are looked up.
+func getPreview(node *db.Node, spec previewSpec, acceptWebP bool) ([]byte, string, error) {
+	cachePath := path.Join(previewDir, fs.NodeKey(node), node.Etag, spec.key())
+
+	for _, format := range cachedFormats(acceptWebP) {
+		cached, err := readFile(cachePath + "." + format.extension)
+		if err == nil {
+			previewRequests.Inc("hit")
+			return cached, format.contentType, nil
+		}
+	}
+	previewRequests.Inc("miss")
+
+	data, format, err := generate(node, spec, acceptWebP)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = fs.WriteFile(context.Background(), storage, cachePath+"."+format.extension, bytes.NewReader(data))
+	if err != nil {
+		// The preview can still be served, it will just be generated again
+		log.Warnf("Failed to cache preview of %v: %v", node.Path, err)
+	}
+	return data, format.contentType, nil
+}
+
+// generate renders the preview of the node with the provider for its type
+func generate(node *db.Node, spec previewSpec, acceptWebP bool) ([]byte, outputFormat, error) {
+	provider := providerFor(node.MimeType, node.Path)
+	if provider == nil {
+		return nil, outputFormat{}, ErrNoPreview
+	}
+	defer previewDuration.ObserveSince(time.Now(), provider.Name)
+	file, err := storage.OpenFile(context.Background(), node.Path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, outputFormat{}, err
+	}
+	defer file.Close()
+
+	img, err := provider.Render(file)
+	if err != nil {
+		if err == ErrNoPreview {
+			log.Debugf("The %v provider has no preview for %v", provider.Name, node.Path)
+		}
+		return nil, outputFormat{}, err
+	}
+
+	preview := spec.scale(img)
+	format := chooseFormat(preview, acceptWebP)
+	var buffer bytes.Buffer
+	err = encode(&buffer, preview, format)
+	if err != nil {
+		return nil, outputFormat{}, err
+	}
+	return buffer.Bytes(), format, nil
+}
+
+// readFile reads a file from the storage
+func readFile(name string) ([]byte, error) {
+	file, err := storage.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
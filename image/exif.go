@@ -0,0 +1,95 @@
+package image
+
+import (
+	"image"
+	"io"
+
+	"github.com/disintegration/imaging"
+)
+
+// tagOrientation is the EXIF tag describing how the image has to be rotated
+const tagOrientation = 0x112
+
+// exifOrientation returns the EXIF orientation of a JPEG or TIFF file. It
+// returns 1, the normal orientation, if the file has no valid orientation.
+func exifOrientation(r io.ReaderAt) int {
+	base, ok := exifOffset(r)
+	if !ok {
+		return 1
+	}
+	t, err := newTIFFReader(r, base)
+	if err != nil {
+		return 1
+	}
+	directory, err := t.readIFD(t.first)
+	if err != nil {
+		return 1
+	}
+	return tiffOrientation(t, directory)
+}
+
+// tiffOrientation returns the orientation stored in a directory
+func tiffOrientation(t *tiffReader, directory *ifd) int {
+	orientation, ok := t.uint(directory, tagOrientation)
+	if !ok || orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return int(orientation)
+}
+
+// exifOffset returns the offset of the TIFF structure holding the EXIF data. For
+// TIFF files, including most RAW files, that is the start of the file. JPEG
+// files store it in an APP1 segment.
+func exifOffset(r io.ReaderAt) (int64, bool) {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err != nil {
+		return 0, false
+	}
+	if string(magic[:2]) == "II" || string(magic[:2]) == "MM" {
+		return 0, true
+	}
+	if magic[0] != 0xFF || magic[1] != 0xD8 {
+		return 0, false
+	}
+
+	// Walk the segments up to the start of the image data
+	offset := int64(2)
+	header := make([]byte, 10)
+	for {
+		if _, err := r.ReadAt(header[:4], offset); err != nil || header[0] != 0xFF {
+			return 0, false
+		}
+		marker := header[1]
+		length := int64(header[2])<<8 | int64(header[3])
+		if marker == 0xDA || marker == 0xD9 || length < 2 {
+			return 0, false
+		}
+		if marker == 0xE1 && length >= 8 {
+			if _, err := r.ReadAt(header[4:10], offset+4); err == nil && string(header[4:10]) == "Exif\x00\x00" {
+				return offset + 10, true
+			}
+		}
+		offset += 2 + length
+	}
+}
+
+// orient transforms the image to its normal orientation
+func orient(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 2:
+		return imaging.FlipH(img)
+	case 3:
+		return imaging.Rotate180(img)
+	case 4:
+		return imaging.FlipV(img)
+	case 5:
+		return imaging.Transpose(img)
+	case 6:
+		return imaging.Rotate270(img)
+	case 7:
+		return imaging.Transverse(img)
+	case 8:
+		return imaging.Rotate90(img)
+	}
+	return img
+}
@@ -1,99 +1,244 @@
 package image
 
 import (
-	"bytes"
+	"fmt"
 	"image"
+	"io"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/disintegration/imaging"
+	db "github.com/gowncloud/gowncloud/database"
 )
 
-// generatePreview generates an image preview from a file
-func GeneratePreview(widthString, heightString, filePath string, w http.ResponseWriter) {
+// Mode describes how an image is scaled to the requested size
+type Mode int
 
+const (
+	// ModeFill scales and crops the image to fill the requested size exactly
+	ModeFill Mode = iota
+	// ModeFit scales the image down until it fits in the requested size
+	ModeFit
+	// ModeCover scales the image down until it just covers the requested size,
+	// keeping its aspect ratio
+	ModeCover
+)
+
+// previewSpec describes a requested preview
+type previewSpec struct {
+	width  int
+	height int
+	mode   Mode
+}
+
+// outputFormat is an encoding for previews
+type outputFormat struct {
+	extension   string
+	contentType string
+}
+
+var (
+	formatJPEG = outputFormat{extension: "jpg", contentType: "image/jpeg"}
+	formatPNG  = outputFormat{extension: "png", contentType: "image/png"}
+	formatWebP = outputFormat{extension: "webp", contentType: "image/webp"}
+)
+
+// key identifies the preview size in the cache and the ETag
+func (spec previewSpec) key() string {
+	return fmt.Sprintf("%vx%v-%v", spec.width, spec.height, spec.mode)
+}
+
+// scale resizes the image to the preview size. Images are never enlarged,
+// except to fill the size exactly.
+func (spec previewSpec) scale(img image.Image) image.Image {
+	switch spec.mode {
+	case ModeFill:
+		return imaging.Thumbnail(img, spec.width, spec.height, imaging.Lanczos)
+	case ModeCover:
+		bounds := img.Bounds()
+		scale := math.Max(float64(spec.width)/float64(bounds.Dx()), float64(spec.height)/float64(bounds.Dy()))
+		if scale >= 1 {
+			return img
+		}
+		width := int(math.Ceil(float64(bounds.Dx()) * scale))
+		height := int(math.Ceil(float64(bounds.Dy()) * scale))
+		return imaging.Resize(img, width, height, imaging.Lanczos)
+	}
+	return imaging.Fit(img, spec.width, spec.height, imaging.Lanczos)
+}
+
+// chooseFormat picks the encoding of a preview. Opaque images are sent as JPEG,
+// images with transparency as PNG, or as WebP if the client accepts it.
+func chooseFormat(img image.Image, acceptWebP bool) outputFormat {
+	if opaque, ok := img.(interface {
+		Opaque() bool
+	}); !ok || opaque.Opaque() {
+		return formatJPEG
+	}
+	bounds := img.Bounds()
+	if acceptWebP && bounds.Dx() <= webpMaxSize && bounds.Dy() <= webpMaxSize {
+		return formatWebP
+	}
+	return formatPNG
+}
+
+// cachedFormats are the formats in which a preview may have been cached for a
+// client, in order of preference
+func cachedFormats(acceptWebP bool) []outputFormat {
+	if acceptWebP {
+		return []outputFormat{formatJPEG, formatWebP, formatPNG}
+	}
+	return []outputFormat{formatJPEG, formatPNG}
+}
+
+// canPreview checks if a provider is available for the file
+func canPreview(mimetype, name string) bool {
+	return providerFor(mimetype, name) != nil
+}
+
+// encode writes the preview in the output format
+func encode(w io.Writer, img image.Image, format outputFormat) error {
+	switch format {
+	case formatWebP:
+		return encodeWebP(w, img)
+	case formatPNG:
+		return imaging.Encode(w, img, imaging.PNG)
+	}
+	return imaging.Encode(w, img, imaging.JPEG)
+}
+
+// requestedMode returns the scaling mode requested by the client. Clients ask to
+// keep the aspect ratio with the 'a' parameter, in which case the 'mode'
+// parameter selects whether the preview fits in or covers the requested size.
+func requestedMode(r *http.Request, defaultMode Mode) Mode {
+	query := r.URL.Query()
+	mode := defaultMode
+	if _, ok := query["a"]; ok {
+		switch strings.ToLower(query.Get("a")) {
+		case "0", "false":
+			mode = ModeFill
+		default:
+			mode = ModeFit
+		}
+	}
+	if mode == ModeFill {
+		return mode
+	}
+	switch query.Get("mode") {
+	case "cover":
+		return ModeCover
+	case "fill":
+		return ModeFit
+	}
+	return mode
+}
+
+// acceptsWebP checks if the client lists WebP in its Accept header, without
+// refusing it with a quality of 0
+func acceptsWebP(r *http.Request) bool {
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		parts := strings.Split(mediaRange, ";")
+		if !strings.EqualFold(strings.TrimSpace(parts[0]), "image/webp") {
+			continue
+		}
+		for _, parameter := range parts[1:] {
+			parameter = strings.Replace(parameter, " ", "", -1)
+			if !strings.HasPrefix(strings.ToLower(parameter), "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(parameter[2:], 64); err == nil && q <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// GeneratePreview serves a thumbnail of the node which fills the given size,
+// unless the client asks to keep the aspect ratio
+func GeneratePreview(w http.ResponseWriter, r *http.Request, node *db.Node, widthString, heightString string) {
+	servePreview(w, r, node, widthString, heightString, ModeFill)
+}
+
+// RenderImage serves the image of the node, resized to the designated size if it's
+// too large, or scaled as requested by the client
+func RenderImage(w http.ResponseWriter, r *http.Request, node *db.Node, maxWidthString string, maxHeightString string) {
+	servePreview(w, r, node, maxWidthString, maxHeightString, ModeFit)
+}
+
+// servePreview serves a preview from the cache. Previews are identified by the
+// etag of the node and the requested size, so clients can revalidate them.
+func servePreview(w http.ResponseWriter, r *http.Request, node *db.Node, widthString, heightString string, defaultMode Mode) {
 	width, err := strconv.Atoi(widthString)
-	if err != nil {
-		log.Error("Failed to read width: ", err)
+	if err != nil || width <= 0 {
+		log.Errorf("Failed to read width: %v", widthString)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	height, err := strconv.Atoi(heightString)
-	if err != nil {
-		log.Error("Failed to read height: ", err)
+	if err != nil || height <= 0 {
+		log.Errorf("Failed to read height: %v", heightString)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	spec := previewSpec{width: width, height: height, mode: requestedMode(r, defaultMode)}
+	acceptWebP := acceptsWebP(r)
 
-	var preview *image.NRGBA
-	img, err := imaging.Open(filePath)
-	if err != nil {
-		if err != image.ErrFormat {
-			log.Error("Failed to open file as image: ", err)
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		log.Debug("Could not render preview: file is not a supported image format")
+	// Files with a generic mimetype are matched by their extension, and decoding
+	// fails fast if the content isn't what the provider expects
+	if node.Isdir || !canPreview(node.MimeType, node.Path) {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	preview = imaging.Thumbnail(img, width, height, imaging.Lanczos)
 
-	var buffer bytes.Buffer
-	err = imaging.Encode(&buffer, preview, imaging.GIF)
-	if err != nil {
-		log.Warn("Failed to encode preview")
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	// Clients accepting WebP may get a different encoding of the same preview
+	variant := spec.key()
+	if acceptWebP {
+		variant += "-webp"
 	}
-	w.Header().Set("Content-type", "image/gif")
-	w.WriteHeader(http.StatusOK)
-	w.Write(buffer.Bytes())
-}
-
-// RenderImage renders the given image and resizes it to the designated size if it's
-// too large. Images are encoded as JPEGs when they are send to the client
-func RenderImage(maxWidthString string, maxHeightString string, path string, w http.ResponseWriter) {
-	width, err := strconv.Atoi(maxWidthString)
-	if err != nil {
-		log.Error("Failed to read width: ", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	etag := "\"" + node.Etag + "-" + variant + "\""
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept")
+	// Clients which pass the etag of the file in the 'c' parameter change the url
+	// when the file changes, so the preview can be cached without revalidation
+	if c := r.URL.Query().Get("c"); c != "" && c == node.Etag {
+		w.Header().Set("Cache-Control", "private, max-age=31536000")
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
 	}
-	height, err := strconv.Atoi(maxHeightString)
-	if err != nil {
-		log.Error("Failed to read height: ", err)
-		w.WriteHeader(http.StatusBadRequest)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	var preview *image.NRGBA
-	img, err := imaging.Open(path)
+	data, contentType, err := getPreview(node, spec, acceptWebP)
 	if err != nil {
-		if err != image.ErrFormat {
-			log.Error("Failed to open file as image: ", err)
+		if err == ErrNoPreview {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		log.Debug("Could not render preview: file is not a supported image format")
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-	// Resize image if too large
-	preview = imaging.Fit(img, width, height, imaging.Lanczos)
-
-	var buffer bytes.Buffer
-	// For now encode everything we send as a jpeg as this seems to be the most efficient way
-	err = imaging.Encode(&buffer, preview, imaging.JPEG)
-	if err != nil {
-		log.Warn("Failed to encode preview")
+		log.Errorf("Failed to generate preview of %v: %v", node.Path, err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-type", "image/jpeg")
-	w.Header().Set("Content-length", strconv.Itoa(len(buffer.Bytes())))
+	w.Header().Set("Content-type", contentType)
+	w.Header().Set("Content-length", strconv.Itoa(len(data)))
 	w.WriteHeader(http.StatusOK)
-	w.Write(buffer.Bytes())
+	w.Write(data)
+}
+
+// etagMatches checks if the etag is listed in an If-None-Match header
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,61 @@
+package image
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestedMode(t *testing.T) {
+	tests := []struct {
+		query       string
+		defaultMode Mode
+		mode        Mode
+	}{
+		{"", ModeFill, ModeFill},
+		{"", ModeFit, ModeFit},
+		{"a=1", ModeFill, ModeFit},
+		{"a=true", ModeFill, ModeFit},
+		{"a=", ModeFill, ModeFit},
+		{"a=0", ModeFit, ModeFill},
+		{"a=FALSE", ModeFit, ModeFill},
+		{"a=1&mode=cover", ModeFill, ModeCover},
+		{"a=1&mode=fill", ModeFill, ModeFit},
+		{"a=1&mode=stretch", ModeFill, ModeFit},
+		{"mode=cover", ModeFit, ModeCover},
+		// The mode only applies when the aspect ratio is kept
+		{"mode=cover", ModeFill, ModeFill},
+		{"a=0&mode=cover", ModeFit, ModeFill},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/preview?"+test.query, nil)
+		if mode := requestedMode(r, test.defaultMode); mode != test.mode {
+			t.Errorf("requestedMode(%q, %v) = %v, want %v", test.query, test.defaultMode, mode, test.mode)
+		}
+	}
+}
+
+func TestAcceptsWebP(t *testing.T) {
+	tests := []struct {
+		accept string
+		webp   bool
+	}{
+		{"", false},
+		{"image/webp", true},
+		{"image/avif,image/webp,*/*", true},
+		{"text/html,application/xhtml+xml,image/webp,image/apng,*/*;q=0.8", true},
+		{"image/webp;q=0.5", true},
+		{"Image/WebP", true},
+		{"image/webp;q=0", false},
+		{"image/webp; q=0.0", false},
+		{"image/webp;Q=0.000", false},
+		{"image/png,image/*;q=0.8,*/*;q=0.5", false},
+		{"image/webpx", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/preview", nil)
+		r.Header.Set("Accept", test.accept)
+		if webp := acceptsWebP(r); webp != test.webp {
+			t.Errorf("acceptsWebP(%q) = %v, want %v", test.accept, webp, test.webp)
+		}
+	}
+}
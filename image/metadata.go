@@ -0,0 +1,171 @@
+package image
+
+import (
+	"image"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	db "github.com/gowncloud/gowncloud/database"
+	"golang.org/x/net/context"
+)
+
+// EXIF tags of the photo metadata
+const (
+	tagMake               = 0x10F
+	tagModel              = 0x110
+	tagDateTime           = 0x132
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagPixelXDimension    = 0xA002
+	tagPixelYDimension    = 0xA003
+	tagGPSLatitudeRef     = 0x1
+	tagGPSLatitude        = 0x2
+	tagGPSLongitudeRef    = 0x3
+	tagGPSLongitude       = 0x4
+)
+
+// exifTimeLayout is the format of the EXIF date and time fields
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// UpdateMetadata extracts the photo metadata of the node from its EXIF data and
+// stores it
+func UpdateMetadata(node *db.Node) (*db.PhotoMetadata, error) {
+	if storage == nil || node.Isdir || !strings.HasPrefix(node.MimeType, "image/") {
+		return nil, nil
+	}
+	file, err := storage.OpenFile(context.Background(), node.Path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	metadata := readMetadata(file)
+	metadata.NodeID = node.ID
+	metadata.Etag = node.Etag
+	err = db.SavePhotoMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// UpdateMissingMetadata extracts the metadata of the images of the user which
+// have no metadata yet, or of which the metadata is outdated. It returns the
+// amount of updated images.
+func UpdateMissingMetadata(username string) (int, error) {
+	nodes, err := db.GetNodesWithoutPhotoMetadata(username)
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, node := range nodes {
+		_, err = UpdateMetadata(node)
+		if err != nil {
+			log.Warnf("Failed to extract the metadata of %v: %v", node.Path, err)
+			continue
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// readMetadata reads the EXIF data and the dimensions of an image. Files without
+// EXIF data, or with damaged EXIF data, result in partial metadata.
+func readMetadata(file io.ReadSeeker) *db.PhotoMetadata {
+	metadata := &db.PhotoMetadata{}
+	r := readerAt{file}
+	orientation := 1
+
+	if base, ok := exifOffset(r); ok {
+		if t, err := newTIFFReader(r, base); err == nil {
+			if directory, err := t.readIFD(t.first); err == nil {
+				orientation = tiffOrientation(t, directory)
+				readEXIF(t, directory, metadata)
+			}
+		}
+	}
+
+	if metadata.Width == 0 || metadata.Height == 0 {
+		if _, err := file.Seek(0, io.SeekStart); err == nil {
+			if config, _, err := image.DecodeConfig(file); err == nil {
+				metadata.Width, metadata.Height = config.Width, config.Height
+			}
+		}
+	}
+	// Orientations 5 to 8 turn the image a quarter
+	if orientation >= 5 {
+		metadata.Width, metadata.Height = metadata.Height, metadata.Width
+	}
+	return metadata
+}
+
+// readEXIF reads the camera, the capture time and the GPS position from the
+// first directory and the EXIF and GPS directories it links to
+func readEXIF(t *tiffReader, directory *ifd, metadata *db.PhotoMetadata) {
+	metadata.Make = t.ascii(directory, tagMake)
+	metadata.Model = t.ascii(directory, tagModel)
+	taken := t.ascii(directory, tagDateTime)
+	offset := ""
+
+	if exifOffset, ok := t.uint(directory, tagExifIFD); ok {
+		if exif, err := t.readIFD(exifOffset); err == nil {
+			if original := t.ascii(exif, tagDateTimeOriginal); original != "" {
+				taken = original
+				offset = t.ascii(exif, tagOffsetTimeOriginal)
+			}
+			width, _ := t.uint(exif, tagPixelXDimension)
+			height, _ := t.uint(exif, tagPixelYDimension)
+			metadata.Width, metadata.Height = int(width), int(height)
+		}
+	}
+	metadata.Taken = parseEXIFTime(taken, offset)
+
+	if gpsOffset, ok := t.uint(directory, tagGPSIFD); ok {
+		if gps, err := t.readIFD(gpsOffset); err == nil {
+			latitude, ok1 := gpsCoordinate(t.rationals(gps, tagGPSLatitude), t.ascii(gps, tagGPSLatitudeRef), "S")
+			longitude, ok2 := gpsCoordinate(t.rationals(gps, tagGPSLongitude), t.ascii(gps, tagGPSLongitudeRef), "W")
+			if ok1 && ok2 && latitude >= -90 && latitude <= 90 && longitude >= -180 && longitude <= 180 {
+				metadata.Latitude = &latitude
+				metadata.Longitude = &longitude
+			}
+		}
+	}
+}
+
+// parseEXIFTime parses an EXIF date and time. Cameras store the local time,
+// without time zone unless they set the offset field. Times without offset are
+// interpreted as UTC, so they at least sort correctly among each other.
+func parseEXIFTime(value, offset string) *time.Time {
+	if value == "" || strings.HasPrefix(value, "0000") {
+		return nil
+	}
+	location := time.UTC
+	if offset != "" {
+		if zone, err := time.Parse("-07:00", offset); err == nil {
+			location = zone.Location()
+		}
+	}
+	taken, err := time.ParseInLocation(exifTimeLayout, value, location)
+	if err != nil {
+		return nil
+	}
+	return &taken
+}
+
+// gpsCoordinate converts degrees, minutes and seconds to degrees. The reference
+// is the hemisphere, negative is "S" for latitudes and "W" for longitudes.
+func gpsCoordinate(values []float64, reference, negative string) (float64, bool) {
+	if len(values) != 3 {
+		return 0, false
+	}
+	degrees := values[0] + values[1]/60 + values[2]/3600
+	if strings.EqualFold(reference, negative) {
+		degrees = -degrees
+	}
+	return degrees, true
+}
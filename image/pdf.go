@@ -0,0 +1,704 @@
+package image
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+const (
+	// pdfMaxBytes is the maximum size of a PDF file of which a preview is rendered
+	pdfMaxBytes = 64 << 20
+	// pdfMaxPixels is the maximum size of an embedded image that is decoded
+	pdfMaxPixels = 50 << 20
+	// pdfMaxDepth limits the nesting of objects and references
+	pdfMaxDepth = 32
+)
+
+var (
+	errPDFSyntax = errors.New("Invalid PDF syntax")
+
+	// pdfObjectHeader matches the start of an indirect object
+	pdfObjectHeader = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+)
+
+// pdfName is a name object, without the leading slash
+type pdfName string
+
+// pdfDict is a dictionary object
+type pdfDict map[pdfName]interface{}
+
+// pdfArray is an array object
+type pdfArray []interface{}
+
+// pdfRef is a reference to an indirect object
+type pdfRef struct {
+	number int
+}
+
+// pdfStream is a stream object with its raw, still encoded, data
+type pdfStream struct {
+	dict pdfDict
+	data []byte
+}
+
+// pdfDocument gives access to the objects of a PDF file. It doesn't rely on
+// the cross reference table, which is often damaged, but locates the objects by
+// scanning the file.
+type pdfDocument struct {
+	data       []byte
+	offsets    map[int]int
+	compressed map[int]interface{}
+}
+
+// renderPDF renders a preview of the first page of a PDF document. Laying out
+// text and vector graphics is out of reach of this renderer, so the preview is
+// the thumbnail embedded for the page, or the largest image on the page. Pages
+// without either, like plain text documents, have no preview.
+func renderPDF(file io.ReadSeeker) (image.Image, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(file, pdfMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > pdfMaxBytes || !bytes.HasPrefix(data, []byte("%PDF-")) {
+		return nil, ErrNoPreview
+	}
+	document := loadPDF(data)
+
+	page := document.firstPage()
+	if page == nil {
+		return nil, ErrNoPreview
+	}
+	if thumbnail, ok := document.resolve(page["Thumb"]).(*pdfStream); ok {
+		if img, err := document.decodeImage(thumbnail); err == nil {
+			return img, nil
+		}
+	}
+
+	var images []*pdfStream
+	resources, _ := document.inherited(page, "Resources").(pdfDict)
+	xobjects, _ := document.resolve(resources["XObject"]).(pdfDict)
+	for _, value := range xobjects {
+		stream, ok := document.resolve(value).(*pdfStream)
+		if ok && document.resolve(stream.dict["Subtype"]) == pdfName("Image") {
+			images = append(images, stream)
+		}
+	}
+	// Try the largest image first, it's most likely what the page is about
+	sort.Sort(bySize{document, images})
+	for _, stream := range images {
+		img, err := document.decodeImage(stream)
+		if err == nil {
+			return img, nil
+		}
+	}
+	return nil, ErrNoPreview
+}
+
+// bySize sorts image streams from large to small
+type bySize struct {
+	document *pdfDocument
+	images   []*pdfStream
+}
+
+func (s bySize) Len() int      { return len(s.images) }
+func (s bySize) Swap(i, j int) { s.images[i], s.images[j] = s.images[j], s.images[i] }
+func (s bySize) Less(i, j int) bool {
+	return s.document.pixels(s.images[i]) > s.document.pixels(s.images[j])
+}
+
+// pixels returns the amount of pixels in an image stream
+func (d *pdfDocument) pixels(stream *pdfStream) int {
+	width, _ := d.resolve(stream.dict["Width"]).(int)
+	height, _ := d.resolve(stream.dict["Height"]).(int)
+	return width * height
+}
+
+// loadPDF indexes the objects in the file, including the ones in object streams
+func loadPDF(data []byte) *pdfDocument {
+	document := &pdfDocument{
+		data:       data,
+		offsets:    make(map[int]int),
+		compressed: make(map[int]interface{}),
+	}
+	// Later definitions replace earlier ones in incrementally updated files
+	for _, match := range pdfObjectHeader.FindAllSubmatchIndex(data, -1) {
+		if match[0] > 0 && !isPDFDelimiter(data[match[0]-1]) {
+			continue
+		}
+		number, err := strconv.Atoi(string(data[match[2]:match[3]]))
+		if err == nil {
+			document.offsets[number] = match[1]
+		}
+	}
+	for number := range document.offsets {
+		stream, ok := document.object(number).(*pdfStream)
+		if ok && stream.dict["Type"] == pdfName("ObjStm") {
+			document.loadObjectStream(stream)
+		}
+	}
+	return document
+}
+
+// loadObjectStream parses the objects stored in an object stream
+func (d *pdfDocument) loadObjectStream(stream *pdfStream) {
+	data, err := d.decodeStream(stream, pdfMaxBytes)
+	if err != nil {
+		return
+	}
+	count, _ := d.resolve(stream.dict["N"]).(int)
+	first, _ := d.resolve(stream.dict["First"]).(int)
+	if first <= 0 || first > len(data) {
+		return
+	}
+	header := &pdfParser{data: data[:first]}
+	for i := 0; i < count; i++ {
+		number, ok1 := header.next().(int)
+		offset, ok2 := header.next().(int)
+		if !ok1 || !ok2 || first+offset >= len(data) {
+			return
+		}
+		if _, exists := d.offsets[number]; exists {
+			continue
+		}
+		parser := &pdfParser{data: data, pos: first + offset}
+		d.compressed[number] = parser.parseObject(0)
+	}
+}
+
+// object returns the indirect object with the given number, or nil
+func (d *pdfDocument) object(number int) interface{} {
+	if value, ok := d.compressed[number]; ok {
+		return value
+	}
+	offset, ok := d.offsets[number]
+	if !ok {
+		return nil
+	}
+	parser := &pdfParser{data: d.data, pos: offset}
+	value := parser.parseObject(0)
+	dict, ok := value.(pdfDict)
+	if !ok || !parser.skipKeyword("stream") {
+		return value
+	}
+
+	// The stream data starts after the end of line following the keyword
+	start := parser.pos
+	if start < len(d.data) && d.data[start] == '\r' {
+		start++
+	}
+	if start < len(d.data) && d.data[start] == '\n' {
+		start++
+	}
+	end := -1
+	if length, ok := d.resolveLength(dict["Length"]); ok && start+length <= len(d.data) {
+		end = start + length
+	} else if i := bytes.Index(d.data[start:], []byte("endstream")); i >= 0 {
+		end = start + i
+	}
+	if end < 0 {
+		return nil
+	}
+	return &pdfStream{dict: dict, data: d.data[start:end]}
+}
+
+// resolveLength resolves the length of a stream, which may be an indirect object.
+// Streams don't have their length in another stream, which prevents a loop.
+func (d *pdfDocument) resolveLength(value interface{}) (int, bool) {
+	if ref, ok := value.(pdfRef); ok {
+		offset, exists := d.offsets[ref.number]
+		if !exists {
+			return 0, false
+		}
+		parser := &pdfParser{data: d.data, pos: offset}
+		value = parser.parseObject(0)
+	}
+	length, ok := value.(int)
+	return length, ok && length >= 0
+}
+
+// resolve follows references until it reaches a direct object
+func (d *pdfDocument) resolve(value interface{}) interface{} {
+	for i := 0; i < pdfMaxDepth; i++ {
+		ref, ok := value.(pdfRef)
+		if !ok {
+			return value
+		}
+		value = d.object(ref.number)
+	}
+	return nil
+}
+
+// inherited returns an attribute of a page, which may be set on one of the
+// parents in the page tree
+func (d *pdfDocument) inherited(page pdfDict, key pdfName) interface{} {
+	for i := 0; i < pdfMaxDepth && page != nil; i++ {
+		if value, ok := page[key]; ok {
+			return d.resolve(value)
+		}
+		page, _ = d.resolve(page["Parent"]).(pdfDict)
+	}
+	return nil
+}
+
+// firstPage returns the first page of the document. If the page tree can't be
+// followed, the first page object in the file is used.
+func (d *pdfDocument) firstPage() pdfDict {
+	numbers := make([]int, 0, len(d.offsets)+len(d.compressed))
+	for number := range d.offsets {
+		numbers = append(numbers, number)
+	}
+	for number := range d.compressed {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	var firstPage pdfDict
+	for _, number := range numbers {
+		dict, ok := d.object(number).(pdfDict)
+		if !ok {
+			continue
+		}
+		switch dict["Type"] {
+		case pdfName("Catalog"):
+			if page := d.firstKid(d.resolve(dict["Pages"]), 0); page != nil {
+				return page
+			}
+		case pdfName("Page"):
+			if firstPage == nil {
+				firstPage = dict
+			}
+		}
+	}
+	return firstPage
+}
+
+// firstKid descends the page tree to its first page
+func (d *pdfDocument) firstKid(node interface{}, depth int) pdfDict {
+	dict, ok := node.(pdfDict)
+	if !ok || depth > pdfMaxDepth {
+		return nil
+	}
+	if dict["Type"] == pdfName("Page") {
+		return dict
+	}
+	kids, _ := d.resolve(dict["Kids"]).(pdfArray)
+	for _, kid := range kids {
+		if page := d.firstKid(d.resolve(kid), depth+1); page != nil {
+			return page
+		}
+	}
+	return nil
+}
+
+// filters returns the filters of a stream in the order they have to be applied
+func (d *pdfDocument) filters(stream *pdfStream) []pdfName {
+	switch filter := d.resolve(stream.dict["Filter"]).(type) {
+	case pdfName:
+		return []pdfName{filter}
+	case pdfArray:
+		names := make([]pdfName, 0, len(filter))
+		for _, value := range filter {
+			if name, ok := d.resolve(value).(pdfName); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// decodeStream applies the filters of the stream. Decoding stops at the first
+// image filter, which is left to the image decoder. Streams inflating to more
+// than limit bytes are refused.
+func (d *pdfDocument) decodeStream(stream *pdfStream, limit int) ([]byte, error) {
+	data := stream.data
+	for _, filter := range d.filters(stream) {
+		switch filter {
+		case "FlateDecode", "Fl":
+			reader, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, err
+			}
+			decoded, err := ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+			if err != nil && len(decoded) == 0 {
+				return nil, err
+			}
+			if len(decoded) > limit {
+				return nil, ErrNoPreview
+			}
+			data = decoded
+		case "DCTDecode", "DCT":
+			return data, nil
+		default:
+			return nil, ErrNoPreview
+		}
+	}
+	return data, nil
+}
+
+// decodeImage decodes an image XObject. JPEG images and uncompressed or deflated
+// 8-bit gray, RGB and CMYK images are supported.
+func (d *pdfDocument) decodeImage(stream *pdfStream) (image.Image, error) {
+	width, _ := d.resolve(stream.dict["Width"]).(int)
+	height, _ := d.resolve(stream.dict["Height"]).(int)
+	if width <= 0 || height <= 0 || width*height > pdfMaxPixels {
+		return nil, ErrNoPreview
+	}
+	// 4 bytes for each CMYK pixel, and a predictor byte for each row
+	data, err := d.decodeStream(stream, width*height*4+height)
+	if err != nil {
+		return nil, err
+	}
+	filters := d.filters(stream)
+	if len(filters) > 0 && (filters[len(filters)-1] == "DCTDecode" || filters[len(filters)-1] == "DCT") {
+		return jpeg.Decode(bytes.NewReader(data))
+	}
+
+	if bits, _ := d.resolve(stream.dict["BitsPerComponent"]).(int); bits != 8 {
+		return nil, ErrNoPreview
+	}
+	components := d.colorComponents(stream.dict["ColorSpace"])
+	if components == 0 {
+		return nil, ErrNoPreview
+	}
+	params, _ := d.resolve(stream.dict["DecodeParms"]).(pdfDict)
+	if predictor, _ := d.resolve(params["Predictor"]).(int); predictor >= 10 {
+		data, err = unpredictPNG(data, width*components, components)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(data) < width*height*components {
+		return nil, ErrNoPreview
+	}
+
+	rect := image.Rect(0, 0, width, height)
+	switch components {
+	case 1:
+		img := image.NewGray(rect)
+		copy(img.Pix, data)
+		return img, nil
+	case 3:
+		img := image.NewRGBA(rect)
+		for i := 0; i < width*height; i++ {
+			img.Pix[4*i] = data[3*i]
+			img.Pix[4*i+1] = data[3*i+1]
+			img.Pix[4*i+2] = data[3*i+2]
+			img.Pix[4*i+3] = 0xff
+		}
+		return img, nil
+	default:
+		img := image.NewRGBA(rect)
+		for i := 0; i < width*height; i++ {
+			r, g, b := color.CMYKToRGB(data[4*i], data[4*i+1], data[4*i+2], data[4*i+3])
+			img.Pix[4*i] = r
+			img.Pix[4*i+1] = g
+			img.Pix[4*i+2] = b
+			img.Pix[4*i+3] = 0xff
+		}
+		return img, nil
+	}
+}
+
+// colorComponents returns the amount of components of a color space, or 0 if it
+// is not supported
+func (d *pdfDocument) colorComponents(value interface{}) int {
+	switch colorSpace := d.resolve(value).(type) {
+	case pdfName:
+		switch colorSpace {
+		case "DeviceGray", "CalGray", "G":
+			return 1
+		case "DeviceRGB", "CalRGB", "RGB":
+			return 3
+		case "DeviceCMYK", "CMYK":
+			return 4
+		}
+	case pdfArray:
+		if len(colorSpace) < 2 {
+			return 0
+		}
+		switch d.resolve(colorSpace[0]) {
+		case pdfName("ICCBased"):
+			if profile, ok := d.resolve(colorSpace[1]).(*pdfStream); ok {
+				if n, _ := d.resolve(profile.dict["N"]).(int); n == 1 || n == 3 || n == 4 {
+					return n
+				}
+			}
+		case pdfName("CalGray"):
+			return 1
+		case pdfName("CalRGB"):
+			return 3
+		}
+	}
+	return 0
+}
+
+// unpredictPNG reverses the PNG predictors applied to every row of the data
+func unpredictPNG(data []byte, rowSize, bytesPerPixel int) ([]byte, error) {
+	stride := rowSize + 1
+	rows := len(data) / stride
+	result := make([]byte, rows*rowSize)
+	previous := make([]byte, rowSize)
+	for row := 0; row < rows; row++ {
+		filter := data[row*stride]
+		in := data[row*stride+1 : (row+1)*stride]
+		out := result[row*rowSize : (row+1)*rowSize]
+		for i := range in {
+			var left, upLeft byte
+			if i >= bytesPerPixel {
+				left = out[i-bytesPerPixel]
+				upLeft = previous[i-bytesPerPixel]
+			}
+			up := previous[i]
+			switch filter {
+			case 0:
+				out[i] = in[i]
+			case 1:
+				out[i] = in[i] + left
+			case 2:
+				out[i] = in[i] + up
+			case 3:
+				out[i] = in[i] + byte((int(left)+int(up))/2)
+			case 4:
+				out[i] = in[i] + paeth(left, up, upLeft)
+			default:
+				return nil, errPDFSyntax
+			}
+		}
+		previous = out
+	}
+	return result, nil
+}
+
+// paeth is the Paeth predictor of the PNG specification
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	}
+	if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// pdfParser parses objects from PDF syntax. Numbers are returned as int or
+// float64, strings as []byte, and the keywords true, false and null as bool and
+// nil. Syntax errors result in nil values rather than errors, the caller checks
+// the types of what it needs.
+type pdfParser struct {
+	data []byte
+	pos  int
+}
+
+// isPDFDelimiter checks if the character ends a token
+func isPDFDelimiter(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '\f', 0, '(', ')', '<', '>', '[', ']', '{', '}', '/', '%':
+		return true
+	}
+	return false
+}
+
+// skipSpace skips whitespace and comments
+func (p *pdfParser) skipSpace() {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case ' ', '\t', '\r', '\n', '\f', 0:
+			p.pos++
+		case '%':
+			for p.pos < len(p.data) && p.data[p.pos] != '\r' && p.data[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// skipKeyword skips the keyword if it is next in the data
+func (p *pdfParser) skipKeyword(keyword string) bool {
+	p.skipSpace()
+	end := p.pos + len(keyword)
+	if end > len(p.data) || string(p.data[p.pos:end]) != keyword {
+		return false
+	}
+	if end < len(p.data) && !isPDFDelimiter(p.data[end]) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+// next parses the next object without resolving references
+func (p *pdfParser) next() interface{} {
+	return p.parseValue(0)
+}
+
+// parseObject parses an object, turning "number generation R" into a reference
+func (p *pdfParser) parseObject(depth int) interface{} {
+	value := p.parseValue(depth)
+	number, ok := value.(int)
+	if !ok {
+		return value
+	}
+	// Look ahead for the generation number and the R keyword
+	saved := p.pos
+	if generation, ok := p.parseValue(depth).(int); ok && generation >= 0 && p.skipKeyword("R") {
+		return pdfRef{number: number}
+	}
+	p.pos = saved
+	return number
+}
+
+// parseValue parses a single token or a compound object
+func (p *pdfParser) parseValue(depth int) interface{} {
+	p.skipSpace()
+	if p.pos >= len(p.data) || depth > pdfMaxDepth {
+		return nil
+	}
+	switch c := p.data[p.pos]; {
+	case c == '/':
+		p.pos++
+		start := p.pos
+		for p.pos < len(p.data) && !isPDFDelimiter(p.data[p.pos]) {
+			p.pos++
+		}
+		return pdfName(p.data[start:p.pos])
+	case c == '<' && p.pos+1 < len(p.data) && p.data[p.pos+1] == '<':
+		p.pos += 2
+		dict := make(pdfDict)
+		for {
+			p.skipSpace()
+			if p.pos+1 >= len(p.data) {
+				return dict
+			}
+			if p.data[p.pos] == '>' && p.data[p.pos+1] == '>' {
+				p.pos += 2
+				return dict
+			}
+			key, ok := p.parseValue(depth + 1).(pdfName)
+			if !ok {
+				return dict
+			}
+			dict[key] = p.parseObject(depth + 1)
+		}
+	case c == '<':
+		return p.parseHexString()
+	case c == '(':
+		return p.parseLiteralString()
+	case c == '[':
+		p.pos++
+		array := make(pdfArray, 0)
+		for {
+			p.skipSpace()
+			if p.pos >= len(p.data) {
+				return array
+			}
+			if p.data[p.pos] == ']' {
+				p.pos++
+				return array
+			}
+			start := p.pos
+			array = append(array, p.parseObject(depth+1))
+			if p.pos == start {
+				// Skip what can't be parsed
+				p.pos++
+			}
+		}
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		p.pos++
+		for p.pos < len(p.data) && !isPDFDelimiter(p.data[p.pos]) {
+			p.pos++
+		}
+		token := string(p.data[start:p.pos])
+		if number, err := strconv.Atoi(token); err == nil {
+			return number
+		}
+		if number, err := strconv.ParseFloat(token, 64); err == nil {
+			return number
+		}
+		return nil
+	default:
+		start := p.pos
+		for p.pos < len(p.data) && !isPDFDelimiter(p.data[p.pos]) {
+			p.pos++
+		}
+		switch string(p.data[start:p.pos]) {
+		case "true":
+			return true
+		case "false":
+			return false
+		}
+		if p.pos == start {
+			// A delimiter that doesn't start an object
+			p.pos++
+		}
+		return nil
+	}
+}
+
+// parseHexString parses a string in hexadecimal notation
+func (p *pdfParser) parseHexString() []byte {
+	p.pos++
+	var result []byte
+	var digits []byte
+	for p.pos < len(p.data) && p.data[p.pos] != '>' {
+		if value, err := strconv.ParseUint(string(p.data[p.pos]), 16, 8); err == nil {
+			digits = append(digits, byte(value))
+			if len(digits) == 2 {
+				result = append(result, digits[0]<<4|digits[1])
+				digits = digits[:0]
+			}
+		}
+		p.pos++
+	}
+	p.pos++
+	if len(digits) == 1 {
+		result = append(result, digits[0]<<4)
+	}
+	return result
+}
+
+// parseLiteralString parses a string in parentheses. Escapes are only handled
+// as far as needed to find the end of the string.
+func (p *pdfParser) parseLiteralString() []byte {
+	p.pos++
+	start := p.pos
+	nesting := 1
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case '\\':
+			p.pos++
+		case '(':
+			nesting++
+		case ')':
+			nesting--
+			if nesting == 0 {
+				result := p.data[start:p.pos]
+				p.pos++
+				return result
+			}
+		}
+		p.pos++
+	}
+	return p.data[start:]
+}
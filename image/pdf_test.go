@@ -0,0 +1,33 @@
+package image
+
+import (
+	"bytes"
+	"compress/zlib"
+	"testing"
+)
+
+func TestDecodeStreamLimit(t *testing.T) {
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write(make([]byte, 1<<20))
+	w.Close()
+	tests := []struct {
+		limit int
+		err   error
+	}{
+		{1 << 20, nil},
+		{1<<20 + 1, nil},
+		{1<<20 - 1, ErrNoPreview},
+		{0, ErrNoPreview},
+	}
+	d := &pdfDocument{}
+	for _, test := range tests {
+		stream := &pdfStream{dict: pdfDict{"Filter": pdfName("FlateDecode")}, data: compressed.Bytes()}
+		data, err := d.decodeStream(stream, test.limit)
+		if err != test.err {
+			t.Errorf("decodeStream with limit %v returned error %v, want %v", test.limit, err, test.err)
+		} else if err == nil && len(data) != 1<<20 {
+			t.Errorf("decodeStream with limit %v returned %v bytes, want %v", test.limit, len(data), 1<<20)
+		}
+	}
+}
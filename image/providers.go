@@ -0,0 +1,161 @@
+package image
+
+import (
+	"image"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// Provider renders the content of a file as an image, from which the previews
+// are scaled
+type Provider struct {
+	// Name identifies the provider in the logs
+	Name string
+	// MimeTypes are the mimetypes the provider can render. A mimetype ending in
+	// a '/' matches all mimetypes with that prefix
+	MimeTypes []string
+	// Extensions are used to select the provider for files stored without a
+	// specific mimetype. They include the leading dot.
+	Extensions []string
+	// Render reads the file and returns its image. It returns ErrNoPreview if
+	// the file contains nothing that can be shown.
+	Render func(file io.ReadSeeker) (image.Image, error)
+}
+
+// providers are the registered providers, in order of registration
+var providers []*Provider
+
+func init() {
+	RegisterProvider(&Provider{
+		Name:       "image",
+		MimeTypes:  []string{"image/"},
+		Extensions: []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tif", ".tiff"},
+		Render:     renderImage,
+	})
+	RegisterProvider(&Provider{
+		Name:       "text",
+		MimeTypes:  []string{"text/"},
+		Extensions: []string{".txt", ".md", ".markdown", ".csv", ".log"},
+		Render:     renderText,
+	})
+	RegisterProvider(&Provider{
+		Name:       "svg",
+		MimeTypes:  []string{"image/svg+xml"},
+		Extensions: []string{".svg"},
+		Render:     renderSVG,
+	})
+	RegisterProvider(&Provider{
+		Name:       "pdf",
+		MimeTypes:  []string{"application/pdf"},
+		Extensions: []string{".pdf"},
+		Render:     renderPDF,
+	})
+	RegisterProvider(&Provider{
+		Name: "raw",
+		MimeTypes: []string{"image/x-dcraw", "image/x-adobe-dng", "image/x-canon-cr2", "image/x-nikon-nef",
+			"image/x-sony-arw", "image/x-olympus-orf", "image/x-panasonic-rw2", "image/x-pentax-pef",
+			"image/x-samsung-srw", "image/x-fuji-raf"},
+		Extensions: []string{".dng", ".cr2", ".nef", ".arw", ".orf", ".rw2", ".pef", ".srw", ".raf"},
+		Render:     renderRAW,
+	})
+	RegisterProvider(&Provider{
+		Name:       "audio",
+		MimeTypes:  []string{"audio/mpeg", "audio/mp3", "audio/flac", "audio/x-flac"},
+		Extensions: []string{".mp3", ".flac"},
+		Render:     renderAudioCover,
+	})
+}
+
+// RegisterProvider adds a provider to the registry
+func RegisterProvider(provider *Provider) {
+	providers = append(providers, provider)
+}
+
+// providerFor returns the provider for a file. A provider listing the exact
+// mimetype is preferred over one matching a mimetype prefix. If the mimetype is
+// missing or generic, the extension of the file name is used instead.
+func providerFor(mimetype, name string) *Provider {
+	mimetype = strings.ToLower(mimetype)
+	if mimetype != "" && mimetype != "application/octet-stream" {
+		if provider := providerForMimeType(mimetype); provider != nil {
+			return provider
+		}
+	}
+
+	extension := strings.ToLower(path.Ext(name))
+	for _, provider := range providers {
+		for _, providerExtension := range provider.Extensions {
+			if extension == providerExtension {
+				return provider
+			}
+		}
+	}
+	if byExtension := mime.TypeByExtension(extension); byExtension != "" {
+		return providerForMimeType(strings.ToLower(byExtension))
+	}
+	return nil
+}
+
+// providerForMimeType returns the provider for the mimetype, or nil if there is none
+func providerForMimeType(mimetype string) *Provider {
+	if i := strings.Index(mimetype, ";"); i >= 0 {
+		mimetype = strings.TrimSpace(mimetype[:i])
+	}
+	var prefixMatch *Provider
+	for _, provider := range providers {
+		for _, providerType := range provider.MimeTypes {
+			if providerType == mimetype {
+				return provider
+			}
+			if prefixMatch == nil && strings.HasSuffix(providerType, "/") && strings.HasPrefix(mimetype, providerType) {
+				prefixMatch = provider
+			}
+		}
+	}
+	return prefixMatch
+}
+
+// renderImage decodes the file as an image in one of the supported formats, and
+// rotates it as described by its EXIF orientation
+func renderImage(file io.ReadSeeker) (image.Image, error) {
+	img, err := imaging.Decode(file)
+	if err == image.ErrFormat {
+		return nil, ErrNoPreview
+	}
+	if err != nil {
+		return nil, err
+	}
+	return orient(img, exifOrientation(readerAt{file})), nil
+}
+
+// readerAt implements io.ReaderAt on top of an io.ReadSeeker, for parsers that
+// need random access. It is not safe for concurrent use.
+type readerAt struct {
+	io.ReadSeeker
+}
+
+func (r readerAt) ReadAt(p []byte, offset int64) (int, error) {
+	_, err := r.Seek(offset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r, p)
+}
+
+// PreviewMimeTypes returns the mimetypes of the registered providers. Mimetype
+// prefixes, which match a family of mimetypes, are not included.
+func PreviewMimeTypes() []string {
+	var mimetypes []string
+	for _, provider := range providers {
+		for _, mimetype := range provider.MimeTypes {
+			if !strings.HasSuffix(mimetype, "/") {
+				mimetypes = append(mimetypes, mimetype)
+			}
+		}
+	}
+	return mimetypes
+}
@@ -0,0 +1,131 @@
+package image
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"sort"
+)
+
+// TIFF tags locating the previews embedded in RAW files
+const (
+	tagCompression     = 0x103
+	tagStripOffsets    = 0x111
+	tagStripByteCounts = 0x117
+	tagSubIFDs         = 0x14A
+	tagJPEGOffset      = 0x201
+	tagJPEGLength      = 0x202
+	// tagPanasonicJPEG holds the embedded JPEG of Panasonic RW2 files
+	tagPanasonicJPEG = 0x2E
+)
+
+const (
+	// rawMaxPreviewBytes is the maximum size of an embedded preview
+	rawMaxPreviewBytes = 32 << 20
+	// rafHeader is the magic of Fujifilm RAF files, which are not TIFF based
+	rafHeader = "FUJIFILMCCD-RAW "
+)
+
+// embeddedJPEG is the location of a JPEG image inside a RAW file
+type embeddedJPEG struct {
+	offset int64
+	length int64
+	pixels int
+}
+
+// renderRAW renders a camera RAW file using the largest JPEG preview the camera
+// embedded in it. Developing the raw sensor data itself is not supported.
+func renderRAW(file io.ReadSeeker) (image.Image, error) {
+	r := readerAt{file}
+	candidates, orientation := rawPreviews(r)
+
+	// Measure the candidates, and try the largest first
+	var previews []embeddedJPEG
+	for _, candidate := range candidates {
+		config, err := jpeg.DecodeConfig(io.NewSectionReader(r, candidate.offset, candidate.length))
+		if err != nil {
+			continue
+		}
+		candidate.pixels = config.Width * config.Height
+		previews = append(previews, candidate)
+	}
+	sort.Sort(byPixels(previews))
+	for _, preview := range previews {
+		img, err := jpeg.Decode(io.NewSectionReader(r, preview.offset, preview.length))
+		if err == nil {
+			return orient(img, orientation), nil
+		}
+	}
+	return nil, ErrNoPreview
+}
+
+// byPixels sorts embedded images from large to small
+type byPixels []embeddedJPEG
+
+func (p byPixels) Len() int           { return len(p) }
+func (p byPixels) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byPixels) Less(i, j int) bool { return p[i].pixels > p[j].pixels }
+
+// rawPreviews lists the JPEG images embedded in a RAW file, and returns the
+// orientation of the photo. The previews are stored unrotated.
+func rawPreviews(r io.ReaderAt) ([]embeddedJPEG, int) {
+	header := make([]byte, 92)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, 1
+	}
+	if string(header[:len(rafHeader)]) == rafHeader {
+		offset := int64(header[84])<<24 | int64(header[85])<<16 | int64(header[86])<<8 | int64(header[87])
+		length := int64(header[88])<<24 | int64(header[89])<<16 | int64(header[90])<<8 | int64(header[91])
+		// The embedded JPEG of RAF files carries its own EXIF orientation
+		return []embeddedJPEG{{offset: offset, length: length}}, exifOrientation(io.NewSectionReader(r, offset, length))
+	}
+
+	t, err := newTIFFReader(r, 0)
+	if err != nil {
+		return nil, 1
+	}
+	var candidates []embeddedJPEG
+	queue := t.directories(t.first)
+	orientation := 1
+	if len(queue) > 0 {
+		orientation = tiffOrientation(t, queue[0])
+	}
+	for i := 0; i < len(queue) && i < maxIFDs; i++ {
+		directory := queue[i]
+		if entry, ok := directory.entries[tagSubIFDs]; ok {
+			for _, offset := range t.uints(entry) {
+				queue = append(queue, t.directories(offset)...)
+			}
+		}
+
+		if offset, ok := t.uint(directory, tagJPEGOffset); ok {
+			if length, ok := t.uint(directory, tagJPEGLength); ok {
+				candidates = append(candidates, embeddedJPEG{offset: int64(offset), length: int64(length)})
+			}
+		}
+		if entry, ok := directory.entries[tagPanasonicJPEG]; ok && entry.size() > 4 {
+			candidates = append(candidates, embeddedJPEG{offset: t.valueOffset(entry), length: entry.size()})
+		}
+		// Some cameras store the preview as the single strip of a JPEG compressed image
+		compression, _ := t.uint(directory, tagCompression)
+		offsets := t.uints(directory.entries[tagStripOffsets])
+		lengths := t.uints(directory.entries[tagStripByteCounts])
+		if (compression == 6 || compression == 7) && len(offsets) == 1 && len(lengths) == 1 {
+			candidates = append(candidates, embeddedJPEG{offset: int64(offsets[0]), length: int64(lengths[0])})
+		}
+	}
+
+	// Only keep what looks like a JPEG image
+	var result []embeddedJPEG
+	for _, candidate := range candidates {
+		if candidate.length <= 2 || candidate.length > rawMaxPreviewBytes {
+			continue
+		}
+		magic := make([]byte, 2)
+		if _, err := r.ReadAt(magic, candidate.offset); err == nil && bytes.Equal(magic, []byte{0xFF, 0xD8}) {
+			result = append(result, candidate)
+		}
+	}
+	return result, orientation
+}
@@ -0,0 +1,706 @@
+package image
+
+import (
+	"encoding/xml"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/image/vector"
+)
+
+const (
+	// svgMaxSize is the size of the longest side of a rasterized SVG image
+	svgMaxSize = 512
+	// svgMaxBytes is the maximum size of an SVG file that is rasterized
+	svgMaxBytes = 10 << 20
+	// curveSegments is the amount of line segments an elliptical arc is split in
+	curveSegments = 16
+)
+
+// svgNamedColors are the most common of the SVG color keywords
+var svgNamedColors = map[string]color.RGBA{
+	"black":   {0x00, 0x00, 0x00, 0xff},
+	"white":   {0xff, 0xff, 0xff, 0xff},
+	"red":     {0xff, 0x00, 0x00, 0xff},
+	"green":   {0x00, 0x80, 0x00, 0xff},
+	"lime":    {0x00, 0xff, 0x00, 0xff},
+	"blue":    {0x00, 0x00, 0xff, 0xff},
+	"yellow":  {0xff, 0xff, 0x00, 0xff},
+	"cyan":    {0x00, 0xff, 0xff, 0xff},
+	"aqua":    {0x00, 0xff, 0xff, 0xff},
+	"magenta": {0xff, 0x00, 0xff, 0xff},
+	"fuchsia": {0xff, 0x00, 0xff, 0xff},
+	"gray":    {0x80, 0x80, 0x80, 0xff},
+	"grey":    {0x80, 0x80, 0x80, 0xff},
+	"silver":  {0xc0, 0xc0, 0xc0, 0xff},
+	"maroon":  {0x80, 0x00, 0x00, 0xff},
+	"olive":   {0x80, 0x80, 0x00, 0xff},
+	"navy":    {0x00, 0x00, 0x80, 0xff},
+	"purple":  {0x80, 0x00, 0x80, 0xff},
+	"teal":    {0x00, 0x80, 0x80, 0xff},
+	"orange":  {0xff, 0xa5, 0x00, 0xff},
+}
+
+// svgStyle holds the inherited presentation attributes of an element
+type svgStyle struct {
+	fill        *color.RGBA
+	stroke      *color.RGBA
+	strokeWidth float64
+	opacity     float64
+}
+
+// matrix is an affine transformation [a c e; b d f]
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+func (m matrix) multiply(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[2]*n[1],
+		m[1]*n[0] + m[3]*n[1],
+		m[0]*n[2] + m[2]*n[3],
+		m[1]*n[2] + m[3]*n[3],
+		m[0]*n[4] + m[2]*n[5] + m[4],
+		m[1]*n[4] + m[3]*n[5] + m[5],
+	}
+}
+
+func (m matrix) apply(x, y float64) (float32, float32) {
+	return float32(m[0]*x + m[2]*y + m[4]), float32(m[1]*x + m[3]*y + m[5])
+}
+
+// scale returns the average scale factor of the transformation, used for stroke widths
+func (m matrix) scale() float64 {
+	return math.Sqrt(math.Abs(m[0]*m[3] - m[1]*m[2]))
+}
+
+// svgPath is a shape as a list of closed or open polylines
+type svgPath [][]point
+
+type point struct {
+	x, y float64
+}
+
+// svgRenderer rasterizes the shapes of an SVG document
+type svgRenderer struct {
+	canvas *image.RGBA
+}
+
+// renderSVG rasterizes an SVG image. It supports the basic shapes and paths with
+// solid fills and strokes, which covers icons and simple drawings. Gradients,
+// text, filters and clipping are not supported.
+func renderSVG(file io.ReadSeeker) (image.Image, error) {
+	decoder := xml.NewDecoder(io.LimitReader(file, svgMaxBytes))
+	decoder.Strict = false
+
+	var renderer *svgRenderer
+	transforms := []matrix{}
+	styles := []svgStyle{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if renderer != nil {
+				// Show what could be rendered of a damaged document
+				break
+			}
+			return nil, ErrNoPreview
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			attrs := attributeMap(element.Attr)
+			if renderer == nil {
+				if element.Name.Local != "svg" {
+					return nil, ErrNoPreview
+				}
+				var base matrix
+				renderer, base = newSVGRenderer(attrs)
+				transforms = append(transforms, base)
+				black := color.RGBA{0, 0, 0, 0xff}
+				styles = append(styles, svgStyle{fill: &black, strokeWidth: 1, opacity: 1})
+				continue
+			}
+			parentTransform := transforms[len(transforms)-1]
+			transform := parentTransform.multiply(parseTransform(attrs["transform"]))
+			style := parseStyle(attrs, styles[len(styles)-1])
+			transforms = append(transforms, transform)
+			styles = append(styles, style)
+
+			switch element.Name.Local {
+			case "defs", "clipPath", "mask", "pattern", "symbol", "marker", "linearGradient", "radialGradient":
+				// Definitions are not drawn themselves
+				decoder.Skip()
+				transforms = transforms[:len(transforms)-1]
+				styles = styles[:len(styles)-1]
+				continue
+			}
+			if shape := parseShape(element.Name.Local, attrs); shape != nil {
+				renderer.draw(shape, transform, style)
+			}
+		case xml.EndElement:
+			if len(transforms) > 1 {
+				transforms = transforms[:len(transforms)-1]
+				styles = styles[:len(styles)-1]
+			}
+		}
+	}
+	if renderer == nil {
+		return nil, ErrNoPreview
+	}
+	return renderer.canvas, nil
+}
+
+// newSVGRenderer creates the canvas for the svg element, and returns the
+// transformation of the viewBox to the canvas
+func newSVGRenderer(attrs map[string]string) (*svgRenderer, matrix) {
+	viewBox := parseNumbers(attrs["viewBox"])
+	width := parseLength(attrs["width"])
+	height := parseLength(attrs["height"])
+	var minX, minY, viewWidth, viewHeight float64
+	if len(viewBox) == 4 && viewBox[2] > 0 && viewBox[3] > 0 {
+		minX, minY, viewWidth, viewHeight = viewBox[0], viewBox[1], viewBox[2], viewBox[3]
+	} else {
+		viewWidth, viewHeight = width, height
+	}
+	if viewWidth <= 0 || viewHeight <= 0 {
+		viewWidth, viewHeight = svgMaxSize, svgMaxSize
+	}
+	if width <= 0 || height <= 0 {
+		width, height = viewWidth, viewHeight
+	}
+
+	// Rasterize at a fixed size, previews are scaled down from it
+	scale := svgMaxSize / math.Max(width, height)
+	canvasWidth := int(math.Ceil(width * scale))
+	canvasHeight := int(math.Ceil(height * scale))
+	canvas := image.NewRGBA(image.Rect(0, 0, canvasWidth, canvasHeight))
+
+	// Scale the viewBox uniformly and center it, like preserveAspectRatio xMidYMid
+	viewScale := math.Min(float64(canvasWidth)/viewWidth, float64(canvasHeight)/viewHeight)
+	offsetX := (float64(canvasWidth) - viewWidth*viewScale) / 2
+	offsetY := (float64(canvasHeight) - viewHeight*viewScale) / 2
+	base := matrix{viewScale, 0, 0, viewScale, offsetX - minX*viewScale, offsetY - minY*viewScale}
+	return &svgRenderer{canvas: canvas}, base
+}
+
+// draw fills and strokes a shape
+func (r *svgRenderer) draw(shape svgPath, transform matrix, style svgStyle) {
+	if style.opacity <= 0 {
+		return
+	}
+	if style.fill != nil {
+		r.fill(shape, transform, *style.fill, style.opacity)
+	}
+	if style.stroke != nil && style.strokeWidth > 0 {
+		width := style.strokeWidth * transform.scale()
+		r.stroke(shape, transform, width, *style.stroke, style.opacity)
+	}
+}
+
+// fill fills the polygons of the shape
+func (r *svgRenderer) fill(shape svgPath, transform matrix, c color.RGBA, opacity float64) {
+	bounds := r.canvas.Bounds()
+	rasterizer := vector.NewRasterizer(bounds.Dx(), bounds.Dy())
+	drawn := false
+	for _, polyline := range shape {
+		if len(polyline) < 3 {
+			continue
+		}
+		rasterizer.MoveTo(transform.apply(polyline[0].x, polyline[0].y))
+		for _, p := range polyline[1:] {
+			rasterizer.LineTo(transform.apply(p.x, p.y))
+		}
+		rasterizer.ClosePath()
+		drawn = true
+	}
+	if drawn {
+		rasterizer.Draw(r.canvas, bounds, image.NewUniform(withOpacity(c, opacity)), image.ZP)
+	}
+}
+
+// stroke draws the outlines of the shape, by filling a quad around every segment
+// and a square on every joint
+func (r *svgRenderer) stroke(shape svgPath, transform matrix, width float64, c color.RGBA, opacity float64) {
+	bounds := r.canvas.Bounds()
+	rasterizer := vector.NewRasterizer(bounds.Dx(), bounds.Dy())
+	half := float32(width / 2)
+	for _, polyline := range shape {
+		for i := 1; i < len(polyline); i++ {
+			x0, y0 := transform.apply(polyline[i-1].x, polyline[i-1].y)
+			x1, y1 := transform.apply(polyline[i].x, polyline[i].y)
+			dx, dy := x1-x0, y1-y0
+			length := float32(math.Sqrt(float64(dx*dx + dy*dy)))
+			if length == 0 {
+				continue
+			}
+			nx, ny := -dy/length*half, dx/length*half
+			rasterizer.MoveTo(x0+nx, y0+ny)
+			rasterizer.LineTo(x1+nx, y1+ny)
+			rasterizer.LineTo(x1-nx, y1-ny)
+			rasterizer.LineTo(x0-nx, y0-ny)
+			rasterizer.ClosePath()
+		}
+	}
+	rasterizer.Draw(r.canvas, bounds, image.NewUniform(withOpacity(c, opacity)), image.ZP)
+}
+
+// withOpacity returns the color premultiplied with the opacity
+func withOpacity(c color.RGBA, opacity float64) color.Color {
+	if opacity >= 1 {
+		return c
+	}
+	return color.NRGBA{c.R, c.G, c.B, uint8(float64(c.A) * opacity)}
+}
+
+// parseShape converts an element to its outline, or returns nil if the element
+// doesn't draw anything
+func parseShape(name string, attrs map[string]string) svgPath {
+	number := func(key string) float64 {
+		return parseLength(attrs[key])
+	}
+	switch name {
+	case "rect":
+		x, y, w, h := number("x"), number("y"), number("width"), number("height")
+		if w <= 0 || h <= 0 {
+			return nil
+		}
+		return svgPath{{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}, {x, y}}}
+	case "circle":
+		r := number("r")
+		return ellipse(number("cx"), number("cy"), r, r)
+	case "ellipse":
+		return ellipse(number("cx"), number("cy"), number("rx"), number("ry"))
+	case "line":
+		return svgPath{{{number("x1"), number("y1")}, {number("x2"), number("y2")}}}
+	case "polyline", "polygon":
+		numbers := parseNumbers(attrs["points"])
+		polyline := make([]point, 0, len(numbers)/2)
+		for i := 0; i+1 < len(numbers); i += 2 {
+			polyline = append(polyline, point{numbers[i], numbers[i+1]})
+		}
+		if name == "polygon" && len(polyline) > 0 {
+			polyline = append(polyline, polyline[0])
+		}
+		return svgPath{polyline}
+	case "path":
+		return parsePathData(attrs["d"])
+	}
+	return nil
+}
+
+// ellipse approximates an ellipse with a polygon
+func ellipse(cx, cy, rx, ry float64) svgPath {
+	if rx <= 0 || ry <= 0 {
+		return nil
+	}
+	segments := 4 * curveSegments
+	polyline := make([]point, 0, segments+1)
+	for i := 0; i <= segments; i++ {
+		angle := 2 * math.Pi * float64(i) / float64(segments)
+		polyline = append(polyline, point{cx + rx*math.Cos(angle), cy + ry*math.Sin(angle)})
+	}
+	return svgPath{polyline}
+}
+
+// parsePathData converts the path data of a path element to polylines. Curves are
+// flattened, elliptical arcs are approximated by straight lines.
+func parsePathData(data string) svgPath {
+	tokens := tokenizePath(data)
+	var result svgPath
+	var current []point
+	var x, y, startX, startY float64
+	// The control point of the previous curve, for the smooth curve commands
+	var controlX, controlY float64
+	var command byte
+	i := 0
+	next := func() (float64, bool) {
+		if i >= len(tokens) || tokens[i].command != 0 {
+			return 0, false
+		}
+		i++
+		return tokens[i-1].number, true
+	}
+	add := func(px, py float64) {
+		if current == nil {
+			current = []point{{x, y}}
+		}
+		current = append(current, point{px, py})
+		x, y = px, py
+	}
+	finish := func() {
+		if len(current) > 1 {
+			result = append(result, current)
+		}
+		current = nil
+	}
+
+	for i < len(tokens) {
+		if tokens[i].command != 0 {
+			command = tokens[i].command
+			i++
+		} else if command == 0 {
+			// Path data has to start with a command
+			return result
+		}
+		relative := unicode.IsLower(rune(command))
+		var dx, dy float64
+		if relative {
+			dx, dy = x, y
+		}
+
+		switch unicode.ToUpper(rune(command)) {
+		case 'M':
+			px, ok1 := next()
+			py, ok2 := next()
+			if !ok1 || !ok2 {
+				return result
+			}
+			finish()
+			x, y = px+dx, py+dy
+			startX, startY = x, y
+			controlX, controlY = x, y
+			// Subsequent pairs are implicit line commands
+			if relative {
+				command = 'l'
+			} else {
+				command = 'L'
+			}
+		case 'L':
+			px, ok1 := next()
+			py, ok2 := next()
+			if !ok1 || !ok2 {
+				return result
+			}
+			add(px+dx, py+dy)
+			controlX, controlY = x, y
+		case 'H':
+			px, ok := next()
+			if !ok {
+				return result
+			}
+			add(px+dx, y)
+			controlX, controlY = x, y
+		case 'V':
+			py, ok := next()
+			if !ok {
+				return result
+			}
+			add(x, py+dy)
+			controlX, controlY = x, y
+		case 'C', 'S':
+			var x1, y1 float64
+			if unicode.ToUpper(rune(command)) == 'C' {
+				px, ok1 := next()
+				py, ok2 := next()
+				if !ok1 || !ok2 {
+					return result
+				}
+				x1, y1 = px+dx, py+dy
+			} else {
+				// Reflect the previous control point
+				x1, y1 = 2*x-controlX, 2*y-controlY
+			}
+			values := make([]float64, 4)
+			for j := range values {
+				value, ok := next()
+				if !ok {
+					return result
+				}
+				values[j] = value
+			}
+			x2, y2 := values[0]+dx, values[1]+dy
+			ex, ey := values[2]+dx, values[3]+dy
+			x0, y0 := x, y
+			for s := 1; s <= curveSegments; s++ {
+				t := float64(s) / curveSegments
+				mt := 1 - t
+				add(mt*mt*mt*x0+3*mt*mt*t*x1+3*mt*t*t*x2+t*t*t*ex,
+					mt*mt*mt*y0+3*mt*mt*t*y1+3*mt*t*t*y2+t*t*t*ey)
+			}
+			controlX, controlY = x2, y2
+		case 'Q', 'T':
+			var x1, y1 float64
+			if unicode.ToUpper(rune(command)) == 'Q' {
+				px, ok1 := next()
+				py, ok2 := next()
+				if !ok1 || !ok2 {
+					return result
+				}
+				x1, y1 = px+dx, py+dy
+			} else {
+				x1, y1 = 2*x-controlX, 2*y-controlY
+			}
+			px, ok1 := next()
+			py, ok2 := next()
+			if !ok1 || !ok2 {
+				return result
+			}
+			ex, ey := px+dx, py+dy
+			x0, y0 := x, y
+			for s := 1; s <= curveSegments; s++ {
+				t := float64(s) / curveSegments
+				mt := 1 - t
+				add(mt*mt*x0+2*mt*t*x1+t*t*ex, mt*mt*y0+2*mt*t*y1+t*t*ey)
+			}
+			controlX, controlY = x1, y1
+		case 'A':
+			values := make([]float64, 7)
+			for j := range values {
+				value, ok := next()
+				if !ok {
+					return result
+				}
+				values[j] = value
+			}
+			add(values[5]+dx, values[6]+dy)
+			controlX, controlY = x, y
+		case 'Z':
+			if current != nil {
+				add(startX, startY)
+			}
+			finish()
+			x, y = startX, startY
+			controlX, controlY = x, y
+		default:
+			return result
+		}
+	}
+	finish()
+	return result
+}
+
+// pathToken is either a command letter or a number of the path data
+type pathToken struct {
+	command byte
+	number  float64
+}
+
+// tokenizePath splits path data in commands and numbers
+func tokenizePath(data string) []pathToken {
+	tokens := make([]pathToken, 0)
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case strings.IndexByte("MmLlHhVvCcSsQqTtAaZz", c) >= 0:
+			tokens = append(tokens, pathToken{command: c})
+			i++
+		case c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9'):
+			end := numberEnd(data, i)
+			value, err := strconv.ParseFloat(data[i:end], 64)
+			if err != nil {
+				return tokens
+			}
+			tokens = append(tokens, pathToken{number: value})
+			i = end
+		default:
+			i++
+		}
+	}
+	return tokens
+}
+
+// numberEnd returns the end of the number starting at start
+func numberEnd(data string, start int) int {
+	i := start
+	if i < len(data) && (data[i] == '-' || data[i] == '+') {
+		i++
+	}
+	seenDot, seenExponent := false, false
+	for i < len(data) {
+		c := data[i]
+		switch {
+		case c >= '0' && c <= '9':
+		case c == '.' && !seenDot && !seenExponent:
+			seenDot = true
+		case (c == 'e' || c == 'E') && !seenExponent:
+			seenExponent = true
+			if i+1 < len(data) && (data[i+1] == '-' || data[i+1] == '+') {
+				i++
+			}
+		default:
+			return i
+		}
+		i++
+	}
+	return i
+}
+
+// parseNumbers parses a list of numbers separated by whitespace or commas
+func parseNumbers(value string) []float64 {
+	numbers := make([]float64, 0)
+	for _, token := range tokenizePath(value) {
+		if token.command != 0 {
+			break
+		}
+		numbers = append(numbers, token.number)
+	}
+	return numbers
+}
+
+// parseLength parses a length, ignoring its unit
+func parseLength(value string) float64 {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.HasSuffix(value, "%") {
+		return 0
+	}
+	end := numberEnd(value, 0)
+	number, err := strconv.ParseFloat(value[:end], 64)
+	if err != nil {
+		return 0
+	}
+	return number
+}
+
+// parseTransform parses the transform attribute
+func parseTransform(value string) matrix {
+	result := identity
+	for {
+		open := strings.Index(value, "(")
+		end := strings.Index(value, ")")
+		if open < 0 || end < open {
+			return result
+		}
+		name := strings.TrimSpace(strings.TrimLeft(value[:open], ", "))
+		args := parseNumbers(value[open+1 : end])
+		value = value[end+1:]
+
+		var m matrix
+		switch {
+		case name == "matrix" && len(args) == 6:
+			copy(m[:], args)
+		case name == "translate" && len(args) >= 1:
+			ty := 0.0
+			if len(args) > 1 {
+				ty = args[1]
+			}
+			m = matrix{1, 0, 0, 1, args[0], ty}
+		case name == "scale" && len(args) >= 1:
+			sy := args[0]
+			if len(args) > 1 {
+				sy = args[1]
+			}
+			m = matrix{args[0], 0, 0, sy, 0, 0}
+		case name == "rotate" && len(args) >= 1:
+			angle := args[0] * math.Pi / 180
+			cos, sin := math.Cos(angle), math.Sin(angle)
+			m = matrix{cos, sin, -sin, cos, 0, 0}
+			if len(args) == 3 {
+				cx, cy := args[1], args[2]
+				m = matrix{1, 0, 0, 1, cx, cy}.multiply(m).multiply(matrix{1, 0, 0, 1, -cx, -cy})
+			}
+		case name == "skewX" && len(args) == 1:
+			m = matrix{1, 0, math.Tan(args[0] * math.Pi / 180), 1, 0, 0}
+		case name == "skewY" && len(args) == 1:
+			m = matrix{1, math.Tan(args[0] * math.Pi / 180), 0, 1, 0, 0}
+		default:
+			m = identity
+		}
+		result = result.multiply(m)
+	}
+}
+
+// parseStyle applies the presentation attributes and the style attribute of an
+// element to the inherited style
+func parseStyle(attrs map[string]string, inherited svgStyle) svgStyle {
+	style := inherited
+	properties := make(map[string]string)
+	for _, key := range []string{"fill", "stroke", "stroke-width", "opacity", "fill-opacity", "display", "visibility"} {
+		if value, ok := attrs[key]; ok {
+			properties[key] = value
+		}
+	}
+	// The style attribute takes precedence over the presentation attributes
+	for _, declaration := range strings.Split(attrs["style"], ";") {
+		parts := strings.SplitN(declaration, ":", 2)
+		if len(parts) == 2 {
+			properties[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if value, ok := properties["fill"]; ok {
+		style.fill = parseColor(value, inherited.fill)
+	}
+	if value, ok := properties["stroke"]; ok {
+		style.stroke = parseColor(value, inherited.stroke)
+	}
+	if value, ok := properties["stroke-width"]; ok {
+		style.strokeWidth = parseLength(value)
+	}
+	for _, key := range []string{"opacity", "fill-opacity"} {
+		if value, ok := properties[key]; ok {
+			if opacity, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				style.opacity *= opacity
+			}
+		}
+	}
+	if properties["display"] == "none" || properties["visibility"] == "hidden" {
+		style.opacity = 0
+	}
+	return style
+}
+
+// parseColor parses a paint value. Unsupported paints, like gradients, are drawn
+// in gray so the shape is still visible.
+func parseColor(value string, inherited *color.RGBA) *color.RGBA {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch {
+	case value == "none" || value == "transparent":
+		return nil
+	case value == "inherit" || value == "currentcolor":
+		return inherited
+	case strings.HasPrefix(value, "#"):
+		hex := value[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		if len(hex) != 6 {
+			return nil
+		}
+		rgb, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return nil
+		}
+		return &color.RGBA{uint8(rgb >> 16), uint8(rgb >> 8), uint8(rgb), 0xff}
+	case strings.HasPrefix(value, "rgb(") && strings.HasSuffix(value, ")"):
+		parts := strings.Split(value[4:len(value)-1], ",")
+		if len(parts) != 3 {
+			return nil
+		}
+		var rgb [3]uint8
+		for i, part := range parts {
+			part = strings.TrimSpace(part)
+			if strings.HasSuffix(part, "%") {
+				percentage, _ := strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+				rgb[i] = uint8(math.Min(math.Max(percentage, 0), 100) * 255 / 100)
+				continue
+			}
+			component, _ := strconv.ParseFloat(part, 64)
+			rgb[i] = uint8(math.Min(math.Max(component, 0), 255))
+		}
+		return &color.RGBA{rgb[0], rgb[1], rgb[2], 0xff}
+	case strings.HasPrefix(value, "url("):
+		gray := color.RGBA{0x80, 0x80, 0x80, 0xff}
+		return &gray
+	}
+	if named, ok := svgNamedColors[value]; ok {
+		return &named
+	}
+	return nil
+}
+
+// attributeMap converts the attributes of an element to a map
+func attributeMap(attrs []xml.Attr) map[string]string {
+	result := make(map[string]string, len(attrs))
+	for _, attr := range attrs {
+		result[attr.Name.Local] = attr.Value
+	}
+	return result
+}
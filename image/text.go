@@ -0,0 +1,92 @@
+package image
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	// textPreviewSize is the width and height of the rendered text page
+	textPreviewSize = 256
+	// textMargin is the space around the text on the page
+	textMargin = 8
+	// textMaxBytes is the amount of the file read to render its first lines
+	textMaxBytes = 8 << 10
+)
+
+var (
+	textColor        = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	textHeadingColor = color.RGBA{0x00, 0x00, 0x00, 0xff}
+
+	// markdownLink matches links and images, keeping their text
+	markdownLink = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+	// markdownEmphasis matches the markers for bold, italic and code
+	markdownEmphasis = regexp.MustCompile("(\\*\\*|__|\\*|`)")
+)
+
+// renderText draws the first lines of a text file on a page. Markdown headings
+// are drawn in bold and the inline markup is removed.
+func renderText(file io.ReadSeeker) (image.Image, error) {
+	page := image.NewRGBA(image.Rect(0, 0, textPreviewSize, textPreviewSize))
+	draw.Draw(page, page.Bounds(), image.White, image.ZP, draw.Src)
+
+	face := basicfont.Face7x13
+	lineHeight := face.Metrics().Height.Ceil()
+	maxLines := (textPreviewSize - 2*textMargin) / lineHeight
+	maxChars := (textPreviewSize - 2*textMargin) / face.Advance
+
+	drawer := &font.Drawer{Dst: page, Face: face}
+	scanner := bufio.NewScanner(io.LimitReader(file, textMaxBytes))
+	lines := 0
+	empty := true
+	for lines < maxLines && scanner.Scan() {
+		line := strings.Replace(scanner.Text(), "\t", "    ", -1)
+		if !utf8.ValidString(line) {
+			// Binary content, not something to show
+			return nil, ErrNoPreview
+		}
+		if strings.TrimSpace(line) != "" {
+			empty = false
+		}
+
+		heading := false
+		if trimmed := strings.TrimLeft(line, "#"); trimmed != line && strings.HasPrefix(trimmed, " ") {
+			heading = true
+			line = strings.TrimSpace(trimmed)
+		}
+		line = markdownLink.ReplaceAllString(line, "$1")
+		line = markdownEmphasis.ReplaceAllString(line, "")
+		if utf8.RuneCountInString(line) > maxChars {
+			line = string([]rune(line)[:maxChars])
+		}
+
+		lines++
+		y := textMargin + lines*lineHeight - face.Descent
+		drawer.Src = image.NewUniform(textColor)
+		if heading {
+			drawer.Src = image.NewUniform(textHeadingColor)
+			// Simulate a bold font by drawing the line twice
+			drawer.Dot = fixed.P(textMargin+1, y)
+			drawer.DrawString(line)
+		}
+		drawer.Dot = fixed.P(textMargin, y)
+		drawer.DrawString(line)
+	}
+	if err := scanner.Err(); err != nil && err != bufio.ErrTooLong {
+		return nil, err
+	}
+	if empty {
+		return nil, ErrNoPreview
+	}
+	return page, nil
+}
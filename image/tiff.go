@@ -0,0 +1,237 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	// maxIFDEntries limits the size of a single directory in a damaged file
+	maxIFDEntries = 1000
+	// maxIFDs limits the amount of directories followed in a file
+	maxIFDs = 64
+)
+
+// TIFF data types
+const (
+	tiffByte      = 1
+	tiffASCII     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffUndefined = 7
+	tiffSLong     = 9
+	tiffSRational = 10
+)
+
+// tiffTypeSizes are the sizes in bytes of the TIFF data types
+var tiffTypeSizes = map[uint16]uint32{
+	tiffByte: 1, tiffASCII: 1, tiffShort: 2, tiffLong: 4, tiffRational: 8,
+	6: 1, tiffUndefined: 1, 8: 2, tiffSLong: 4, tiffSRational: 8, 11: 4, 12: 8,
+}
+
+var errInvalidTIFF = errors.New("Invalid TIFF structure")
+
+// tiffReader reads the image file directories of TIFF structured data, as used
+// by EXIF and most camera RAW formats
+type tiffReader struct {
+	r     io.ReaderAt
+	order binary.ByteOrder
+	// base is the offset of the TIFF header, all offsets are relative to it
+	base int64
+	// first is the offset of the first directory
+	first uint32
+}
+
+// tiffEntry is a field in a directory. Values which don't fit in the entry are
+// stored elsewhere in the file, and are read when they are needed.
+type tiffEntry struct {
+	tag    uint16
+	typ    uint16
+	count  uint32
+	inline [4]byte
+}
+
+// ifd is an image file directory
+type ifd struct {
+	entries map[uint16]tiffEntry
+	next    uint32
+}
+
+// newTIFFReader reads the TIFF header at base. Besides the standard magic number,
+// the variants used by Olympus and Panasonic RAW files are accepted.
+func newTIFFReader(r io.ReaderAt, base int64) (*tiffReader, error) {
+	header := make([]byte, 8)
+	if _, err := r.ReadAt(header, base); err != nil {
+		return nil, errInvalidTIFF
+	}
+	t := &tiffReader{r: r, base: base}
+	switch string(header[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errInvalidTIFF
+	}
+	switch t.order.Uint16(header[2:4]) {
+	case 42, 0x4F52, 0x5352, 0x55:
+	default:
+		return nil, errInvalidTIFF
+	}
+	t.first = t.order.Uint32(header[4:8])
+	return t, nil
+}
+
+// readIFD reads the directory at the offset
+func (t *tiffReader) readIFD(offset uint32) (*ifd, error) {
+	countBytes := make([]byte, 2)
+	if _, err := t.r.ReadAt(countBytes, t.base+int64(offset)); err != nil {
+		return nil, errInvalidTIFF
+	}
+	count := int(t.order.Uint16(countBytes))
+	if count == 0 || count > maxIFDEntries {
+		return nil, errInvalidTIFF
+	}
+	data := make([]byte, count*12+4)
+	if _, err := t.r.ReadAt(data, t.base+int64(offset)+2); err != nil {
+		return nil, errInvalidTIFF
+	}
+	directory := &ifd{entries: make(map[uint16]tiffEntry, count)}
+	for i := 0; i < count; i++ {
+		raw := data[i*12 : (i+1)*12]
+		entry := tiffEntry{
+			tag:   t.order.Uint16(raw[0:2]),
+			typ:   t.order.Uint16(raw[2:4]),
+			count: t.order.Uint32(raw[4:8]),
+		}
+		copy(entry.inline[:], raw[8:12])
+		directory.entries[entry.tag] = entry
+	}
+	directory.next = t.order.Uint32(data[count*12:])
+	return directory, nil
+}
+
+// directories reads the chain of directories starting at offset
+func (t *tiffReader) directories(offset uint32) []*ifd {
+	var result []*ifd
+	seen := make(map[uint32]bool)
+	for offset != 0 && !seen[offset] && len(result) < maxIFDs {
+		seen[offset] = true
+		directory, err := t.readIFD(offset)
+		if err != nil {
+			break
+		}
+		result = append(result, directory)
+		offset = directory.next
+	}
+	return result
+}
+
+// size returns the size of the value of the entry in bytes
+func (e tiffEntry) size() int64 {
+	return int64(tiffTypeSizes[e.typ]) * int64(e.count)
+}
+
+// valueOffset returns the offset of the value of the entry, relative to the
+// TIFF header
+func (t *tiffReader) valueOffset(e tiffEntry) int64 {
+	return int64(t.order.Uint32(e.inline[:]))
+}
+
+// value reads the raw bytes of the value of the entry. Values larger than limit
+// are not read.
+func (t *tiffReader) value(e tiffEntry, limit int64) ([]byte, error) {
+	size := e.size()
+	if size <= 4 {
+		return e.inline[:size], nil
+	}
+	if size > limit {
+		return nil, errInvalidTIFF
+	}
+	data := make([]byte, size)
+	if _, err := t.r.ReadAt(data, t.base+t.valueOffset(e)); err != nil {
+		return nil, errInvalidTIFF
+	}
+	return data, nil
+}
+
+// uints returns the values of an integer entry
+func (t *tiffReader) uints(e tiffEntry) []uint32 {
+	data, err := t.value(e, 1<<20)
+	if err != nil {
+		return nil
+	}
+	values := make([]uint32, 0, e.count)
+	for i := uint32(0); i < e.count; i++ {
+		switch e.typ {
+		case tiffByte, tiffUndefined:
+			values = append(values, uint32(data[i]))
+		case tiffShort:
+			values = append(values, uint32(t.order.Uint16(data[2*i:])))
+		case tiffLong, tiffSLong:
+			values = append(values, t.order.Uint32(data[4*i:]))
+		default:
+			return nil
+		}
+	}
+	return values
+}
+
+// uint returns the first value of an integer entry of the directory
+func (t *tiffReader) uint(directory *ifd, tag uint16) (uint32, bool) {
+	entry, ok := directory.entries[tag]
+	if !ok {
+		return 0, false
+	}
+	values := t.uints(entry)
+	if len(values) == 0 {
+		return 0, false
+	}
+	return values[0], true
+}
+
+// ascii returns the value of a string entry, without the terminating zero
+func (t *tiffReader) ascii(directory *ifd, tag uint16) string {
+	entry, ok := directory.entries[tag]
+	if !ok || (entry.typ != tiffASCII && entry.typ != tiffUndefined) {
+		return ""
+	}
+	data, err := t.value(entry, 1<<16)
+	if err != nil {
+		return ""
+	}
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		data = data[:end]
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// rationals returns the values of a rational entry as floating point numbers
+func (t *tiffReader) rationals(directory *ifd, tag uint16) []float64 {
+	entry, ok := directory.entries[tag]
+	if !ok || (entry.typ != tiffRational && entry.typ != tiffSRational) {
+		return nil
+	}
+	data, err := t.value(entry, 1<<16)
+	if err != nil {
+		return nil
+	}
+	values := make([]float64, 0, entry.count)
+	for i := uint32(0); i < entry.count; i++ {
+		numerator := t.order.Uint32(data[8*i:])
+		denominator := t.order.Uint32(data[8*i+4:])
+		if denominator == 0 {
+			return nil
+		}
+		if entry.typ == tiffSRational {
+			values = append(values, float64(int32(numerator))/float64(int32(denominator)))
+		} else {
+			values = append(values, float64(numerator)/float64(denominator))
+		}
+	}
+	return values
+}
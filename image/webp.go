@@ -0,0 +1,308 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"sort"
+)
+
+const (
+	// webpMaxSize is the maximum width and height of a lossless WebP image
+	webpMaxSize = 1 << 14
+	// maxCodeLength is the maximum length of the prefix codes of the pixels
+	maxCodeLength = 15
+	// maxCodeLengthCodeLength is the maximum length of the prefix code used to
+	// encode the lengths of the other codes
+	maxCodeLengthCodeLength = 7
+	// subtractGreenTransform is the transform subtracting green from red and blue
+	subtractGreenTransform = 2
+)
+
+// codeLengthCodeOrder is the order in which the code length code lengths are written
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+var errImageTooLarge = errors.New("Image is too large for WebP")
+
+// encodeWebP writes the image as a lossless WebP image. The encoder keeps it
+// simple: it applies the subtract green transform and codes every pixel with
+// its own prefix codes, without backward references or a color cache. That
+// compresses previews with transparency to about the size of a PNG image.
+func encodeWebP(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= 0 || height <= 0 || width > webpMaxSize || height > webpMaxSize {
+		return errImageTooLarge
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+
+	// Subtract green, the channels are now green, red, blue and alpha
+	pixels := nrgba.Pix
+	var histograms [4][256]int
+	for i := 0; i < len(pixels); i += 4 {
+		g := pixels[i+1]
+		pixels[i] -= g
+		pixels[i+2] -= g
+		histograms[0][g]++
+		histograms[1][pixels[i]]++
+		histograms[2][pixels[i+2]]++
+		histograms[3][pixels[i+3]]++
+	}
+
+	bits := &bitWriter{}
+	bits.write(0x2f, 8)
+	bits.write(uint64(width-1), 14)
+	bits.write(uint64(height-1), 14)
+	bits.write(1, 1) // alpha is used
+	bits.write(0, 3) // version
+	bits.write(1, 1) // a transform follows
+	bits.write(subtractGreenTransform, 2)
+	bits.write(0, 1) // no more transforms
+	bits.write(0, 1) // no color cache
+	bits.write(0, 1) // no meta prefix codes
+
+	// The green alphabet also holds the 24 length prefixes, which are unused
+	var codes [4][]prefixCode
+	for i, histogram := range histograms {
+		frequencies := histogram[:]
+		if i == 0 {
+			frequencies = append(frequencies, make([]int, 24)...)
+		}
+		codes[i] = writePrefixCode(bits, frequencies)
+	}
+	// The distance code is required, even though it is unused
+	writePrefixCode(bits, make([]int, 40))
+
+	for i := 0; i < len(pixels); i += 4 {
+		for channel, offset := range [4]int{1, 0, 2, 3} {
+			code := codes[channel][pixels[i+offset]]
+			bits.write(uint64(code.bits), code.length)
+		}
+	}
+	data := bits.bytes()
+
+	header := make([]byte, 20)
+	chunkSize := len(data)
+	riffSize := 4 + 8 + chunkSize + chunkSize%2
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(riffSize))
+	copy(header[8:16], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:20], uint32(chunkSize))
+	if chunkSize%2 == 1 {
+		data = append(data, 0)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// prefixCode is the code of a symbol, with its bits reversed so it can be
+// written least significant bit first
+type prefixCode struct {
+	bits   uint32
+	length uint
+}
+
+// writePrefixCode builds a prefix code for the symbol frequencies and writes it
+func writePrefixCode(bits *bitWriter, frequencies []int) []prefixCode {
+	var used []int
+	for symbol, frequency := range frequencies {
+		if frequency > 0 {
+			used = append(used, symbol)
+		}
+	}
+	// A single symbol, or none at all, is written as a simple code of zero bits
+	if len(used) <= 1 {
+		symbol := 0
+		if len(used) == 1 {
+			symbol = used[0]
+		}
+		bits.write(1, 1) // simple code
+		bits.write(0, 1) // one symbol
+		if symbol < 2 {
+			bits.write(0, 1)
+			bits.write(uint64(symbol), 1)
+		} else {
+			bits.write(1, 1)
+			bits.write(uint64(symbol), 8)
+		}
+		return make([]prefixCode, len(frequencies))
+	}
+
+	lengths := codeLengths(frequencies, maxCodeLength)
+	lengthFrequencies := make([]int, 19)
+	for _, length := range lengths {
+		lengthFrequencies[length]++
+	}
+	lengthCodeLengths := codeLengths(lengthFrequencies, maxCodeLengthCodeLength)
+	lengthCodes := canonicalCodes(lengthCodeLengths)
+
+	bits.write(0, 1) // normal code
+	count := len(codeLengthCodeOrder)
+	for count > 4 && lengthCodeLengths[codeLengthCodeOrder[count-1]] == 0 {
+		count--
+	}
+	bits.write(uint64(count-4), 4)
+	for _, symbol := range codeLengthCodeOrder[:count] {
+		bits.write(uint64(lengthCodeLengths[symbol]), 3)
+	}
+	bits.write(0, 1) // the lengths of all symbols are written
+	for _, length := range lengths {
+		code := lengthCodes[length]
+		bits.write(uint64(code.bits), code.length)
+	}
+	return canonicalCodes(lengths)
+}
+
+// codeLengths computes the lengths of a Huffman code for the frequencies. If
+// the code gets too long, the frequencies are flattened until it fits.
+func codeLengths(frequencies []int, maxLength uint) []uint {
+	scaled := make([]int, len(frequencies))
+	copy(scaled, frequencies)
+	for {
+		lengths := huffmanLengths(scaled)
+		fits := true
+		for _, length := range lengths {
+			if length > maxLength {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return lengths
+		}
+		for i, frequency := range scaled {
+			if frequency > 0 {
+				scaled[i] = frequency/2 + 1
+			}
+		}
+	}
+}
+
+// huffmanNode is a node of the tree used to compute the code lengths
+type huffmanNode struct {
+	frequency int
+	symbol    int
+	left      *huffmanNode
+	right     *huffmanNode
+}
+
+// byFrequency sorts nodes on frequency, ties are broken on symbol to keep the
+// codes deterministic
+type byFrequency []*huffmanNode
+
+func (n byFrequency) Len() int      { return len(n) }
+func (n byFrequency) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n byFrequency) Less(i, j int) bool {
+	if n[i].frequency != n[j].frequency {
+		return n[i].frequency < n[j].frequency
+	}
+	return n[i].symbol < n[j].symbol
+}
+
+// huffmanLengths computes the lengths of an optimal prefix code
+func huffmanLengths(frequencies []int) []uint {
+	lengths := make([]uint, len(frequencies))
+	var nodes []*huffmanNode
+	for symbol, frequency := range frequencies {
+		if frequency > 0 {
+			nodes = append(nodes, &huffmanNode{frequency: frequency, symbol: symbol})
+		}
+	}
+	if len(nodes) == 1 {
+		lengths[nodes[0].symbol] = 1
+		return lengths
+	}
+	for len(nodes) > 1 {
+		sort.Sort(byFrequency(nodes))
+		parent := &huffmanNode{
+			frequency: nodes[0].frequency + nodes[1].frequency,
+			symbol:    len(frequencies),
+			left:      nodes[0],
+			right:     nodes[1],
+		}
+		nodes = append(nodes[2:], parent)
+	}
+	var walk func(node *huffmanNode, depth uint)
+	walk = func(node *huffmanNode, depth uint) {
+		if node.left == nil {
+			lengths[node.symbol] = depth
+			return
+		}
+		walk(node.left, depth+1)
+		walk(node.right, depth+1)
+	}
+	if len(nodes) == 1 {
+		walk(nodes[0], 0)
+	}
+	return lengths
+}
+
+// canonicalCodes assigns the canonical codes to the code lengths. A code of a
+// single symbol takes no bits at all.
+func canonicalCodes(lengths []uint) []prefixCode {
+	codes := make([]prefixCode, len(lengths))
+	used := 0
+	for _, length := range lengths {
+		if length > 0 {
+			used++
+		}
+	}
+	if used <= 1 {
+		return codes
+	}
+	code := uint32(0)
+	for length := uint(1); length <= maxCodeLength; length++ {
+		for symbol, symbolLength := range lengths {
+			if symbolLength != length {
+				continue
+			}
+			codes[symbol] = prefixCode{bits: reverseBits(code, length), length: length}
+			code++
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// reverseBits reverses the lowest length bits of the code
+func reverseBits(code uint32, length uint) uint32 {
+	var reversed uint32
+	for i := uint(0); i < length; i++ {
+		reversed = reversed<<1 | code&1
+		code >>= 1
+	}
+	return reversed
+}
+
+// bitWriter packs values least significant bit first
+type bitWriter struct {
+	buffer bytes.Buffer
+	bits   uint64
+	count  uint
+}
+
+func (w *bitWriter) write(value uint64, count uint) {
+	w.bits |= value << w.count
+	w.count += count
+	for w.count >= 8 {
+		w.buffer.WriteByte(byte(w.bits))
+		w.bits >>= 8
+		w.count -= 8
+	}
+}
+
+// bytes returns the written data, padding the last byte with zeros
+func (w *bitWriter) bytes() []byte {
+	if w.count > 0 {
+		w.buffer.WriteByte(byte(w.bits))
+		w.bits, w.count = 0, 0
+	}
+	return w.buffer.Bytes()
+}
@@ -0,0 +1,101 @@
+package mail
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gowncloud/gowncloud/activity"
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+// digestLimit is the highest number of activities listed in a digest, the
+// others are only counted
+const digestLimit = 50
+
+// digestActivity is an activity as listed in the digest template
+type digestActivity struct {
+	Time    string
+	Subject string
+}
+
+// digestData are the parameters of the digest template
+type digestData struct {
+	Username   string
+	Activities []digestActivity
+	Count      int
+	More       int
+	Link       string
+}
+
+// StartDigest sends the digests every day at the hour, in the local time zone
+func StartDigest(hour int) {
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.Local)
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			time.Sleep(next.Sub(now))
+			SendDigests()
+		}
+	}()
+}
+
+// SendDigests mails the users who enabled the digest the activities of the
+// other users on their files since their previous digest. Only the activities
+// on the files of the user and the files shared with the user himself are
+// included, his groups are only known while he is logged in.
+func SendDigests() {
+	if !Enabled() {
+		return
+	}
+	users, err := db.GetDigestUsers()
+	if err != nil {
+		return
+	}
+	for _, user := range users {
+		err = sendDigest(user)
+		if err != nil {
+			log.Errorf("Failed to send the digest to %v: %v", user.Username, err)
+		}
+	}
+}
+
+// sendDigest mails the new activities to a user, nothing is sent if there are
+// none
+func sendDigest(user *db.DigestUser) error {
+	activities, err := db.GetActivities(&db.ActivityQuery{
+		Username:  user.Username,
+		Others:    true,
+		Since:     user.LastActivity,
+		Ascending: true,
+	})
+	if err != nil || len(activities) == 0 {
+		return err
+	}
+	data := &digestData{
+		Username: user.Username,
+		Count:    len(activities),
+		Link:     config.BaseURL + "/index.php/apps/files/",
+	}
+	for i, a := range activities {
+		if i == digestLimit {
+			data.More = len(activities) - digestLimit
+			break
+		}
+		data.Activities = append(data.Activities, digestActivity{
+			Time:    a.Time.Local().Format(expirationFormat),
+			Subject: activity.Subject(a, user.Username),
+		})
+	}
+	message, err := digestTemplate.render(user.Email, data)
+	if err != nil {
+		return err
+	}
+	err = Send(message)
+	if err != nil {
+		return err
+	}
+	return db.SetDigestActivity(user.Username, activities[len(activities)-1].ID)
+}
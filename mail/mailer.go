@@ -0,0 +1,231 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// The ways the connection to the SMTP server is secured
+const (
+	// TLSNone sends the mails unencrypted, e.g. to a local SMTP server
+	TLSNone = "none"
+	// TLSStartTLS upgrades the connection with STARTTLS, the server has to
+	// support it
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects with TLS, usually to port 465
+	TLSImplicit = "tls"
+)
+
+var (
+	// ErrNotConfigured is returned when a mail is sent without an SMTP server
+	ErrNotConfigured = errors.New("No SMTP server is configured")
+	// ErrNoStartTLS is returned if the SMTP server doesn't support STARTTLS
+	ErrNoStartTLS = errors.New("The SMTP server doesn't support STARTTLS")
+)
+
+// Config is the SMTP server the mails are sent through
+type Config struct {
+	// Host and Port of the SMTP server, no mails are sent if Host is empty
+	Host string
+	Port int
+	// TLS is TLSNone, TLSStartTLS or TLSImplicit
+	TLS string
+	// Username and Password authenticate to the server if Username is set
+	Username string
+	Password string
+	// From is the sender address of the mails
+	From string
+	// BaseURL is the address of gowncloud used in the links in the mails,
+	// e.g. https://cloud.example.com
+	BaseURL string
+}
+
+// Message is a mail with a text and an html body
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// dialTimeout is how long connecting to the SMTP server may take
+const dialTimeout = 30 * time.Second
+
+var config Config
+
+// Init sets the SMTP server the mails are sent through
+func Init(c Config) error {
+	if c.Host == "" {
+		return nil
+	}
+	switch c.TLS {
+	case TLSNone, TLSStartTLS, TLSImplicit:
+	default:
+		return fmt.Errorf("Unknown SMTP TLS mode %v, use %v, %v or %v", c.TLS, TLSNone, TLSStartTLS, TLSImplicit)
+	}
+	if _, err := mail.ParseAddress(c.From); err != nil {
+		return fmt.Errorf("Invalid sender address %v: %v", c.From, err)
+	}
+	if c.BaseURL == "" {
+		return errors.New("The base url is needed for the links in the mails")
+	}
+	c.BaseURL = strings.TrimSuffix(c.BaseURL, "/")
+	config = c
+	log.Infof("Sending mails through %v:%v", c.Host, c.Port)
+	return nil
+}
+
+// Enabled checks if an SMTP server is configured
+func Enabled() bool {
+	return config.Host != ""
+}
+
+// Deliver sends a message in the background, failures are logged
+func Deliver(message *Message) {
+	go func() {
+		err := Send(message)
+		if err != nil {
+			log.Errorf("Failed to send the mail %q to %v: %v", message.Subject, message.To, err)
+		}
+	}()
+}
+
+// Send sends a message through the SMTP server
+func Send(message *Message) error {
+	if !Enabled() {
+		return ErrNotConfigured
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddress(message.To)
+	if err != nil {
+		return err
+	}
+	body, err := compose(from, to, message)
+	if err != nil {
+		return err
+	}
+
+	client, err := dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if config.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", config.Username, config.Password, config.Host))
+		if err != nil {
+			return err
+		}
+	}
+	if err = client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err = client.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(body); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// dial connects to the SMTP server, secured as configured
+func dial() (*smtp.Client, error) {
+	address := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	tlsConfig := &tls.Config{ServerName: config.Host}
+	var conn net.Conn
+	var err error
+	if config.TLS == TLSImplicit {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", address, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", address, dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if config.TLS == TLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			client.Close()
+			return nil, ErrNoStartTLS
+		}
+		if err = client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// compose formats a message as a multipart mail with the text and the html
+// body
+func compose(from, to *mail.Address, message *Message) ([]byte, error) {
+	boundary, err := randomBoundary()
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %v\r\n", from)
+	fmt.Fprintf(&b, "To: %v\r\n", to)
+	// The subject holds file names, which must not add headers
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(message.Subject)
+	fmt.Fprintf(&b, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%v@%v>\r\n", boundary, config.Host)
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", boundary)
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", message.Text},
+		{"text/html", message.HTML},
+	} {
+		fmt.Fprintf(&b, "--%v\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: %v; charset=utf-8\r\n", part.contentType)
+		fmt.Fprintf(&b, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		w := quotedprintable.NewWriter(&b)
+		if _, err = w.Write([]byte(strings.Replace(part.body, "\n", "\r\n", -1))); err != nil {
+			return nil, err
+		}
+		if err = w.Close(); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&b, "\r\n")
+	}
+	fmt.Fprintf(&b, "--%v--\r\n", boundary)
+	return b.Bytes(), nil
+}
+
+// randomBoundary returns a random string to separate the parts of a mail
+func randomBoundary() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
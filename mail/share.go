@@ -0,0 +1,73 @@
+package mail
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+// expirationFormat is how the expiration of a share is shown in the mails
+const expirationFormat = "2006-01-02 15:04"
+
+// shareData are the parameters of the share and link templates
+type shareData struct {
+	Actor      string
+	Name       string
+	Expiration string
+	Link       string
+}
+
+// SendShare mails the user that actor shared the node named name with him, if
+// the user has an email address and wants the share mails
+func SendShare(actor, username, name string, expiration *time.Time) {
+	if !Enabled() {
+		return
+	}
+	settings, err := db.GetMailSettings(username)
+	if err != nil || settings == nil || settings.Email == "" || !settings.Shares {
+		return
+	}
+	data := &shareData{
+		Actor:      actor,
+		Name:       name,
+		Expiration: formatExpiration(expiration),
+		Link:       config.BaseURL + "/index.php/apps/files/?view=sharingin",
+	}
+	message, err := shareTemplate.render(settings.Email, data)
+	if err != nil {
+		log.Error("Failed to render the share mail: ", err)
+		return
+	}
+	Deliver(message)
+}
+
+// SendShareLink mails the public link of a share of the node named name to an
+// address. gowncloud doesn't create link shares yet, this is how their links
+// are sent once it does.
+func SendShareLink(actor, address, name, link string, expiration *time.Time) error {
+	if !Enabled() {
+		return ErrNotConfigured
+	}
+	data := &shareData{
+		Actor:      actor,
+		Name:       name,
+		Expiration: formatExpiration(expiration),
+		Link:       link,
+	}
+	message, err := linkTemplate.render(address, data)
+	if err != nil {
+		log.Error("Failed to render the link mail: ", err)
+		return err
+	}
+	return Send(message)
+}
+
+// formatExpiration formats the expiration of a share for the mails, empty if
+// it doesn't expire
+func formatExpiration(expiration *time.Time) string {
+	if expiration == nil {
+		return ""
+	}
+	return expiration.Local().Format(expirationFormat)
+}
@@ -0,0 +1,111 @@
+package mail
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+)
+
+// template is a mail with a subject, a text and an html body, all executed with
+// the same data
+type template struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// newTemplate parses the templates of a mail
+func newTemplate(name, subject, text, html string) *template {
+	return &template{
+		subject: texttemplate.Must(texttemplate.New(name + "-subject").Parse(subject)),
+		text:    texttemplate.Must(texttemplate.New(name + "-text").Parse(text)),
+		html:    htmltemplate.Must(htmltemplate.New(name + "-html").Parse(htmlHeader + html + htmlFooter)),
+	}
+}
+
+// render executes the templates into a message to the address
+func (t *template) render(to string, data interface{}) (*Message, error) {
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return nil, err
+	}
+	if err := t.html.Execute(&html, data); err != nil {
+		return nil, err
+	}
+	return &Message{To: to, Subject: subject.String(), Text: text.String(), HTML: html.String()}, nil
+}
+
+const htmlHeader = `<!DOCTYPE html>
+<html>
+<body style="font-family: 'Open Sans', Frutiger, Calibri, 'Myriad Pro', Myriad, sans-serif; color: #333;">
+<table cellspacing="0" cellpadding="0" border="0" width="100%"><tr><td>
+<table cellspacing="0" cellpadding="0" border="0" width="600px" style="margin: 0 auto;">
+<tr><td style="background-color: #1d2d44; padding: 16px; color: #fff; font-size: 20px;">gowncloud</td></tr>
+<tr><td style="padding: 16px;">
+`
+
+const htmlFooter = `
+</td></tr>
+<tr><td style="padding: 16px; color: #777; font-size: 12px;">This mail was sent by gowncloud.</td></tr>
+</table>
+</td></tr></table>
+</body>
+</html>
+`
+
+// shareTemplate is sent to a user when a file or folder is shared with him
+var shareTemplate = newTemplate("share",
+	`{{.Actor}} shared {{.Name}} with you`,
+	`Hey there,
+
+{{.Actor}} shared {{.Name}} with you.
+{{if .Expiration}}
+The share expires at {{.Expiration}}.
+{{end}}
+View it: {{.Link}}
+`,
+	`<p>Hey there,</p>
+<p>{{.Actor}} shared <strong>{{.Name}}</strong> with you.</p>
+{{if .Expiration}}<p>The share expires at {{.Expiration}}.</p>{{end}}
+<p><a href="{{.Link}}">View it</a></p>`)
+
+// linkTemplate sends the public link of a share to an address
+var linkTemplate = newTemplate("link",
+	`{{.Actor}} shared {{.Name}} with you`,
+	`Hey there,
+
+{{.Actor}} shared {{.Name}} with you.
+{{if .Expiration}}
+The link expires at {{.Expiration}}.
+{{end}}
+Open it: {{.Link}}
+`,
+	`<p>Hey there,</p>
+<p>{{.Actor}} shared <strong>{{.Name}}</strong> with you.</p>
+{{if .Expiration}}<p>The link expires at {{.Expiration}}.</p>{{end}}
+<p><a href="{{.Link}}">Open it</a></p>`)
+
+// digestTemplate sends the activities of the other users since the previous
+// digest
+var digestTemplate = newTemplate("digest",
+	`{{.Count}} new {{if eq .Count 1}}activity{{else}}activities{{end}} in your files`,
+	`Hey {{.Username}},
+
+This happened in your files since the last mail:
+{{range .Activities}}
+* {{.Time}}: {{.Subject}}{{end}}
+{{if .More}}
+and {{.More}} more.
+{{end}}
+Open your files: {{.Link}}
+`,
+	`<p>Hey {{.Username}},</p>
+<p>This happened in your files since the last mail:</p>
+<ul>
+{{range .Activities}}<li><span style="color: #777;">{{.Time}}</span> {{.Subject}}</li>
+{{end}}</ul>
+{{if .More}}<p>and {{.More}} more.</p>{{end}}
+<p><a href="{{.Link}}">Open your files</a></p>`)
@@ -5,18 +5,32 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/codegangsta/cli"
 
+	activity_routes "github.com/gowncloud/gowncloud/apps/activity/routes"
 	"github.com/gowncloud/gowncloud/apps/dav"
+	files "github.com/gowncloud/gowncloud/apps/files/ajax"
 	files_routes "github.com/gowncloud/gowncloud/apps/files/routes"
 	sharing_routes "github.com/gowncloud/gowncloud/apps/files_sharing/routes"
 	"github.com/gowncloud/gowncloud/apps/files_texteditor"
+	trash "github.com/gowncloud/gowncloud/apps/files_trashbin/ajax"
 	trash_routes "github.com/gowncloud/gowncloud/apps/files_trashbin/routes"
 	gallery_routes "github.com/gowncloud/gowncloud/apps/gallery/routes"
+	notifications_routes "github.com/gowncloud/gowncloud/apps/notifications/routes"
+	"github.com/gowncloud/gowncloud/core/maintenance"
+	"github.com/gowncloud/gowncloud/core/metrics"
 	core_routes "github.com/gowncloud/gowncloud/core/routes"
+	"github.com/gowncloud/gowncloud/core/scanner"
 	"github.com/gowncloud/gowncloud/core/search"
+	"github.com/gowncloud/gowncloud/fs"
+	"github.com/gowncloud/gowncloud/image"
+	"github.com/gowncloud/gowncloud/mail"
+	"github.com/gowncloud/gowncloud/media"
+	"github.com/gowncloud/gowncloud/notification"
 
+	"github.com/gowncloud/gowncloud/core/audit"
 	"github.com/gowncloud/gowncloud/core/identity"
 	"github.com/gowncloud/gowncloud/core/logging"
 	"github.com/gowncloud/gowncloud/public/routes"
@@ -41,6 +55,15 @@ func main() {
 	var clientID, clientSecret string
 	var dburl string
 	var davroot string
+	var scanInterval time.Duration
+	var transcodeCommand string
+	var encryptionKeyFile string
+	var deduplicate bool
+	var metricsBindAddress string
+	var accessLog, accessLogFormat, auditLog string
+	var logMaxSize, logMaxBackups int
+	var mailConfig mail.Config
+	var digestHour int
 
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
@@ -74,6 +97,104 @@ func main() {
 			Usage:       "Dav root directory",
 			Destination: &davroot,
 		},
+		cli.DurationFlag{
+			Name:        "scan-interval",
+			Usage:       "Interval of the background scan reconciling the files on disk with the database, 0 disables it",
+			Destination: &scanInterval,
+		},
+		cli.StringFlag{
+			Name:        "transcode-command",
+			Usage:       "Command transcoding audio and video files browsers can't play to MP4, {input} and {output} are replaced by the file paths, e.g. \"ffmpeg -y -i {input} -c:v libx264 -c:a aac -movflags +faststart {output}\"",
+			Destination: &transcodeCommand,
+		},
+		cli.StringFlag{
+			Name:        "encryption-key-file",
+			Usage:       "File holding the 32 byte master key used to encrypt the stored files, raw or hex or base64 encoded. The key can also be set in the " + fs.MasterKeyEnv + " environment variable. Without a key files are stored unencrypted.",
+			Destination: &encryptionKeyFile,
+		},
+		cli.BoolFlag{
+			Name:        "deduplicate",
+			Usage:       "Store the content of identical files only once",
+			Destination: &deduplicate,
+		},
+		cli.StringFlag{
+			Name:        "metrics-bind",
+			Usage:       "Bind address of the Prometheus metrics on /metrics, e.g. \"localhost:9090\". The metrics are not served if it is not set.",
+			Destination: &metricsBindAddress,
+		},
+		cli.StringFlag{
+			Name:        "access-log",
+			Usage:       "Destination of the access log: stdout, stderr, syslog, syslog://host:port, syslog+tcp://host:port or a file path",
+			Value:       "stdout",
+			Destination: &accessLog,
+		},
+		cli.StringFlag{
+			Name:        "access-log-format",
+			Usage:       "Format of the access log: clf, combined or json",
+			Value:       "clf",
+			Destination: &accessLogFormat,
+		},
+		cli.StringFlag{
+			Name:        "audit-log",
+			Usage:       "Destination of the audit log recording the uploads, downloads, deletes, restores, shares and logins as JSON, like --access-log. The audit log is disabled if it is not set.",
+			Destination: &auditLog,
+		},
+		cli.IntFlag{
+			Name:        "log-max-size",
+			Usage:       "Size in MB after which a log file is rotated, 0 disables the rotation",
+			Value:       100,
+			Destination: &logMaxSize,
+		},
+		cli.IntFlag{
+			Name:        "log-max-backups",
+			Usage:       "Number of rotated log files kept",
+			Value:       5,
+			Destination: &logMaxBackups,
+		},
+		cli.StringFlag{
+			Name:        "smtp-host",
+			Usage:       "SMTP server the mails are sent through. No mails are sent if it is not set.",
+			Destination: &mailConfig.Host,
+		},
+		cli.IntFlag{
+			Name:        "smtp-port",
+			Usage:       "Port of the SMTP server",
+			Value:       587,
+			Destination: &mailConfig.Port,
+		},
+		cli.StringFlag{
+			Name:        "smtp-tls",
+			Usage:       "How the connection to the SMTP server is secured: starttls, tls or none",
+			Value:       mail.TLSStartTLS,
+			Destination: &mailConfig.TLS,
+		},
+		cli.StringFlag{
+			Name:        "smtp-username",
+			Usage:       "Username to authenticate to the SMTP server, no authentication is used if it is not set",
+			Destination: &mailConfig.Username,
+		},
+		cli.StringFlag{
+			Name:        "smtp-password",
+			Usage:       "Password to authenticate to the SMTP server",
+			EnvVar:      "GOWNCLOUD_SMTP_PASSWORD",
+			Destination: &mailConfig.Password,
+		},
+		cli.StringFlag{
+			Name:        "mail-from",
+			Usage:       "Sender address of the mails, e.g. \"gowncloud <gowncloud@example.com>\"",
+			Destination: &mailConfig.From,
+		},
+		cli.StringFlag{
+			Name:        "base-url",
+			Usage:       "Address of gowncloud used in the links in the mails, e.g. https://cloud.example.com",
+			Destination: &mailConfig.BaseURL,
+		},
+		cli.IntFlag{
+			Name:        "digest-hour",
+			Usage:       "Hour of the day the daily activity digests are mailed",
+			Value:       7,
+			Destination: &digestHour,
+		},
 	}
 
 	app.Before = func(c *cli.Context) error {
@@ -81,9 +202,15 @@ func main() {
 			log.SetLevel(log.DebugLevel)
 			log.Debug("Debug logging enabled")
 		}
-		return nil
+		return mail.Init(mailConfig)
 	}
 
+	app.Commands = adminCommands(func() string {
+		return initDatabase(dburl, davroot)
+	}, func(davroot string) fs.FileSystem {
+		return openFileSystem(davroot, encryptionKeyFile, deduplicate)
+	})
+
 	app.Action = func(c *cli.Context) {
 
 		if clientID == "" || clientSecret == "" {
@@ -93,49 +220,45 @@ func main() {
 
 		log.Infoln(app.Name, "version", app.Version)
 
-		// init database connection
-		parsedDbUrl, err := url.Parse(dburl)
+		format, err := logging.FormatByName(accessLogFormat)
 		if err != nil {
-			log.Fatal("failed to parse database url: ", err)
+			log.Fatal(err)
 		}
-
-		db.Connect("postgres", parsedDbUrl.String())
-		defer db.Close()
-		db.Initialize()
-
-		// If the data-directory flag isn't set, use the previous or default directory
-		if davroot == "" {
-			davroot = db.GetSetting(db.DAV_ROOT)
+		accessLogWriter, err := logging.Open(accessLog, "gowncloud", int64(logMaxSize)<<20, logMaxBackups)
+		if err != nil {
+			log.Fatal("Failed to open the access log: ", err)
 		}
-
-		// If the data-directory flag is set, but the user didn't end with a '/', append it
-		// to maintain consistency
-		if !strings.HasSuffix(davroot, "/") {
-			davroot += "/"
+		if auditLog != "" {
+			auditLogWriter, err := logging.Open(auditLog, "gowncloud-audit", int64(logMaxSize)<<20, logMaxBackups)
+			if err != nil {
+				log.Fatal("Failed to open the audit log: ", err)
+			}
+			audit.Init(auditLogWriter)
 		}
 
-		// If the data-directory flag specifies another directory than the previously
-		// used one or the default directory on first run, update the database to point
-		// to this new directory
-		if db.GetSetting(db.DAV_ROOT) != davroot {
-			db.UpdateSetting(db.DAV_ROOT, davroot)
-		}
+		davroot = initDatabase(dburl, davroot)
+		defer db.Close()
 
-		// Update the versionstring in the database if it changed
-		if db.GetSetting(db.VERSION) != version {
-			db.UpdateSetting(db.VERSION, version)
-		}
+		fileSystem := openFileSystem(davroot, encryptionKeyFile, deduplicate)
+		image.Init(fileSystem)
+		media.Init(fileSystem, transcodeCommand)
+		files.Init(fileSystem)
+		files_texteditor.Init(fileSystem)
+		trash.Init(fileSystem)
 
-		// make the dav root dir
-		err = os.MkdirAll(davroot, os.ModePerm)
-		if err != nil {
-			log.Fatal("Failed to create dav root directory")
+		if scanInterval > 0 {
+			log.Infoln("Scanning files every", scanInterval)
+			scanner.StartBackgroundScan(fileSystem, scanInterval)
+		}
+		notification.StartExpiryCheck(10 * time.Minute)
+		if mail.Enabled() {
+			mail.StartDigest(digestHour)
 		}
 
 		defaultMux := http.NewServeMux()
 		publicMux := http.NewServeMux()
 
-		server := dav.NewCustomOCDav(davroot)
+		server := dav.NewCustomOCDav(fileSystem)
 
 		defaultMux.Handle("/remote.php/webdav/", dav.NormalizePath(server.DispatchRequest()))
 
@@ -162,12 +285,29 @@ func main() {
 		core_routes.RegisterRoutes(defaultMux, publicMux)
 		search.RegisterRoutes(defaultMux, publicMux)
 		gallery_routes.RegisterRoutes(defaultMux, publicMux)
+		activity_routes.RegisterRoutes(defaultMux, publicMux)
+		notifications_routes.RegisterRoutes(defaultMux, publicMux)
 		files_texteditor.RegisterRoutes(defaultMux, publicMux)
 
 		rootMux := http.NewServeMux()
-		rootMux.Handle("/", identity.AddIdentity(logging.Handler(os.Stdout, identity.Protect(clientID, clientSecret, defaultMux)), clientID))
+		// The maintenance handler goes behind the login, so the OAuth login and
+		// callback keep working, and its responses are counted and logged
+		rootMux.Handle("/", identity.AddIdentity(metrics.InstrumentHandler(defaultMux, logging.FormatHandler(accessLogWriter, format, identity.Protect(clientID, clientSecret, maintenance.Handler(defaultMux)))), clientID))
 		rootMux.Handle("/status.php", publicMux)
 
+		if metricsBindAddress != "" {
+			// The metrics are served separately, so they don't have to be exposed
+			// to the users
+			metricsMux := http.NewServeMux()
+			metricsMux.Handle("/metrics", metrics.Handler())
+			log.Infoln("Serving metrics on", metricsBindAddress)
+			go func() {
+				if err := http.ListenAndServe(metricsBindAddress, metricsMux); err != nil {
+					log.Fatalf("metrics server error: %v", err)
+				}
+			}()
+		}
+
 		log.Infoln("Start listening on", bindAddress)
 		if err := http.ListenAndServe(bindAddress, rootMux); err != nil {
 			log.Fatalf("server error: %v", err)
@@ -176,3 +316,74 @@ func main() {
 
 	app.Run(os.Args)
 }
+
+// initDatabase connects to and initializes the database, and stores the dav root
+// directory and version in the settings. It returns the dav root directory to use.
+func initDatabase(dburl, davroot string) string {
+	// init database connection
+	parsedDbUrl, err := url.Parse(dburl)
+	if err != nil {
+		log.Fatal("failed to parse database url: ", err)
+	}
+
+	db.Connect(parsedDbUrl.String())
+	db.Initialize()
+
+	// If the data-directory flag isn't set, use the previous or default directory
+	if davroot == "" {
+		davroot = db.GetSetting(db.DAV_ROOT)
+	}
+
+	// If the data-directory flag is set, but the user didn't end with a '/', append it
+	// to maintain consistency
+	if !strings.HasSuffix(davroot, "/") {
+		davroot += "/"
+	}
+
+	// If the data-directory flag specifies another directory than the previously
+	// used one or the default directory on first run, update the database to point
+	// to this new directory
+	if db.GetSetting(db.DAV_ROOT) != davroot {
+		db.UpdateSetting(db.DAV_ROOT, davroot)
+	}
+
+	// Update the versionstring in the database if it changed
+	if db.GetSetting(db.VERSION) != version {
+		db.UpdateSetting(db.VERSION, version)
+	}
+
+	// make the dav root dir
+	err = os.MkdirAll(davroot, os.ModePerm)
+	if err != nil {
+		log.Fatal("Failed to create dav root directory")
+	}
+
+	return davroot
+}
+
+// openFileSystem returns the file system storing the files in the dav root
+// directory. If a master key is configured, the files are encrypted. The
+// deduplication is layered on top of the encryption, so identical files are
+// recognized by their plaintext.
+func openFileSystem(davroot, keyFile string, deduplicate bool) fs.FileSystem {
+	var fileSystem fs.FileSystem = fs.NewLocalFileSystem(davroot)
+	masterKey, err := fs.LoadMasterKey(keyFile)
+	if err != nil {
+		log.Fatal("Failed to load the master key: ", err)
+	}
+	if masterKey != nil {
+		fileSystem, err = fs.NewEncryptedFileSystem(fileSystem, masterKey)
+		if err != nil {
+			log.Fatal("Failed to set up encryption: ", err)
+		}
+		log.Debug("Encrypting the stored files")
+	}
+	if deduplicate {
+		fileSystem, err = fs.NewDedupFileSystem(fileSystem)
+		if err != nil {
+			log.Fatal("Failed to set up deduplication: ", err)
+		}
+		log.Debug("Deduplicating the stored files")
+	}
+	return fileSystem
+}
@@ -0,0 +1,128 @@
+package media
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/fs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// renditionDir is the directory in the app-data area where transcoded
+	// renditions are cached. They are stored as renditionDir/<node id>/<etag>.mp4
+	renditionDir = fs.AppDataDir + "/renditions"
+	// renditionExtension is the extension of the renditions, they are always
+	// MP4 files with H.264 video and AAC audio, which all browsers can play
+	renditionExtension = "mp4"
+)
+
+var (
+	// storage is where the originals are read and the renditions are cached
+	storage fs.FileSystem
+)
+
+// browserTypes are the audio and video types browsers play without transcoding
+var browserTypes = map[string]bool{
+	"video/mp4":   true,
+	"video/webm":  true,
+	"video/ogg":   true,
+	"audio/mpeg":  true,
+	"audio/mp3":   true,
+	"audio/mp4":   true,
+	"audio/aac":   true,
+	"audio/ogg":   true,
+	"audio/wav":   true,
+	"audio/x-wav": true,
+	"audio/webm":  true,
+	"audio/flac":  true,
+}
+
+// Init sets the storage of the originals and the rendition cache. If command is
+// not empty, audio and video files browsers can't play are transcoded with it.
+func Init(fileSystem fs.FileSystem, command string) {
+	storage = fileSystem
+	if command != "" {
+		startTranscoder(command)
+	}
+}
+
+// IsMedia checks if the mimetype is an audio or video type
+func IsMedia(mimetype string) bool {
+	return strings.HasPrefix(mimetype, "video/") || strings.HasPrefix(mimetype, "audio/")
+}
+
+// needsTranscoding checks if the node is an audio or video file the browsers
+// can't play
+func needsTranscoding(node *db.Node) bool {
+	mimetype := strings.ToLower(node.MimeType)
+	if i := strings.Index(mimetype, ";"); i >= 0 {
+		mimetype = strings.TrimSpace(mimetype[:i])
+	}
+	return !node.Isdir && IsMedia(mimetype) && !browserTypes[mimetype]
+}
+
+// ServeRendition serves the transcoded rendition of the node, if the node needs
+// one and it is available. If the rendition still has to be made, transcoding
+// is scheduled and false is returned, so the original can be served instead.
+// Range requests are supported like they are for the originals.
+func ServeRendition(w http.ResponseWriter, r *http.Request, node *db.Node) bool {
+	if storage == nil || transcodeQueue == nil || !needsTranscoding(node) {
+		return false
+	}
+	file, err := storage.OpenFile(context.Background(), renditionPath(node), os.O_RDONLY, 0)
+	if err != nil {
+		ScheduleTranscoding(node)
+		return false
+	}
+	defer file.Close()
+
+	contentType := "video/mp4"
+	if strings.HasPrefix(node.MimeType, "audio/") {
+		contentType = "audio/mp4"
+	}
+	name := strings.TrimSuffix(path.Base(node.Path), path.Ext(node.Path)) + "." + renditionExtension
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", "\""+node.Etag+"-"+renditionExtension+"\"")
+	http.ServeContent(w, r, name, node.Mtime, file)
+	return true
+}
+
+// InvalidateRenditions removes the cached renditions of the node
+func InvalidateRenditions(node *db.Node) {
+	if storage == nil {
+		return
+	}
+	err := storage.RemoveAll(context.Background(), path.Join(renditionDir, fs.NodeKey(node)))
+	if err != nil {
+		log.Warnf("Failed to remove the renditions of %v: %v", node.Path, err)
+	}
+}
+
+// InvalidateSubtreeRenditions removes the cached renditions of the node at
+// nodePath and all its descendants. It must be called before the nodes are
+// removed from the database.
+func InvalidateSubtreeRenditions(nodePath string) {
+	if storage == nil {
+		return
+	}
+	nodes, err := db.GetSubtreeNodes(nodePath)
+	if err != nil {
+		log.Warnf("Failed to get the nodes to remove the renditions of %v: %v", nodePath, err)
+		return
+	}
+	for _, node := range nodes {
+		if needsTranscoding(node) {
+			InvalidateRenditions(node)
+		}
+	}
+}
+
+// renditionPath returns the path of the rendition of the current version of the node
+func renditionPath(node *db.Node) string {
+	return path.Join(renditionDir, fs.NodeKey(node), node.Etag+"."+renditionExtension)
+}
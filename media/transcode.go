@@ -0,0 +1,176 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/fs"
+	"golang.org/x/net/context"
+)
+
+const (
+	// transcodeQueueSize is the amount of nodes waiting to be transcoded, new
+	// nodes are dropped when the queue is full
+	transcodeQueueSize = 20
+	// transcodeTimeout is the maximum time a single transcoding may take
+	transcodeTimeout = 2 * time.Hour
+	// inputPlaceholder and outputPlaceholder are replaced in the command by the
+	// paths of the original and the rendition
+	inputPlaceholder  = "{input}"
+	outputPlaceholder = "{output}"
+)
+
+var (
+	// transcodeCommand is the command and its arguments, with placeholders
+	transcodeCommand []string
+	// transcodeQueue holds the nodes waiting to be transcoded, it is nil if
+	// transcoding is disabled
+	transcodeQueue chan *db.Node
+	// scheduled are the renditions which are queued or being made, so a node is
+	// only transcoded once when it is requested repeatedly
+	scheduled     = make(map[string]bool)
+	scheduledLock sync.Mutex
+
+	errTimeout = errors.New("Transcoding took too long")
+)
+
+// startTranscoder starts transcoding the scheduled nodes in the background. The
+// command is split on white space, its {input} and {output} arguments are
+// replaced by local file paths.
+func startTranscoder(command string) {
+	transcodeCommand = strings.Fields(command)
+	transcodeQueue = make(chan *db.Node, transcodeQueueSize)
+	go transcodeScheduled()
+}
+
+// ScheduleTranscoding queues the node to make its rendition, if it is an audio
+// or video file the browsers can't play and transcoding is enabled
+func ScheduleTranscoding(node *db.Node) {
+	if transcodeQueue == nil || !needsTranscoding(node) {
+		return
+	}
+	key := renditionPath(node)
+	scheduledLock.Lock()
+	defer scheduledLock.Unlock()
+	if scheduled[key] {
+		return
+	}
+	select {
+	case transcodeQueue <- node:
+		scheduled[key] = true
+	default:
+		log.Debug("Transcoding queue is full, not transcoding ", node.Path)
+	}
+}
+
+// transcodeScheduled transcodes the queued nodes one at a time
+func transcodeScheduled() {
+	for node := range transcodeQueue {
+		err := transcode(node)
+		if err != nil {
+			log.Errorf("Failed to transcode %v: %v", node.Path, err)
+		}
+		scheduledLock.Lock()
+		delete(scheduled, renditionPath(node))
+		scheduledLock.Unlock()
+	}
+}
+
+// transcode makes the rendition of the node. The command works on local files,
+// so the original is copied out of the storage and the rendition is copied into
+// it afterwards.
+func transcode(node *db.Node) error {
+	ctx := context.Background()
+	if _, err := storage.Stat(ctx, renditionPath(node)); err == nil {
+		return nil
+	}
+
+	workDir, err := ioutil.TempDir("", "gowncloud-transcode")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+	input := filepath.Join(workDir, "input"+path.Ext(node.Path))
+	output := filepath.Join(workDir, "output."+renditionExtension)
+
+	err = copyFromStorage(node.Path, input)
+	if err != nil {
+		return err
+	}
+
+	args := make([]string, len(transcodeCommand))
+	for i, arg := range transcodeCommand {
+		arg = strings.Replace(arg, inputPlaceholder, input, -1)
+		args[i] = strings.Replace(arg, outputPlaceholder, output, -1)
+	}
+	log.Debugf("Transcoding %v: %v", node.Path, strings.Join(args, " "))
+	start := time.Now()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = workDir
+	var combinedOutput bytes.Buffer
+	cmd.Stdout = &combinedOutput
+	cmd.Stderr = &combinedOutput
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(transcodeTimeout):
+		cmd.Process.Kill()
+		<-done
+		return errTimeout
+	}
+	if err != nil {
+		log.Debugf("Output of the transcoding command: %s", combinedOutput.Bytes())
+		return err
+	}
+
+	// Only the rendition of the current version is kept
+	InvalidateRenditions(node)
+	rendition, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer rendition.Close()
+	err = fs.WriteFile(context.Background(), storage, renditionPath(node), rendition)
+	if err != nil {
+		return err
+	}
+	log.Infof("Transcoded %v in %v", node.Path, time.Since(start))
+	return nil
+}
+
+// copyFromStorage copies a file from the storage to a local file
+func copyFromStorage(name, localPath string) error {
+	source, err := storage.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(target, source)
+	closeErr := target.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
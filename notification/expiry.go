@@ -0,0 +1,60 @@
+package notification
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+// ExpiryWarning is how long before a share expires its owner and target are
+// warned
+const ExpiryWarning = 24 * time.Hour
+
+// StartExpiryCheck checks the shares at the interval, warning about the shares
+// which expire soon and removing the expired shares
+func StartExpiryCheck(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			CheckExpiringShares()
+		}
+	}()
+}
+
+// CheckExpiringShares warns about the shares which expire within the
+// ExpiryWarning, and removes the expired shares
+func CheckExpiringShares() {
+	now := time.Now()
+	expired, err := db.GetExpiredShares(now)
+	if err != nil {
+		log.Error("Failed to get the expired shares: ", err)
+		return
+	}
+	for _, share := range expired {
+		err = db.DeleteShare(share.ShareID)
+		if err != nil {
+			log.Errorf("Failed to remove expired share %v: %v", share.ShareID, err)
+			continue
+		}
+		log.Debugf("Removed share %v which expired at %v", share.ShareID, share.Expiration)
+		ShareRemoved(share.ShareID)
+	}
+
+	expiring, err := db.GetSharesToWarn(now.Add(ExpiryWarning))
+	if err != nil {
+		log.Error("Failed to get the expiring shares: ", err)
+		return
+	}
+	for _, share := range expiring {
+		node, err := db.GetNodeById(share.NodeID)
+		if err != nil || node == nil {
+			log.Errorf("Failed to get the node of expiring share %v: %v", share.ShareID, err)
+			continue
+		}
+		err = db.SetShareExpiryWarned(share.ShareID)
+		if err != nil {
+			continue
+		}
+		ShareExpiring(node, share)
+	}
+}
@@ -0,0 +1,169 @@
+package notification
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	db "github.com/gowncloud/gowncloud/database"
+	"github.com/gowncloud/gowncloud/mail"
+)
+
+// Subjects of the notifications
+const (
+	// SubjectIncomingShare tells a user a node was shared with him or his group
+	SubjectIncomingShare = "incoming_share"
+	// SubjectShareExpiring warns the owner and the target of a share that it
+	// expires soon
+	SubjectShareExpiring = "share_expiring"
+	// SubjectQuotaWarning tells a user he uses most of his quota
+	SubjectQuotaWarning = "quota_warning"
+	// SubjectFederatedShare offers a share from another server to a user
+	SubjectFederatedShare = "federated_share_offer"
+)
+
+// quotaThresholds are the percentages of the quota at which users are warned,
+// in increasing order
+var quotaThresholds = []int{80, 90, 100}
+
+// Notify saves a notification and pushes it to the connected clients of its
+// target. Failures are logged.
+func Notify(notification *db.Notification) {
+	err := db.CreateNotification(notification)
+	if err != nil {
+		log.Errorf("Failed to save the %v notification for %v: %v", notification.Subject, notification.Target, err)
+		return
+	}
+	publish(notification)
+}
+
+// Dismiss hides a notification from the user and tells his other connected
+// clients it is gone
+func Dismiss(notification *db.Notification, username string) error {
+	err := db.DismissNotification(notification, username)
+	if err != nil {
+		return err
+	}
+	publishDismissal(notification.ID, username)
+	return nil
+}
+
+// IncomingShare notifies the target of a new share of the node by actor, a
+// user is also sent a mail
+func IncomingShare(actor string, node *db.Node, share *db.Share) {
+	parameters := shareParameters(node, share)
+	parameters["user"] = actor
+	Notify(&db.Notification{
+		Target:     share.Target,
+		App:        "files_sharing",
+		Subject:    SubjectIncomingShare,
+		ObjectType: "share",
+		ObjectID:   strconv.FormatInt(share.ShareID, 10),
+		Parameters: parameters,
+	})
+	if share.ShareType == db.USERSHARE {
+		mail.SendShare(actor, share.Target, parameters["file"], share.Expiration)
+	}
+}
+
+// ShareRemoved removes the notifications about a share which no longer exists
+func ShareRemoved(shareId int64) {
+	err := db.DeleteNotificationsForObject("share", strconv.FormatInt(shareId, 10))
+	if err != nil {
+		log.Errorf("Failed to remove the notifications of share %v: %v", shareId, err)
+	}
+}
+
+// ShareExpiring warns the owner of the node and the target of the share that
+// the share expires soon
+func ShareExpiring(node *db.Node, share *db.Share) {
+	for _, target := range []string{node.Owner, share.Target} {
+		Notify(&db.Notification{
+			Target:     target,
+			App:        "files_sharing",
+			Subject:    SubjectShareExpiring,
+			ObjectType: "share",
+			ObjectID:   strconv.FormatInt(share.ShareID, 10),
+			Parameters: shareParameters(node, share),
+		})
+	}
+}
+
+// shareParameters are the notification parameters describing a share: the
+// owner, the name and id of the node, the target and the expiration
+func shareParameters(node *db.Node, share *db.Share) map[string]string {
+	parameters := map[string]string{
+		"owner":     node.Owner,
+		"file":      node.Path[strings.LastIndex(node.Path, "/")+1:],
+		"nodeid":    strconv.FormatInt(node.ID, 10),
+		"sharewith": share.Target,
+		"sharetype": strconv.Itoa(share.ShareType),
+	}
+	if share.Expiration != nil {
+		parameters["expiration"] = share.Expiration.UTC().Format(time.RFC3339)
+	}
+	return parameters
+}
+
+// CheckQuota warns a user when his files grow past one of the quotaThresholds
+// of his quota. Every threshold is only warned about once, until the usage
+// drops below it again.
+func CheckQuota(username string) {
+	user, err := db.GetUser(username)
+	if err != nil || user == nil || user.Allowedspace == 0 {
+		return
+	}
+	// Only the files count against the quota, not the trash and the versions
+	files, err := db.GetNode(username + "/files")
+	if err != nil || files == nil {
+		return
+	}
+	// Allowedspace is stored as GB
+	allowedSpace := int64(user.Allowedspace) << 30
+	percent := int(100 * files.Size / allowedSpace)
+	reached := 0
+	for _, threshold := range quotaThresholds {
+		if percent >= threshold {
+			reached = threshold
+		}
+	}
+	warned, err := db.GetQuotaWarning(username)
+	if err != nil || reached == warned {
+		return
+	}
+	err = db.SetQuotaWarning(username, reached)
+	if err != nil || reached < warned {
+		return
+	}
+	Notify(&db.Notification{
+		Target:     username,
+		App:        "files",
+		Subject:    SubjectQuotaWarning,
+		ObjectType: "quota",
+		ObjectID:   username,
+		Parameters: map[string]string{
+			"percent": strconv.Itoa(reached),
+			"used":    strconv.FormatInt(files.Size, 10),
+			"quota":   strconv.FormatInt(allowedSpace, 10),
+		},
+	})
+}
+
+// FederatedShareOffer offers a share from a user on another server to a user.
+// gowncloud doesn't receive federated shares yet, this is where they are
+// announced once it does.
+func FederatedShareOffer(username, remoteUser, remote, name, remoteShareId string) {
+	Notify(&db.Notification{
+		Target:     username,
+		App:        "files_sharing",
+		Subject:    SubjectFederatedShare,
+		ObjectType: "remote_share",
+		ObjectID:   remoteShareId,
+		Parameters: map[string]string{
+			"user":   remoteUser,
+			"remote": remote,
+			"file":   name,
+		},
+	})
+}
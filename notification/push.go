@@ -0,0 +1,96 @@
+package notification
+
+import (
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	db "github.com/gowncloud/gowncloud/database"
+)
+
+// Event is a change of the notifications of a user pushed to his clients,
+// either a new notification or the id of a dismissed one
+type Event struct {
+	Notification *db.Notification
+	Dismissed    int64
+}
+
+// subscriber is a connected client waiting for the events of a user
+type subscriber struct {
+	username string
+	groups   []string
+	events   chan Event
+}
+
+// subscriberBuffer is the number of events buffered for a client, a client
+// which falls further behind is disconnected so it reconnects and catches up
+const subscriberBuffer = 16
+
+var (
+	subscribers     = make(map[*subscriber]bool)
+	subscribersLock sync.Mutex
+)
+
+// Subscribe returns the events for the user and his groups, and a function
+// to call when the client is gone. The channel is closed if the client can't
+// keep up with the events.
+func Subscribe(username string, groups []string) (<-chan Event, func()) {
+	s := &subscriber{username: username, groups: groups, events: make(chan Event, subscriberBuffer)}
+	subscribersLock.Lock()
+	subscribers[s] = true
+	subscribersLock.Unlock()
+	return s.events, func() {
+		subscribersLock.Lock()
+		defer subscribersLock.Unlock()
+		if subscribers[s] {
+			delete(subscribers, s)
+			close(s.events)
+		}
+	}
+}
+
+// publish pushes a new notification to the clients of its target
+func publish(notification *db.Notification) {
+	send(func(s *subscriber) bool {
+		return isTarget(notification.Target, s.username, s.groups)
+	}, Event{Notification: notification})
+}
+
+// publishDismissal tells the clients of the user a notification was dismissed
+func publishDismissal(id int64, username string) {
+	send(func(s *subscriber) bool {
+		return s.username == username
+	}, Event{Dismissed: id})
+}
+
+// send sends an event to the matching subscribers without blocking
+func send(matches func(s *subscriber) bool, event Event) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+	for s := range subscribers {
+		if !matches(s) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			log.Warnf("Disconnecting a notification client of %v which doesn't keep up", s.username)
+			delete(subscribers, s)
+			close(s.events)
+		}
+	}
+}
+
+// isTarget checks if a notification for target is for the user, directly or
+// through one of his groups or their subgroups, like the shares are
+func isTarget(target, username string, groups []string) bool {
+	if target == username {
+		return true
+	}
+	for _, group := range groups {
+		if target == group || strings.HasPrefix(target, group+".") {
+			return true
+		}
+	}
+	return false
+}